@@ -5,10 +5,19 @@ import (
 	"fmt"
 	"github.com/barasher/picdexer/internal/binary"
 	"github.com/barasher/picdexer/internal/browse"
+	"github.com/barasher/picdexer/internal/checkpoint"
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/barasher/picdexer/internal/deadletter"
 	"github.com/barasher/picdexer/internal/dispatch"
 	"github.com/barasher/picdexer/internal/elasticsearch"
 	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/barasher/picdexer/internal/metrics"
+	"github.com/barasher/picdexer/internal/privacy"
+	"github.com/barasher/picdexer/internal/report"
+	"github.com/barasher/picdexer/pkg/picdexer"
 	"github.com/rs/zerolog/log"
+	"io"
+	"sort"
 	"sync"
 	"time"
 )
@@ -17,146 +26,671 @@ const (
 	defaultMetadataThreadCount = 4
 	defaultEsBulkSize          = 30
 	defaultBinaryThreadCount   = 4
+	defaultEnrichThreadCount   = 4
 	dateFormat                 = "2006:01:02"
+	resizerConvert             = "convert"
+	resizerGo                  = "go"
+	defaultRenditionName       = "default"
+	storageFileServer          = "fileServer"
+	storageFs                  = "fs"
+	storageS3                  = "s3"
+	stageEnrich                = "enrich"
 )
 
-func max(v1, v2 int) int {
-	if v1 < v2 {
-		return v2
-	}
-	return v1
-}
-
-type MetadataExtractorInterface interface {
-	Close() error
-	ExtractMetadata(ctx context.Context, inTaskChan chan browse.Task, outPicMetaChan chan metadata.PictureMetadata) error
-}
-
-type BinaryManagerInterface interface {
-	Store(ctx context.Context, inTaskChan chan browse.Task, outDir string) error
-}
-
-type EsPusherInterface interface {
-	Push(ctx context.Context, inEsDocChan chan elasticsearch.EsDoc) error
-	ConvertMetadataToEsDoc(ctx context.Context, in chan metadata.PictureMetadata, out chan elasticsearch.EsDoc) error
-}
-
-type BrowserInterface interface {
-	Browse(ctx context.Context, dirList []string, outFileChan chan browse.Task) error
-}
+// the stages of the pipeline, which can be replaced by custom implementations
+type (
+	MetadataExtractorInterface = picdexer.Extractor
+	BinaryManagerInterface     = picdexer.Storage
+	EsPusherInterface          = picdexer.Indexer
+	BrowserInterface           = picdexer.Source
+)
 
-func buildMetadataExtractor(c Config) (MetadataExtractorInterface, int, error) {
+func buildMetadataExtractor(c Config, extraOpts ...func(*metadata.MetadataExtractor) error) (MetadataExtractorInterface, int, error) {
 	tc := c.Elasticsearch.ThreadCount
 	if tc == 0 {
 		tc = defaultMetadataThreadCount
 	}
-	me, err := metadata.NewMetadataExtractor(tc)
+	me, err := picdexer.NewExtractor(tc, extraOpts...)
 	return me, tc, err
 }
 
-func buildEsPusher(c Config) (EsPusherInterface, error) {
+// buildEnricher builds the enricher running the configured plugins, nil if
+// there is no plugin.
+func buildEnricher(c Config) (picdexer.Enricher, error) {
+	if len(c.Enrichment.Plugins) == 0 {
+		return nil, nil
+	}
+	plugins := make([]picdexer.Plugin, len(c.Enrichment.Plugins))
+	for i, p := range c.Enrichment.Plugins {
+		timeout, err := parseOptionalDuration(p.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing timeout of plugin %v: %w", p.Name, err)
+		}
+		plugins[i] = picdexer.Plugin{
+			Name:        p.Name,
+			Command:     p.Command,
+			Timeout:     timeout,
+			Concurrency: p.Concurrency,
+			MimeTypes:   p.MimeTypes,
+			Keywords:    p.Keywords,
+		}
+	}
+	tc := c.Enrichment.ThreadCount
+	if tc == 0 {
+		tc = defaultEnrichThreadCount
+	}
+	return picdexer.NewEnricher(tc, plugins...)
+}
+
+func buildRules(c Config) []picdexer.Rule {
+	rs := make([]picdexer.Rule, len(c.Rules))
+	for i, r := range c.Rules {
+		rs[i] = picdexer.Rule{
+			Type:        r.Type,
+			Field:       r.Field,
+			Values:      r.Values,
+			Pattern:     r.Pattern,
+			Replacement: r.Replacement,
+			Synonyms:    r.Synonyms,
+			Separator:   r.Separator,
+			Keywords:    r.Keywords,
+			Into:        r.Into,
+		}
+		if r.When != nil {
+			rs[i].When = &picdexer.Condition{Field: r.When.Field, Matches: r.When.Matches}
+		}
+	}
+	return rs
+}
+
+func buildEsPusher(c Config, extraOpts ...func(*elasticsearch.EsPusher) error) (EsPusherInterface, error) {
 	bs := c.Elasticsearch.BulkSize
 	if bs == 0 {
 		bs = defaultEsBulkSize
 	}
 	var opts []func(*elasticsearch.EsPusher) error
-	opts = append(opts, elasticsearch.EsUrl(c.Elasticsearch.Url))
 	for k, d := range c.Elasticsearch.SyncOnDate {
 		parsedD, err := time.Parse(dateFormat, d)
 		if err != nil {
 			return nil, fmt.Errorf("syncOnDate : error while parsing date %v", d)
 		}
-		opts = append(opts, elasticsearch.SyncOnDate(k, parsedD))
+		opts = append(opts, picdexer.SyncOnDate(k, parsedD))
+	}
+	if c.Elasticsearch.BulkWorkers > 0 {
+		opts = append(opts, picdexer.BulkWorkers(c.Elasticsearch.BulkWorkers))
+	}
+	if c.Elasticsearch.BulkMaxBytes > 0 {
+		opts = append(opts, picdexer.MaxBulkBytes(c.Elasticsearch.BulkMaxBytes))
+	}
+	if c.Elasticsearch.Gzip {
+		opts = append(opts, picdexer.Gzip())
+	}
+	if len(c.Rules) > 0 {
+		opts = append(opts, picdexer.Normalize(buildRules(c)...))
+	}
+	opts = append(opts, extraOpts...)
+	return picdexer.NewIndexer(c.Elasticsearch.Url, bs, opts...)
+}
+
+// buildRenditions returns the configured renditions. The legacy width and
+// height settings define a single rendition stored under the file identifier.
+func buildRenditions(c Config) []binary.Rendition {
+	if len(c.Binary.Renditions) > 0 {
+		renditions := make([]binary.Rendition, len(c.Binary.Renditions))
+		for i, r := range c.Binary.Renditions {
+			renditions[i] = binary.Rendition{
+				Name:          r.Name,
+				Width:         r.Width,
+				Height:        r.Height,
+				Quality:       r.Quality,
+				Crop:          r.Crop,
+				KeySuffix:     r.KeySuffix,
+				Format:        r.Format,
+				Progressive:   r.Progressive,
+				Subsampling:   r.Subsampling,
+				StripMetadata: r.StripMetadata,
+				ToSRGB:        r.ToSRGB,
+			}
+			if w := r.Watermark; w != nil {
+				renditions[i].Watermark = &binary.Watermark{
+					Text:     w.Text,
+					Image:    w.Image,
+					Position: w.Position,
+					Opacity:  w.Opacity,
+					Margin:   w.Margin,
+					Scale:    w.Scale,
+				}
+			}
+		}
+		return renditions
+	}
+	if c.Binary.Width != 0 && c.Binary.Height != 0 {
+		return []binary.Rendition{{
+			Name:   defaultRenditionName,
+			Width:  c.Binary.Width,
+			Height: c.Binary.Height,
+		}}
 	}
-	return elasticsearch.NewEsPusher(bs, opts...)
+	return nil
 }
 
-func buildBinaryManager(c Config) (BinaryManagerInterface, int, error) {
-	if c.Binary.Url == "" { // lazy
-		return binary.LazyBinaryManager{}, 1, nil
+func buildS3Conf(c S3StorageConf) (binary.S3Conf, error) {
+	s3Conf := binary.S3Conf{
+		Endpoint:           c.Endpoint,
+		Region:             c.Region,
+		Bucket:             c.Bucket,
+		Prefix:             c.Prefix,
+		AccessKey:          c.AccessKey,
+		SecretKey:          c.SecretKey,
+		SessionToken:       c.SessionToken,
+		PathStyle:          c.PathStyle,
+		PublicUrl:          c.PublicUrl,
+		CacheControl:       c.CacheControl,
+		MultipartThreshold: c.MultipartThreshold,
+		PartSize:           c.PartSize,
+	}
+	d, err := parseOptionalDuration(c.PresignExpiry)
+	if err != nil {
+		return s3Conf, fmt.Errorf("error while parsing S3 presign expiry: %w", err)
 	}
+	s3Conf.PresignExpiry = d
+	return s3Conf, nil
+}
 
+// buildStrategyConf builds the resizing strategy chains : the configured
+// rules come first, then the legacy usePreviewForExtensions rule. The
+// resizer defines the default chain.
+func buildStrategyConf(c Config, timeout time.Duration) (binary.StrategyConf, error) {
+	sc := binary.StrategyConf{
+		SRGBProfile: c.Binary.SRGBProfile,
+		Timeout:     timeout,
+		Filter:      c.Binary.ResizeFilter,
+	}
+	switch c.Binary.Resizer {
+	case "", resizerConvert:
+		sc.Default = []binary.Strategy{{Type: binary.StrategyConvert}}
+	case resizerGo:
+		sc.Default = []binary.Strategy{{Type: binary.StrategyGo}}
+	default:
+		return sc, fmt.Errorf("unsupported resizer (%v)", c.Binary.Resizer)
+	}
+	for _, rule := range c.Binary.ResizeStrategies {
+		r := binary.StrategyRule{Match: rule.Match}
+		for _, cur := range rule.Strategies {
+			r.Strategies = append(r.Strategies, binary.Strategy{Type: cur.Type, Tags: cur.Tags, Command: cur.Command})
+		}
+		sc.Rules = append(sc.Rules, r)
+	}
+	if len(c.Binary.UsePreviewForExtensions) > 0 {
+		sc.Rules = append(sc.Rules, binary.StrategyRule{
+			Match:      c.Binary.UsePreviewForExtensions,
+			Strategies: []binary.Strategy{{Type: binary.StrategyPreview}},
+		})
+	}
+	return sc, nil
+}
+
+// parseOptionalDuration parses a duration, 0 if empty.
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("wrong duration (%v): %w", s, err)
+	}
+	return d, nil
+}
+
+func buildBinaryManager(c Config, extraOpts ...func(*binary.BinaryManager) error) (BinaryManagerInterface, int, error) {
 	opts := []func(manager *binary.BinaryManager) error{}
-	if c.Binary.Url != "" {
-		opts = append(opts, binary.BinaryManagerDoPush(c.Binary.Url))
+	uploadTimeout, err := parseOptionalDuration(c.Binary.UploadTimeout)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error while parsing upload timeout: %w", err)
 	}
-	if c.Binary.Width != 0 && c.Binary.Height != 0 {
-		opts = append(opts, binary.BinaryManagerDoResize(c.Binary.Width, c.Binary.Height, c.Binary.UsePreviewForExtensions))
+	resizeTimeout, err := parseOptionalDuration(c.Binary.ResizeTimeout)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error while parsing resize timeout: %w", err)
+	}
+	switch c.Binary.Storage {
+	case "", storageFileServer:
+		if c.Binary.Url == "" { // lazy
+			return binary.LazyBinaryManager{}, 1, nil
+		}
+		opts = append(opts, binary.BinaryManagerDoPush(c.Binary.Url, uploadTimeout))
+	case storageFs:
+		opts = append(opts, binary.BinaryManagerDoFsPush(c.Binary.Fs.Root, c.Binary.Fs.BaseUrl, c.Binary.Fs.HardLink))
+	case storageS3:
+		s3Conf, err := buildS3Conf(c.Binary.S3)
+		if err != nil {
+			return nil, 0, err
+		}
+		s3Conf.Timeout = uploadTimeout
+		opts = append(opts, binary.BinaryManagerDoS3Push(s3Conf))
+	default:
+		return nil, 0, fmt.Errorf("unsupported storage (%v)", c.Binary.Storage)
+	}
+	if c.Binary.SkipExisting.RecordFile != "" {
+		opts = append(opts, binary.BinaryManagerSkipExisting(c.Binary.SkipExisting.RecordFile, c.Binary.SkipExisting.Verify))
+	}
+	if c.Binary.ArchiveOriginals {
+		opts = append(opts, binary.BinaryManagerArchiveOriginals())
 	}
+	if renditions := buildRenditions(c); len(renditions) > 0 {
+		switch {
+		case len(c.Binary.ResizeStrategies) > 0:
+			sc, err := buildStrategyConf(c, resizeTimeout)
+			if err != nil {
+				return nil, 0, err
+			}
+			opts = append(opts, binary.BinaryManagerDoStrategyResize(sc, renditions...))
+		case c.Binary.Resizer == "" || c.Binary.Resizer == resizerConvert:
+			opts = append(opts, binary.BinaryManagerDoResize(c.Binary.UsePreviewForExtensions, c.Binary.SRGBProfile, resizeTimeout, renditions...))
+		case c.Binary.Resizer == resizerGo:
+			opts = append(opts, binary.BinaryManagerDoGoResize(c.Binary.ResizeFilter, renditions...))
+		default:
+			return nil, 0, fmt.Errorf("unsupported resizer (%v)", c.Binary.Resizer)
+		}
+	}
+	opts = append(opts, extraOpts...)
 	tc := c.Binary.ThreadCount
 	if tc == 0 {
 		tc = defaultBinaryThreadCount
 	}
-	bm, err := binary.NewBinaryManager(tc, opts...)
+	bm, err := picdexer.NewStorage(tc, opts...)
 	return bm, tc, err
 }
 
+// withoutResize returns the configuration without renditions : the original
+// pictures are stored.
+func withoutResize(c Config) Config {
+	c.Binary.Renditions = nil
+	c.Binary.Width = 0
+	c.Binary.Height = 0
+	return c
+}
+
 func buildBrowser(c Config) BrowserInterface {
-	return &browse.Browser{}
+	return picdexer.NewBrowser()
 }
 
-func Run(ctx context.Context, c Config, input []string) error {
-	metadataExtractor, metc, err := buildMetadataExtractor(c)
-	if err != nil {
-		return fmt.Errorf("error while building MetadataExtractor: %w", err)
+func buildJournal(ctx context.Context, c Config) (*checkpoint.Journal, error) {
+	dir := c.Checkpoint.Dir
+	if dir == "" {
+		dir = c.Binary.WorkingDir
 	}
-	defer metadataExtractor.Close()
-	binaryManager, bmtc, err := buildBinaryManager(c)
-	if err != nil {
-		return fmt.Errorf("error while building BinaryManager: %w", err)
+	resume := common.IsResumed(ctx)
+	if dir == "" {
+		if resume {
+			return nil, fmt.Errorf("resuming requires checkpoint.dir or binary.workingDir to be configured")
+		}
+		return nil, nil
 	}
-	esPusher, err := buildEsPusher(c)
-	if err != nil {
-		return fmt.Errorf("error while building EsPusher: %w", err)
+	return checkpoint.Open(dir, common.GetImportID(ctx), resume)
+}
+
+// buildDeadLetter opens the dead-letter journal, nil if neither
+// deadLetter.file, checkpoint.dir nor binary.workingDir is configured.
+func buildDeadLetter(ctx context.Context, c Config) (*deadletter.Journal, error) {
+	f := c.DeadLetter.File
+	if f == "" {
+		dir := c.Checkpoint.Dir
+		if dir == "" {
+			dir = c.Binary.WorkingDir
+		}
+		if dir == "" {
+			return nil, nil
+		}
+		f = deadletter.Path(dir)
 	}
-	browseChan := make(chan browse.Task, max(metc, bmtc))
-	binToPushChan := make(chan browse.Task, bmtc)
-	metaToExtractChan := make(chan browse.Task, metc)
-	metaToConvertChan := make(chan metadata.PictureMetadata, metc)
-	docToPushChan := make(chan elasticsearch.EsDoc, metc)
+	return deadletter.Open(f, common.GetImportID(ctx))
+}
 
-	wg := sync.WaitGroup{}
-	wg.Add(5)
+// buildPolicy builds the privacy policy, nil if no privacy control is
+// configured.
+func buildPolicy(c Config) (*privacy.Policy, error) {
+	if !c.Privacy.ScrubGPS && len(c.Privacy.Rules) == 0 {
+		return nil, nil
+	}
+	pc := privacy.Conf{ScrubGPS: c.Privacy.ScrubGPS}
+	for _, r := range c.Privacy.Rules {
+		pc.Rules = append(pc.Rules, privacy.Rule{
+			Keywords: r.Keywords,
+			Folders:  r.Folders,
+			Paths:    r.Paths,
+			Exclude:  r.Exclude,
+			ScrubGPS: r.ScrubGPS,
+		})
+	}
+	return privacy.NewPolicy(pc)
+}
 
-	go func() { // push to es
-		if err := esPusher.Push(ctx, docToPushChan); err != nil {
-			log.Error().Msgf("Error while pushing to Elasticsearch: %v", err)
-		}
-		wg.Done()
-	}()
+func markCheckpoint(j *checkpoint.Journal, fileID string, path string, s checkpoint.Stage) {
+	if err := j.Mark(fileID, path, s); err != nil {
+		log.Warn().Str(common.LogFileIdentifier, path).Msgf("Error while recording checkpoint (%v): %v", s, err)
+	}
+}
+
+// reportCheckpoint records the checkpoint counters of a resumed run in the
+// run report.
+func reportCheckpoint(j *checkpoint.Journal, rep *report.Report) {
+	r := j.Report()
+	if !r.Resumed {
+		return
+	}
+	skipped, completed := make(map[string]int), make(map[string]int)
+	for _, s := range checkpoint.Stages {
+		skipped[string(s)] = r.Skipped[s]
+		completed[string(s)] = r.Completed[s]
+	}
+	rep.Resumed(skipped, completed)
+}
 
-	go func() { // metadata to doc
-		if err := esPusher.ConvertMetadataToEsDoc(ctx, metaToConvertChan, docToPushChan); err != nil {
-			log.Error().Msgf("Error while converting metadata to Elasticsearch documents: %v", err)
+// countSkipped wraps a dispatch filter to count the rejected tasks.
+func countSkipped(trk *tracker, s report.Stage, f dispatch.Filter) dispatch.Filter {
+	return func(t browse.Task) bool {
+		if f != nil && !f(t) {
+			trk.skipped(s)
+			return false
 		}
-		wg.Done()
-	}()
+		return true
+	}
+}
+
+// tracker records the outcome of the stages in the run report, in the
+// dead-letter journal and in the metrics.
+type tracker struct {
+	rep *report.Report
+	dl  *deadletter.Journal
+	met *metrics.Metrics
+	// paths of the pictures being indexed, by file identifier
+	paths sync.Map
+	mu    sync.Mutex
+	// paths of the pictures that failed, unattributed being true if a failure
+	// is not associated to a file
+	failedPaths  map[string]bool
+	unattributed bool
+}
 
-	go func() { // task to metadata
-		if err := metadataExtractor.ExtractMetadata(ctx, metaToExtractChan, metaToConvertChan); err != nil {
-			log.Error().Msgf("Error while extracting metadata: %v", err)
+func (t *tracker) browsed() {
+	t.rep.Browsed()
+	t.met.File(string(report.StageBrowse), metrics.OutcomeProcessed)
+}
+
+func (t *tracker) extracted(fileID string) {
+	t.rep.Extracted()
+	t.met.File(string(report.StageExtract), metrics.OutcomeProcessed)
+	t.resolved(fileID, deadletter.StageExtract)
+}
+
+func (t *tracker) skipped(s report.Stage) {
+	t.rep.Skipped(s)
+	t.met.File(string(s), metrics.OutcomeSkipped)
+}
+
+func (t *tracker) failed(s report.Stage, path string, fileID string, err error) {
+	file := path
+	if file == "" {
+		file = fileID
+	}
+	t.rep.Failed(s, file, err)
+	t.met.File(string(s), metrics.OutcomeFailed)
+	t.mu.Lock()
+	if path == "" {
+		t.unattributed = true
+	} else {
+		if t.failedPaths == nil {
+			t.failedPaths = make(map[string]bool)
 		}
-		wg.Done()
-	}()
+		t.failedPaths[path] = true
+	}
+	t.mu.Unlock()
+	if t.dl != nil && fileID != "" {
+		if err := t.dl.Failed(path, fileID, deadletter.Stage(s), err); err != nil {
+			log.Warn().Str(common.LogFileIdentifier, path).Msgf("Error while recording failure (%v): %v", s, err)
+		}
+	}
+}
 
-	go func() { // task to binary upload
-		if err := binaryManager.Store(ctx, binToPushChan, c.Binary.WorkingDir); err != nil {
-			log.Error().Msgf("Error while pushing to FileServer: %v", err)
+func (t *tracker) resolved(fileID string, stages ...deadletter.Stage) {
+	if t.dl == nil {
+		return
+	}
+	for _, s := range stages {
+		if err := t.dl.Resolved(fileID, s); err != nil {
+			log.Warn().Msgf("Error while recording resolution of %v (%v): %v", fileID, s, err)
 		}
-		wg.Done()
-	}()
+	}
+}
 
-	go func() { // dispatch
-		dispatch.DispatchTasks(ctx, browseChan, binToPushChan, metaToExtractChan)
-		wg.Done()
-	}()
+func (t *tracker) indexed(ids []string) {
+	t.rep.Indexed(len(ids))
+	for _, id := range ids {
+		t.met.File(string(report.StageIndex), metrics.OutcomeProcessed)
+		t.paths.Delete(id)
+		t.resolved(id, deadletter.StageIndex)
+	}
+}
 
-	// browse
-	if err := buildBrowser(c).Browse(ctx, input, browseChan); err != nil {
-		log.Error().Msgf("Error while browsing input folder: %v", err)
+func (t *tracker) indexFailed(ids []string, err error) {
+	for _, id := range ids {
+		path, _ := t.paths.LoadAndDelete(id)
+		p, _ := path.(string)
+		t.failed(report.StageIndex, p, id, err)
 	}
+}
 
-	wg.Wait()
+func (t *tracker) stored(r binary.StoreResult) {
+	switch {
+	case r.Err != nil:
+		t.failed(report.StageStore, r.Task.Path, r.Task.FileID, r.Err)
+		return
+	case r.Skipped:
+		t.skipped(report.StageStore)
+	default:
+		t.rep.Stored()
+		t.met.File(string(report.StageStore), metrics.OutcomeProcessed)
+	}
+	t.resolved(r.Task.FileID, deadletter.StageStore)
+}
 
-	return nil
+// failedFiles returns the paths of the pictures that failed, nil if a failure
+// is not associated to a file.
+func (t *tracker) failedFiles() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.unattributed {
+		return nil
+	}
+	files := make([]string, 0, len(t.failedPaths))
+	for p := range t.failedPaths {
+		files = append(files, p)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// runFailure returns the error associated to the outcome of a run, files
+// being the files that failed (nil if they are not known).
+func runFailure(s report.Summary, files []string) error {
+	var code int
+	var err error
+	switch s.Status {
+	case report.StatusFailure:
+		code, err = retExecFailure, fmt.Errorf("import %v failed (failures: %v)", s.ImportID, s.Failed)
+	case report.StatusPartialFailure:
+		code, err = retPartialFailure, fmt.Errorf("import %v partially failed (failures: %v)", s.ImportID, s.Failed)
+	default:
+		return nil
+	}
+	return exitError{code: code, err: err, files: files}
+}
+
+func Run(ctx context.Context, c Config, input []string) error {
+	toggles := getToggles(ctx)
+	indexing, storing := toggles.indexing(), toggles.storing()
+	if !indexing && !storing {
+		return fmt.Errorf("all the stages are disabled")
+	}
+	ctx, err := withLimits(ctx, c)
+	if err != nil {
+		return err
+	}
+	journal, err := buildJournal(ctx, c)
+	if err != nil {
+		return fmt.Errorf("error while opening checkpoint journal: %w", err)
+	}
+	dl, err := buildDeadLetter(ctx, c)
+	if err != nil {
+		return fmt.Errorf("error while opening dead-letter journal: %w", err)
+	}
+	if dl != nil {
+		defer dl.Close()
+	}
+	trk := &tracker{rep: report.New(common.GetImportID(ctx)), dl: dl, met: metrics.Get(ctx)}
+	events := picdexer.Events{
+		Extracted: func(p metadata.PictureMetadata) {
+			trk.extracted(p.FileID)
+			if journal != nil {
+				markCheckpoint(journal, p.FileID, p.SourceFile, checkpoint.StageExtracted)
+			}
+		},
+		ExtractionFailed: func(t browse.Task, err error) {
+			trk.paths.Delete(t.FileID)
+			trk.failed(report.StageExtract, t.Path, t.FileID, err)
+		},
+		Indexed: func(ids []string) {
+			trk.indexed(ids)
+			if journal != nil {
+				for _, id := range ids {
+					markCheckpoint(journal, id, "", checkpoint.StageIndexed)
+				}
+			}
+		},
+		EnrichmentFailed: func(metadata.PictureMetadata, error) {
+			trk.met.File(stageEnrich, metrics.OutcomeFailed)
+		},
+		IndexFailed: trk.indexFailed,
+		Stored: func(r binary.StoreResult) {
+			if r.Err == nil && journal != nil {
+				markCheckpoint(journal, r.Task.FileID, r.Task.Path, checkpoint.StageStored)
+			}
+			trk.stored(r)
+		},
+		Failed: func(s picdexer.Stage, err error) {
+			trk.failed(report.Stage(s), "", "", err)
+		},
+	}
+	var metaOpts []func(*metadata.MetadataExtractor) error
+	var binOpts []func(*binary.BinaryManager) error
+	var idxFilter, binFilter dispatch.Filter
+	if journal != nil {
+		defer journal.Close()
+		idxFilter = func(t browse.Task) bool { return !journal.IsDone(t.FileID, checkpoint.StageIndexed) }
+		binFilter = func(t browse.Task) bool { return !journal.IsDone(t.FileID, checkpoint.StageStored) }
+	}
+	if r := getRetried(ctx); r != nil {
+		idxFilter = dispatch.All(idxFilter, r.index)
+		binFilter = dispatch.All(binFilter, r.store)
+	}
+	policy, err := buildPolicy(c)
+	if err != nil {
+		return fmt.Errorf("error while building privacy policy: %w", err)
+	}
+	if policy != nil {
+		defer policy.Close()
+		metaOpts = append(metaOpts, metadata.ScrubGPS(policy.ScrubGPS), metadata.Exclude(func(m metadata.PictureMetadata) bool {
+			if policy.IndexMetadata(m) {
+				return false
+			}
+			trk.paths.Delete(m.FileID)
+			trk.skipped(report.StageIndex)
+			return true
+		}))
+		binOpts = append(binOpts, binary.BinaryManagerStripLocation(policy.ScrubLocation))
+		idxFilter = dispatch.All(idxFilter, policy.Index)
+		binFilter = dispatch.All(binFilter, policy.Store)
+	}
+	events.Browsed = func(browse.Task) { trk.browsed() }
+	if indexing {
+		idxFilter = dispatch.All(countSkipped(trk, report.StageIndex, idxFilter), func(t browse.Task) bool {
+			trk.paths.Store(t.FileID, t.Path)
+			return true
+		})
+	}
+	binFilter = countSkipped(trk, report.StageStore, binFilter)
+
+	opts := []func(*picdexer.Pipeline) error{
+		picdexer.WithSource(buildBrowser(c)),
+		picdexer.WithEvents(events),
+		picdexer.IndexFilter(idxFilter),
+		picdexer.StoreFilter(binFilter),
+	}
+	if indexing {
+		metadataExtractor, metc, err := buildMetadataExtractor(c, metaOpts...)
+		if err != nil {
+			return fmt.Errorf("error while building MetadataExtractor: %w", err)
+		}
+		defer metadataExtractor.Close()
+		esPusher, err := buildEsPusher(c)
+		if err != nil {
+			return fmt.Errorf("error while building EsPusher: %w", err)
+		}
+		opts = append(opts, picdexer.WithExtractor(metadataExtractor, metc), picdexer.WithIndexer(esPusher))
+		enricher, err := buildEnricher(c)
+		if err != nil {
+			return fmt.Errorf("error while building Enricher: %w", err)
+		}
+		if enricher != nil {
+			opts = append(opts, picdexer.WithEnricher(enricher))
+		}
+	}
+	binConf := c
+	if toggles.doNotResize {
+		binConf = withoutResize(c)
+	}
+	// the binary manager is built even if nothing is stored : it provides the
+	// references of the stored renditions to the documents
+	binaryManager, bmtc, err := buildBinaryManager(binConf, binOpts...)
+	if err != nil {
+		return fmt.Errorf("error while building BinaryManager: %w", err)
+	}
+	if c, ok := binaryManager.(io.Closer); ok {
+		defer c.Close()
+	}
+	if bm, ok := binaryManager.(picdexer.Referencer); ok && indexing {
+		opts = append(opts, picdexer.WithRenditionRefs(func(fileID string) []metadata.RenditionRef {
+			if policy != nil && policy.StorageExcluded(fileID) {
+				return nil
+			}
+			return bm.RenditionRefs(fileID)
+		}))
+	}
+	if storing {
+		opts = append(opts, picdexer.WithStorage(binaryManager, bmtc, c.Binary.WorkingDir))
+	}
+	p, err := picdexer.NewPipeline(opts...)
+	if err != nil {
+		return fmt.Errorf("error while building pipeline: %w", err)
+	}
+	// the stage failures are reported by the events
+	p.Run(ctx, input)
+	if common.IsStopping(ctx) || ctx.Err() != nil {
+		trk.rep.Interrupted()
+	}
+
+	if journal != nil {
+		reportCheckpoint(journal, trk.rep)
+	}
+	summary := trk.rep.Summary()
+	summary.Log()
+	if c.Report.File != "" {
+		if err := summary.Write(c.Report.File); err != nil {
+			log.Error().Msgf("Error while writing report: %v", err)
+		}
+	}
+	if summary.Interrupted {
+		return interrupted(fmt.Errorf("import %v interrupted", summary.ImportID))
+	}
+	return runFailure(summary, trk.failedFiles())
 }
@@ -1,13 +1,25 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/barasher/picdexer/internal/binary"
+	"github.com/barasher/picdexer/internal/browse"
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/barasher/picdexer/internal/deadletter"
+	"github.com/barasher/picdexer/internal/elasticsearch"
+	"github.com/barasher/picdexer/internal/metrics"
+	"github.com/barasher/picdexer/internal/report"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestRun(t *testing.T) {
@@ -44,16 +56,254 @@ func TestRun(t *testing.T) {
 		},
 	}
 
-	err = Run(context.Background(), c, []string{"../testdata/"})
+	err = Run(common.NewContext(""), c, []string{"../testdata/"})
 	assert.Nil(t, err)
 	assert.True(t, esDocPushed)
 	assert.True(t, binPushed)
 }
 
-func TestMax(t *testing.T) {
-	assert.Equal(t, 2, max(1, 2))
-	assert.Equal(t, 2, max(2, 1))
-	assert.Equal(t, 2, max(2, 2))
+func TestRun_Failures(t *testing.T) {
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingServer.Close()
+
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	reportFile := filepath.Join(dir, "report.json")
+
+	c := Config{
+		Elasticsearch: ElasticsearchConf{Url: failingServer.URL},
+		Binary:        BinaryConf{Url: failingServer.URL, WorkingDir: dir},
+		Report:        ReportConf{File: reportFile},
+	}
+	err = Run(common.NewContext("imp"), c, []string{"../testdata/"})
+	assert.Equal(t, retExecFailure, exitCode(err))
+
+	b, err := os.ReadFile(reportFile)
+	assert.Nil(t, err)
+	s := report.Summary{}
+	assert.Nil(t, json.Unmarshal(b, &s))
+	assert.Equal(t, report.StatusFailure, s.Status)
+	assert.Equal(t, 1, s.Browsed)
+	assert.Equal(t, 1, s.Failed[report.StageStore])
+	assert.Equal(t, 1, s.Failed[report.StageIndex])
+
+	dl, err := deadletter.Open(deadletter.Path(dir), "imp")
+	assert.Nil(t, err)
+	defer dl.Close()
+	stages := []deadletter.Stage{}
+	for _, e := range dl.Pending() {
+		assert.Equal(t, "../testdata/picture.jpg", e.Path)
+		stages = append(stages, e.Stage)
+	}
+	assert.ElementsMatch(t, []deadletter.Stage{deadletter.StageIndex, deadletter.StageStore}, stages)
+}
+
+func TestRun_Toggles(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inToggles  stageToggles
+		expStored  bool
+		expIndexed bool
+	}{
+		{"uploadOnly", stageToggles{doNotExtractMetadata: true, doNotResize: true}, true, false},
+		{"doNotIndex", stageToggles{doNotIndex: true, doNotResize: true}, true, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			binPushed := []string{}
+			binServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				binPushed = append(binPushed, r.URL.Path)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer binServer.Close()
+			esDocPushed := false
+			esServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				esDocPushed = true
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer esServer.Close()
+			dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{
+				Elasticsearch: ElasticsearchConf{Url: esServer.URL},
+				Binary: BinaryConf{
+					Url:        binServer.URL,
+					Renditions: []RenditionConf{{Name: "thumb", Width: 70, Height: 50, KeySuffix: "-thumb"}},
+					WorkingDir: dir,
+				},
+			}
+			ctx := withToggles(common.NewContext("imp"), tc.inToggles)
+			assert.Nil(t, Run(ctx, c, []string{"../testdata/picture.jpg"}))
+			assert.Equal(t, tc.expIndexed, esDocPushed)
+			assert.Equal(t, tc.expStored, len(binPushed) > 0)
+			// the original picture is stored under the file identifier
+			for _, p := range binPushed {
+				assert.NotContains(t, p, "-thumb")
+			}
+		})
+	}
+}
+
+func TestRun_IndexOnly(t *testing.T) {
+	binPushed := false
+	binServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		binPushed = true
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer binServer.Close()
+	esBody := ""
+	esServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		esBody += string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer esServer.Close()
+
+	c := Config{
+		Elasticsearch: ElasticsearchConf{Url: esServer.URL},
+		Binary: BinaryConf{
+			Url:        binServer.URL,
+			Renditions: []RenditionConf{{Name: "thumb", Width: 70, Height: 50, KeySuffix: "-thumb"}},
+		},
+	}
+	ctx := withToggles(common.NewContext("imp"), stageToggles{doNotUpload: true})
+	assert.Nil(t, Run(ctx, c, []string{"../testdata/picture.jpg"}))
+	assert.False(t, binPushed)
+	// the documents reference the previously stored renditions
+	assert.Contains(t, esBody, "picture-thumb.jpg")
+}
+
+func TestRun_AllStagesDisabled(t *testing.T) {
+	ctx := withToggles(common.NewContext("imp"), stageToggles{doNotIndex: true, doNotUpload: true})
+	assert.NotNil(t, Run(ctx, Config{}, []string{"../testdata/"}))
+}
+
+func TestWithoutResize(t *testing.T) {
+	c := Config{Binary: BinaryConf{Url: "http://fs", Height: 50, Width: 70, Renditions: []RenditionConf{{Name: "thumb", Width: 10, Height: 10}}}}
+	assert.Len(t, buildRenditions(c), 1)
+	assert.Empty(t, buildRenditions(withoutResize(c)))
+	assert.Equal(t, "http://fs", withoutResize(c).Binary.Url)
+}
+
+func TestRunFailure(t *testing.T) {
+	var tcs = []struct {
+		inStatus string
+		expCode  int
+	}{
+		{report.StatusSuccess, retOk},
+		{report.StatusPartialFailure, retPartialFailure},
+		{report.StatusFailure, retExecFailure},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.inStatus, func(t *testing.T) {
+			assert.Equal(t, tc.expCode, exitCode(runFailure(report.Summary{Status: tc.inStatus}, nil)))
+		})
+	}
+
+	files, known := failedFiles(runFailure(report.Summary{Status: report.StatusPartialFailure}, []string{"a.jpg"}))
+	assert.True(t, known)
+	assert.Equal(t, []string{"a.jpg"}, files)
+	_, known = failedFiles(runFailure(report.Summary{Status: report.StatusPartialFailure}, nil))
+	assert.False(t, known)
+}
+
+func TestTracker(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dl, err := deadletter.Open(deadletter.Path(dir), "imp")
+	assert.Nil(t, err)
+	defer dl.Close()
+	assert.Nil(t, dl.Failed("b.jpg", "idB", deadletter.StageStore, fmt.Errorf("previous error")))
+
+	trk := &tracker{rep: report.New("imp"), dl: dl, met: metrics.New()}
+	trk.stored(binary.StoreResult{Task: browse.Task{Path: "a.jpg", FileID: "idA"}, Err: fmt.Errorf("error")})
+	trk.stored(binary.StoreResult{Task: browse.Task{Path: "b.jpg", FileID: "idB"}})
+	trk.stored(binary.StoreResult{Task: browse.Task{Path: "c.jpg", FileID: "idC"}, Skipped: true})
+	trk.paths.Store("idD", "d.jpg")
+	trk.paths.Store("idE", "e.jpg")
+	trk.indexFailed([]string{"idD"}, fmt.Errorf("error"))
+	trk.indexed([]string{"idE"})
+
+	s := trk.rep.Summary()
+	assert.Equal(t, 1, s.Stored)
+	assert.Equal(t, 1, s.Indexed)
+	assert.Equal(t, 1, s.Skipped[report.StageStore])
+	assert.Equal(t, 1, s.Failed[report.StageStore])
+	assert.Equal(t, 1, s.Failed[report.StageIndex])
+	assert.Equal(t, "a.jpg", s.Failures[0].File)
+	assert.Equal(t, "d.jpg", s.Failures[1].File)
+
+	pending := dl.Pending()
+	assert.Len(t, pending, 2)
+	assert.Equal(t, "a.jpg", pending[0].Path)
+	assert.Equal(t, deadletter.StageStore, pending[0].Stage)
+	assert.Equal(t, "d.jpg", pending[1].Path)
+	assert.Equal(t, "idD", pending[1].FileID)
+	assert.Equal(t, deadletter.StageIndex, pending[1].Stage)
+	_, found := trk.paths.Load("idE")
+	assert.False(t, found)
+	assert.Equal(t, []string{"a.jpg", "d.jpg"}, trk.failedFiles())
+	// a failure that is not associated to a file
+	trk.failed(report.StageBrowse, "", "", fmt.Errorf("error"))
+	assert.Nil(t, trk.failedFiles())
+
+	b := bytes.Buffer{}
+	_, err = trk.met.WriteTo(&b)
+	assert.Nil(t, err)
+	assert.Contains(t, b.String(), `picdexer_files_total{stage="store",outcome="processed"} 1`)
+	assert.Contains(t, b.String(), `picdexer_files_total{stage="store",outcome="skipped"} 1`)
+	assert.Contains(t, b.String(), `picdexer_files_total{stage="store",outcome="failed"} 1`)
+	assert.Contains(t, b.String(), `picdexer_files_total{stage="index",outcome="processed"} 1`)
+	assert.Contains(t, b.String(), `picdexer_files_total{stage="index",outcome="failed"} 1`)
+}
+
+func TestBuildDeadLetter(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var tcs = []struct {
+		tcID    string
+		inConf  Config
+		expFile string
+	}{
+		{"none", Config{}, ""},
+		{"file", Config{DeadLetter: DeadLetterConf{File: filepath.Join(dir, "dl.jsonl")}}, filepath.Join(dir, "dl.jsonl")},
+		{"checkpointDir", Config{Checkpoint: CheckpointConf{Dir: dir}}, deadletter.Path(dir)},
+		{"workingDir", Config{Binary: BinaryConf{WorkingDir: dir}}, deadletter.Path(dir)},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			dl, err := buildDeadLetter(common.NewContext("imp"), tc.inConf)
+			assert.Nil(t, err)
+			if tc.expFile == "" {
+				assert.Nil(t, dl)
+				return
+			}
+			assert.NotNil(t, dl)
+			assert.Nil(t, dl.Close())
+			_, err = os.Stat(tc.expFile)
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestCountSkipped(t *testing.T) {
+	trk := &tracker{rep: report.New("imp")}
+	f := countSkipped(trk, report.StageIndex, func(t browse.Task) bool { return t.Path == "a.jpg" })
+	assert.True(t, f(browse.Task{Path: "a.jpg"}))
+	assert.False(t, f(browse.Task{Path: "b.jpg"}))
+	assert.True(t, countSkipped(trk, report.StageIndex, nil)(browse.Task{Path: "b.jpg"}))
+	assert.Equal(t, 1, trk.rep.Summary().Skipped[report.StageIndex])
 }
 
 func TestBuildBinaryManager_Lazy(t *testing.T) {
@@ -66,3 +316,310 @@ func TestBuildBinaryManager_Lazy(t *testing.T) {
 	assert.Nil(t, err)
 	assert.IsType(t, binary.LazyBinaryManager{}, bm)
 }
+
+func TestBuildJournal(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	j, err := buildJournal(common.NewContext("imp"), Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, j)
+
+	_, err = buildJournal(common.WithResume(common.NewContext("imp")), Config{})
+	assert.NotNil(t, err)
+
+	j, err = buildJournal(common.NewContext("imp"), Config{Binary: BinaryConf{WorkingDir: dir}})
+	assert.Nil(t, err)
+	assert.NotNil(t, j)
+	assert.Nil(t, j.Close())
+
+	j, err = buildJournal(common.WithResume(common.NewContext("imp")), Config{Checkpoint: CheckpointConf{Dir: dir}})
+	assert.Nil(t, err)
+	assert.NotNil(t, j)
+	assert.Nil(t, j.Close())
+}
+
+func TestBuildBinaryManager_Resizer(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inResizer  string
+		expSuccess bool
+	}{
+		{"default", "", true},
+		{"convert", "convert", true},
+		{"go", "go", true},
+		{"unknown", "blabla", false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			_, _, err := buildBinaryManager(Config{
+				Binary: BinaryConf{
+					Url:     "http://localhost:8080",
+					Width:   640,
+					Height:  480,
+					Resizer: tc.inResizer,
+				},
+			})
+			assert.Equal(t, tc.expSuccess, err == nil)
+		})
+	}
+}
+
+func TestBuildBinaryManager_ResizeStrategies(t *testing.T) {
+	var tcs = []struct {
+		tcID         string
+		inStrategies []StrategyRuleConf
+		expSuccess   bool
+	}{
+		{"nominal", []StrategyRuleConf{{Match: []string{"cr2"}, Strategies: []StrategyConf{{Type: "preview", Tags: []string{"JpgFromRaw"}}, {Type: "convert"}}}}, true},
+		{"command", []StrategyRuleConf{{Match: []string{"image/heic"}, Strategies: []StrategyConf{{Type: "command", Command: []string{"heif-convert", "{input}", "{output}"}}}}}, true},
+		{"noMatch", []StrategyRuleConf{{Strategies: []StrategyConf{{Type: "convert"}}}}, false},
+		{"noStrategy", []StrategyRuleConf{{Match: []string{"cr2"}}}, false},
+		{"unknownStrategy", []StrategyRuleConf{{Match: []string{"cr2"}, Strategies: []StrategyConf{{Type: "blabla"}}}}, false},
+		{"commandWithoutInput", []StrategyRuleConf{{Match: []string{"cr2"}, Strategies: []StrategyConf{{Type: "command", Command: []string{"dcraw"}}}}}, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			_, _, err := buildBinaryManager(Config{
+				Binary: BinaryConf{
+					Url:              "http://localhost:8080",
+					Width:            640,
+					Height:           480,
+					ResizeStrategies: tc.inStrategies,
+				},
+			})
+			assert.Equal(t, tc.expSuccess, err == nil)
+		})
+	}
+}
+
+func TestBuildStrategyConf(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inConf     BinaryConf
+		expConf    binary.StrategyConf
+		expSuccess bool
+	}{
+		{
+			"default",
+			BinaryConf{},
+			binary.StrategyConf{Default: []binary.Strategy{{Type: binary.StrategyConvert}}, Timeout: time.Second},
+			true,
+		},
+		{
+			"goWithRules",
+			BinaryConf{
+				Resizer:                 "go",
+				ResizeFilter:            "bilinear",
+				UsePreviewForExtensions: []string{"nef"},
+				ResizeStrategies:        []StrategyRuleConf{{Match: []string{"cr2"}, Strategies: []StrategyConf{{Type: "preview", Tags: []string{"JpgFromRaw"}}}}},
+			},
+			binary.StrategyConf{
+				Default: []binary.Strategy{{Type: binary.StrategyGo}},
+				Rules: []binary.StrategyRule{
+					{Match: []string{"cr2"}, Strategies: []binary.Strategy{{Type: binary.StrategyPreview, Tags: []string{"JpgFromRaw"}}}},
+					{Match: []string{"nef"}, Strategies: []binary.Strategy{{Type: binary.StrategyPreview}}},
+				},
+				Timeout: time.Second,
+				Filter:  "bilinear",
+			},
+			true,
+		},
+		{"unknownResizer", BinaryConf{Resizer: "blabla"}, binary.StrategyConf{}, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			sc, err := buildStrategyConf(Config{Binary: tc.inConf}, time.Second)
+			assert.Equal(t, tc.expSuccess, err == nil)
+			if tc.expSuccess {
+				assert.Equal(t, tc.expConf, sc)
+			}
+		})
+	}
+}
+
+func TestBuildRenditions(t *testing.T) {
+	var tcs = []struct {
+		tcID   string
+		inConf BinaryConf
+		expRen []binary.Rendition
+	}{
+		{"none", BinaryConf{}, nil},
+		{"legacy", BinaryConf{Width: 640, Height: 480}, []binary.Rendition{{Name: "default", Width: 640, Height: 480}}},
+		{
+			"list",
+			BinaryConf{
+				Width:  640,
+				Height: 480,
+				Renditions: []RenditionConf{
+					{Name: "thumb", Width: 100, Height: 100, Quality: 70, Crop: "fill", KeySuffix: "_t"},
+				},
+			},
+			[]binary.Rendition{{Name: "thumb", Width: 100, Height: 100, Quality: 70, Crop: "fill", KeySuffix: "_t"}},
+		},
+		{
+			"watermark",
+			BinaryConf{
+				Renditions: []RenditionConf{
+					{Name: "web", Width: 640, Height: 480, Watermark: &WatermarkConf{Text: "© {{Artist}}", Position: "south", Opacity: 0.3, Margin: 0.05, Scale: 0.4}},
+				},
+			},
+			[]binary.Rendition{{Name: "web", Width: 640, Height: 480, Watermark: &binary.Watermark{Text: "© {{Artist}}", Position: "south", Opacity: 0.3, Margin: 0.05, Scale: 0.4}}},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expRen, buildRenditions(Config{Binary: tc.inConf}))
+		})
+	}
+}
+
+func TestBuildBinaryManager_Storage(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inConf     BinaryConf
+		expSuccess bool
+		expLazy    bool
+	}{
+		{"lazy", BinaryConf{}, true, true},
+		{"fileServer", BinaryConf{Storage: "fileServer", Url: "http://localhost:8080"}, true, false},
+		{"uploadTimeout", BinaryConf{Storage: "fileServer", Url: "http://localhost:8080", UploadTimeout: "2m"}, true, false},
+		{"wrongUploadTimeout", BinaryConf{Storage: "fileServer", Url: "http://localhost:8080", UploadTimeout: "blabla"}, false, false},
+		{"resizeTimeout", BinaryConf{Storage: "fileServer", Url: "http://localhost:8080", Width: 10, Height: 10, ResizeTimeout: "1m"}, true, false},
+		{"wrongResizeTimeout", BinaryConf{Storage: "fileServer", Url: "http://localhost:8080", ResizeTimeout: "blabla"}, false, false},
+		{"fs", BinaryConf{Storage: "fs", Fs: FsStorageConf{Root: os.TempDir()}}, true, false},
+		{"fsWithoutRoot", BinaryConf{Storage: "fs"}, false, false},
+		{"s3", BinaryConf{Storage: "s3", S3: S3StorageConf{Endpoint: "http://minio:9000", Bucket: "pics", PresignExpiry: "1h"}}, true, false},
+		{"s3WithoutBucket", BinaryConf{Storage: "s3", S3: S3StorageConf{Endpoint: "http://minio:9000"}}, false, false},
+		{"s3WrongExpiry", BinaryConf{Storage: "s3", S3: S3StorageConf{Endpoint: "http://minio:9000", Bucket: "pics", PresignExpiry: "blabla"}}, false, false},
+		{"unknown", BinaryConf{Storage: "blabla"}, false, false},
+		{"skipExisting", BinaryConf{Storage: "fs", Fs: FsStorageConf{Root: os.TempDir()}, SkipExisting: SkipExistingConf{RecordFile: filepath.Join(os.TempDir(), "picdexer_uploads_test.jsonl"), Verify: true}}, true, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			bm, _, err := buildBinaryManager(Config{Binary: tc.inConf})
+			assert.Equal(t, tc.expSuccess, err == nil)
+			if tc.expSuccess {
+				_, isLazy := bm.(binary.LazyBinaryManager)
+				assert.Equal(t, tc.expLazy, isLazy)
+			}
+		})
+	}
+}
+
+func TestBuildPolicy(t *testing.T) {
+	var tcs = []struct {
+		tcID      string
+		inConf    PrivacyConf
+		expPolicy bool
+		expError  bool
+	}{
+		{"none", PrivacyConf{}, false, false},
+		{"scrubAll", PrivacyConf{ScrubGPS: true}, true, false},
+		{"folderRule", PrivacyConf{Rules: []PrivacyRuleConf{{Folders: []string{"kids"}, Exclude: "all"}}}, true, false},
+		{"wrongRule", PrivacyConf{Rules: []PrivacyRuleConf{{Folders: []string{"kids"}, Exclude: "blabla"}}}, false, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			p, err := buildPolicy(Config{Privacy: tc.inConf})
+			assert.Equal(t, tc.expError, err != nil)
+			assert.Equal(t, tc.expPolicy, p != nil)
+			if p != nil {
+				assert.Nil(t, p.Close())
+			}
+		})
+	}
+}
+
+func TestBuildEnricher(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		inConf      EnrichmentConf
+		expEnricher bool
+		expError    bool
+	}{
+		{"none", EnrichmentConf{}, false, false},
+		{"nominal", EnrichmentConf{Plugins: []PluginConf{{Name: "p", Command: []string{"cmd"}, Timeout: "10s", MimeTypes: []string{"image/*"}}}}, true, false},
+		{"wrongTimeout", EnrichmentConf{Plugins: []PluginConf{{Name: "p", Command: []string{"cmd"}, Timeout: "blabla"}}}, false, true},
+		{"noCommand", EnrichmentConf{Plugins: []PluginConf{{Name: "p"}}}, false, true},
+		{"wrongThreadCount", EnrichmentConf{ThreadCount: -1, Plugins: []PluginConf{{Name: "p", Command: []string{"cmd"}}}}, false, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			e, err := buildEnricher(Config{Enrichment: tc.inConf})
+			assert.Equal(t, tc.expError, err != nil)
+			assert.Equal(t, tc.expEnricher, e != nil)
+		})
+	}
+}
+
+func TestBuildEsPusher_Rules(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		inRules  []RuleConf
+		expError bool
+	}{
+		{"none", nil, false},
+		{"nominal", []RuleConf{{Type: "tag", Keywords: []string{"canon"}, When: &ConditionConf{Field: "CameraModel", Matches: "Canon"}}}, false},
+		{"wrongRule", []RuleConf{{Type: "tag"}}, true},
+		{"wrongCondition", []RuleConf{{Type: "tag", Keywords: []string{"canon"}, When: &ConditionConf{Field: "CameraModel", Matches: "("}}}, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			_, err := buildEsPusher(Config{Rules: tc.inRules})
+			assert.Equal(t, tc.expError, err != nil)
+		})
+	}
+}
+
+func TestBuildEsPusher_Bulks(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		inConf      ElasticsearchConf
+		expBulks    int
+		expEncoding string
+	}{
+		{"default", ElasticsearchConf{}, 1, ""},
+		{"maxBytes", ElasticsearchConf{BulkMaxBytes: 10}, 3, ""},
+		{"workers", ElasticsearchConf{BulkSize: 1, BulkWorkers: 2}, 3, ""},
+		{"gzip", ElasticsearchConf{Gzip: true}, 1, "gzip"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			bulks := make(chan string, 10)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				bulks <- r.Header.Get("Content-Encoding")
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer ts.Close()
+			tc.inConf.Url = ts.URL
+			p, err := buildEsPusher(Config{Elasticsearch: tc.inConf})
+			assert.Nil(t, err)
+
+			in := make(chan elasticsearch.EsDoc, 3)
+			for _, id := range []string{"id1", "id2", "id3"} {
+				in <- elasticsearch.EsDoc{Header: elasticsearch.EsHeader{Index: elasticsearch.EsHeaderIndex{Index: "picdexer", ID: id}}, Document: map[string]string{"FileName": id}}
+			}
+			close(in)
+			assert.Nil(t, p.Push(context.TODO(), in))
+			close(bulks)
+			count := 0
+			for enc := range bulks {
+				assert.Equal(t, tc.expEncoding, enc)
+				count++
+			}
+			assert.Equal(t, tc.expBulks, count)
+		})
+	}
+}
@@ -1,11 +1,17 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"github.com/barasher/picdexer/internal/common"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"syscall"
+	"time"
 )
 
+const defaultGracePeriod = 8 * time.Second
+
 func setLoggingLevel(lvl string) error {
 	if lvl != "" {
 		lvl, err := zerolog.ParseLevel(lvl)
@@ -17,3 +23,17 @@ func setLoggingLevel(lvl string) error {
 	}
 	return nil
 }
+
+// withShutdown handles SIGINT and SIGTERM : the run is stopped and the
+// in-flight work is drained during the grace period.
+func withShutdown(ctx context.Context, c Config) (context.Context, func(), error) {
+	grace := defaultGracePeriod
+	if c.Shutdown.GracePeriod != "" {
+		var err error
+		if grace, err = time.ParseDuration(c.Shutdown.GracePeriod); err != nil {
+			return nil, nil, fmt.Errorf("error while parsing grace period (%v): %w", c.Shutdown.GracePeriod, err)
+		}
+	}
+	ctx, release := common.WithShutdown(ctx, grace, syscall.SIGINT, syscall.SIGTERM)
+	return ctx, release, nil
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"github.com/barasher/picdexer/internal/common"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -53,3 +54,27 @@ func TestSetLoggingLevel(t *testing.T) {
 		})
 	}
 }
+
+func TestWithShutdown(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inGrace    string
+		expSuccess bool
+	}{
+		{"default", "", true},
+		{"set", "30s", true},
+		{"wrong", "blabla", false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			ctx, release, err := withShutdown(context.Background(), Config{Shutdown: ShutdownConf{GracePeriod: tc.inGrace}})
+			assert.Equal(t, tc.expSuccess, err == nil)
+			if err == nil {
+				assert.False(t, common.IsStopping(ctx))
+				release()
+				assert.NotNil(t, ctx.Err())
+			}
+		})
+	}
+}
@@ -12,22 +12,177 @@ type Config struct {
 	Binary        BinaryConf        `json:"binary"`
 	Dropzone      DropzoneConf      `json:"dropzone"`
 	Kibana        KibanaConf        `json:"kibana"`
+	Checkpoint    CheckpointConf    `json:"checkpoint"`
+	Privacy       PrivacyConf       `json:"privacy"`
+	Report        ReportConf        `json:"report"`
+	DeadLetter    DeadLetterConf    `json:"deadLetter"`
+	Shutdown      ShutdownConf      `json:"shutdown"`
+	Monitoring    MonitoringConf    `json:"monitoring"`
+	Enrichment    EnrichmentConf    `json:"enrichment"`
+	Rules         []RuleConf        `json:"rules"`
+	Limits        LimitsConf        `json:"limits"`
+}
+
+type RuleConf struct {
+	Type        string              `json:"type"`
+	Field       string              `json:"field"`
+	When        *ConditionConf      `json:"when"`
+	Values      map[string]string   `json:"values"`
+	Pattern     string              `json:"pattern"`
+	Replacement string              `json:"replacement"`
+	Synonyms    map[string][]string `json:"synonyms"`
+	Separator   string              `json:"separator"`
+	Keywords    []string            `json:"keywords"`
+	Into        string              `json:"into"`
+}
+
+type ConditionConf struct {
+	Field   string `json:"field"`
+	Matches string `json:"matches"`
+}
+
+type EnrichmentConf struct {
+	ThreadCount int          `json:"threadCount"`
+	Plugins     []PluginConf `json:"plugins"`
+}
+
+type PluginConf struct {
+	Name        string   `json:"name"`
+	Command     []string `json:"command"`
+	Timeout     string   `json:"timeout"`
+	Concurrency int      `json:"concurrency"`
+	MimeTypes   []string `json:"mimeTypes"`
+	Keywords    []string `json:"keywords"`
+}
+
+type LimitsConf struct {
+	FilesPerSecond       float64 `json:"filesPerSecond"`
+	UploadsPerSecond     float64 `json:"uploadsPerSecond"`
+	UploadBytesPerSecond int64   `json:"uploadBytesPerSecond"`
+	BulksPerSecond       float64 `json:"bulksPerSecond"`
+	MaxInFlightBulks     int     `json:"maxInFlightBulks"`
+}
+
+type MonitoringConf struct {
+	Listen string `json:"listen"`
+}
+
+type ShutdownConf struct {
+	GracePeriod string `json:"gracePeriod"`
+}
+
+type DeadLetterConf struct {
+	File string `json:"file"`
+}
+
+type ReportConf struct {
+	File string `json:"file"`
 }
 
 type ElasticsearchConf struct {
-	Url         string `json:"url"`
-	ThreadCount int    `json:"threadCount"`
-	BulkSize    int    `json:"bulkSize"`
-	SyncOnDate map[string]string `json:"syncOnDate"`
+	Url          string            `json:"url"`
+	ThreadCount  int               `json:"threadCount"`
+	BulkSize     int               `json:"bulkSize"`
+	BulkWorkers  int               `json:"bulkWorkers"`
+	BulkMaxBytes int               `json:"bulkMaxBytes"`
+	Gzip         bool              `json:"gzip"`
+	SyncOnDate   map[string]string `json:"syncOnDate"`
 }
 
 type BinaryConf struct {
-	Url                     string   `json:"url"`
-	Height                  int      `json:"height"`
-	Width                   int      `json:"width"`
-	ThreadCount             int      `json:"threadCount"`
-	WorkingDir              string   `json:"workingDir"`
-	UsePreviewForExtensions []string `json:"usePreviewForExtensions"`
+	Url                     string             `json:"url"`
+	UploadTimeout           string             `json:"uploadTimeout"`
+	Height                  int                `json:"height"`
+	Width                   int                `json:"width"`
+	ThreadCount             int                `json:"threadCount"`
+	WorkingDir              string             `json:"workingDir"`
+	UsePreviewForExtensions []string           `json:"usePreviewForExtensions"`
+	Resizer                 string             `json:"resizer"`
+	ResizeFilter            string             `json:"resizeFilter"`
+	ResizeTimeout           string             `json:"resizeTimeout"`
+	ResizeStrategies        []StrategyRuleConf `json:"resizeStrategies"`
+	Renditions              []RenditionConf    `json:"renditions"`
+	SRGBProfile             string             `json:"srgbProfile"`
+	Storage                 string             `json:"storage"`
+	Fs                      FsStorageConf      `json:"fs"`
+	S3                      S3StorageConf      `json:"s3"`
+	SkipExisting            SkipExistingConf   `json:"skipExisting"`
+	ArchiveOriginals        bool               `json:"archiveOriginals"`
+}
+
+type PrivacyConf struct {
+	ScrubGPS bool              `json:"scrubGPS"`
+	Rules    []PrivacyRuleConf `json:"rules"`
+}
+
+type PrivacyRuleConf struct {
+	Keywords []string `json:"keywords"`
+	Folders  []string `json:"folders"`
+	Paths    []string `json:"paths"`
+	Exclude  string   `json:"exclude"`
+	ScrubGPS bool     `json:"scrubGPS"`
+}
+
+type SkipExistingConf struct {
+	RecordFile string `json:"recordFile"`
+	Verify     bool   `json:"verify"`
+}
+
+type FsStorageConf struct {
+	Root     string `json:"root"`
+	BaseUrl  string `json:"baseUrl"`
+	HardLink bool   `json:"hardLink"`
+}
+
+type S3StorageConf struct {
+	Endpoint           string `json:"endpoint"`
+	Region             string `json:"region"`
+	Bucket             string `json:"bucket"`
+	Prefix             string `json:"prefix"`
+	AccessKey          string `json:"accessKey"`
+	SecretKey          string `json:"secretKey"`
+	SessionToken       string `json:"sessionToken"`
+	PathStyle          bool   `json:"pathStyle"`
+	PublicUrl          string `json:"publicUrl"`
+	PresignExpiry      string `json:"presignExpiry"`
+	CacheControl       string `json:"cacheControl"`
+	MultipartThreshold int64  `json:"multipartThreshold"`
+	PartSize           int64  `json:"partSize"`
+}
+
+type StrategyRuleConf struct {
+	Match      []string       `json:"match"`
+	Strategies []StrategyConf `json:"strategies"`
+}
+
+type StrategyConf struct {
+	Type    string   `json:"type"`
+	Tags    []string `json:"tags"`
+	Command []string `json:"command"`
+}
+
+type RenditionConf struct {
+	Name          string         `json:"name"`
+	Width         int            `json:"width"`
+	Height        int            `json:"height"`
+	Quality       int            `json:"quality"`
+	Crop          string         `json:"crop"`
+	KeySuffix     string         `json:"keySuffix"`
+	Format        string         `json:"format"`
+	Progressive   bool           `json:"progressive"`
+	Subsampling   string         `json:"subsampling"`
+	StripMetadata bool           `json:"stripMetadata"`
+	ToSRGB        bool           `json:"toSRGB"`
+	Watermark     *WatermarkConf `json:"watermark"`
+}
+
+type WatermarkConf struct {
+	Text     string  `json:"text"`
+	Image    string  `json:"image"`
+	Position string  `json:"position"`
+	Opacity  float64 `json:"opacity"`
+	Margin   float64 `json:"margin"`
+	Scale    float64 `json:"scale"`
 }
 
 type DropzoneConf struct {
@@ -35,6 +190,10 @@ type DropzoneConf struct {
 	Period string `json:"period"`
 }
 
+type CheckpointConf struct {
+	Dir string `json:"dir"`
+}
+
 type KibanaConf struct {
 	Url string `json:"url"`
 }
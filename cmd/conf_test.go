@@ -29,6 +29,11 @@ func TestLoadConf_Nominal(t *testing.T) {
 	assert.Equal(t, 11, c.Binary.ThreadCount)
 	assert.Equal(t, "/tmp", c.Binary.WorkingDir)
 	assert.Equal(t, []string{"ext1", "ext2"}, c.Binary.UsePreviewForExtensions)
+	expRenditions := []RenditionConf{
+		{Name: "thumbnail", Width: 200, Height: 200, Quality: 70, Crop: "fill", KeySuffix: "_thumb"},
+		{Name: "preview", Width: 1920, Height: 1080},
+	}
+	assert.Equal(t, expRenditions, c.Binary.Renditions)
 	// kibana
 	assert.Equal(t, "http://localhost:5601", c.Kibana.Url)
 	// dropzone
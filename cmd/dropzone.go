@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"github.com/barasher/picdexer/internal/common"
 	"github.com/barasher/picdexer/internal/filewatcher"
+	"github.com/barasher/picdexer/internal/metrics"
+	"github.com/barasher/picdexer/internal/ratelimit"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"os"
+	"syscall"
 	"time"
 )
 
@@ -45,6 +48,23 @@ func dropzone2(confFile string, importId string, runFct func(context.Context, Co
 	if err := setLoggingLevel(c.LogLevel); err != nil {
 		return fmt.Errorf("error while configuring logging level: %w", err)
 	}
+	ctx, release, err := withShutdown(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx, stop, err := startMonitoring(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	if ctx, err = withLimits(ctx, c); err != nil {
+		return err
+	}
+	if confFile != "" {
+		// the limits can be adjusted without restarting : kill -HUP
+		defer watchLimits(confFile, ratelimit.Get(ctx), syscall.SIGHUP)()
+	}
 	return doDropzone(ctx, c, runFct)
 }
 
@@ -66,6 +86,9 @@ func doDropzone(ctx context.Context, c Config, runFct func(context.Context, Conf
 		select {
 		case <-ctx.Done():
 			return nil
+		case <-common.Stopping(ctx):
+			log.Info().Msg("Dropzone stopped")
+			return nil
 		case <-timer.C:
 			err = process(ctx, fw, c, runFct)
 			if err != nil {
@@ -92,15 +115,43 @@ func process(ctx context.Context, fw *filewatcher.FileWatcher, c Config, runFct
 			inputs[i] = c.Path
 		}
 		err = runFct(ctx, c, inputs)
-		if err != nil {
+		switch exitCode(err) {
+		case retConfFailure:
 			return fmt.Errorf("error while running: %w", err)
+		case retInterrupted:
+			// the files that may not have been processed are kept
+			return err
 		}
-
-		// delete
-		for _, curInput := range inputs {
-			os.Remove(curInput)
+		if err != nil {
+			// the failures are reported, the dropzone keeps being watched and
+			// the failed files are kept so that they can be retried. All the
+			// inputs are kept if the failed files are not known.
+			failed, known := failedFiles(err)
+			if !known {
+				log.Error().Msgf("Error while running, inputs kept: %v", err)
+				return nil
+			}
+			log.Error().Msgf("Error while running, failed files kept (%v): %v", failed, err)
+			removeInputs(inputs, failed)
+			return nil
 		}
+
+		removeInputs(inputs, nil)
 	}
 
+	metrics.Get(ctx).Succeeded(time.Now())
 	return nil
 }
+
+// removeInputs deletes the processed inputs, except the kept ones.
+func removeInputs(inputs []string, kept []string) {
+	keep := make(map[string]bool, len(kept))
+	for _, k := range kept {
+		keep[k] = true
+	}
+	for _, curInput := range inputs {
+		if !keep[curInput] {
+			os.Remove(curInput)
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"github.com/barasher/picdexer/internal/filewatcher"
+	"github.com/barasher/picdexer/internal/metrics"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -28,6 +33,108 @@ func TestFailOnRun(t *testing.T) {
 	assert.NotNil(t, doDropzone(context.Background(), c, simulateRun(false)))
 }
 
+func TestDoDropzone_ContinueOnRunFailure(t *testing.T) {
+	d, err := os.MkdirTemp("/tmp/", "TestContinueOnRunFailure")
+	assert.Nil(t, err)
+	defer os.RemoveAll(d)
+	assert.Nil(t, copy("../testdata/picture.jpg", d+"/picture.jpg"))
+	c := Config{Dropzone: DropzoneConf{
+		Root:   d,
+		Period: "10ms",
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	fct := func(ctx2 context.Context, conf2 Config, inputs []string) error {
+		runs++
+		if runs == 1 {
+			assert.Nil(t, copy("../testdata/picture.jpg", d+"/picture2.jpg"))
+		}
+		return partialFailure(fmt.Errorf("error"))
+	}
+	res := make(chan error)
+	go func() { res <- doDropzone(ctx, c, fct) }()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	assert.Nil(t, <-res)
+	// the inputs of the failed runs are kept and processed again
+	assert.True(t, runs > 2, "%v", runs)
+	for _, f := range []string{"picture.jpg", "picture2.jpg"} {
+		_, err = os.Stat(d + "/" + f)
+		assert.Nil(t, err)
+	}
+}
+
+func TestProcess_LastSuccess(t *testing.T) {
+	d, err := os.MkdirTemp("/tmp/", "TestLastSuccess")
+	assert.Nil(t, err)
+	defer os.RemoveAll(d)
+	fw := filewatcher.NewFileWatcher(d)
+	_, err = fw.Watch()
+	assert.Nil(t, err)
+	m := metrics.New()
+	ctx := metrics.WithMetrics(context.Background(), m)
+
+	var tcs = []struct {
+		tcID       string
+		inFile     bool
+		inRunError error
+		expSuccess bool
+		expKept    bool
+	}{
+		{"partialFailure", true, partialFailure(fmt.Errorf("error")), false, true},
+		{"failure", true, execFailure(fmt.Errorf("error")), false, true},
+		{"failedFile", true, exitError{code: retExecFailure, err: fmt.Errorf("error"), files: []string{d + "/failedFile.jpg"}}, false, true},
+		{"otherFailedFile", true, exitError{code: retPartialFailure, err: fmt.Errorf("error"), files: []string{d + "/other.jpg"}}, false, false},
+		{"nothingToDo", false, nil, true, false},
+		{"success", true, nil, true, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			m.Succeeded(time.Time{})
+			if tc.inFile {
+				assert.Nil(t, copy("../testdata/picture.jpg", d+"/"+tc.tcID+".jpg"))
+				// the file watcher only returns stable files
+				_, err = fw.Watch()
+				assert.Nil(t, err)
+			}
+			fct := func(ctx2 context.Context, conf2 Config, inputs []string) error {
+				return tc.inRunError
+			}
+			assert.Nil(t, process(ctx, fw, Config{}, fct))
+			b := bytes.Buffer{}
+			_, err := m.WriteTo(&b)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expSuccess, !strings.Contains(b.String(), "picdexer_last_success_timestamp_seconds 0\n"))
+			if tc.inFile {
+				_, err = os.Stat(d + "/" + tc.tcID + ".jpg")
+				assert.Equal(t, tc.expKept, err == nil)
+			}
+		})
+	}
+}
+
+func TestDoDropzone_Interrupted(t *testing.T) {
+	d, err := os.MkdirTemp("/tmp/", "TestInterrupted")
+	assert.Nil(t, err)
+	defer os.RemoveAll(d)
+	assert.Nil(t, copy("../testdata/picture.jpg", d+"/picture.jpg"))
+	c := Config{Dropzone: DropzoneConf{
+		Root:   d,
+		Period: "10ms",
+	}}
+
+	fct := func(ctx2 context.Context, conf2 Config, inputs []string) error {
+		return interrupted(fmt.Errorf("error"))
+	}
+	err = doDropzone(context.Background(), c, fct)
+	assert.Equal(t, retInterrupted, exitCode(err))
+	_, err = os.Stat(d + "/picture.jpg")
+	assert.Nil(t, err)
+}
+
 func TestFailOnNonExistingRootFolder(t *testing.T) {
 	c := Config{Dropzone: DropzoneConf{
 		Root:   "/tmp123456789",
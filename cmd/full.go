@@ -7,6 +7,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
+const stagesCtxKey = "stages"
+
 var (
 	fullCmd = &cobra.Command{
 		Use:   "full",
@@ -20,23 +22,69 @@ func init() {
 	fullCmd.Flags().StringVarP(&confFile, "conf", "c", "", "Picdexer configuration file")
 	fullCmd.Flags().StringArrayVarP(&input, "dir", "d", []string{}, "Directory/File containing pictures")
 	fullCmd.Flags().StringVarP(&importID, "impId", "i", "", "Import identifier")
+	fullCmd.Flags().StringVarP(&resumeID, "resume", "", "", "Import identifier to resume")
 
-	/*fullCmd.Flags().BoolVarP(&doNotExtractMetadata, "doNotExtractMetadata", "", false, "Does not extract metadata")
+	fullCmd.Flags().BoolVarP(&doNotExtractMetadata, "doNotExtractMetadata", "", false, "Does not extract metadata (nor index)")
 	fullCmd.Flags().BoolVarP(&doNotIndex, "doNotIndex", "", false, "Does not index metadata")
 	fullCmd.Flags().BoolVarP(&doNotUpload, "doNotUpload", "", false, "Does not upload picture")
-	fullCmd.Flags().BoolVarP(&doNotResize, "doNotResize", "", false, "Does not resize")*/
+	fullCmd.Flags().BoolVarP(&doNotResize, "doNotResize", "", false, "Does not resize (uploads the original picture)")
 
 	fullCmd.MarkFlagRequired("conf")
 	fullCmd.MarkFlagRequired("dir")
 	rootCmd.AddCommand(fullCmd)
 }
 
+// stageToggles disables some stages of a run, all the stages being enabled
+// by default.
+type stageToggles struct {
+	doNotExtractMetadata bool
+	doNotIndex           bool
+	doNotUpload          bool
+	doNotResize          bool
+}
+
+// indexing returns true if the metadata are extracted and indexed : the
+// extracted metadata are only used by the indexing.
+func (t stageToggles) indexing() bool {
+	return !t.doNotExtractMetadata && !t.doNotIndex
+}
+
+func (t stageToggles) storing() bool {
+	return !t.doNotUpload
+}
+
+func withToggles(ctx context.Context, t stageToggles) context.Context {
+	return context.WithValue(ctx, stagesCtxKey, t)
+}
+
+func getToggles(ctx context.Context) stageToggles {
+	if v := ctx.Value(stagesCtxKey); v != nil {
+		return v.(stageToggles)
+	}
+	return stageToggles{}
+}
+
 func full(cmd *cobra.Command, args []string) error {
-	return doFull(confFile, importID, input, Run)
+	toggles := stageToggles{
+		doNotExtractMetadata: doNotExtractMetadata,
+		doNotIndex:           doNotIndex,
+		doNotUpload:          doNotUpload,
+		doNotResize:          doNotResize,
+	}
+	return doFull(confFile, importID, resumeID, input, toggles, Run)
 }
 
-func doFull(confFile string, importID string, inputs []string, runFct func(context.Context, Config, []string) error) error {
-	ctx := common.NewContext(importID)
+func doFull(confFile string, importID string, resumeID string, inputs []string, toggles stageToggles, runFct func(context.Context, Config, []string) error) error {
+	if resumeID != "" && importID != "" && resumeID != importID {
+		return fmt.Errorf("import identifier (%v) and resumed import identifier (%v) differ", importID, resumeID)
+	}
+	var ctx context.Context
+	if resumeID != "" {
+		ctx = common.WithResume(common.NewContext(resumeID))
+	} else {
+		ctx = common.NewContext(importID)
+	}
+	ctx = withToggles(ctx, toggles)
 	var c Config
 	var err error
 	if confFile != "" {
@@ -48,6 +96,11 @@ func doFull(confFile string, importID string, inputs []string, runFct func(conte
 	if err := setLoggingLevel(c.LogLevel); err != nil {
 		return fmt.Errorf("error while configuring logging level: %w", err)
 	}
+	ctx, release, err := withShutdown(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	return runFct(ctx, c, inputs)
 }
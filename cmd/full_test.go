@@ -1,22 +1,74 @@
 package cmd
 
 import (
+	"context"
+	"github.com/barasher/picdexer/internal/common"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
 func TestDoFull_Nominal(t *testing.T) {
-	assert.Nil(t, doFull("../testdata/conf/picdexer_nominal.json", "", []string{}, simulateRun(true)))
+	assert.Nil(t, doFull("../testdata/conf/picdexer_nominal.json", "", "", []string{}, stageToggles{}, simulateRun(true)))
 }
 
 func TestDoFull_FailOnWrongLoggingLevel(t *testing.T) {
-	assert.NotNil(t, doFull("../testdata/conf/picdexer_wrongLoggingLevel.json", "", []string{}, simulateRun(true)))
+	assert.NotNil(t, doFull("../testdata/conf/picdexer_wrongLoggingLevel.json", "", "", []string{}, stageToggles{}, simulateRun(true)))
 }
 
 func TestDoFull_FailOnConfLoad(t *testing.T) {
-	assert.NotNil(t, doFull("nonExistingFile", "", []string{}, simulateRun(true)))
+	assert.NotNil(t, doFull("nonExistingFile", "", "", []string{}, stageToggles{}, simulateRun(true)))
 }
 
 func TestDoFull_FailOnRun(t *testing.T) {
-	assert.NotNil(t, doFull("../testdata/conf/picdexer_nominal.json", "", []string{}, simulateRun(false)))
+	assert.NotNil(t, doFull("../testdata/conf/picdexer_nominal.json", "", "", []string{}, stageToggles{}, simulateRun(false)))
+}
+
+func TestDoFull_ResumeIDMismatch(t *testing.T) {
+	assert.NotNil(t, doFull("../testdata/conf/picdexer_nominal.json", "imp1", "imp2", []string{}, stageToggles{}, simulateRun(true)))
+}
+
+func TestDoFull_Resume(t *testing.T) {
+	var resumed bool
+	var impID string
+	runFct := func(ctx context.Context, c Config, inputs []string) error {
+		resumed = common.IsResumed(ctx)
+		impID = common.GetImportID(ctx)
+		return nil
+	}
+	assert.Nil(t, doFull("../testdata/conf/picdexer_nominal.json", "", "imp1", []string{}, stageToggles{}, runFct))
+	assert.True(t, resumed)
+	assert.Equal(t, "imp1", impID)
+}
+
+func TestDoFull_Toggles(t *testing.T) {
+	var toggles stageToggles
+	runFct := func(ctx context.Context, c Config, inputs []string) error {
+		toggles = getToggles(ctx)
+		return nil
+	}
+	exp := stageToggles{doNotIndex: true, doNotResize: true}
+	assert.Nil(t, doFull("../testdata/conf/picdexer_nominal.json", "", "", []string{}, exp, runFct))
+	assert.Equal(t, exp, toggles)
+}
+
+func TestStageToggles(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		inToggles   stageToggles
+		expIndexing bool
+		expStoring  bool
+	}{
+		{"all", stageToggles{}, true, true},
+		{"doNotExtractMetadata", stageToggles{doNotExtractMetadata: true}, false, true},
+		{"doNotIndex", stageToggles{doNotIndex: true}, false, true},
+		{"doNotUpload", stageToggles{doNotUpload: true}, true, false},
+		{"doNotResize", stageToggles{doNotResize: true}, true, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expIndexing, tc.inToggles.indexing())
+			assert.Equal(t, tc.expStoring, tc.inToggles.storing())
+		})
+	}
 }
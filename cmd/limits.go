@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/barasher/picdexer/internal/ratelimit"
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+func limitSettings(c Config) ratelimit.Settings {
+	return ratelimit.Settings{
+		FilesPerSecond:       c.Limits.FilesPerSecond,
+		UploadsPerSecond:     c.Limits.UploadsPerSecond,
+		UploadBytesPerSecond: c.Limits.UploadBytesPerSecond,
+		BulksPerSecond:       c.Limits.BulksPerSecond,
+		MaxInFlightBulks:     c.Limits.MaxInFlightBulks,
+	}
+}
+
+// withLimits returns a context holding the limits of the configuration,
+// unless the context already holds limits (shared by the dropzone runs).
+func withLimits(ctx context.Context, c Config) (context.Context, error) {
+	if ratelimit.Get(ctx) != nil {
+		return ctx, nil
+	}
+	l, err := ratelimit.NewLimits(limitSettings(c))
+	if err != nil {
+		return nil, fmt.Errorf("error while building limits: %w", err)
+	}
+	return ratelimit.WithLimits(ctx, l), nil
+}
+
+// watchLimits reloads the limits from the configuration file when one of
+// the signals is received, the running stages applying them immediately.
+// The other settings of the file are ignored. release stops handling the
+// signals.
+func watchLimits(confFile string, l *ratelimit.Limits, signals ...os.Signal) (release func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, signals...)
+	released := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigs:
+				reloadLimits(confFile, l)
+			case <-released:
+				return
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			signal.Stop(sigs)
+			close(released)
+		})
+	}
+}
+
+func reloadLimits(confFile string, l *ratelimit.Limits) {
+	c, err := LoadConf(confFile)
+	if err != nil {
+		log.Error().Msgf("Limits not reloaded, error while loading configuration (%v): %v", confFile, err)
+		return
+	}
+	s := limitSettings(c)
+	if err := l.Set(s); err != nil {
+		log.Error().Msgf("Limits not reloaded: %v", err)
+		return
+	}
+	log.Info().Msgf("Limits reloaded: %+v", s)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"context"
+	"github.com/barasher/picdexer/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWithLimits(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		inConf      Config
+		expOk       bool
+		expSettings ratelimit.Settings
+	}{
+		{"unlimited", Config{}, true, ratelimit.Settings{}},
+		{"nominal", Config{Limits: LimitsConf{FilesPerSecond: 50, UploadsPerSecond: 5, UploadBytesPerSecond: 1048576, BulksPerSecond: 2, MaxInFlightBulks: 1}}, true,
+			ratelimit.Settings{FilesPerSecond: 50, UploadsPerSecond: 5, UploadBytesPerSecond: 1048576, BulksPerSecond: 2, MaxInFlightBulks: 1}},
+		{"negative", Config{Limits: LimitsConf{BulksPerSecond: -1}}, false, ratelimit.Settings{}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			ctx, err := withLimits(context.TODO(), tc.inConf)
+			assert.Equal(t, tc.expOk, err == nil)
+			if tc.expOk {
+				assert.Equal(t, tc.expSettings, ratelimit.Get(ctx).Settings())
+			}
+		})
+	}
+}
+
+func TestWithLimits_Shared(t *testing.T) {
+	l, err := ratelimit.NewLimits(ratelimit.Settings{FilesPerSecond: 1})
+	assert.Nil(t, err)
+	ctx, err := withLimits(ratelimit.WithLimits(context.TODO(), l), Config{Limits: LimitsConf{FilesPerSecond: 2}})
+	assert.Nil(t, err)
+	assert.Equal(t, l, ratelimit.Get(ctx))
+	assert.Equal(t, 1.0, l.Settings().FilesPerSecond)
+}
+
+func TestWatchLimits(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "picdexer.json")
+	assert.Nil(t, os.WriteFile(conf, []byte(`{"limits": {"bulksPerSecond": 1}}`), 0644))
+	l, err := ratelimit.NewLimits(ratelimit.Settings{BulksPerSecond: 1})
+	assert.Nil(t, err)
+	release := watchLimits(conf, l, syscall.SIGUSR2)
+	defer release()
+
+	reloaded := func(exp ratelimit.Settings) bool {
+		assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGUSR2))
+		for i := 0; i < 100; i++ {
+			if l.Settings() == exp {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	assert.Nil(t, os.WriteFile(conf, []byte(`{"limits": {"bulksPerSecond": 3, "maxInFlightBulks": 2}}`), 0644))
+	assert.True(t, reloaded(ratelimit.Settings{BulksPerSecond: 3, MaxInFlightBulks: 2}))
+
+	// wrong limits are ignored
+	assert.Nil(t, os.WriteFile(conf, []byte(`{"limits": {"bulksPerSecond": -1}}`), 0644))
+	assert.False(t, reloaded(ratelimit.Settings{BulksPerSecond: -1}))
+	assert.Equal(t, ratelimit.Settings{BulksPerSecond: 3, MaxInFlightBulks: 2}, l.Settings())
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/barasher/picdexer/internal/metrics"
+	"os"
+)
+
+// startMonitoring serves the metrics and the health endpoints if
+// monitoring.listen is configured. The returned context holds the metrics
+// recorded by the runs.
+func startMonitoring(ctx context.Context, c Config) (context.Context, func(), error) {
+	if c.Monitoring.Listen == "" {
+		return ctx, func() {}, nil
+	}
+	m := metrics.New()
+	stop, err := metrics.Serve(c.Monitoring.Listen, metrics.Handler(m, buildChecks(c)...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while starting monitoring: %w", err)
+	}
+	return metrics.WithMetrics(ctx, m), stop, nil
+}
+
+// buildChecks returns the reachability checks of Elasticsearch and of the
+// storage.
+func buildChecks(c Config) []metrics.Check {
+	var checks []metrics.Check
+	if c.Elasticsearch.Url != "" {
+		checks = append(checks, metrics.Check{Name: "elasticsearch", Probe: metrics.HTTPProbe(c.Elasticsearch.Url)})
+	}
+	switch c.Binary.Storage {
+	case "", storageFileServer:
+		if c.Binary.Url != "" {
+			checks = append(checks, metrics.Check{Name: storageFileServer, Probe: metrics.HTTPProbe(c.Binary.Url)})
+		}
+	case storageFs:
+		checks = append(checks, metrics.Check{Name: storageFs, Probe: dirProbe(c.Binary.Fs.Root)})
+	case storageS3:
+		checks = append(checks, metrics.Check{Name: storageS3, Probe: metrics.HTTPProbe(c.Binary.S3.Endpoint)})
+	}
+	return checks
+}
+
+// dirProbe returns a probe that succeeds if the directory exists.
+func dirProbe(dir string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%v is not a directory", dir)
+		}
+		return nil
+	}
+}
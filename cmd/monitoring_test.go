@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"context"
+	"github.com/barasher/picdexer/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestStartMonitoring(t *testing.T) {
+	ctx, stop, err := startMonitoring(context.TODO(), Config{})
+	assert.Nil(t, err)
+	assert.Nil(t, metrics.Get(ctx))
+	stop()
+
+	ctx, stop, err = startMonitoring(context.TODO(), Config{Monitoring: MonitoringConf{Listen: "127.0.0.1:0"}})
+	assert.Nil(t, err)
+	assert.NotNil(t, metrics.Get(ctx))
+	stop()
+
+	_, _, err = startMonitoring(context.TODO(), Config{Monitoring: MonitoringConf{Listen: "wrong:address:1"}})
+	assert.NotNil(t, err)
+}
+
+func TestBuildChecks(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		inConf   Config
+		expNames []string
+	}{
+		{"none", Config{}, nil},
+		{"es", Config{Elasticsearch: ElasticsearchConf{Url: "http://es:9200"}}, []string{"elasticsearch"}},
+		{"fileServer", Config{Elasticsearch: ElasticsearchConf{Url: "http://es:9200"}, Binary: BinaryConf{Url: "http://fs:8080"}}, []string{"elasticsearch", storageFileServer}},
+		{"fs", Config{Binary: BinaryConf{Storage: storageFs, Fs: FsStorageConf{Root: "/tmp"}}}, []string{storageFs}},
+		{"s3", Config{Binary: BinaryConf{Storage: storageS3, S3: S3StorageConf{Endpoint: "http://s3:9000"}}}, []string{storageS3}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			var names []string
+			for _, c := range buildChecks(tc.inConf) {
+				names = append(names, c.Name)
+			}
+			assert.Equal(t, tc.expNames, names)
+		})
+	}
+}
+
+func TestDirProbe(t *testing.T) {
+	d, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(d)
+
+	assert.Nil(t, dirProbe(d)(context.TODO()))
+	assert.NotNil(t, dirProbe(d+"/nonExisting")(context.TODO()))
+	assert.NotNil(t, dirProbe("../testdata/picture.jpg")(context.TODO()))
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/barasher/picdexer/internal/browse"
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/barasher/picdexer/internal/deadletter"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+const retryCtxKey = "retry"
+
+var (
+	retryCmd = &cobra.Command{
+		Use:   "retry",
+		Short: "Picdexer : reprocess the files of the dead-letter journal",
+		RunE:  retry,
+	}
+)
+
+func init() {
+	retryCmd.Flags().StringVarP(&confFile, "conf", "c", "", "Picdexer configuration file")
+	retryCmd.Flags().StringVarP(&importID, "impId", "i", "", "Import identifier")
+
+	retryCmd.MarkFlagRequired("conf")
+	rootCmd.AddCommand(retryCmd)
+}
+
+// retried lists the stages to run again for each file.
+type retried map[string]map[deadletter.Stage]bool
+
+func (r retried) index(t browse.Task) bool {
+	// indexing requires the metadata to be extracted
+	return r[t.Path][deadletter.StageExtract] || r[t.Path][deadletter.StageIndex]
+}
+
+func (r retried) store(t browse.Task) bool {
+	return r[t.Path][deadletter.StageStore]
+}
+
+func withRetried(ctx context.Context, r retried) context.Context {
+	return context.WithValue(ctx, retryCtxKey, r)
+}
+
+func getRetried(ctx context.Context) retried {
+	if v := ctx.Value(retryCtxKey); v != nil {
+		return v.(retried)
+	}
+	return nil
+}
+
+func retry(cmd *cobra.Command, args []string) error {
+	return doRetry(confFile, importID, Run)
+}
+
+func doRetry(confFile string, importID string, runFct func(context.Context, Config, []string) error) error {
+	ctx := common.NewContext(importID)
+	var c Config
+	var err error
+	if confFile != "" {
+		if c, err = LoadConf(confFile); err != nil {
+			return fmt.Errorf("error while loading configuration (%v): %w", confFile, err)
+		}
+	}
+
+	if err := setLoggingLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("error while configuring logging level: %w", err)
+	}
+	ctx, release, err := withShutdown(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	dl, err := buildDeadLetter(ctx, c)
+	if err != nil {
+		return fmt.Errorf("error while opening dead-letter journal: %w", err)
+	}
+	if dl == nil {
+		return fmt.Errorf("retrying requires deadLetter.file, checkpoint.dir or binary.workingDir to be configured")
+	}
+	r, inputs, err := retriedFiles(dl)
+	if cErr := dl.Close(); cErr != nil && err == nil {
+		err = fmt.Errorf("error while closing dead-letter journal: %w", cErr)
+	}
+	if err != nil {
+		return execFailure(err)
+	}
+	if len(inputs) == 0 {
+		log.Info().Msg("No failure to retry")
+		return nil
+	}
+
+	log.Info().Msgf("Retrying %v files...", len(inputs))
+	runErr := runFct(withRetried(ctx, r), c, inputs)
+	if exitCode(runErr) == retConfFailure {
+		return runErr
+	}
+	if dl, err = buildDeadLetter(ctx, c); err != nil {
+		return fmt.Errorf("error while opening dead-letter journal: %w", err)
+	}
+	defer dl.Close()
+	failing := 0
+	for _, e := range dl.Pending() {
+		if r[e.Path][e.Stage] {
+			failing++
+		}
+	}
+	log.Info().Msgf("Retry: %v failures resolved, %v still failing", count(r)-failing, failing)
+	return runErr
+}
+
+// retriedFiles returns the stages to run again for each file of the pending
+// failures. The failures of the files that don't exist anymore are dropped
+// from the journal, they can't be retried.
+func retriedFiles(dl *deadletter.Journal) (retried, []string, error) {
+	r := retried{}
+	inputs := []string{}
+	for _, e := range dl.Pending() {
+		if _, err := os.Stat(e.Path); errors.Is(err, os.ErrNotExist) {
+			log.Warn().Str(common.LogFileIdentifier, e.Path).Msgf("Can't retry %v stage, dropped from the dead-letter journal: %v", e.Stage, err)
+			if err := dl.Dropped(e.FileID, e.Stage, err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		} else if err != nil {
+			log.Error().Str(common.LogFileIdentifier, e.Path).Msgf("Can't retry %v stage: %v", e.Stage, err)
+			continue
+		}
+		if _, found := r[e.Path]; !found {
+			r[e.Path] = make(map[deadletter.Stage]bool)
+			inputs = append(inputs, e.Path)
+		}
+		r[e.Path][e.Stage] = true
+	}
+	return r, inputs, nil
+}
+
+func count(r retried) int {
+	c := 0
+	for _, stages := range r {
+		c += len(stages)
+	}
+	return c
+}
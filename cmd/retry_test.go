@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/barasher/picdexer/internal/browse"
+	"github.com/barasher/picdexer/internal/deadletter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetried(t *testing.T) {
+	r := retried{
+		"extract.jpg": {deadletter.StageExtract: true},
+		"index.jpg":   {deadletter.StageIndex: true},
+		"store.jpg":   {deadletter.StageStore: true},
+	}
+	var tcs = []struct {
+		inPath   string
+		expIndex bool
+		expStore bool
+	}{
+		{"extract.jpg", true, false},
+		{"index.jpg", true, false},
+		{"store.jpg", false, true},
+		{"other.jpg", false, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.inPath, func(t *testing.T) {
+			task := browse.Task{Path: tc.inPath}
+			assert.Equal(t, tc.expIndex, r.index(task))
+			assert.Equal(t, tc.expStore, r.store(task))
+		})
+	}
+	assert.Nil(t, getRetried(context.TODO()))
+	assert.Equal(t, r, getRetried(withRetried(context.TODO(), r)))
+}
+
+func TestDoRetry(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pic := filepath.Join(dir, "picture.jpg")
+	assert.Nil(t, copy("../testdata/picture.jpg", pic))
+	missing := filepath.Join(dir, "missing.jpg")
+	conf := filepath.Join(dir, "conf.json")
+	assert.Nil(t, os.WriteFile(conf, []byte(`{"checkpoint": {"dir": "`+dir+`"}}`), 0644))
+
+	dl, err := deadletter.Open(deadletter.Path(dir), "imp")
+	assert.Nil(t, err)
+	assert.Nil(t, dl.Failed(pic, "id1", deadletter.StageIndex, fmt.Errorf("error")))
+	assert.Nil(t, dl.Failed(pic, "id1", deadletter.StageStore, fmt.Errorf("error")))
+	assert.Nil(t, dl.Failed(missing, "id2", deadletter.StageStore, fmt.Errorf("error")))
+	assert.Nil(t, dl.Close())
+
+	var inputs []string
+	var r retried
+	runFct := func(ctx context.Context, c Config, in []string) error {
+		inputs = in
+		r = getRetried(ctx)
+		dl, err := buildDeadLetter(ctx, c)
+		assert.Nil(t, err)
+		defer dl.Close()
+		assert.Nil(t, dl.Resolved("id1", deadletter.StageIndex))
+		return partialFailure(fmt.Errorf("error"))
+	}
+	err = doRetry(conf, "retry", runFct)
+	assert.Equal(t, retPartialFailure, exitCode(err))
+	assert.Equal(t, []string{pic}, inputs)
+	assert.Equal(t, retried{pic: {deadletter.StageIndex: true, deadletter.StageStore: true}}, r)
+
+	dl, err = deadletter.Open(deadletter.Path(dir), "imp")
+	assert.Nil(t, err)
+	defer dl.Close()
+	stillFailing := []string{}
+	for _, e := range dl.Pending() {
+		stillFailing = append(stillFailing, e.Path+":"+string(e.Stage))
+	}
+	sort.Strings(stillFailing)
+	// the failure of the missing file is dropped
+	assert.Equal(t, []string{pic + ":store"}, stillFailing)
+}
+
+func TestDoRetry_Failures(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "conf.json")
+	assert.Nil(t, os.WriteFile(conf, []byte(`{}`), 0644))
+
+	assert.NotNil(t, doRetry("nonExistingFile", "", simulateRun(true)))
+	assert.NotNil(t, doRetry("../testdata/conf/picdexer_wrongLoggingLevel.json", "", simulateRun(true)))
+	// no dead-letter journal
+	assert.NotNil(t, doRetry(conf, "", simulateRun(true)))
+
+	// nothing to retry
+	assert.Nil(t, os.WriteFile(conf, []byte(`{"deadLetter": {"file": "`+filepath.Join(dir, "dl.jsonl")+`"}}`), 0644))
+	assert.Nil(t, doRetry(conf, "", simulateRun(false)))
+}
@@ -1,15 +1,18 @@
 package cmd
 
 import (
+	"errors"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"os"
 )
 
 const (
-	retOk          int = 0
-	retConfFailure int = 1
-	retExecFailure int = 2
+	retOk             int = 0
+	retConfFailure    int = 1
+	retExecFailure    int = 2
+	retPartialFailure int = 3
+	retInterrupted    int = 4
 )
 
 var (
@@ -20,18 +23,69 @@ var (
 	input    []string
 	importID string
 	confFile string
+	resumeID string
 
-	/*// full
+	// full
 	doNotExtractMetadata bool
 	doNotIndex           bool
 	doNotUpload          bool
-	doNotResize          bool*/
-
+	doNotResize          bool
 )
 
+// exitError associates an exit code to an error.
+type exitError struct {
+	code int
+	err  error
+	// files that failed, nil if some failures are not associated to a file
+	files []string
+}
+
+func (e exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e exitError) Unwrap() error {
+	return e.err
+}
+
+func execFailure(err error) error {
+	return exitError{code: retExecFailure, err: err}
+}
+
+func partialFailure(err error) error {
+	return exitError{code: retPartialFailure, err: err}
+}
+
+func interrupted(err error) error {
+	return exitError{code: retInterrupted, err: err}
+}
+
+// failedFiles returns the files that failed in a run, false if they are not
+// known (failure not associated to a file, configuration failure...).
+func failedFiles(err error) ([]string, bool) {
+	var e exitError
+	if errors.As(err, &e) && e.files != nil {
+		return e.files, true
+	}
+	return nil, false
+}
+
+// exitCode returns the exit code associated to an error, the errors that are
+// not associated to a code being configuration failures.
+func exitCode(err error) int {
+	if err == nil {
+		return retOk
+	}
+	var e exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return retConfFailure
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		log.Error().Msgf("%v", err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	var tcs = []struct {
+		tcID    string
+		inErr   error
+		expCode int
+	}{
+		{"ok", nil, retOk},
+		{"conf", fmt.Errorf("error"), retConfFailure},
+		{"exec", execFailure(fmt.Errorf("error")), retExecFailure},
+		{"partial", partialFailure(fmt.Errorf("error")), retPartialFailure},
+		{"interrupted", interrupted(fmt.Errorf("error")), retInterrupted},
+		{"wrapped", fmt.Errorf("wrapped: %w", partialFailure(fmt.Errorf("error"))), retPartialFailure},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expCode, exitCode(tc.inErr))
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/barasher/picdexer/internal/browse"
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/barasher/picdexer/internal/rules"
+	"github.com/spf13/cobra"
+)
+
+const removedValue = "(none)"
+
+var (
+	rulesCmd = &cobra.Command{
+		Use:   "rules",
+		Short: "Picdexer : normalization rules",
+	}
+	rulesTestCmd = &cobra.Command{
+		Use:   "test",
+		Short: "Picdexer : preview the effect of the rules on pictures",
+		RunE:  rulesTest,
+	}
+)
+
+func init() {
+	rulesTestCmd.Flags().StringVarP(&confFile, "conf", "c", "", "Picdexer configuration file")
+	rulesTestCmd.Flags().StringArrayVarP(&input, "dir", "d", []string{}, "Directory/File containing pictures")
+
+	rulesTestCmd.MarkFlagRequired("conf")
+	rulesTestCmd.MarkFlagRequired("dir")
+	rulesCmd.AddCommand(rulesTestCmd)
+	rootCmd.AddCommand(rulesCmd)
+}
+
+func rulesTest(cmd *cobra.Command, args []string) error {
+	return doRulesTest(confFile, input, os.Stdout, extractMetadata)
+}
+
+func doRulesTest(confFile string, inputs []string, w io.Writer, extractFct func(context.Context, Config, []string) ([]metadata.PictureMetadata, error)) error {
+	c, err := LoadConf(confFile)
+	if err != nil {
+		return fmt.Errorf("error while loading configuration (%v): %w", confFile, err)
+	}
+	if err := setLoggingLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("error while configuring logging level: %w", err)
+	}
+	engine, err := rules.NewEngine(buildRules(c)...)
+	if err != nil {
+		return fmt.Errorf("error while building rules: %w", err)
+	}
+
+	pics, err := extractFct(common.NewContext(""), c, inputs)
+	if err != nil {
+		return execFailure(err)
+	}
+	sort.Slice(pics, func(i, j int) bool { return pics[i].SourceFile < pics[j].SourceFile })
+	for _, pic := range pics {
+		changes, err := diffDocuments(pic, engine.Apply(pic))
+		if err != nil {
+			return execFailure(err)
+		}
+		fmt.Fprintln(w, pic.SourceFile)
+		if len(changes) == 0 {
+			fmt.Fprintln(w, "  no change")
+		}
+		for _, cur := range changes {
+			fmt.Fprintf(w, "  %v\n", cur)
+		}
+	}
+	return nil
+}
+
+// diffDocuments lists the fields of the documents that differ, sorted by
+// name.
+func diffDocuments(before metadata.PictureMetadata, after metadata.PictureMetadata) ([]string, error) {
+	b, err := documentFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := documentFields(after)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for k := range b {
+		names = append(names, k)
+	}
+	for k := range a {
+		if _, found := b[k]; !found {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	changes := []string{}
+	for _, k := range names {
+		from, to := string(b[k]), string(a[k])
+		if from == to {
+			continue
+		}
+		if from == "" {
+			from = removedValue
+		}
+		if to == "" {
+			to = removedValue
+		}
+		changes = append(changes, fmt.Sprintf("%v: %v -> %v", k, from, to))
+	}
+	return changes, nil
+}
+
+func documentFields(m metadata.PictureMetadata) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("error while encoding document: %w", err)
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("error while decoding document: %w", err)
+	}
+	return fields, nil
+}
+
+// extractMetadata extracts (and enriches if plugins are configured) the
+// metadata of the pictures, as they are before the rules are applied.
+func extractMetadata(ctx context.Context, c Config, inputs []string) ([]metadata.PictureMetadata, error) {
+	me, _, err := buildMetadataExtractor(c)
+	if err != nil {
+		return nil, fmt.Errorf("error while building MetadataExtractor: %w", err)
+	}
+	defer me.Close()
+	enricher, err := buildEnricher(c)
+	if err != nil {
+		return nil, fmt.Errorf("error while building Enricher: %w", err)
+	}
+
+	taskChan := make(chan browse.Task)
+	extractedChan := make(chan metadata.PictureMetadata)
+	metaChan := extractedChan
+	wg := sync.WaitGroup{}
+	if enricher != nil {
+		metaChan = make(chan metadata.PictureMetadata)
+		wg.Add(1)
+		go func() {
+			enricher.Enrich(ctx, extractedChan, metaChan)
+			wg.Done()
+		}()
+	}
+	var browseErr error
+	wg.Add(2)
+	go func() {
+		browseErr = buildBrowser(c).Browse(ctx, inputs, taskChan)
+		wg.Done()
+	}()
+	go func() {
+		me.ExtractMetadata(ctx, taskChan, extractedChan)
+		wg.Done()
+	}()
+
+	pics := []metadata.PictureMetadata{}
+	for cur := range metaChan {
+		pics = append(pics, cur)
+	}
+	wg.Wait()
+	if browseErr != nil {
+		return nil, fmt.Errorf("error while browsing input folder: %w", browseErr)
+	}
+	return pics, nil
+}
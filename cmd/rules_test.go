@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoRulesTest(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	model := "5D3"
+	gps := "1,2"
+	extract := func(ctx context.Context, c Config, inputs []string) ([]metadata.PictureMetadata, error) {
+		assert.Equal(t, []string{"/photos"}, inputs)
+		return []metadata.PictureMetadata{
+			{SourceFile: "/photos/b.jpg", FileName: "b.jpg", Keywords: []string{"dog"}},
+			{SourceFile: "/photos/a.jpg", FileName: "a.jpg", CameraModel: &model, GPS: &gps, Keywords: []string{"Kitty"}},
+		}, nil
+	}
+
+	var tcs = []struct {
+		tcID      string
+		inConf    string
+		inExtract func(context.Context, Config, []string) ([]metadata.PictureMetadata, error)
+		expCode   int
+		expOutput string
+	}{
+		{"nominal", `{"rules": [
+			{"type": "map", "field": "CameraModel", "values": {"5D3": "Canon EOS 5D Mark III"}},
+			{"type": "synonyms", "synonyms": {"cat": ["kitty"]}},
+			{"type": "tag", "keywords": ["canon"], "when": {"field": "CameraModel", "matches": "^Canon"}},
+			{"type": "drop", "field": "GPS"}
+		]}`, extract, retOk,
+			"/photos/a.jpg\n" +
+				`  CameraModel: "5D3" -> "Canon EOS 5D Mark III"` + "\n" +
+				`  GPS: "1,2" -> (none)` + "\n" +
+				`  Keywords: ["Kitty"] -> ["cat","canon"]` + "\n" +
+				"/photos/b.jpg\n" +
+				"  no change\n"},
+		{"wrongRule", `{"rules": [{"type": "blabla"}]}`, extract, retConfFailure, ""},
+		{"extractionFailure", `{}`, func(context.Context, Config, []string) ([]metadata.PictureMetadata, error) {
+			return nil, fmt.Errorf("error")
+		}, retExecFailure, ""},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			conf := filepath.Join(dir, tc.tcID+".json")
+			assert.Nil(t, os.WriteFile(conf, []byte(tc.inConf), 0644))
+			out := bytes.Buffer{}
+			err := doRulesTest(conf, []string{"/photos"}, &out, tc.inExtract)
+			assert.Equal(t, tc.expCode, exitCode(err))
+			assert.Equal(t, tc.expOutput, out.String())
+		})
+	}
+}
+
+func TestDoRulesTest_NonExistingConf(t *testing.T) {
+	err := doRulesTest("nonExistingFile", nil, &bytes.Buffer{}, nil)
+	assert.Equal(t, retConfFailure, exitCode(err))
+}
+
+func TestDiffDocuments(t *testing.T) {
+	before := metadata.PictureMetadata{FileName: "a.jpg", Fields: map[string]interface{}{"Labels": "cat"}}
+	after := metadata.PictureMetadata{FileName: "b.jpg", Fields: map[string]interface{}{"Project": "p1"}}
+	changes, err := diffDocuments(before, after)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		`FileName: "a.jpg" -> "b.jpg"`,
+		`Labels: "cat" -> (none)`,
+		`Project: (none) -> "p1"`,
+	}, changes)
+}
+
+func TestExtractMetadata(t *testing.T) {
+	pics, err := extractMetadata(context.Background(), Config{}, []string{"../testdata/picture.jpg"})
+	assert.Nil(t, err)
+	assert.Len(t, pics, 1)
+	assert.Equal(t, "picture.jpg", pics[0].FileName)
+}
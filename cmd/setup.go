@@ -52,10 +52,10 @@ func doConfigure(confFile string, setupBuilder func(string, string, string) (set
 	}
 
 	if err := s.SetupElasticsearch(); err != nil {
-		return fmt.Errorf("error while configuring Elasticsearch: %w", err)
+		return execFailure(fmt.Errorf("error while configuring Elasticsearch: %w", err))
 	}
 	if err := s.SetupKibana(); err != nil {
-		return fmt.Errorf("error while configuring Kibana: %w", err)
+		return execFailure(fmt.Errorf("error while configuring Kibana: %w", err))
 	}
 
 	return nil
@@ -8,4 +8,5 @@ require (
 	github.com/rs/zerolog v1.20.0
 	github.com/spf13/cobra v1.1.3
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/image v0.0.0-20211028202545-6944b10bf410
 )
@@ -0,0 +1,102 @@
+package binary
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/barasher/picdexer/internal/browse"
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/barasher/picdexer/internal/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// archiveKey returns the content-addressed key of an original : the SHA-256
+// of its content followed by its extension.
+func archiveKey(checksum string, path string) string {
+	return checksum + strings.ToLower(filepath.Ext(path))
+}
+
+// archive stores the untouched original of a picture under its
+// content-addressed key. The stored file is read back and its checksum is
+// compared with the checksum of the original.
+func (bm *BinaryManager) archive(ctx context.Context, task browse.Task) (*metadata.ArchiveRef, error) {
+	sum, err := sha256File(task.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error while computing checksum: %w", err)
+	}
+	key := archiveKey(sum, task.Path)
+	if e, found := bm.recordedArchive(key, sum); found && !bm.verify {
+		log.Info().Str(common.LogFileIdentifier, task.Path).Msg("Original already archived, skipped")
+		return bm.archiveRef(e), nil
+	}
+
+	exists, err := bm.pusher.exists(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("error while checking if %v is archived: %w", key, err)
+	}
+	if exists {
+		if err := bm.verifyArchive(ctx, key, sum); err != nil {
+			log.Warn().Str(common.LogFileIdentifier, task.Path).Msgf("Archived original is corrupted, archiving again: %v", err)
+		} else {
+			log.Info().Str(common.LogFileIdentifier, task.Path).Msg("Original already archived, skipped")
+			if e, found := bm.recordedArchive(key, sum); found {
+				return bm.archiveRef(e), nil
+			}
+			return bm.archiveRef(bm.recordArchive(task, key, sum)), nil
+		}
+	}
+
+	log.Info().Str(common.LogFileIdentifier, task.Path).Msg("Archiving original...")
+	if err := bm.upload(ctx, task.Path, key); err != nil {
+		return nil, fmt.Errorf("error while archiving: %w", err)
+	}
+	if err := bm.verifyArchive(ctx, key, sum); err != nil {
+		return nil, err
+	}
+	e := bm.recordArchive(task, key, sum)
+	metrics.Get(ctx).Uploaded(bm.pusher.backend(), e.Size)
+	return bm.archiveRef(e), nil
+}
+
+// verifyArchive compares the checksum of a stored file with the expected one.
+func (bm *BinaryManager) verifyArchive(ctx context.Context, key string, expected string) error {
+	stored, err := bm.pusher.checksum(ctx, key)
+	if err != nil {
+		return fmt.Errorf("error while verifying %v: %w", key, err)
+	}
+	if stored != expected {
+		return fmt.Errorf("checksum mismatch for %v: %v stored instead of %v", key, stored, expected)
+	}
+	return nil
+}
+
+func (bm *BinaryManager) recordArchive(task browse.Task, key string, sum string) uploadEntry {
+	e := describe(task, task.Path, key, sum, "", false)
+	e.Time = time.Now()
+	bm.recordStored(task, e)
+	return e
+}
+
+func (bm *BinaryManager) recordedArchive(key string, sum string) (uploadEntry, bool) {
+	if bm.record == nil || !bm.record.has(key, sum, bm.pusher.destination()) {
+		return uploadEntry{}, false
+	}
+	return bm.record.get(key)
+}
+
+// archiveRef builds the reference of an archived original.
+func (bm *BinaryManager) archiveRef(e uploadEntry) *metadata.ArchiveRef {
+	ref := bm.ref(originalRenditionName, e)
+	return &metadata.ArchiveRef{
+		Key:      ref.Key,
+		Url:      ref.Url,
+		Backend:  ref.Backend,
+		Sha256:   e.Fingerprint,
+		Size:     ref.Size,
+		StoredAt: ref.StoredAt,
+	}
+}
@@ -0,0 +1,160 @@
+package binary
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/barasher/picdexer/internal/browse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveKey(t *testing.T) {
+	assert.Equal(t, "abc.cr2", archiveKey("abc", "/a/b/pic.CR2"))
+	assert.Equal(t, "abc", archiveKey("abc", "/a/b/pic"))
+}
+
+func TestArchive(t *testing.T) {
+	root, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	sum, err := sha256File("../../testdata/picture.jpg")
+	assert.Nil(t, err)
+	key := sum + ".jpg"
+	task := browse.Task{Path: "../../testdata/picture.jpg", FileID: "id1"}
+
+	bm, err := NewBinaryManager(1, BinaryManagerDoFsPush(root, "http://nginx", false), BinaryManagerArchiveOriginals())
+	assert.Nil(t, err)
+	ref, err := bm.archive(context.Background(), task)
+	assert.Nil(t, err)
+	assert.Equal(t, key, ref.Key)
+	assert.Equal(t, sum, ref.Sha256)
+	assert.Equal(t, BackendFs, ref.Backend)
+	assert.Equal(t, "http://nginx/"+shard(key), ref.Url)
+	assert.NotNil(t, ref.Size)
+	fi, err := os.Stat("../../testdata/picture.jpg")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(fi.Size()), *ref.Size)
+	assert.NotNil(t, ref.StoredAt)
+	stored := filepath.Join(root, filepath.FromSlash(shard(key)))
+	storedSum, err := sha256File(stored)
+	assert.Nil(t, err)
+	assert.Equal(t, sum, storedSum)
+
+	// corrupted archives are archived again
+	assert.Nil(t, os.WriteFile(stored, []byte("corrupted"), 0644))
+	_, err = bm.archive(context.Background(), task)
+	assert.Nil(t, err)
+	storedSum, err = sha256File(stored)
+	assert.Nil(t, err)
+	assert.Equal(t, sum, storedSum)
+}
+
+func TestArchive_Skipped(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	sum, err := sha256File("../../testdata/picture.jpg")
+	assert.Nil(t, err)
+	key := sum + ".jpg"
+	task := browse.Task{Path: "../../testdata/picture.jpg", FileID: "id1"}
+
+	var tcs = []struct {
+		tcID          string
+		inRecord      bool
+		inVerify      bool
+		inStored      bool
+		expPushedKeys []string
+	}{
+		{"notStored", false, false, false, []string{key}},
+		{"stored", false, false, true, nil},
+		{"recorded", true, false, false, nil},
+		{"recordedVerifiedMissing", true, true, false, []string{key}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			opts := []func(*BinaryManager) error{BinaryManagerArchiveOriginals()}
+			if tc.inRecord {
+				recordFile := filepath.Join(dir, tc.tcID+".jsonl")
+				r, err := openUploadRecord(recordFile)
+				assert.Nil(t, err)
+				assert.Nil(t, r.add(uploadEntry{Key: key, Fingerprint: sum, Destination: "mock:http://fs"}))
+				opts = append(opts, BinaryManagerSkipExisting(recordFile, tc.inVerify))
+			}
+			bm, err := NewBinaryManager(1, opts...)
+			assert.Nil(t, err)
+			mock := &mockSubStore{stored: map[string]bool{key: tc.inStored}, checksums: map[string]string{key: sum}}
+			bm.pusher = mock
+
+			ref, err := bm.archive(context.Background(), task)
+			assert.Nil(t, err)
+			assert.Equal(t, key, ref.Key)
+			assert.Equal(t, tc.expPushedKeys, mock.pushedKeys)
+		})
+	}
+}
+
+func TestArchive_ChecksumMismatch(t *testing.T) {
+	bm, err := NewBinaryManager(1, BinaryManagerArchiveOriginals())
+	assert.Nil(t, err)
+	bm.pusher = &mockSubStore{checksums: map[string]string{}}
+	_, err = bm.archive(context.Background(), browse.Task{Path: "../../testdata/picture.jpg", FileID: "id1"})
+	assert.NotNil(t, err)
+}
+
+func TestStore_Archive(t *testing.T) {
+	sum, err := sha256File("../../testdata/picture.jpg")
+	assert.Nil(t, err)
+	key := sum + ".jpg"
+
+	results := []StoreResult{}
+	bm, err := NewBinaryManager(1,
+		BinaryManagerArchiveOriginals(),
+		BinaryManagerOnStoreResult(func(r StoreResult) { results = append(results, r) }))
+	assert.Nil(t, err)
+	mock := &mockSubStore{checksums: map[string]string{key: sum}}
+	bm.resizer = mock
+	bm.pusher = mock
+	bm.renditions = []Rendition{{Name: "r", Width: 10, Height: 10}}
+
+	in := make(chan browse.Task, 1)
+	in <- browse.Task{Path: "../../testdata/picture.jpg", FileID: "id1.jpg"}
+	close(in)
+	assert.Nil(t, bm.Store(context.TODO(), in, ""))
+	assert.Equal(t, []string{"id1.jpg", key}, mock.pushedKeys)
+	assert.Len(t, results, 1)
+	assert.Nil(t, results[0].Err)
+	assert.NotNil(t, results[0].Archive)
+	assert.Equal(t, key, results[0].Archive.Key)
+	assert.Equal(t, "mock", results[0].Archive.Backend)
+	assert.Equal(t, "http://fs/key/"+key, results[0].Archive.Url)
+}
+
+func TestStore_ArchiveStripLocation(t *testing.T) {
+	sum, err := sha256File("../../testdata/picture.jpg")
+	assert.Nil(t, err)
+	key := sum + ".jpg"
+
+	results := []StoreResult{}
+	bm, err := NewBinaryManager(1,
+		BinaryManagerArchiveOriginals(),
+		BinaryManagerStripLocation(func(browse.Task) bool { return true }),
+		BinaryManagerOnStoreResult(func(r StoreResult) { results = append(results, r) }))
+	assert.Nil(t, err)
+	mock := &mockSubStore{checksums: map[string]string{key: sum}}
+	bm.resizer = mock
+	bm.pusher = mock
+	bm.renditions = []Rendition{{Name: "r", Width: 10, Height: 10}}
+
+	in := make(chan browse.Task, 1)
+	in <- browse.Task{Path: "../../testdata/picture.jpg", FileID: "id1.jpg"}
+	close(in)
+	assert.Nil(t, bm.Store(context.TODO(), in, ""))
+	assert.Len(t, results, 1)
+	assert.Nil(t, results[0].Err)
+	// the original is archived but its url is not published
+	assert.Equal(t, key, results[0].Archive.Key)
+	assert.Empty(t, results[0].Archive.Url)
+}
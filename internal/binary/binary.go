@@ -5,16 +5,38 @@ import (
 	"fmt"
 	"github.com/barasher/picdexer/internal/browse"
 	"github.com/barasher/picdexer/internal/common"
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/barasher/picdexer/internal/metrics"
+	"github.com/barasher/picdexer/internal/ratelimit"
 	"github.com/rs/zerolog/log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 type BinaryManager struct {
 	threadCount int
 	resizer     resizerInterface
 	pusher      pusherInterface
+	renditions  []Rendition
+	marks       *watermarks
+	onResult    func(StoreResult)
+	record      *uploadRecord
+	verify      bool
+	archiveOrig bool
+	stripLoc    func(browse.Task) bool
+}
+
+// StoreResult describes the storage of a picture, successful or not.
+type StoreResult struct {
+	Task       browse.Task
+	Strategy   string
+	Renditions []metadata.RenditionRef
+	Archive    *metadata.ArchiveRef
+	// Skipped is true if the picture was already stored
+	Skipped bool
+	Err     error
 }
 
 func NewBinaryManager(threadCount int, opts ...func(*BinaryManager) error) (*BinaryManager, error) {
@@ -34,19 +56,145 @@ func NewBinaryManager(threadCount int, opts ...func(*BinaryManager) error) (*Bin
 	return bm, nil
 }
 
-func BinaryManagerDoResize(w int, h int, fallbackExtensions []string) func(*BinaryManager) error {
+// Close stops the exiftool instance reading the fields of the watermark
+// texts.
+func (bm *BinaryManager) Close() error {
+	return bm.marks.close()
+}
+
+func BinaryManagerDoResize(fallbackExtensions []string, srgbProfile string, timeout time.Duration, renditions ...Rendition) func(*BinaryManager) error {
+	return func(bm *BinaryManager) error {
+		if err := validateRenditions(renditions); err != nil {
+			return err
+		}
+		bm.resizer = NewResizer(fallbackExtensions, srgbProfile, timeout)
+		marks, err := loadWatermarks(renditions)
+		if err != nil {
+			return err
+		}
+		bm.renditions = renditions
+		bm.marks = marks
+		return nil
+	}
+}
+
+func BinaryManagerDoGoResize(filter string, renditions ...Rendition) func(*BinaryManager) error {
+	return func(bm *BinaryManager) error {
+		if err := validateRenditions(renditions); err != nil {
+			return err
+		}
+		r, err := NewGoResizer(filter)
+		if err != nil {
+			return err
+		}
+		if err := r.validate(renditions); err != nil {
+			return err
+		}
+		bm.resizer = r
+		marks, err := loadWatermarks(renditions)
+		if err != nil {
+			return err
+		}
+		bm.renditions = renditions
+		bm.marks = marks
+		return nil
+	}
+}
+
+func BinaryManagerDoStrategyResize(c StrategyConf, renditions ...Rendition) func(*BinaryManager) error {
+	return func(bm *BinaryManager) error {
+		if err := validateRenditions(renditions); err != nil {
+			return err
+		}
+		r, err := NewStrategyResizer(c)
+		if err != nil {
+			return err
+		}
+		if r.usesGo() {
+			if err := r.goR.validate(renditions); err != nil {
+				return err
+			}
+		}
+		bm.resizer = r
+		marks, err := loadWatermarks(renditions)
+		if err != nil {
+			return err
+		}
+		bm.renditions = renditions
+		bm.marks = marks
+		return nil
+	}
+}
+
+func BinaryManagerDoPush(url string, timeout time.Duration) func(*BinaryManager) error {
+	return func(bm *BinaryManager) error {
+		bm.pusher = NewPusher(url, timeout)
+		return nil
+	}
+}
+
+func BinaryManagerDoFsPush(root string, baseUrl string, hardLink bool) func(*BinaryManager) error {
+	return func(bm *BinaryManager) error {
+		p, err := NewFsPusher(root, baseUrl, hardLink)
+		if err != nil {
+			return err
+		}
+		bm.pusher = p
+		return nil
+	}
+}
+
+func BinaryManagerDoS3Push(c S3Conf) func(*BinaryManager) error {
+	return func(bm *BinaryManager) error {
+		p, err := NewS3Pusher(c)
+		if err != nil {
+			return err
+		}
+		bm.pusher = p
+		return nil
+	}
+}
+
+// BinaryManagerSkipExisting skips the pictures whose renditions have already
+// been stored with the same parameters, according to the upload record. If
+// verify is true, the existence of the recorded keys is also checked in the
+// storage.
+func BinaryManagerSkipExisting(recordFile string, verify bool) func(*BinaryManager) error {
 	return func(bm *BinaryManager) error {
-		if w == 0 || h == 0 {
-			return fmt.Errorf("neither width (%v) nor height (%v) can equals 0", w, h)
+		r, err := openUploadRecord(recordFile)
+		if err != nil {
+			return err
 		}
-		bm.resizer = NewResizer(w, h, fallbackExtensions)
+		bm.record = r
+		bm.verify = verify
+		return nil
+	}
+}
+
+// BinaryManagerArchiveOriginals also stores the untouched original of each
+// picture under a content-addressed key, the upload being verified.
+func BinaryManagerArchiveOriginals() func(*BinaryManager) error {
+	return func(bm *BinaryManager) error {
+		bm.archiveOrig = true
+		return nil
+	}
+}
+
+// BinaryManagerStripLocation removes the location metadata of the stored
+// files of the pictures for which f returns true. Archived originals are
+// kept untouched.
+func BinaryManagerStripLocation(f func(browse.Task) bool) func(*BinaryManager) error {
+	return func(bm *BinaryManager) error {
+		bm.stripLoc = f
 		return nil
 	}
 }
 
-func BinaryManagerDoPush(url string) func(*BinaryManager) error {
+// BinaryManagerOnStoreResult registers a function called once each picture
+// has been processed, whatever the result.
+func BinaryManagerOnStoreResult(f func(StoreResult)) func(*BinaryManager) error {
 	return func(bm *BinaryManager) error {
-		bm.pusher = NewPusher(url)
+		bm.onResult = f
 		return nil
 	}
 }
@@ -85,21 +233,232 @@ func (bm *BinaryManager) Store(ctx context.Context, inTaskChan chan browse.Task,
 	return nil
 }
 
+// RenditionRefs returns the references of the stored renditions of a
+// picture. If no rendition is defined, the original picture is referenced.
+// The details of the files (dimensions, size, storage date) are provided if
+// they have been recorded by the upload record.
+func (bm *BinaryManager) RenditionRefs(fileID string) []metadata.RenditionRef {
+	names, keys := bm.storedFiles(fileID)
+	refs := make([]metadata.RenditionRef, len(keys))
+	for i, k := range keys {
+		e := uploadEntry{Key: k}
+		if bm.record != nil {
+			if recorded, found := bm.record.get(k); found && recorded.Destination == bm.pusher.destination() {
+				e = recorded
+			}
+		}
+		refs[i] = bm.ref(names[i], e)
+	}
+	return refs
+}
+
+// storedFiles returns the names and the keys of the files stored for a
+// picture.
+func (bm *BinaryManager) storedFiles(fileID string) ([]string, []string) {
+	if len(bm.renditions) == 0 {
+		return []string{originalRenditionName}, []string{fileID}
+	}
+	names := make([]string, len(bm.renditions))
+	for i, r := range bm.renditions {
+		names[i] = r.Name
+	}
+	return names, renditionKeys(bm.renditions, fileID)
+}
+
+// ref builds the reference of a stored file.
+func (bm *BinaryManager) ref(name string, e uploadEntry) metadata.RenditionRef {
+	r := metadata.RenditionRef{
+		Name:    name,
+		Key:     e.Key,
+		Url:     bm.pusher.url(e.Key),
+		Backend: bm.pusher.backend(),
+	}
+	if e.Width > 0 && e.Height > 0 {
+		w, h := uint64(e.Width), uint64(e.Height)
+		r.Width, r.Height = &w, &h
+	}
+	if e.Size > 0 {
+		s := uint64(e.Size)
+		r.Size = &s
+	}
+	if !e.Time.IsZero() {
+		t := uint64(e.Time.UnixNano() / int64(time.Millisecond))
+		r.StoredAt = &t
+	}
+	return r
+}
+
+// describe returns the entry of a file to upload : its size and, if
+// requested, its dimensions.
+func describe(task browse.Task, f string, key string, fingerprint string, strategy string, withDimensions bool) uploadEntry {
+	e := uploadEntry{Key: key, Fingerprint: fingerprint, Strategy: strategy}
+	if fi, err := os.Stat(f); err != nil {
+		log.Warn().Str(common.LogFileIdentifier, task.Path).Msgf("Error while getting size of %v: %v", f, err)
+	} else {
+		e.Size = fi.Size()
+	}
+	if withDimensions {
+		if w, h, err := decodeDimensions(f); err != nil {
+			log.Warn().Str(common.LogFileIdentifier, task.Path).Msgf("Error while getting dimensions of %v: %v", f, err)
+		} else {
+			e.Width, e.Height = w, h
+		}
+	}
+	return e
+}
+
+// alreadyStored returns true if all the keys have been recorded with the
+// same fingerprints (and exist in the storage if verification is enabled).
+func (bm *BinaryManager) alreadyStored(ctx context.Context, task browse.Task, keys []string, fingerprints []string) bool {
+	if bm.record == nil {
+		return false
+	}
+	for i, k := range keys {
+		if !bm.record.has(k, fingerprints[i], bm.pusher.destination()) {
+			return false
+		}
+		if bm.verify {
+			exists, err := bm.pusher.exists(ctx, k)
+			if err != nil {
+				log.Warn().Str(common.LogFileIdentifier, task.Path).Msgf("Error while checking if %v is stored: %v", k, err)
+				return false
+			}
+			if !exists {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (bm *BinaryManager) recordStored(task browse.Task, e uploadEntry) {
+	if bm.record == nil {
+		return
+	}
+	e.Destination = bm.pusher.destination()
+	if err := bm.record.add(e); err != nil {
+		log.Warn().Str(common.LogFileIdentifier, task.Path).Msgf("Error while recording upload: %v", err)
+	}
+}
+
 func (bm *BinaryManager) store(ctx context.Context, task browse.Task, outDir string) {
+	res := StoreResult{Task: task}
+	res.Strategy, res.Renditions, res.Skipped, res.Err = bm.doStore(ctx, task, outDir)
+	if res.Err == nil && bm.archiveOrig {
+		if res.Archive, res.Err = bm.archive(ctx, task); res.Err != nil {
+			log.Error().Str(common.LogFileIdentifier, task.Path).Msgf("Error while archiving original: %v", res.Err)
+		} else if bm.stripsLocation(task) {
+			// the archived original keeps its location : its url is not
+			// published in the document
+			res.Archive.Url = ""
+		}
+	}
+	if bm.onResult != nil {
+		bm.onResult(res)
+	}
+}
+
+// doStore stores a picture and returns the resizing strategy used, the
+// references of the stored files and whether they were already stored.
+func (bm *BinaryManager) doStore(ctx context.Context, task browse.Task, outDir string) (string, []metadata.RenditionRef, bool, error) {
+	renditions := bm.renditionsFor(task)
+	if len(renditions) == 0 {
+		orig := Rendition{Name: originalRenditionName, StripLocation: bm.stripsLocation(task)}
+		fp := fingerprint(orig)
+		if bm.alreadyStored(ctx, task, []string{task.FileID}, []string{fp}) {
+			log.Info().Str(common.LogFileIdentifier, task.Path).Msg("Picture already stored, skipped")
+			return "", bm.RenditionRefs(task.FileID), true, nil
+		}
+		from := task.Path
+		if orig.StripLocation {
+			from = filepath.Join(outDir, task.FileID)
+			if err := copyAtomically(task.Path, from); err != nil {
+				return "", nil, false, err
+			}
+			defer os.Remove(from)
+			if err := stripLocation(ctx, from); err != nil {
+				log.Error().Str(common.LogFileIdentifier, task.Path).Msgf("Error while stripping location: %v", err)
+				return "", nil, false, err
+			}
+		}
+		// the dimensions of the original picture are the indexed ones
+		e := describe(task, from, task.FileID, fp, "", false)
+		log.Info().Str(common.LogFileIdentifier, task.Path).Msg("Pushing picture...")
+		if err := bm.upload(ctx, from, task.FileID); err != nil {
+			log.Error().Str(common.LogFileIdentifier, task.Path).Msgf("Error while pushing: %v", err)
+			return "", nil, false, err
+		}
+		e.Time = time.Now()
+		metrics.Get(ctx).Uploaded(bm.pusher.backend(), e.Size)
+		bm.recordStored(task, e)
+		return "", []metadata.RenditionRef{bm.ref(originalRenditionName, e)}, false, nil
+	}
+
+	keys := renditionKeys(renditions, task.FileID)
+	if bm.alreadyStored(ctx, task, keys, renditionFingerprints(renditions)) {
+		log.Info().Str(common.LogFileIdentifier, task.Path).Msg("Renditions already stored, skipped")
+		e, _ := bm.record.get(keys[0])
+		return e.Strategy, bm.RenditionRefs(task.FileID), true, nil
+	}
+
 	log.Info().Str(common.LogFileIdentifier, task.Path).Msg("Resizing picture...")
-	resizedPath := filepath.Join(outDir, task.FileID)
-	err := bm.resizer.resize(ctx, task.Path, resizedPath)
+	targets := buildTargets(renditions, bm.marks, task.FileID, outDir)
+	if err := resolveWatermarks(ctx, bm.marks, task.Path, targets); err != nil {
+		log.Error().Str(common.LogFileIdentifier, task.Path).Msgf("Error while resolving watermarks: %v", err)
+		return "", nil, false, err
+	}
+	strategy, err := bm.resizer.resize(ctx, task.Path, targets)
+	for _, t := range targets {
+		defer bm.resizer.cleanup(ctx, t.path)
+	}
 	if err != nil {
 		log.Error().Str(common.LogFileIdentifier, task.Path).Msgf("Error while resizing: %v", err)
-		return
+		return "", nil, false, err
+	}
+
+	refs := make([]metadata.RenditionRef, len(targets))
+	for i, t := range targets {
+		if needsLocationStrip(t, strategy) {
+			if err := stripLocation(ctx, t.path); err != nil {
+				log.Error().Str(common.LogFileIdentifier, task.Path).Str(resizedFileIdentifier, t.path).Msgf("Error while stripping location of %v rendition: %v", t.Name, err)
+				return "", nil, false, err
+			}
+		}
+		e := describe(task, t.path, t.key, fingerprint(t.Rendition), strategy, true)
+		log.Info().Str(common.LogFileIdentifier, task.Path).Str(resizedFileIdentifier, t.path).Msgf("Pushing %v rendition...", t.Name)
+		if err := bm.upload(ctx, t.path, t.key); err != nil {
+			log.Error().Str(common.LogFileIdentifier, task.Path).Str(resizedFileIdentifier, t.path).Msgf("Error while pushing %v rendition: %v", t.Name, err)
+			return "", nil, false, err
+		}
+		e.Time = time.Now()
+		metrics.Get(ctx).Uploaded(bm.pusher.backend(), e.Size)
+		bm.recordStored(task, e)
+		refs[i] = bm.ref(t.Name, e)
 	}
+	return strategy, refs, false, nil
+}
 
-	defer bm.resizer.cleanup(ctx, resizedPath)
+// upload pushes a file once the limits of the context allow a new upload.
+func (bm *BinaryManager) upload(ctx context.Context, from string, key string) error {
+	if err := ratelimit.Get(ctx).WaitUpload(ctx); err != nil {
+		return fmt.Errorf("error while waiting to upload %v: %w", key, err)
+	}
+	return bm.pusher.push(ctx, from, key)
+}
 
-	log.Info().Str(common.LogFileIdentifier, task.Path).Str(resizedFileIdentifier, resizedPath).Str(common.LogFileIdentifier, task.FileID).Msg("Pushing picture...")
-	err = bm.pusher.push(resizedPath, task.FileID)
-	if err != nil {
-		log.Error().Str(common.LogFileIdentifier, task.Path).Str(resizedFileIdentifier, resizedPath).Str(common.LogFileIdentifier, task.FileID).Msgf("Error while pushing: %v", err)
-		return
+func (bm *BinaryManager) stripsLocation(task browse.Task) bool {
+	return bm.stripLoc != nil && bm.stripLoc(task)
+}
+
+// renditionsFor returns the renditions to produce for a picture.
+func (bm *BinaryManager) renditionsFor(task browse.Task) []Rendition {
+	if len(bm.renditions) == 0 || !bm.stripsLocation(task) {
+		return bm.renditions
+	}
+	renditions := make([]Rendition, len(bm.renditions))
+	for i, r := range bm.renditions {
+		r.StripLocation = true
+		renditions[i] = r
 	}
+	return renditions
 }
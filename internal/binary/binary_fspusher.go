@@ -0,0 +1,182 @@
+package binary
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const objectsDir = ".objects"
+
+// fsPusher stores pictures in a local (or mounted) folder, using a sharded
+// layout (ab/cd/<key>) so that it can be served by any http server.
+type fsPusher struct {
+	root     string
+	baseUrl  string
+	hardLink bool
+}
+
+func NewFsPusher(root string, baseUrl string, hardLink bool) (fsPusher, error) {
+	if root == "" {
+		return fsPusher{}, fmt.Errorf("storage root folder can't be empty")
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return fsPusher{}, fmt.Errorf("error while checking storage root folder %v: %w", root, err)
+	}
+	if !info.IsDir() {
+		return fsPusher{}, fmt.Errorf("storage root %v is not a folder", root)
+	}
+	return fsPusher{root: root, baseUrl: baseUrl, hardLink: hardLink}, nil
+}
+
+// shard returns the relative path of a key in the storage.
+func shard(key string) string {
+	h := md5.Sum([]byte(key))
+	s := hex.EncodeToString(h[:])
+	return path.Join(s[0:2], s[2:4], key)
+}
+
+// copyAtomically copies a file through a temporary file that is renamed, so
+// that a partially written file is never visible under its final name.
+func copyAtomically(from string, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return fmt.Errorf("error while creating folder for %v: %w", to, err)
+	}
+	input, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(to), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("error while creating temporary file for %v: %w", to, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, input); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error while copying %v: %w", from, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error while syncing %v: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error while closing %v: %w", tmp.Name(), err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("error while setting permissions of %v: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), to); err != nil {
+		return fmt.Errorf("error while renaming %v to %v: %w", tmp.Name(), to, err)
+	}
+	return nil
+}
+
+func sha256File(f string) (string, error) {
+	input, err := os.Open(f)
+	if err != nil {
+		return "", err
+	}
+	defer input.Close()
+	sum, err := sha256Reader(input)
+	if err != nil {
+		return "", fmt.Errorf("error while hashing %v: %w", f, err)
+	}
+	return sum, nil
+}
+
+func sha256Reader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// linkAtomically hard links the content-addressed copy of the file under the
+// key path : identical files share the same storage.
+func (p fsPusher) linkAtomically(from string, to string) error {
+	sum, err := sha256File(from)
+	if err != nil {
+		return err
+	}
+	object := filepath.Join(p.root, objectsDir, sum[0:2], sum)
+	if _, err := os.Stat(object); errors.Is(err, os.ErrNotExist) {
+		if err := copyAtomically(from, object); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("error while checking %v: %w", object, err)
+	}
+
+	if objInfo, err := os.Stat(object); err == nil {
+		if toInfo, err := os.Stat(to); err == nil && os.SameFile(objInfo, toInfo) {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return fmt.Errorf("error while creating folder for %v: %w", to, err)
+	}
+	// the temporary file only reserves a unique name : concurrent pushes of
+	// the same key don't share their temporary link
+	f, err := os.CreateTemp(filepath.Dir(to), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("error while creating temporary file for %v: %w", to, err)
+	}
+	tmp := f.Name()
+	f.Close()
+	os.Remove(tmp)
+	if err := os.Link(object, tmp); err != nil {
+		return fmt.Errorf("error while linking %v: %w", object, err)
+	}
+	if err := os.Rename(tmp, to); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error while renaming %v to %v: %w", tmp, to, err)
+	}
+	return nil
+}
+
+func (p fsPusher) push(ctx context.Context, f string, key string) error {
+	to := filepath.Join(p.root, filepath.FromSlash(shard(key)))
+	if p.hardLink {
+		return p.linkAtomically(f, to)
+	}
+	return copyAtomically(f, to)
+}
+
+func (p fsPusher) exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(filepath.Join(p.root, filepath.FromSlash(shard(key))))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (p fsPusher) url(key string) string {
+	if p.baseUrl == "" {
+		return ""
+	}
+	return strings.TrimSuffix(p.baseUrl, "/") + "/" + shard(key)
+}
+
+func (p fsPusher) checksum(ctx context.Context, key string) (string, error) {
+	return sha256File(filepath.Join(p.root, filepath.FromSlash(shard(key))))
+}
+
+func (p fsPusher) backend() string {
+	return BackendFs
+}
+
+func (p fsPusher) destination() string {
+	return BackendFs + ":" + p.root
+}
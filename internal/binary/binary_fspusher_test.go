@@ -0,0 +1,144 @@
+package binary
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFsPusher(t *testing.T) {
+	_, err := NewFsPusher("", "", false)
+	assert.NotNil(t, err)
+	_, err = NewFsPusher("/nonExistingFolder123", "", false)
+	assert.NotNil(t, err)
+	_, err = NewFsPusher("../../testdata/picture.jpg", "", false)
+	assert.NotNil(t, err)
+	_, err = NewFsPusher(os.TempDir(), "", false)
+	assert.Nil(t, err)
+}
+
+func TestShard(t *testing.T) {
+	s := shard("myKey")
+	assert.Equal(t, "myKey", filepath.Base(s))
+	assert.Regexp(t, "^[0-9a-f]{2}/[0-9a-f]{2}/myKey$", s)
+	assert.Equal(t, s, shard("myKey"))
+}
+
+func TestFsPusher_Push(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inHardLink bool
+	}{
+		{"copy", false},
+		{"hardLink", true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			root, err := os.MkdirTemp(os.TempDir(), "picdexer")
+			assert.Nil(t, err)
+			defer os.RemoveAll(root)
+
+			p, err := NewFsPusher(root, "http://nginx/pics/", tc.inHardLink)
+			assert.Nil(t, err)
+			assert.Nil(t, p.push(context.Background(), "../../testdata/picture.jpg", "k1.jpg"))
+			assert.Nil(t, p.push(context.Background(), "../../testdata/picture.jpg", "k2.jpg"))
+			assert.Nil(t, p.push(context.Background(), "../../testdata/picture.jpg", "k2.jpg"))
+
+			exp, err := os.ReadFile("../../testdata/picture.jpg")
+			assert.Nil(t, err)
+			for _, k := range []string{"k1.jpg", "k2.jpg"} {
+				b, err := os.ReadFile(filepath.Join(root, shard(k)))
+				assert.Nil(t, err)
+				assert.Equal(t, exp, b)
+				assert.Equal(t, "http://nginx/pics/"+shard(k), p.url(k))
+			}
+
+			info1, err := os.Stat(filepath.Join(root, shard("k1.jpg")))
+			assert.Nil(t, err)
+			info2, err := os.Stat(filepath.Join(root, shard("k2.jpg")))
+			assert.Nil(t, err)
+			assert.Equal(t, tc.inHardLink, os.SameFile(info1, info2))
+
+			tmps, err := filepath.Glob(filepath.Join(root, "*", "*", ".tmp-*"))
+			assert.Nil(t, err)
+			assert.Empty(t, tmps)
+		})
+	}
+}
+
+func TestFsPusher_ConcurrentLinks(t *testing.T) {
+	root, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+	p, err := NewFsPusher(root, "", true)
+	assert.Nil(t, err)
+	assert.Nil(t, p.push(context.Background(), "../../testdata/picture.jpg", "k1.jpg"))
+
+	wg := sync.WaitGroup{}
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.push(context.Background(), "../../testdata/picture.jpg", "k2.jpg")
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.Nil(t, err)
+	}
+	tmps, err := filepath.Glob(filepath.Join(root, "*", "*", ".tmp-*"))
+	assert.Nil(t, err)
+	assert.Empty(t, tmps)
+}
+
+func TestFsPusher_UnknownFile(t *testing.T) {
+	root, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	for _, hl := range []bool{false, true} {
+		p, err := NewFsPusher(root, "", hl)
+		assert.Nil(t, err)
+		assert.NotNil(t, p.push(context.Background(), "../../testdata/unknown.jpg", "k"))
+		assert.Equal(t, "", p.url("k"))
+	}
+}
+
+func TestFsPusher_Exists(t *testing.T) {
+	root, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	p, err := NewFsPusher(root, "", false)
+	assert.Nil(t, err)
+	exists, err := p.exists(context.Background(), "k1.jpg")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, p.push(context.Background(), "../../testdata/picture.jpg", "k1.jpg"))
+	exists, err = p.exists(context.Background(), "k1.jpg")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestFsPusher_Checksum(t *testing.T) {
+	root, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	p, err := NewFsPusher(root, "", false)
+	assert.Nil(t, err)
+	_, err = p.checksum(context.Background(), "k1.jpg")
+	assert.NotNil(t, err)
+	assert.Nil(t, p.push(context.Background(), "../../testdata/picture.jpg", "k1.jpg"))
+	sum, err := p.checksum(context.Background(), "k1.jpg")
+	assert.Nil(t, err)
+	exp, err := sha256File("../../testdata/picture.jpg")
+	assert.Nil(t, err)
+	assert.Equal(t, exp, sum)
+}
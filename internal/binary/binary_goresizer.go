@@ -0,0 +1,251 @@
+package binary
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	FilterLanczos    = "lanczos"
+	FilterCatmullRom = "catmullrom"
+	FilterBiLinear   = "bilinear"
+
+	defaultJpegQuality = 85
+)
+
+var lanczos3 = &draw.Kernel{
+	Support: 3,
+	At: func(t float64) float64 {
+		if t == 0 {
+			return 1
+		}
+		if t < 0 {
+			t = -t
+		}
+		if t >= 3 {
+			return 0
+		}
+		pt := math.Pi * t
+		return 3 * math.Sin(pt) * math.Sin(pt/3) / (pt * pt)
+	},
+}
+
+func kernel(filter string) (*draw.Kernel, error) {
+	switch strings.ToLower(filter) {
+	case "", FilterLanczos:
+		return lanczos3, nil
+	case FilterCatmullRom:
+		return draw.CatmullRom, nil
+	case FilterBiLinear:
+		return draw.BiLinear, nil
+	default:
+		return nil, fmt.Errorf("unsupported resize filter (%v)", filter)
+	}
+}
+
+// goResizer resizes pictures without any external tool. It supports JPEG,
+// PNG, GIF, TIFF and WebP sources and produces JPEG or PNG.
+type goResizer struct {
+	kernel *draw.Kernel
+}
+
+func NewGoResizer(filter string) (goResizer, error) {
+	k, err := kernel(filter)
+	if err != nil {
+		return goResizer{}, err
+	}
+	return goResizer{kernel: k}, nil
+}
+
+// fit returns the dimensions of a w*h picture scaled down to fit in a
+// maxW*maxH box, keeping its aspect ratio. Pictures are never enlarged.
+func fit(w int, h int, maxW int, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	ratio := math.Min(float64(maxW)/float64(w), float64(maxH)/float64(h))
+	fw := int(math.Round(float64(w) * ratio))
+	fh := int(math.Round(float64(h) * ratio))
+	if fw < 1 {
+		fw = 1
+	}
+	if fh < 1 {
+		fh = 1
+	}
+	return fw, fh
+}
+
+func decodeImage(f string) (image.Image, error) {
+	input, err := os.Open(f)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening %v: %w", f, err)
+	}
+	defer input.Close()
+	img, _, err := image.Decode(input)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding %v: %w", f, err)
+	}
+	return img, nil
+}
+
+// decodeDimensions returns the dimensions of a picture without decoding it.
+func decodeDimensions(f string) (int, int, error) {
+	input, err := os.Open(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error while opening %v: %w", f, err)
+	}
+	defer input.Close()
+	c, _, err := image.DecodeConfig(input)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error while decoding %v: %w", f, err)
+	}
+	return c.Width, c.Height, nil
+}
+
+// Encoder encodes a rendition in a specific format.
+type Encoder func(w io.Writer, img image.Image, r Rendition) error
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[string]Encoder{
+		FormatJpeg: encodeJpeg,
+		FormatPng:  encodePng,
+	}
+)
+
+// RegisterEncoder makes an encoder available to the go resizer for a format.
+// No WebP encoder is provided by default.
+func RegisterEncoder(format string, e Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	encoders[format] = e
+}
+
+func getEncoder(format string) (Encoder, bool) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	e, found := encoders[format]
+	return e, found
+}
+
+func encodeJpeg(w io.Writer, img image.Image, r Rendition) error {
+	q := r.Quality
+	if q == 0 {
+		q = defaultJpegQuality
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: q})
+}
+
+func encodePng(w io.Writer, img image.Image, r Rendition) error {
+	return png.Encode(w, img)
+}
+
+func encode(img image.Image, t target) error {
+	e, found := getEncoder(t.format())
+	if !found {
+		return fmt.Errorf("no encoder available for %v format", t.format())
+	}
+	output, err := os.Create(t.path)
+	if err != nil {
+		return fmt.Errorf("error while creating %v: %w", t.path, err)
+	}
+	if err := e(output, img, t.Rendition); err != nil {
+		output.Close()
+		return fmt.Errorf("error while encoding %v: %w", t.path, err)
+	}
+	return output.Close()
+}
+
+// validate checks that the renditions only use encoding options supported by
+// the go resizer. Metadata are never copied to the renditions.
+func (r goResizer) validate(renditions []Rendition) error {
+	for _, cur := range renditions {
+		if _, found := getEncoder(cur.format()); !found {
+			return fmt.Errorf("rendition %v: no encoder available for %v format", cur.Name, cur.format())
+		}
+		if cur.Progressive {
+			return fmt.Errorf("rendition %v: progressive encoding is not supported by the go resizer", cur.Name)
+		}
+		if cur.Subsampling != "" && cur.Subsampling != "4:2:0" {
+			return fmt.Errorf("rendition %v: %v chroma subsampling is not supported by the go resizer", cur.Name, cur.Subsampling)
+		}
+		if cur.ToSRGB {
+			return fmt.Errorf("rendition %v: sRGB conversion is not supported by the go resizer", cur.Name)
+		}
+	}
+	return nil
+}
+
+// cropRect returns the largest centered rectangle of b whose aspect ratio
+// is w:h.
+func cropRect(b image.Rectangle, w int, h int) image.Rectangle {
+	cw, ch := b.Dx(), b.Dy()
+	if cw*h > ch*w {
+		cw = int(math.Round(float64(ch) * float64(w) / float64(h)))
+	} else {
+		ch = int(math.Round(float64(cw) * float64(h) / float64(w)))
+	}
+	x := b.Min.X + (b.Dx()-cw)/2
+	y := b.Min.Y + (b.Dy()-ch)/2
+	return image.Rect(x, y, x+cw, y+ch)
+}
+
+func (r goResizer) scale(src image.Image, t target) image.Image {
+	b := src.Bounds()
+	if t.fill() {
+		b = cropRect(b, t.Width, t.Height)
+	}
+	w, h := fit(b.Dx(), b.Dy(), t.Width, t.Height)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	r.kernel.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+func (r goResizer) resize(ctx context.Context, from string, targets []target) (string, error) {
+	if len(targets) == 0 {
+		return "", nil
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	src, err := decodeImage(from)
+	if err != nil {
+		return "", err
+	}
+	o := readOrientation(from)
+	for _, t := range targets {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		// scaling is done before orienting, on the smallest picture
+		scaled := t
+		if swapsDimensions(o) {
+			scaled.Width, scaled.Height = t.Height, t.Width
+		}
+		img, err := drawWatermark(orient(r.scale(src, scaled), o), t)
+		if err != nil {
+			return "", err
+		}
+		if err := encode(img, t); err != nil {
+			return "", err
+		}
+	}
+	return StrategyGo, nil
+}
+
+func (r goResizer) cleanup(ctx context.Context, f string) error {
+	return os.Remove(f)
+}
@@ -0,0 +1,219 @@
+package binary
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFit(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inW, inH   int
+		maxW, maxH int
+		expW, expH int
+	}{
+		{"smaller", 100, 50, 640, 480, 100, 50},
+		{"landscape", 1280, 960, 640, 480, 640, 480},
+		{"portrait", 960, 1280, 640, 480, 360, 480},
+		{"wide", 2000, 100, 640, 480, 640, 32},
+		{"tiny", 10000, 1, 100, 100, 100, 1},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			w, h := fit(tc.inW, tc.inH, tc.maxW, tc.maxH)
+			assert.Equal(t, tc.expW, w)
+			assert.Equal(t, tc.expH, h)
+		})
+	}
+}
+
+func TestNewGoResizer(t *testing.T) {
+	var tcs = []struct {
+		inFilter string
+		expOk    bool
+	}{
+		{"", true},
+		{"lanczos", true},
+		{"CatmullRom", true},
+		{"bilinear", true},
+		{"unknown", false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.inFilter, func(t *testing.T) {
+			_, err := NewGoResizer(tc.inFilter)
+			assert.Equal(t, tc.expOk, err == nil)
+		})
+	}
+}
+
+func TestGoResizer_Jpeg(t *testing.T) {
+	outDir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outDir)
+	outFile := filepath.Join(outDir, "out.jpg")
+
+	r, err := NewGoResizer(FilterLanczos)
+	assert.Nil(t, err)
+	targets := []target{{Rendition: Rendition{Name: "r", Width: 100, Height: 100}, path: outFile}}
+	strategy, err := r.resize(context.TODO(), "../../testdata/picture.jpg", targets)
+	assert.Nil(t, err)
+	assert.Equal(t, StrategyGo, strategy)
+
+	img, err := decodeImage(outFile)
+	assert.Nil(t, err)
+	assert.True(t, img.Bounds().Dx() <= 100)
+	assert.True(t, img.Bounds().Dy() <= 100)
+	assert.True(t, img.Bounds().Dx() == 100 || img.Bounds().Dy() == 100)
+}
+
+func TestGoResizer_Png(t *testing.T) {
+	outDir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outDir)
+
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for x := 0; x < 200; x++ {
+		for y := 0; y < 100; y++ {
+			src.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	inFile := filepath.Join(outDir, "in.png")
+	f, err := os.Create(inFile)
+	assert.Nil(t, err)
+	assert.Nil(t, png.Encode(f, src))
+	assert.Nil(t, f.Close())
+
+	fitFile := filepath.Join(outDir, "fit.jpg")
+	fillFile := filepath.Join(outDir, "fill.jpg")
+	r, err := NewGoResizer(FilterCatmullRom)
+	assert.Nil(t, err)
+	targets := []target{
+		{Rendition: Rendition{Name: "fit", Width: 50, Height: 50, Quality: 90}, path: fitFile},
+		{Rendition: Rendition{Name: "fill", Width: 50, Height: 50, Crop: CropFill}, path: fillFile},
+	}
+	_, err = r.resize(context.TODO(), inFile, targets)
+	assert.Nil(t, err)
+
+	img, err := decodeImage(fitFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, img.Bounds().Dx())
+	assert.Equal(t, 25, img.Bounds().Dy())
+
+	img, err = decodeImage(fillFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, img.Bounds().Dx())
+	assert.Equal(t, 50, img.Bounds().Dy())
+}
+
+func TestCropRect(t *testing.T) {
+	var tcs = []struct {
+		tcID    string
+		inRect  image.Rectangle
+		inW     int
+		inH     int
+		expRect image.Rectangle
+	}{
+		{"landscapeToSquare", image.Rect(0, 0, 200, 100), 1, 1, image.Rect(50, 0, 150, 100)},
+		{"portraitToSquare", image.Rect(0, 0, 100, 200), 1, 1, image.Rect(0, 50, 100, 150)},
+		{"sameRatio", image.Rect(0, 0, 200, 100), 2, 1, image.Rect(0, 0, 200, 100)},
+		{"offset", image.Rect(10, 10, 210, 110), 1, 1, image.Rect(60, 10, 160, 110)},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expRect, cropRect(tc.inRect, tc.inW, tc.inH))
+		})
+	}
+}
+
+func TestGoResizer_UnsupportedSource(t *testing.T) {
+	outDir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outDir)
+
+	r, err := NewGoResizer("")
+	assert.Nil(t, err)
+	targets := []target{{Rendition: Rendition{Name: "r", Width: 50, Height: 50}, path: filepath.Join(outDir, "out.jpg")}}
+	_, err = r.resize(context.TODO(), "../../testdata/nonPictureFile.txt", targets)
+	assert.NotNil(t, err)
+	_, err = r.resize(context.TODO(), "../../testdata/nonExisting.jpg", targets)
+	assert.NotNil(t, err)
+}
+
+func TestGoResizer_CanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, err := NewGoResizer("")
+	assert.Nil(t, err)
+	targets := []target{{Rendition: Rendition{Name: "r", Width: 50, Height: 50}, path: "/tmp/out.jpg"}}
+	_, err = r.resize(ctx, "../../testdata/picture.jpg", targets)
+	assert.NotNil(t, err)
+}
+
+func TestGoResizer_Validate(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		inRendition Rendition
+		expOk       bool
+	}{
+		{"jpeg", Rendition{Name: "r", Format: FormatJpeg, Subsampling: "4:2:0", StripMetadata: true}, true},
+		{"png", Rendition{Name: "r", Format: FormatPng}, true},
+		{"webp", Rendition{Name: "r", Format: FormatWebp}, false},
+		{"progressive", Rendition{Name: "r", Progressive: true}, false},
+		{"subsampling", Rendition{Name: "r", Subsampling: "4:4:4"}, false},
+		{"srgb", Rendition{Name: "r", ToSRGB: true}, false},
+	}
+
+	r, err := NewGoResizer("")
+	assert.Nil(t, err)
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expOk, r.validate([]Rendition{tc.inRendition}) == nil)
+		})
+	}
+}
+
+func TestGoResizer_RegisteredEncoder(t *testing.T) {
+	outDir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outDir)
+
+	RegisterEncoder("test", func(w io.Writer, img image.Image, r Rendition) error {
+		_, err := w.Write([]byte("encoded"))
+		return err
+	})
+	defer func() {
+		encodersMu.Lock()
+		delete(encoders, "test")
+		encodersMu.Unlock()
+	}()
+
+	r, err := NewGoResizer("")
+	assert.Nil(t, err)
+	assert.Nil(t, r.validate([]Rendition{{Name: "r", Format: "test"}}))
+	pngFile := filepath.Join(outDir, "out.png")
+	testFile := filepath.Join(outDir, "out.test")
+	targets := []target{
+		{Rendition: Rendition{Name: "png", Width: 10, Height: 10, Format: FormatPng}, path: pngFile},
+		{Rendition: Rendition{Name: "test", Width: 10, Height: 10, Format: "test"}, path: testFile},
+	}
+	_, err = r.resize(context.TODO(), "../../testdata/picture.jpg", targets)
+	assert.Nil(t, err)
+
+	img, err := decodeImage(pngFile)
+	assert.Nil(t, err)
+	assert.True(t, img.Bounds().Dx() <= 10)
+	b, err := os.ReadFile(testFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "encoded", string(b))
+}
@@ -2,63 +2,115 @@ package binary
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"github.com/barasher/picdexer/internal/ratelimit"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
+const (
+	BackendFileServer = "fileServer"
+	BackendFs         = "fs"
+	BackendS3         = "s3"
+)
+
 type pusherInterface interface {
-	push(bin string, key string) error
+	push(ctx context.Context, bin string, key string) error
+	exists(ctx context.Context, key string) (bool, error)
+	url(key string) string
+	// checksum reads a stored file back and returns its SHA-256.
+	checksum(ctx context.Context, key string) (string, error)
+	// backend returns the name of the storage backend, empty if nothing is
+	// stored.
+	backend() string
+	// destination identifies the storage the files are pushed to : the
+	// backend and its location (url, root folder, bucket and prefix).
+	destination() string
 }
 
 type pusher struct {
-	url        string
+	baseUrl    string
+	timeout    time.Duration
 	httpClient *http.Client
 }
 
-func NewPusher(url string) pusher {
+// NewPusher creates a pusher to file-server. An upload is interrupted when
+// no progress has been made for the duration of the timeout (30s if 0).
+func NewPusher(url string, timeout time.Duration) pusher {
 	p := pusher{
-		url: url,
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+		baseUrl:    url,
+		timeout:    timeout,
+		httpClient: &http.Client{},
 	}
 	return p
 }
 
-func (p pusher) push(f string, key string) error {
-	body := new(bytes.Buffer)
-	mpart := multipart.NewWriter(body)
-	part, err := mpart.CreateFormFile("file", key)
-	if err != nil {
-		return err
+// multipartLength computes the length of the multipart body that holds a
+// file, so that the body can be streamed with a known Content-Length.
+func multipartLength(boundary string, key string, size int64) (int64, error) {
+	b := new(bytes.Buffer)
+	mpart := multipart.NewWriter(b)
+	if err := mpart.SetBoundary(boundary); err != nil {
+		return 0, err
 	}
+	if _, err := mpart.CreateFormFile("file", key); err != nil {
+		return 0, err
+	}
+	if err := mpart.Close(); err != nil {
+		return 0, err
+	}
+	return int64(b.Len()) + size, nil
+}
 
+func (p pusher) push(ctx context.Context, f string, key string) error {
 	input, err := os.Open(f)
 	if err != nil {
 		return err
 	}
 	defer input.Close()
-	if _, err := io.Copy(part, input); err != nil {
-		return err
+	info, err := input.Stat()
+	if err != nil {
+		return fmt.Errorf("error while getting %v information: %w", f, err)
 	}
-	if err = mpart.Close(); err != nil {
-		return err
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	mpart := multipart.NewWriter(pw)
+	length, err := multipartLength(mpart.Boundary(), key, info.Size())
+	if err != nil {
+		return fmt.Errorf("error while computing body length: %w", err)
 	}
+	go func() {
+		part, err := mpart.CreateFormFile("file", key)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(part, ratelimit.Get(ctx).UploadReader(ctx, input)); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(mpart.Close())
+	}()
 
-	req, err := http.NewRequest("POST", p.url, body)
+	w := newProgressWatcher(ctx, p.timeout)
+	defer w.stop()
+	req, err := http.NewRequestWithContext(w.ctx, "POST", p.baseUrl, w.reader(pr))
 	if err != nil {
 		return err
 	}
+	req.ContentLength = length
 	req.URL.Path = fmt.Sprintf("/key/%s", key)
 	req.Header.Set("Content-type", fmt.Sprintf("multipart/form-data; boundary=%s", mpart.Boundary()))
 
 	resp, err := p.httpClient.Do(req)
 	if err != nil {
-		return err
+		return w.err(err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusNoContent {
@@ -67,12 +119,89 @@ func (p pusher) push(f string, key string) error {
 	return nil
 }
 
+func (p pusher) exists(ctx context.Context, key string) (bool, error) {
+	w := newProgressWatcher(ctx, p.timeout)
+	defer w.stop()
+	req, err := http.NewRequestWithContext(w.ctx, "HEAD", p.baseUrl, nil)
+	if err != nil {
+		return false, err
+	}
+	req.URL.Path = fmt.Sprintf("/key/%s", key)
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return false, w.err(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("Unexpected http status (%v)", resp.StatusCode)
+}
+
+func (p pusher) checksum(ctx context.Context, key string) (string, error) {
+	w := newProgressWatcher(ctx, p.timeout)
+	defer w.stop()
+	req, err := http.NewRequestWithContext(w.ctx, "GET", p.baseUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.URL.Path = fmt.Sprintf("/key/%s", key)
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return "", w.err(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unexpected http status (%v)", resp.StatusCode)
+	}
+	sum, err := sha256Reader(w.reader(resp.Body))
+	if err != nil {
+		return "", w.err(fmt.Errorf("error while reading %v: %w", key, err))
+	}
+	return sum, nil
+}
+
+func (p pusher) url(key string) string {
+	return fmt.Sprintf("%s/key/%s", strings.TrimSuffix(p.baseUrl, "/"), key)
+}
+
+func (p pusher) backend() string {
+	return BackendFileServer
+}
+
+func (p pusher) destination() string {
+	return BackendFileServer + ":" + strings.TrimSuffix(p.baseUrl, "/")
+}
+
 type nopPusher struct{}
 
 func NewNopPusher() nopPusher {
 	return nopPusher{}
 }
 
-func (nopPusher) push(f string, key string) error {
+func (nopPusher) push(ctx context.Context, f string, key string) error {
 	return nil
 }
+
+func (nopPusher) exists(ctx context.Context, key string) (bool, error) {
+	return false, nil
+}
+
+func (nopPusher) url(key string) string {
+	return ""
+}
+
+func (nopPusher) checksum(ctx context.Context, key string) (string, error) {
+	return "", fmt.Errorf("no storage configured")
+}
+
+func (nopPusher) backend() string {
+	return ""
+}
+
+func (nopPusher) destination() string {
+	return ""
+}
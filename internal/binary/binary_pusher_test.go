@@ -1,15 +1,23 @@
 package binary
 
 import (
+	"bytes"
+	"context"
+	"github.com/barasher/picdexer/internal/ratelimit"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestNopPusher(t *testing.T) {
 	p := NewNopPusher()
-	assert.Nil(t, p.push("k", "v"))
+	assert.Nil(t, p.push(context.Background(), "k", "v"))
+	_, err := p.checksum(context.Background(), "k")
+	assert.NotNil(t, err)
 }
 
 func TestPusher_StatusCode(t *testing.T) {
@@ -29,20 +37,147 @@ func TestPusher_StatusCode(t *testing.T) {
 			}))
 			defer ts.Close()
 
-			err := NewPusher(ts.URL).push("../../testdata/picture.jpg", "myKey")
+			err := NewPusher(ts.URL, 0).push(context.Background(), "../../testdata/picture.jpg", "myKey")
 			assert.Equal(t, tc.expSuccess, err == nil)
 		})
 	}
 }
 
 func TestPusher_UnknownFile(t *testing.T) {
-	err := NewPusher("").push("../testdata/unknown.jpg", "myKey")
+	err := NewPusher("", 0).push(context.Background(), "../testdata/unknown.jpg", "myKey")
 	t.Logf("err: %v", err)
 	assert.NotNil(t, err)
 }
 
 func TestPusher_WrongUrl(t *testing.T) {
-	err := NewPusher("file:/tmp/").push("../../testdata/picture.jpg", "myKey")
+	err := NewPusher("file:/tmp/", 0).push(context.Background(), "../../testdata/picture.jpg", "myKey")
 	t.Logf("err: %v", err)
 	assert.NotNil(t, err)
 }
+
+func TestPusher_Exists(t *testing.T) {
+	var tcs = []struct {
+		tcID      string
+		httpCode  int
+		expExists bool
+		expError  bool
+	}{
+		{"exists", http.StatusOK, true, false},
+		{"notFound", http.StatusNotFound, false, false},
+		{"error", http.StatusInternalServerError, false, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodHead, r.Method)
+				assert.Equal(t, "/key/myKey", r.URL.Path)
+				w.WriteHeader(tc.httpCode)
+			}))
+			defer ts.Close()
+
+			exists, err := NewPusher(ts.URL, 0).exists(context.Background(), "myKey")
+			assert.Equal(t, tc.expExists, exists)
+			assert.Equal(t, tc.expError, err != nil)
+		})
+	}
+}
+
+func TestPusher_Checksum(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		httpCode    int
+		expChecksum string
+		expError    bool
+	}{
+		{"nominal", http.StatusOK, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", false},
+		{"notFound", http.StatusNotFound, "", true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodGet, r.Method)
+				assert.Equal(t, "/key/myKey", r.URL.Path)
+				w.WriteHeader(tc.httpCode)
+				w.Write([]byte("hello"))
+			}))
+			defer ts.Close()
+
+			sum, err := NewPusher(ts.URL, 0).checksum(context.Background(), "myKey")
+			assert.Equal(t, tc.expChecksum, sum)
+			assert.Equal(t, tc.expError, err != nil)
+		})
+	}
+}
+
+func TestPusher_Streamed(t *testing.T) {
+	exp, err := os.ReadFile("../../testdata/picture.jpg")
+	assert.Nil(t, err)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(body)), r.ContentLength)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		f, h, err := r.FormFile("file")
+		assert.Nil(t, err)
+		defer f.Close()
+		assert.Equal(t, "myKey", h.Filename)
+		b, err := io.ReadAll(f)
+		assert.Nil(t, err)
+		assert.Equal(t, exp, b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	assert.Nil(t, NewPusher(ts.URL, 0).push(context.Background(), "../../testdata/picture.jpg", "myKey"))
+}
+
+func TestPusher_Limited(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	l, err := ratelimit.NewLimits(ratelimit.Settings{UploadBytesPerSecond: 10000})
+	assert.Nil(t, err)
+	ctx := ratelimit.WithLimits(context.Background(), l)
+
+	// 20504 bytes, the first 10000 being sent immediately
+	start := time.Now()
+	assert.Nil(t, NewPusher(ts.URL, 0).push(ctx, "../../testdata/picture.jpg", "myKey"))
+	assert.True(t, time.Since(start) >= 800*time.Millisecond)
+}
+
+func TestPusher_Timeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	err := NewPusher(ts.URL, 50*time.Millisecond).push(context.Background(), "../../testdata/picture.jpg", "myKey")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no progress")
+}
+
+func TestPusher_Canceled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	p := NewPusher(ts.URL, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.NotNil(t, p.push(ctx, "../../testdata/picture.jpg", "myKey"))
+	_, err := p.exists(ctx, "myKey")
+	assert.NotNil(t, err)
+	_, err = p.checksum(ctx, "myKey")
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 400*time.Millisecond)
+}
@@ -3,21 +3,32 @@ package binary
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/rs/zerolog/log"
 )
 
-const resizedFileIdentifier = "resizedFile"
+const (
+	resizedFileIdentifier = "resizedFile"
+	defaultResizeTimeout  = 5 * time.Minute
+)
 
 type resizerInterface interface {
-	resize(ctx context.Context, from string, to string) error
+	// resize produces the targets and returns the name of the strategy used
+	resize(ctx context.Context, from string, targets []target) (string, error)
 	cleanup(ctx context.Context, f string) error
 }
 
 type resizer struct {
-	dimensions  string
 	fallbackExt []string
+	srgbProfile string
+	timeout     time.Duration
 }
 
 func (r resizer) hasToFallback(f string) bool {
@@ -32,30 +43,166 @@ func (r resizer) hasToFallback(f string) bool {
 	return false
 }
 
-func (r resizer) resize(ctx context.Context, from string, to string) error {
-	var cmd *exec.Cmd
+func geometry(t target) []string {
+	dim := fmt.Sprintf("%vx%v", t.Width, t.Height)
+	if t.fill() {
+		return []string{"-resize", dim + "^", "-gravity", "center", "-extent", dim}
+	}
+	return []string{"-resize", dim}
+}
+
+// encoding returns the convert arguments that apply the encoding options of
+// a target. The sRGB conversion uses the ICC profile if provided, so that the
+// embedded profile of the source is taken into account.
+func encoding(t target, srgbProfile string) (pre []string, post []string) {
+	if t.ToSRGB {
+		if srgbProfile != "" {
+			pre = append(pre, "-profile", srgbProfile)
+		} else {
+			pre = append(pre, "-colorspace", "sRGB")
+		}
+	}
+	if t.StripMetadata {
+		post = append(post, "-strip")
+	}
+	if t.Quality > 0 {
+		post = append(post, "-quality", strconv.Itoa(t.Quality))
+	}
+	if t.Progressive {
+		post = append(post, "-interlace", "Plane")
+	}
+	if t.Subsampling != "" {
+		post = append(post, "-sampling-factor", t.Subsampling)
+	}
+	return pre, post
+}
+
+// convertArgs builds the convert arguments that produce all the targets from
+// a single decoding of the source : each target but the last one is produced
+// from a clone of the source.
+func convertArgs(targets []target, srgbProfile string) []string {
+	args := []string{}
+	for i, t := range targets {
+		last := i == len(targets)-1
+		if !last {
+			args = append(args, "(", "+clone")
+		}
+		pre, post := encoding(t, srgbProfile)
+		args = append(args, pre...)
+		args = append(args, geometry(t)...)
+		if t.markFile != "" {
+			args = append(args, safePath(t.markFile), "-gravity", "northwest", "-geometry", fmt.Sprintf("+%d+%d", t.markOffset.X, t.markOffset.Y), "-composite")
+		}
+		args = append(args, post...)
+		output := t.format() + ":" + t.path
+		if last {
+			args = append(args, output)
+		} else {
+			args = append(args, "-write", output, "+delete", ")")
+		}
+	}
+	return args
+}
+
+func (r resizer) resize(ctx context.Context, from string, targets []target) (string, error) {
+	if len(targets) == 0 {
+		return "", nil
+	}
+	// the intermediate files are written in the working dir of the storage
+	outDir := filepath.Dir(targets[0].path)
 	if r.hasToFallback(from) {
-		args := fmt.Sprintf("exiftool %v -b -previewImage | convert - -size %v %v", from, r.dimensions, to)
-		cmd = exec.Command("bash", "-c", args)
-	} else {
-		args := []string{from, "-quiet", "-resize", r.dimensions, to}
-		cmd = exec.Command("convert", args...)
+		return previewStrategyName(defaultPreviewTag), r.convertPiped(ctx, from, previewCommand(from, defaultPreviewTag), outDir, targets)
+	}
+	return StrategyConvert, r.convertFile(ctx, from, from, outDir, targets)
+}
+
+// convertFile produces the targets from src (the picture or an intermediate
+// file), the watermarks being composited by convert.
+func (r resizer) convertFile(ctx context.Context, from string, src string, outDir string, targets []target) error {
+	marked, release, err := prepareWatermarks(ctx, src, outDir, targets)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return r.run(ctx, from, convertCommands(src, marked, r.srgbProfile))
+}
+
+// convertPiped produces the targets from the output of a command, piped into
+// convert. If a target is watermarked, the output is written in an
+// intermediate file of outDir instead : the dimensions of the source are
+// required to render the watermarks.
+func (r resizer) convertPiped(ctx context.Context, from string, cmd command, outDir string, targets []target) error {
+	if !watermarked(targets) {
+		return r.run(ctx, from, pipedCommands(cmd, targets, r.srgbProfile))
+	}
+	f, err := os.CreateTemp(outDir, "picdexer-source-*")
+	if err != nil {
+		return fmt.Errorf("error while creating intermediate file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	err = r.runTo(ctx, from, f, []command{cmd})
+	if cErr := f.Close(); err == nil && cErr != nil {
+		err = fmt.Errorf("error while writing intermediate file: %w", cErr)
+	}
+	if err != nil {
+		return err
+	}
+	return r.convertFile(ctx, from, f.Name(), outDir, targets)
+}
+
+// run executes the commands that resize a picture, interrupted after the
+// timeout of the resizer.
+func (r resizer) run(ctx context.Context, from string, cmds []command) error {
+	return r.runTo(ctx, from, nil, cmds)
+}
+
+// runTo executes the commands that resize a picture, the output of the last
+// one being written in out.
+func (r resizer) runTo(ctx context.Context, from string, out io.Writer, cmds []command) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	stderrs, err := runPipeline(ctx, out, cmds...)
+	if err != nil {
+		return fmt.Errorf("error while resizing %v: %w", from, err)
 	}
-	b, _ := cmd.CombinedOutput()
-	if len(b) > 0 {
-		return fmt.Errorf("error on stdout %v: %v", from, string(b))
+	for _, cur := range stderrs {
+		if cur != "" {
+			log.Warn().Str(common.LogFileIdentifier, from).Msgf("Resizing warning: %v", cur)
+		}
 	}
 	return nil
 }
 
+func convertCommands(from string, targets []target, srgbProfile string) []command {
+	return []command{
+		{name: "convert", args: append([]string{safePath(from), "-quiet", "-auto-orient"}, convertArgs(targets, srgbProfile)...)},
+	}
+}
+
+// pipedCommands pipes the output of a command into convert.
+func pipedCommands(cmd command, targets []target, srgbProfile string) []command {
+	return []command{
+		cmd,
+		{name: "convert", args: append([]string{"-", "-quiet", "-auto-orient"}, convertArgs(targets, srgbProfile)...)},
+	}
+}
+
+// previewCommand extracts an embedded preview with exiftool.
+func previewCommand(from string, tag string) command {
+	return command{name: "exiftool", args: []string{"-b", "-" + tag, safePath(from)}}
+}
+
 func (r resizer) cleanup(ctx context.Context, f string) error {
 	return os.Remove(f)
 }
 
-func NewResizer(w int, h int, fallbackExtensions []string) resizer {
-	r := resizer{
-		dimensions: fmt.Sprintf("%vx%v", w, h),
+// NewResizer creates a resizer based on ImageMagick. The resizing of a file
+// is interrupted after the timeout (5 minutes if 0).
+func NewResizer(fallbackExtensions []string, srgbProfile string, timeout time.Duration) resizer {
+	if timeout <= 0 {
+		timeout = defaultResizeTimeout
 	}
+	r := resizer{srgbProfile: srgbProfile, timeout: timeout}
 	r.fallbackExt = make([]string, len(fallbackExtensions))
 	for i, cur := range fallbackExtensions {
 		r.fallbackExt[i] = strings.ToLower(cur)
@@ -66,8 +213,8 @@ func NewResizer(w int, h int, fallbackExtensions []string) resizer {
 type nopResizer struct {
 }
 
-func (r nopResizer) resize(ctx context.Context, from string, to string) error {
-	return nil
+func (r nopResizer) resize(ctx context.Context, from string, targets []target) (string, error) {
+	return "", nil
 }
 
 func (r nopResizer) cleanup(ctx context.Context, f string) error {
@@ -3,14 +3,18 @@ package binary
 import (
 	"context"
 	"github.com/stretchr/testify/assert"
+	"image"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestNopResizerResize(t *testing.T) {
 	r := NewNopResizer()
-	assert.Nil(t, r.resize(context.TODO(), "../../testdata/picture.jpg", "/tmp/a.jpg"))
+	strategy, err := r.resize(context.TODO(), "../../testdata/picture.jpg", []target{{path: "/tmp/a.jpg"}})
+	assert.Nil(t, err)
+	assert.Empty(t, strategy)
 }
 
 func TestNopResizerCleanUp(t *testing.T) {
@@ -24,8 +28,8 @@ func TestResizer_Nominal(t *testing.T) {
 	outFile := filepath.Join(outDir, "blabla.jpg")
 	defer os.RemoveAll(outDir)
 
-	r := NewResizer(100, 100, []string{})
-	err = r.resize(context.TODO(), "../../testdata/picture.jpg", outFile)
+	r := NewResizer([]string{}, "", 0)
+	_, err = r.resize(context.TODO(), "../../testdata/picture.jpg", []target{{Rendition: Rendition{Width: 100, Height: 100}, path: outFile}})
 	assert.Nil(t, err)
 	_, err = os.Stat(outFile)
 	assert.Nil(t, err)
@@ -38,8 +42,9 @@ func TestResizer_NonExistingSource(t *testing.T) {
 	outFile := filepath.Join(outDir, "blabla.jpg")
 	defer os.RemoveAll(outDir)
 
-	r := NewResizer(100, 100, []string{})
-	assert.NotNil(t, r.resize(context.TODO(), "../testdata/nonExisting.jpg", outFile))
+	r := NewResizer([]string{}, "", 0)
+	_, err = r.resize(context.TODO(), "../testdata/nonExisting.jpg", []target{{Rendition: Rendition{Width: 100, Height: 100}, path: outFile}})
+	assert.NotNil(t, err)
 }
 
 func TestResizer_FailOnResizing(t *testing.T) {
@@ -48,8 +53,8 @@ func TestResizer_FailOnResizing(t *testing.T) {
 	t.Logf("temp folder: %s", outDir)
 	defer os.RemoveAll(outDir)
 
-	r := NewResizer(100, 100, []string{})
-	err = r.resize(context.TODO(), "../../testdata/picture.jpg", "/blabliblu/aaa.jpg")
+	r := NewResizer([]string{}, "", 0)
+	_, err = r.resize(context.TODO(), "../../testdata/picture.jpg", []target{{Rendition: Rendition{Width: 100, Height: 100}, path: "/blabliblu/aaa.jpg"}})
 	t.Logf("error: %v", err)
 	assert.NotNil(t, err)
 }
@@ -58,14 +63,14 @@ func TestResizerCleanUp_Nominal(t *testing.T) {
 	f, err := os.CreateTemp("/tmp", "TestNopResizer_CleanUp")
 	assert.Nil(t, err)
 	defer os.Remove(f.Name())
-	r := NewResizer(640, 480, []string{})
+	r := NewResizer([]string{}, "", 0)
 	assert.Nil(t, r.cleanup(context.TODO(), f.Name()))
 	_, err = os.Stat("/path/to/whatever")
 	assert.True(t, os.IsNotExist(err))
 }
 
 func TestResizerCleanUp_NonExisting(t *testing.T) {
-	assert.NotNil(t, NewResizer(640, 480, []string{}).cleanup(context.TODO(), "nonExistingFile"))
+	assert.NotNil(t, NewResizer([]string{}, "", 0).cleanup(context.TODO(), "nonExistingFile"))
 }
 
 func TestNewResizer_fallbackExt(t *testing.T) {
@@ -82,17 +87,147 @@ func TestNewResizer_fallbackExt(t *testing.T) {
 
 	for _, tc := range tcs {
 		t.Run(tc.tcID, func(t *testing.T) {
-			r := NewResizer(100, 100, tc.inExt)
+			r := NewResizer(tc.inExt, "", 0)
 			assert.ElementsMatch(t, tc.expExt, r.fallbackExt)
 		})
 	}
 }
 
 func TestResizerHasToFallback(t *testing.T) {
-	r := NewResizer(100, 100, []string{"ExT1", "eXt2"})
+	r := NewResizer([]string{"ExT1", "eXt2"}, "", 0)
 	assert.True(t, r.hasToFallback("/tmp/a.ext1"))
 	assert.True(t, r.hasToFallback("/tmp/a.EXt1"))
 	assert.True(t, r.hasToFallback("/tmp/a.EXT2"))
 	assert.False(t, r.hasToFallback("/tmp/.ext1/a.txt"))
 	assert.False(t, r.hasToFallback("/tmp/a.doc"))
 }
+
+func TestConvertArgs(t *testing.T) {
+	var tcs = []struct {
+		tcID      string
+		inTargets []target
+		expArgs   []string
+	}{
+		{
+			"single",
+			[]target{{Rendition: Rendition{Width: 640, Height: 480}, path: "/o/a.jpg"}},
+			[]string{"-resize", "640x480", "jpeg:/o/a.jpg"},
+		},
+		{
+			"fillWithQuality",
+			[]target{{Rendition: Rendition{Width: 100, Height: 100, Crop: CropFill, Quality: 70}, path: "/o/a.jpg"}},
+			[]string{"-resize", "100x100^", "-gravity", "center", "-extent", "100x100", "-quality", "70", "jpeg:/o/a.jpg"},
+		},
+		{
+			"multiple",
+			[]target{
+				{Rendition: Rendition{Width: 100, Height: 100}, path: "/o/a.jpg"},
+				{Rendition: Rendition{Width: 640, Height: 480}, path: "/o/b.jpg"},
+			},
+			[]string{"(", "+clone", "-resize", "100x100", "-write", "jpeg:/o/a.jpg", "+delete", ")", "-resize", "640x480", "jpeg:/o/b.jpg"},
+		},
+		{
+			"watermark",
+			[]target{
+				{Rendition: Rendition{Width: 100, Height: 100, Quality: 70}, path: "/o/a.jpg", markFile: "/o/m.png", markOffset: image.Point{X: 3, Y: 4}},
+				{Rendition: Rendition{Width: 640, Height: 480}, path: "/o/b.jpg", markFile: "-m.png", markOffset: image.Point{X: 5, Y: 6}},
+			},
+			[]string{
+				"(", "+clone", "-resize", "100x100", "/o/m.png", "-gravity", "northwest", "-geometry", "+3+4", "-composite", "-quality", "70", "-write", "jpeg:/o/a.jpg", "+delete", ")",
+				"-resize", "640x480", "./-m.png", "-gravity", "northwest", "-geometry", "+5+6", "-composite", "jpeg:/o/b.jpg",
+			},
+		},
+		{
+			"encoding",
+			[]target{{Rendition: Rendition{Width: 10, Height: 10, Format: FormatWebp, Progressive: true, Subsampling: "4:4:4", StripMetadata: true, ToSRGB: true}, path: "/o/a.webp"}},
+			[]string{"-profile", "/icc/sRGB.icc", "-resize", "10x10", "-strip", "-interlace", "Plane", "-sampling-factor", "4:4:4", "webp:/o/a.webp"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expArgs, convertArgs(tc.inTargets, "/icc/sRGB.icc"))
+		})
+	}
+}
+
+func TestResizerCommands(t *testing.T) {
+	targets := []target{{Rendition: Rendition{Width: 10, Height: 10}, path: "/o/a.jpg"}}
+	var tcs = []struct {
+		tcID    string
+		inFrom  string
+		expCmds []command
+	}{
+		{
+			"nominal",
+			"/p/it's $(rm -rf) a.jpg",
+			[]command{{name: "convert", args: []string{"/p/it's $(rm -rf) a.jpg", "-quiet", "-auto-orient", "-resize", "10x10", "jpeg:/o/a.jpg"}}},
+		},
+		{
+			"optionLike",
+			"-a.jpg",
+			[]command{{name: "convert", args: []string{"./-a.jpg", "-quiet", "-auto-orient", "-resize", "10x10", "jpeg:/o/a.jpg"}}},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expCmds, convertCommands(tc.inFrom, targets, ""))
+		})
+	}
+
+	expPreview := []command{
+		{name: "exiftool", args: []string{"-b", "-previewImage", "/p/a b.nef"}},
+		{name: "convert", args: []string{"-", "-quiet", "-auto-orient", "-resize", "10x10", "jpeg:/o/a.jpg"}},
+	}
+	assert.Equal(t, expPreview, pipedCommands(previewCommand("/p/a b.nef", defaultPreviewTag), targets, ""))
+}
+
+// fakeCommands puts scripts in the PATH, indexed by command name.
+func fakeCommands(t *testing.T, scripts map[string]string) func() {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	for name, script := range scripts {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755))
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestResizer_Process(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inScript   string
+		expError   bool
+		expMessage string
+	}{
+		{"success", "exit 0", false, ""},
+		{"warning", "echo 'a warning' >&2", false, ""},
+		{"exitCode", "echo 'an error' >&2; exit 3", true, "exit code 3"},
+		{"timeout", "sleep 5", true, "interrupted"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			defer fakeCommands(t, map[string]string{"convert": tc.inScript})()
+			r := NewResizer([]string{}, "", 200*time.Millisecond)
+			start := time.Now()
+			_, err := r.resize(context.TODO(), "../../testdata/picture.jpg", []target{{Rendition: Rendition{Width: 10, Height: 10}, path: "/tmp/a.jpg"}})
+			assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+			assert.Equal(t, tc.expError, err != nil)
+			if tc.expError {
+				assert.Contains(t, err.Error(), tc.expMessage)
+			}
+		})
+	}
+}
+
+func TestEncoding_SRGBWithoutProfile(t *testing.T) {
+	pre, post := encoding(target{Rendition: Rendition{ToSRGB: true}}, "")
+	assert.Equal(t, []string{"-colorspace", "sRGB"}, pre)
+	assert.Empty(t, post)
+}
@@ -0,0 +1,297 @@
+package binary
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/barasher/picdexer/internal/ratelimit"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region             = "us-east-1"
+	defaultS3MultipartThreshold = 64 * 1024 * 1024
+	defaultS3PartSize           = 16 * 1024 * 1024
+	minS3PartSize               = 5 * 1024 * 1024
+	maxS3PresignExpiry          = 7 * 24 * time.Hour
+	defaultContentType          = "application/octet-stream"
+)
+
+// S3Conf configures the storage in a S3 compatible bucket.
+type S3Conf struct {
+	Endpoint     string
+	Region       string
+	Bucket       string
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// PathStyle addresses the bucket in the path (http://endpoint/bucket/key)
+	// instead of the host (http://bucket.endpoint/key), as required by MinIO.
+	PathStyle bool
+	// PublicUrl is the base URL that serves the bucket publicly. If empty and
+	// PresignExpiry is set, the recorded URLs are presigned.
+	PublicUrl          string
+	PresignExpiry      time.Duration
+	CacheControl       string
+	MultipartThreshold int64
+	PartSize           int64
+	// Timeout interrupts a request that has made no progress for this
+	// duration (30s if 0).
+	Timeout time.Duration
+}
+
+type s3StatusError struct {
+	status int
+	body   string
+}
+
+func (e s3StatusError) Error() string {
+	return fmt.Sprintf("Unexpected http status (%v): %v", e.status, e.body)
+}
+
+type s3Pusher struct {
+	conf       S3Conf
+	endpoint   *url.URL
+	signer     sigV4
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+func NewS3Pusher(c S3Conf) (s3Pusher, error) {
+	if c.Bucket == "" {
+		return s3Pusher{}, fmt.Errorf("bucket can't be empty")
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return s3Pusher{}, fmt.Errorf("wrong S3 endpoint (%v)", c.Endpoint)
+	}
+	if c.Region == "" {
+		c.Region = defaultS3Region
+	}
+	if c.MultipartThreshold == 0 {
+		c.MultipartThreshold = defaultS3MultipartThreshold
+	}
+	if c.PartSize == 0 {
+		c.PartSize = defaultS3PartSize
+	}
+	if c.PartSize < minS3PartSize {
+		return s3Pusher{}, fmt.Errorf("part size (%v) should be >= %v", c.PartSize, minS3PartSize)
+	}
+	if c.PresignExpiry < 0 || c.PresignExpiry > maxS3PresignExpiry {
+		return s3Pusher{}, fmt.Errorf("presign expiry (%v) should be in ]0, %v]", c.PresignExpiry, maxS3PresignExpiry)
+	}
+	return s3Pusher{
+		conf:     c,
+		endpoint: u,
+		signer: sigV4{
+			accessKey:    c.AccessKey,
+			secretKey:    c.SecretKey,
+			sessionToken: c.SessionToken,
+			region:       c.Region,
+		},
+		httpClient: &http.Client{},
+		now:        time.Now,
+	}, nil
+}
+
+func contentType(key string) string {
+	if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(key))); t != "" {
+		return t
+	}
+	return defaultContentType
+}
+
+func (p s3Pusher) objectUrl(key string) url.URL {
+	u := *p.endpoint
+	objectKey := path.Join(p.conf.Prefix, key)
+	if p.conf.PathStyle {
+		u.Path = path.Join("/", u.Path, p.conf.Bucket, objectKey)
+	} else {
+		u.Host = p.conf.Bucket + "." + u.Host
+		u.Path = path.Join("/", u.Path, objectKey)
+	}
+	return u
+}
+
+func (p s3Pusher) url(key string) string {
+	if p.conf.PublicUrl != "" {
+		return strings.TrimSuffix(p.conf.PublicUrl, "/") + "/" + path.Join(p.conf.Prefix, key)
+	}
+	u := p.objectUrl(key)
+	if p.conf.PresignExpiry > 0 {
+		return p.signer.presign(http.MethodGet, u, p.conf.PresignExpiry, p.now())
+	}
+	return u.String()
+}
+
+func (p s3Pusher) checksum(ctx context.Context, key string) (string, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := p.doStream(ctx, http.MethodGet, p.objectUrl(key), nil, nil, 0, sha256Hex(nil), nil, pw)
+		pw.CloseWithError(err)
+	}()
+	sum, err := sha256Reader(pr)
+	pr.Close()
+	return sum, err
+}
+
+func (p s3Pusher) backend() string {
+	return BackendS3
+}
+
+// destination is the url of the prefix in the bucket.
+func (p s3Pusher) destination() string {
+	u := p.objectUrl("")
+	return BackendS3 + ":" + u.String()
+}
+
+// do signs and executes a request, the response body is returned if the
+// status code is 200.
+func (p s3Pusher) do(ctx context.Context, method string, u url.URL, q url.Values, body io.Reader, size int64, payloadHash string, headers map[string]string) ([]byte, http.Header, error) {
+	buf := bytes.Buffer{}
+	h, err := p.doStream(ctx, method, u, q, body, size, payloadHash, headers, &buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), h, nil
+}
+
+// doStream signs and executes a request, the response body is written to out
+// if the status code is 200.
+func (p s3Pusher) doStream(ctx context.Context, method string, u url.URL, q url.Values, body io.Reader, size int64, payloadHash string, headers map[string]string, out io.Writer) (http.Header, error) {
+	u.RawQuery = q.Encode()
+	w := newProgressWatcher(ctx, p.conf.Timeout)
+	defer w.stop()
+	if body != nil {
+		body = w.reader(body)
+	}
+	req, err := http.NewRequestWithContext(w.ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating http request: %w", err)
+	}
+	req.ContentLength = size
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	p.signer.sign(req, payloadHash, p.now())
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, w.err(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, s3StatusError{status: resp.StatusCode, body: string(b)}
+	}
+	if _, err := io.Copy(out, w.reader(resp.Body)); err != nil {
+		return nil, w.err(fmt.Errorf("error while reading response body: %w", err))
+	}
+	return resp.Header, nil
+}
+
+func (p s3Pusher) objectHeaders(key string) map[string]string {
+	h := map[string]string{"Content-Type": contentType(key)}
+	if p.conf.CacheControl != "" {
+		h["Cache-Control"] = p.conf.CacheControl
+	}
+	return h
+}
+
+func (p s3Pusher) push(ctx context.Context, f string, key string) error {
+	input, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	info, err := input.Stat()
+	if err != nil {
+		return fmt.Errorf("error while getting %v information: %w", f, err)
+	}
+
+	if info.Size() >= p.conf.MultipartThreshold {
+		return p.pushMultipart(ctx, input, info.Size(), key)
+	}
+	_, _, err = p.do(ctx, http.MethodPut, p.objectUrl(key), nil, ratelimit.Get(ctx).UploadReader(ctx, input), info.Size(), unsignedPayload, p.objectHeaders(key))
+	return err
+}
+
+func (p s3Pusher) exists(ctx context.Context, key string) (bool, error) {
+	_, _, err := p.do(ctx, http.MethodHead, p.objectUrl(key), nil, nil, 0, sha256Hex(nil), nil)
+	var statusErr s3StatusError
+	if errors.As(err, &statusErr) && statusErr.status == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+func (p s3Pusher) pushMultipart(ctx context.Context, input io.ReaderAt, size int64, key string) error {
+	u := p.objectUrl(key)
+	b, _, err := p.do(ctx, http.MethodPost, u, url.Values{"uploads": {""}}, nil, 0, sha256Hex(nil), p.objectHeaders(key))
+	if err != nil {
+		return fmt.Errorf("error while initiating multipart upload: %w", err)
+	}
+	initRes := initiateMultipartUploadResult{}
+	if err := xml.Unmarshal(b, &initRes); err != nil || initRes.UploadID == "" {
+		return fmt.Errorf("error while parsing multipart upload initiation response (%v): %v", string(b), err)
+	}
+
+	complete := completeMultipartUpload{}
+	for offset, part := int64(0), 1; offset < size; offset, part = offset+p.conf.PartSize, part+1 {
+		partSize := p.conf.PartSize
+		if offset+partSize > size {
+			partSize = size - offset
+		}
+		q := url.Values{"partNumber": {strconv.Itoa(part)}, "uploadId": {initRes.UploadID}}
+		_, h, err := p.do(ctx, http.MethodPut, u, q, ratelimit.Get(ctx).UploadReader(ctx, io.NewSectionReader(input, offset, partSize)), partSize, unsignedPayload, nil)
+		if err != nil {
+			p.abortMultipart(u, initRes.UploadID)
+			return fmt.Errorf("error while uploading part %v: %w", part, err)
+		}
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: part, ETag: h.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		p.abortMultipart(u, initRes.UploadID)
+		return fmt.Errorf("error while marshaling multipart upload completion: %w", err)
+	}
+	q := url.Values{"uploadId": {initRes.UploadID}}
+	if _, _, err := p.do(ctx, http.MethodPost, u, q, bytes.NewReader(body), int64(len(body)), sha256Hex(body), nil); err != nil {
+		p.abortMultipart(u, initRes.UploadID)
+		return fmt.Errorf("error while completing multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (p s3Pusher) abortMultipart(u url.URL, uploadID string) {
+	// the bucket lifecycle is in charge of the uploads that can't be aborted,
+	// the abort is sent even if the upload has been interrupted
+	p.do(context.Background(), http.MethodDelete, u, url.Values{"uploadId": {uploadID}}, nil, 0, sha256Hex(nil), nil)
+}
@@ -0,0 +1,222 @@
+package binary
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is a minimal in-memory S3 server, supporting simple and multipart
+// uploads.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	parts    map[string][]byte
+	headers  map[string]http.Header
+	aborted  int
+	failPart bool
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, parts: map[string][]byte{}, headers: map[string]http.Header{}}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), sigV4Algorithm) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	b, _ := io.ReadAll(r.Body)
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && q["uploads"] != nil:
+		s.headers[r.URL.Path] = r.Header.Clone()
+		w.Write([]byte(`<InitiateMultipartUploadResult><UploadId>up1</UploadId></InitiateMultipartUploadResult>`))
+	case r.Method == http.MethodPut && q.Get("uploadId") != "":
+		if s.failPart {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.parts[q.Get("partNumber")] = b
+		w.Header().Set("ETag", `"etag`+q.Get("partNumber")+`"`)
+	case r.Method == http.MethodPost && q.Get("uploadId") != "":
+		complete := completeMultipartUpload{}
+		if err := xml.Unmarshal(b, &complete); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		content := []byte{}
+		for _, p := range complete.Parts {
+			content = append(content, s.parts[strconv.Itoa(p.PartNumber)]...)
+		}
+		s.objects[r.URL.Path] = content
+	case r.Method == http.MethodDelete && q.Get("uploadId") != "":
+		s.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead:
+		if _, found := s.objects[r.URL.Path]; !found {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodGet:
+		o, found := s.objects[r.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(o)
+	case r.Method == http.MethodPut:
+		s.headers[r.URL.Path] = r.Header.Clone()
+		s.objects[r.URL.Path] = b
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestNewS3Pusher(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		inConf   S3Conf
+		expError bool
+	}{
+		{"nominal", S3Conf{Endpoint: "http://minio:9000", Bucket: "pics"}, false},
+		{"noBucket", S3Conf{Endpoint: "http://minio:9000"}, true},
+		{"noEndpoint", S3Conf{Bucket: "pics"}, true},
+		{"partTooSmall", S3Conf{Endpoint: "http://minio:9000", Bucket: "pics", PartSize: 1024}, true},
+		{"presignTooLong", S3Conf{Endpoint: "http://minio:9000", Bucket: "pics", PresignExpiry: 8 * 24 * time.Hour}, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			p, err := NewS3Pusher(tc.inConf)
+			assert.Equal(t, tc.expError, err != nil)
+			if err == nil {
+				assert.Equal(t, defaultS3Region, p.conf.Region)
+			}
+		})
+	}
+}
+
+func TestS3Pusher_Url(t *testing.T) {
+	var tcs = []struct {
+		tcID   string
+		inConf S3Conf
+		expUrl string
+	}{
+		{"pathStyle", S3Conf{Endpoint: "http://minio:9000", Bucket: "pics", Prefix: "p", PathStyle: true}, "http://minio:9000/pics/p/k.jpg"},
+		{"virtualHost", S3Conf{Endpoint: "https://s3.amazonaws.com", Bucket: "pics"}, "https://pics.s3.amazonaws.com/k.jpg"},
+		{"public", S3Conf{Endpoint: "https://s3.amazonaws.com", Bucket: "pics", Prefix: "p", PublicUrl: "https://cdn/"}, "https://cdn/p/k.jpg"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			p, err := NewS3Pusher(tc.inConf)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expUrl, p.url("k.jpg"))
+		})
+	}
+}
+
+func TestS3Pusher_PresignedUrl(t *testing.T) {
+	p, err := NewS3Pusher(S3Conf{Endpoint: "http://minio:9000", Bucket: "pics", PathStyle: true, AccessKey: "ak", SecretKey: "sk", PresignExpiry: time.Hour})
+	assert.Nil(t, err)
+	p.now = func() time.Time { return time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC) }
+	u := p.url("k.jpg")
+	assert.True(t, strings.HasPrefix(u, "http://minio:9000/pics/k.jpg?"))
+	assert.Contains(t, u, "X-Amz-Expires=3600")
+	assert.Contains(t, u, "X-Amz-Signature=")
+}
+
+func TestS3Pusher_Push(t *testing.T) {
+	exp, err := os.ReadFile("../../testdata/picture.jpg")
+	assert.Nil(t, err)
+
+	var tcs = []struct {
+		tcID        string
+		inThreshold int64
+		inFailPart  bool
+		expError    bool
+		expParts    int
+		expAborted  int
+	}{
+		{"simple", 0, false, false, 0, 0},
+		{"multipart", 1, false, false, (len(exp) + minS3PartSize - 1) / minS3PartSize, 0},
+		{"multipartError", 1, true, true, 0, 1},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			s3 := newFakeS3()
+			s3.failPart = tc.inFailPart
+			srv := httptest.NewServer(s3)
+			defer srv.Close()
+
+			p, err := NewS3Pusher(S3Conf{
+				Endpoint:           srv.URL,
+				Bucket:             "pics",
+				Prefix:             "thumbs",
+				PathStyle:          true,
+				AccessKey:          "ak",
+				SecretKey:          "sk",
+				CacheControl:       "max-age=3600",
+				MultipartThreshold: tc.inThreshold,
+				PartSize:           minS3PartSize,
+			})
+			assert.Nil(t, err)
+
+			err = p.push(context.Background(), "../../testdata/picture.jpg", "k.jpg")
+			assert.Equal(t, tc.expError, err != nil)
+			assert.Equal(t, tc.expParts, len(s3.parts))
+			assert.Equal(t, tc.expAborted, s3.aborted)
+			if !tc.expError {
+				assert.Equal(t, exp, s3.objects["/pics/thumbs/k.jpg"])
+				assert.Equal(t, "image/jpeg", s3.headers["/pics/thumbs/k.jpg"].Get("Content-Type"))
+				assert.Equal(t, "max-age=3600", s3.headers["/pics/thumbs/k.jpg"].Get("Cache-Control"))
+			}
+		})
+	}
+}
+
+func TestS3Pusher_Exists(t *testing.T) {
+	s3 := newFakeS3()
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	p, err := NewS3Pusher(S3Conf{Endpoint: srv.URL, Bucket: "pics", PathStyle: true})
+	assert.Nil(t, err)
+	exists, err := p.exists(context.Background(), "k.jpg")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, p.push(context.Background(), "../../testdata/picture.jpg", "k.jpg"))
+	exists, err = p.exists(context.Background(), "k.jpg")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestS3Pusher_Checksum(t *testing.T) {
+	s3 := newFakeS3()
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	p, err := NewS3Pusher(S3Conf{Endpoint: srv.URL, Bucket: "pics", PathStyle: true})
+	assert.Nil(t, err)
+	_, err = p.checksum(context.Background(), "k.jpg")
+	assert.NotNil(t, err)
+	assert.Nil(t, p.push(context.Background(), "../../testdata/picture.jpg", "k.jpg"))
+	sum, err := p.checksum(context.Background(), "k.jpg")
+	assert.Nil(t, err)
+	exp, err := sha256File("../../testdata/picture.jpg")
+	assert.Nil(t, err)
+	assert.Equal(t, exp, sum)
+}
@@ -4,10 +4,14 @@ import (
 	"context"
 	"fmt"
 	"github.com/barasher/picdexer/internal/browse"
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/barasher/picdexer/internal/ratelimit"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestNewBinaryManager_ErrorOnOpts(t *testing.T) {
@@ -54,12 +58,12 @@ func TestBinaryManagerDoResize(t *testing.T) {
 
 	for _, tc := range tcs {
 		t.Run(tc.tcID, func(t *testing.T) {
-			bm, err := NewBinaryManager(4, BinaryManagerDoResize(tc.inW, tc.inH, []string{}))
+			bm, err := NewBinaryManager(4, BinaryManagerDoResize([]string{}, "", 0, Rendition{Name: "r", Width: tc.inW, Height: tc.inH}))
 			if tc.expOk {
 				assert.Nil(t, err)
-				resizer, ok := bm.resizer.(resizer)
+				_, ok := bm.resizer.(resizer)
 				assert.True(t, ok)
-				assert.Equal(t, "1x2", resizer.dimensions)
+				assert.Equal(t, []Rendition{{Name: "r", Width: 1, Height: 2}}, bm.renditions)
 			} else {
 				assert.NotNil(t, err)
 			}
@@ -68,22 +72,27 @@ func TestBinaryManagerDoResize(t *testing.T) {
 }
 
 func TestBinaryManagerDoPush(t *testing.T) {
-	bm, err := NewBinaryManager(4, BinaryManagerDoPush("anUrl"))
+	bm, err := NewBinaryManager(4, BinaryManagerDoPush("anUrl", time.Minute))
 	assert.Nil(t, err)
 	pusher, ok := bm.pusher.(pusher)
 	assert.True(t, ok)
-	assert.Equal(t, "anUrl", pusher.url)
+	assert.Equal(t, "anUrl", pusher.baseUrl)
+	assert.Equal(t, time.Minute, pusher.timeout)
 }
 
 type mockSubStore struct {
-	resized   bool
-	pushed    bool
-	cleanedUp bool
+	resized    bool
+	pushed     bool
+	cleanedUp  bool
+	pushedKeys []string
+	stored     map[string]bool
+	resizeErr  error
+	checksums  map[string]string
 }
 
-func (m *mockSubStore) resize(ctx context.Context, from string, to string) error {
+func (m *mockSubStore) resize(ctx context.Context, from string, targets []target) (string, error) {
 	m.resized = true
-	return nil
+	return "mock", m.resizeErr
 }
 
 func (m *mockSubStore) cleanup(ctx context.Context, f string) error {
@@ -91,17 +100,43 @@ func (m *mockSubStore) cleanup(ctx context.Context, f string) error {
 	return nil
 }
 
-func (m *mockSubStore) push(bin string, key string) error {
+func (m *mockSubStore) push(ctx context.Context, bin string, key string) error {
 	m.pushed = true
+	m.pushedKeys = append(m.pushedKeys, key)
 	return nil
 }
 
+func (m *mockSubStore) exists(ctx context.Context, key string) (bool, error) {
+	return m.stored[key], nil
+}
+
+func (m *mockSubStore) url(key string) string {
+	return "http://fs/key/" + key
+}
+
+func (m *mockSubStore) checksum(ctx context.Context, key string) (string, error) {
+	sum, found := m.checksums[key]
+	if !found {
+		return "", fmt.Errorf("%v not found", key)
+	}
+	return sum, nil
+}
+
+func (m *mockSubStore) backend() string {
+	return "mock"
+}
+
+func (m *mockSubStore) destination() string {
+	return "mock:http://fs"
+}
+
 func TestStore(t *testing.T) {
 	mock := &mockSubStore{}
 	bm, err := NewBinaryManager(4)
 	assert.Nil(t, err)
 	bm.resizer = mock
 	bm.pusher = mock
+	bm.renditions = []Rendition{{Name: "r", Width: 10, Height: 10}}
 
 	f := "../../testdata/picture.jpg"
 	fInfo, err := os.Stat(f)
@@ -115,3 +150,308 @@ func TestStore(t *testing.T) {
 	assert.True(t, mock.pushed)
 	assert.True(t, mock.cleanedUp)
 }
+
+func TestUpload_Limited(t *testing.T) {
+	mock := &mockSubStore{}
+	bm, err := NewBinaryManager(1)
+	assert.Nil(t, err)
+	bm.pusher = mock
+	l, err := ratelimit.NewLimits(ratelimit.Settings{UploadsPerSecond: 2})
+	assert.Nil(t, err)
+	ctx := ratelimit.WithLimits(context.Background(), l)
+
+	start := time.Now()
+	for _, k := range []string{"k1", "k2", "k3"} {
+		assert.Nil(t, bm.upload(ctx, "../../testdata/picture.jpg", k))
+	}
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+	assert.Equal(t, []string{"k1", "k2", "k3"}, mock.pushedKeys)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.NotNil(t, bm.upload(canceled, "../../testdata/picture.jpg", "k4"))
+	assert.Equal(t, []string{"k1", "k2", "k3"}, mock.pushedKeys)
+}
+
+func TestStore_OnStoreResult(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		inResizeErr error
+		expStrategy string
+		expKeys     []string
+		expError    bool
+	}{
+		{"success", nil, "mock", []string{"id1"}, false},
+		{"failure", fmt.Errorf("resizing error"), "", nil, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			mock := &mockSubStore{resizeErr: tc.inResizeErr}
+			results := []StoreResult{}
+			bm, err := NewBinaryManager(1, BinaryManagerOnStoreResult(func(r StoreResult) {
+				results = append(results, r)
+			}))
+			assert.Nil(t, err)
+			bm.resizer = mock
+			bm.pusher = mock
+			bm.renditions = []Rendition{{Name: "r", Width: 10, Height: 10}}
+
+			in := make(chan browse.Task, 1)
+			in <- browse.Task{Path: "../../testdata/picture.jpg", FileID: "id1"}
+			close(in)
+			assert.Nil(t, bm.Store(context.TODO(), in, ""))
+			assert.Len(t, results, 1)
+			assert.Equal(t, "id1", results[0].Task.FileID)
+			assert.Equal(t, tc.expStrategy, results[0].Strategy)
+			keys := []string(nil)
+			for _, cur := range results[0].Renditions {
+				keys = append(keys, cur.Key)
+				assert.Equal(t, "r", cur.Name)
+				assert.Equal(t, "http://fs/key/"+cur.Key, cur.Url)
+				assert.Equal(t, "mock", cur.Backend)
+				assert.NotNil(t, cur.StoredAt)
+			}
+			assert.Equal(t, tc.expKeys, keys)
+			assert.Equal(t, tc.expError, results[0].Err != nil)
+		})
+	}
+}
+
+func TestBinaryManagerDoStrategyResize(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inConf     StrategyConf
+		inRen      Rendition
+		expSuccess bool
+	}{
+		{"nominal", StrategyConf{}, Rendition{Name: "r", Width: 10, Height: 10}, true},
+		{"wrongRendition", StrategyConf{}, Rendition{Name: "r"}, false},
+		{"wrongConf", StrategyConf{Default: []Strategy{{Type: "blabla"}}}, Rendition{Name: "r", Width: 10, Height: 10}, false},
+		{"goUnsupportedRendition", StrategyConf{Default: []Strategy{{Type: StrategyGo}}}, Rendition{Name: "r", Width: 10, Height: 10, Progressive: true}, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			bm, err := NewBinaryManager(1, BinaryManagerDoStrategyResize(tc.inConf, tc.inRen))
+			assert.Equal(t, tc.expSuccess, err == nil)
+			if err == nil {
+				_, ok := bm.resizer.(strategyResizer)
+				assert.True(t, ok)
+			}
+		})
+	}
+}
+
+func TestStore_SkipExisting(t *testing.T) {
+	r1 := Rendition{Name: "r", Width: 10, Height: 10}
+	r2 := Rendition{Name: "r", Width: 20, Height: 20}
+	var tcs = []struct {
+		tcID          string
+		inRecorded    []Rendition
+		inDestination string
+		inRenditions  []Rendition
+		inVerify      bool
+		inStored      map[string]bool
+		expPushedKeys []string
+	}{
+		{"notRecorded", nil, "", []Rendition{r1}, false, nil, []string{"id1"}},
+		{"recorded", []Rendition{r1}, "mock:http://fs", []Rendition{r1}, false, nil, nil},
+		{"changedRendition", []Rendition{r1}, "mock:http://fs", []Rendition{r2}, false, nil, []string{"id1"}},
+		{"changedDestination", []Rendition{r1}, "fs:/other", []Rendition{r1}, false, nil, []string{"id1"}},
+		{"verifiedStored", []Rendition{r1}, "mock:http://fs", []Rendition{r1}, true, map[string]bool{"id1": true}, nil},
+		{"verifiedMissing", []Rendition{r1}, "mock:http://fs", []Rendition{r1}, true, nil, []string{"id1"}},
+		{"original", nil, "", nil, false, nil, []string{"id1"}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			recordFile := filepath.Join(dir, "uploads.jsonl")
+			if len(tc.inRecorded) > 0 {
+				r, err := openUploadRecord(recordFile)
+				assert.Nil(t, err)
+				for _, cur := range tc.inRecorded {
+					assert.Nil(t, r.add(uploadEntry{Key: cur.Key("id1"), Fingerprint: fingerprint(cur), Destination: tc.inDestination, Strategy: "mock"}))
+				}
+			}
+
+			mock := &mockSubStore{stored: tc.inStored}
+			stored := 0
+			skipped := []bool{}
+			bm, err := NewBinaryManager(1, BinaryManagerSkipExisting(recordFile, tc.inVerify), BinaryManagerOnStoreResult(func(r StoreResult) {
+				if r.Err == nil {
+					stored++
+				}
+				skipped = append(skipped, r.Skipped)
+			}))
+			assert.Nil(t, err)
+			bm.resizer = mock
+			bm.pusher = mock
+			bm.renditions = tc.inRenditions
+
+			in := make(chan browse.Task, 2)
+			in <- browse.Task{Path: "../../testdata/picture.jpg", FileID: "id1"}
+			close(in)
+			assert.Nil(t, bm.Store(context.TODO(), in, ""))
+			assert.Equal(t, tc.expPushedKeys, mock.pushedKeys)
+			assert.Equal(t, 1, stored)
+
+			// the second import only costs the check
+			r, err := openUploadRecord(recordFile)
+			assert.Nil(t, err)
+			bm.record = r
+			bm.verify = false
+			mock.pushedKeys = nil
+			in = make(chan browse.Task, 1)
+			in <- browse.Task{Path: "../../testdata/picture.jpg", FileID: "id1"}
+			close(in)
+			assert.Nil(t, bm.Store(context.TODO(), in, ""))
+			assert.Nil(t, mock.pushedKeys)
+			assert.Equal(t, []bool{tc.expPushedKeys == nil, true}, skipped)
+		})
+	}
+}
+
+func TestBinaryManagerDoGoResize(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		inW      int
+		inH      int
+		inFilter string
+		expOk    bool
+	}{
+		{"nominal", 1, 2, "lanczos", true},
+		{"1x0", 1, 0, "lanczos", false},
+		{"wrongFilter", 1, 2, "blabla", false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			bm, err := NewBinaryManager(4, BinaryManagerDoGoResize(tc.inFilter, Rendition{Name: "r", Width: tc.inW, Height: tc.inH}))
+			if tc.expOk {
+				assert.Nil(t, err)
+				_, ok := bm.resizer.(goResizer)
+				assert.True(t, ok)
+				assert.Equal(t, []Rendition{{Name: "r", Width: tc.inW, Height: tc.inH}}, bm.renditions)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestStore_Renditions(t *testing.T) {
+	mock := &mockSubStore{}
+	bm, err := NewBinaryManager(1)
+	assert.Nil(t, err)
+	bm.resizer = mock
+	bm.pusher = mock
+	bm.renditions = []Rendition{
+		{Name: "thumb", Width: 10, Height: 10, KeySuffix: "_thumb"},
+		{Name: "preview", Width: 100, Height: 100},
+	}
+
+	in := make(chan browse.Task, 1)
+	in <- browse.Task{Path: "../../testdata/picture.jpg", FileID: "id_picture.jpg"}
+	close(in)
+
+	assert.Nil(t, bm.Store(context.TODO(), in, ""))
+	assert.Equal(t, []string{"id_picture_thumb.jpg", "id_picture.jpg"}, mock.pushedKeys)
+}
+
+func TestStore_Original(t *testing.T) {
+	mock := &mockSubStore{}
+	bm, err := NewBinaryManager(1)
+	assert.Nil(t, err)
+	bm.resizer = mock
+	bm.pusher = mock
+
+	in := make(chan browse.Task, 1)
+	in <- browse.Task{Path: "../../testdata/picture.jpg", FileID: "id_picture.jpg"}
+	close(in)
+
+	assert.Nil(t, bm.Store(context.TODO(), in, ""))
+	assert.False(t, mock.resized)
+	assert.Equal(t, []string{"id_picture.jpg"}, mock.pushedKeys)
+}
+
+func TestRenditionRefs(t *testing.T) {
+	bm, err := NewBinaryManager(1)
+	assert.Nil(t, err)
+	bm.pusher = &mockSubStore{}
+	assert.Equal(t, []metadata.RenditionRef{{Name: "original", Key: "id_a.jpg", Url: "http://fs/key/id_a.jpg", Backend: "mock"}}, bm.RenditionRefs("id_a.jpg"))
+
+	bm.renditions = []Rendition{
+		{Name: "thumb", Width: 10, Height: 10, KeySuffix: "_thumb"},
+		{Name: "preview", Width: 100, Height: 100},
+	}
+	exp := []metadata.RenditionRef{
+		{Name: "thumb", Key: "id_a_thumb.jpg", Url: "http://fs/key/id_a_thumb.jpg", Backend: "mock"},
+		{Name: "preview", Key: "id_a.jpg", Url: "http://fs/key/id_a.jpg", Backend: "mock"},
+	}
+	assert.Equal(t, exp, bm.RenditionRefs("id_a.jpg"))
+}
+
+func TestStore_RenditionDetails(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	recordFile := filepath.Join(dir, "uploads.jsonl")
+
+	results := []StoreResult{}
+	bm, err := NewBinaryManager(1,
+		BinaryManagerDoGoResize("", Rendition{Name: "thumb", Width: 10, Height: 10, KeySuffix: "_thumb"}),
+		BinaryManagerSkipExisting(recordFile, false),
+		BinaryManagerOnStoreResult(func(r StoreResult) {
+			results = append(results, r)
+		}))
+	assert.Nil(t, err)
+	bm.pusher = &mockSubStore{}
+
+	in := make(chan browse.Task, 1)
+	in <- browse.Task{Path: "../../testdata/picture.jpg", FileID: "id1.jpg"}
+	close(in)
+	before := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	assert.Nil(t, bm.Store(context.TODO(), in, dir))
+	assert.Len(t, results, 1)
+	assert.Len(t, results[0].Renditions, 1)
+	ref := results[0].Renditions[0]
+	assert.Equal(t, "thumb", ref.Name)
+	assert.Equal(t, "id1_thumb.jpg", ref.Key)
+	assert.Equal(t, "mock", ref.Backend)
+	assert.NotNil(t, ref.Width)
+	assert.NotNil(t, ref.Height)
+	assert.True(t, *ref.Width == 10 || *ref.Height == 10)
+	assert.NotNil(t, ref.Size)
+	assert.True(t, *ref.Size > 0)
+	assert.NotNil(t, ref.StoredAt)
+	assert.True(t, *ref.StoredAt >= before)
+
+	// the details are recorded
+	bm2, err := NewBinaryManager(1,
+		BinaryManagerDoGoResize("", Rendition{Name: "thumb", Width: 10, Height: 10, KeySuffix: "_thumb"}),
+		BinaryManagerSkipExisting(recordFile, false))
+	assert.Nil(t, err)
+	bm2.pusher = &mockSubStore{}
+	assert.Equal(t, []metadata.RenditionRef{ref}, bm2.RenditionRefs("id1.jpg"))
+}
+
+func TestBinaryManagerDoGoResize_UnsupportedEncoding(t *testing.T) {
+	_, err := NewBinaryManager(4, BinaryManagerDoGoResize("", Rendition{Name: "r", Width: 1, Height: 1, Progressive: true}))
+	assert.NotNil(t, err)
+}
+
+func TestBinaryManagerDoFsPush(t *testing.T) {
+	bm, err := NewBinaryManager(4, BinaryManagerDoFsPush(os.TempDir(), "http://nginx", true))
+	assert.Nil(t, err)
+	p, ok := bm.pusher.(fsPusher)
+	assert.True(t, ok)
+	assert.Equal(t, os.TempDir(), p.root)
+	assert.True(t, p.hardLink)
+
+	_, err = NewBinaryManager(4, BinaryManagerDoFsPush("", "", false))
+	assert.NotNil(t, err)
+}
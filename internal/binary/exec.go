@@ -0,0 +1,156 @@
+package binary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/barasher/picdexer/internal/metrics"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// command is an external program and its arguments. It is executed without
+// any shell, so that the arguments are never interpreted.
+type command struct {
+	name string
+	args []string
+}
+
+func (c command) String() string {
+	return strings.Join(append([]string{c.name}, c.args...), " ")
+}
+
+// processError describes the failure of a process : its exit code (-1 if it
+// has been killed or could not be started) and what it wrote on stderr.
+type processError struct {
+	cmd      string
+	exitCode int
+	stderr   string
+	err      error
+}
+
+func (e processError) Error() string {
+	msg := fmt.Sprintf("%v failed (exit code %v): %v", e.cmd, e.exitCode, e.err)
+	if e.stderr != "" {
+		msg += fmt.Sprintf(" (stderr: %v)", e.stderr)
+	}
+	return msg
+}
+
+func (e processError) Unwrap() error {
+	return e.err
+}
+
+// safePath prevents a file name to be interpreted as an option.
+func safePath(p string) string {
+	if strings.HasPrefix(p, "-") {
+		return "./" + p
+	}
+	return p
+}
+
+// runPipeline runs the commands, the standard output of each one being
+// piped into the standard input of the next one, the output of the last one
+// being written to out (discarded if nil). All the processes are killed when
+// the context is done. The standard errors are returned, in the order of the
+// commands, whatever the result. The durations of the processes are recorded
+// in the metrics of the context.
+func runPipeline(ctx context.Context, out io.Writer, cmds ...command) ([]string, error) {
+	if len(cmds) == 0 {
+		return nil, fmt.Errorf("no command to run")
+	}
+	execs := make([]*exec.Cmd, len(cmds))
+	// stderr is written in files rather than through pipes : a pipe kept open
+	// by a child of a killed process would block Wait
+	stderrs := make([]*os.File, len(cmds))
+	defer func() {
+		for _, f := range stderrs {
+			if f != nil {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}
+	}()
+	pipes := []*os.File{}
+	closePipes := func() {
+		for _, p := range pipes {
+			p.Close()
+		}
+		pipes = nil
+	}
+	defer closePipes()
+
+	for i, c := range cmds {
+		execs[i] = exec.CommandContext(ctx, c.name, c.args...)
+		f, err := os.CreateTemp(os.TempDir(), "picdexer-stderr-")
+		if err != nil {
+			return nil, fmt.Errorf("error while creating stderr file: %w", err)
+		}
+		stderrs[i] = f
+		execs[i].Stderr = f
+		if i > 0 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				return nil, fmt.Errorf("error while creating pipe: %w", err)
+			}
+			pipes = append(pipes, r, w)
+			execs[i-1].Stdout = w
+			execs[i].Stdin = r
+		}
+	}
+	execs[len(execs)-1].Stdout = out
+
+	started := 0
+	var startErr error
+	start := time.Now()
+	for i, e := range execs {
+		if err := e.Start(); err != nil {
+			startErr = processError{cmd: cmds[i].String(), exitCode: -1, err: err}
+			break
+		}
+		started++
+	}
+	// the pipes are now owned by the processes
+	closePipes()
+
+	errs := make([]error, len(execs))
+	m := metrics.Get(ctx)
+	for i := 0; i < started; i++ {
+		errs[i] = execs[i].Wait()
+		m.ToolRan(filepath.Base(cmds[i].name), time.Since(start))
+	}
+	results := make([]string, len(execs))
+	for i, f := range stderrs {
+		b, _ := os.ReadFile(f.Name())
+		results[i] = strings.TrimSpace(string(b))
+	}
+	if startErr != nil {
+		return results, startErr
+	}
+	if ctx.Err() != nil {
+		names := make([]string, len(cmds))
+		for i, c := range cmds {
+			names[i] = c.name
+		}
+		return results, fmt.Errorf("%v interrupted: %w", strings.Join(names, " | "), ctx.Err())
+	}
+	// like pipefail, the rightmost failure is reported : the failures of the
+	// previous processes are often caused by it (broken pipe)
+	for i := len(errs) - 1; i >= 0; i-- {
+		err := errs[i]
+		if err == nil {
+			continue
+		}
+		pe := processError{cmd: cmds[i].String(), exitCode: -1, stderr: results[i], err: err}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			pe.exitCode = exitErr.ExitCode()
+		}
+		return results, pe
+	}
+	return results, nil
+}
@@ -0,0 +1,79 @@
+package binary
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/barasher/picdexer/internal/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunPipeline(t *testing.T) {
+	arg := "it's a $(touch /tmp/injected) `ls` test"
+	var tcs = []struct {
+		tcID        string
+		inCmds      []command
+		expOut      string
+		expError    bool
+		expExitCode int
+		expStderr   bool
+	}{
+		{"single", []command{{name: "echo", args: []string{"-n", arg}}}, arg, false, 0, false},
+		{"piped", []command{{name: "echo", args: []string{"-n", arg}}, {name: "tr", args: []string{"a", "b"}}, {name: "cat"}}, "it's b $(touch /tmp/injected) `ls` test", false, 0, false},
+		{"exitCode", []command{{name: "echo", args: []string{"a"}}, {name: "false"}}, "", true, 1, false},
+		{"rightmostFailure", []command{{name: "sh", args: []string{"-c", "exit 3"}}, {name: "false"}}, "", true, 1, false},
+		{"stderr", []command{{name: "ls", args: []string{"/nonExistingFolder123"}}}, "", true, 2, true},
+		{"unknown", []command{{name: "nonExistingCommand123"}}, "", true, -1, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			stderrs, err := runPipeline(context.TODO(), out, tc.inCmds...)
+			assert.Equal(t, tc.expError, err != nil)
+			assert.Equal(t, tc.expOut, out.String())
+			if tc.expError {
+				var pe processError
+				assert.True(t, errors.As(err, &pe))
+				assert.Equal(t, tc.expExitCode, pe.exitCode)
+				assert.Equal(t, tc.expStderr, pe.stderr != "")
+			} else {
+				assert.Len(t, stderrs, len(tc.inCmds))
+			}
+		})
+	}
+}
+
+func TestRunPipeline_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := runPipeline(ctx, nil, command{name: "sleep", args: []string{"5"}}, command{name: "cat"})
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestRunPipeline_NoCommand(t *testing.T) {
+	_, err := runPipeline(context.TODO(), nil)
+	assert.NotNil(t, err)
+}
+
+func TestSafePath(t *testing.T) {
+	assert.Equal(t, "./-a.jpg", safePath("-a.jpg"))
+	assert.Equal(t, "/tmp/-a.jpg", safePath("/tmp/-a.jpg"))
+	assert.Equal(t, "a.jpg", safePath("a.jpg"))
+}
+
+func TestRunPipeline_Metrics(t *testing.T) {
+	m := metrics.New()
+	_, err := runPipeline(metrics.WithMetrics(context.TODO(), m), nil, command{name: "/bin/echo", args: []string{"a"}}, command{name: "cat"})
+	assert.Nil(t, err)
+	b := bytes.Buffer{}
+	_, err = m.WriteTo(&b)
+	assert.Nil(t, err)
+	assert.Contains(t, b.String(), `picdexer_tool_duration_seconds_count{tool="echo"} 1`)
+	assert.Contains(t, b.String(), `picdexer_tool_duration_seconds_count{tool="cat"} 1`)
+}
@@ -0,0 +1,28 @@
+package binary
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const stripLocationTimeout = time.Minute
+
+// stripLocation removes the location metadata (EXIF GPS tags and their XMP
+// equivalents) of a file.
+func stripLocation(ctx context.Context, f string) error {
+	ctx, cancel := context.WithTimeout(ctx, stripLocationTimeout)
+	defer cancel()
+	cmd := command{name: "exiftool", args: []string{"-q", "-overwrite_original", "-gps:all=", "-xmp:gps*=", safePath(f)}}
+	if _, err := runPipeline(ctx, nil, cmd); err != nil {
+		return fmt.Errorf("error while stripping location of %v: %w", f, err)
+	}
+	return nil
+}
+
+// needsLocationStrip returns true if the location metadata of a target has
+// to be removed after its production.
+func needsLocationStrip(t target, strategy string) bool {
+	// the go resizer never copies metadata
+	return t.StripLocation && !t.StripMetadata && strategy != StrategyGo
+}
@@ -0,0 +1,95 @@
+package binary
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/barasher/picdexer/internal/browse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNeedsLocationStrip(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		inRendition Rendition
+		inStrategy  string
+		expOk       bool
+	}{
+		{"notRequired", Rendition{}, StrategyConvert, false},
+		{"convert", Rendition{StripLocation: true}, StrategyConvert, true},
+		{"preview", Rendition{StripLocation: true}, previewStrategyName(defaultPreviewTag), true},
+		{"go", Rendition{StripLocation: true}, StrategyGo, false},
+		{"alreadyStripped", Rendition{StripLocation: true, StripMetadata: true}, StrategyConvert, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expOk, needsLocationStrip(target{Rendition: tc.inRendition}, tc.inStrategy))
+		})
+	}
+}
+
+func TestFingerprint_StripLocation(t *testing.T) {
+	r := Rendition{Name: "r", Width: 10, Height: 10}
+	stripped := r
+	stripped.StripLocation = true
+	assert.NotEqual(t, fingerprint(r), fingerprint(stripped))
+	// fingerprints recorded before the privacy rules are kept
+	b, err := json.Marshal(r)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(b), "StripLocation")
+}
+
+func TestStore_StripLocation(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	argsFile := filepath.Join(dir, "args")
+	defer fakeCommands(t, map[string]string{"exiftool": `echo "$@" >> ` + argsFile})()
+
+	var tcs = []struct {
+		tcID          string
+		inRenditions  []Rendition
+		inStrip       bool
+		expStripped   int
+		expPushedKeys []string
+	}{
+		{"renditions", []Rendition{{Name: "r1", Width: 10, Height: 10}, {Name: "r2", Width: 10, Height: 10, KeySuffix: "_2", StripMetadata: true}}, true, 1, []string{"id1.jpg", "id1_2.jpg"}},
+		{"original", nil, true, 1, []string{"id1.jpg"}},
+		{"notStripped", []Rendition{{Name: "r1", Width: 10, Height: 10}}, false, 0, []string{"id1.jpg"}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			os.Remove(argsFile)
+			bm, err := NewBinaryManager(1, BinaryManagerStripLocation(func(browse.Task) bool {
+				return tc.inStrip
+			}))
+			assert.Nil(t, err)
+			mock := &mockSubStore{}
+			bm.resizer = mock
+			bm.pusher = mock
+			bm.renditions = tc.inRenditions
+
+			in := make(chan browse.Task, 1)
+			in <- browse.Task{Path: "../../testdata/picture.jpg", FileID: "id1.jpg"}
+			close(in)
+			assert.Nil(t, bm.Store(context.TODO(), in, dir))
+			assert.Equal(t, tc.expPushedKeys, mock.pushedKeys)
+
+			b, _ := os.ReadFile(argsFile)
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			if tc.expStripped == 0 {
+				assert.Equal(t, "", strings.TrimSpace(string(b)))
+				return
+			}
+			assert.Len(t, lines, tc.expStripped)
+			assert.Contains(t, lines[0], "-gps:all=")
+			assert.Contains(t, lines[0], filepath.Join(dir, "id1.jpg"))
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package binary
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"os"
+)
+
+const (
+	orientationTag  = 0x0112
+	exifHeaderLimit = 256 * 1024
+)
+
+var exifPrefix = []byte("Exif\x00\x00")
+
+// readOrientation returns the EXIF orientation (1 to 8) of a JPEG or TIFF
+// file, 1 if it can't be found.
+func readOrientation(f string) int {
+	input, err := os.Open(f)
+	if err != nil {
+		return 1
+	}
+	defer input.Close()
+	b, err := io.ReadAll(io.LimitReader(input, exifHeaderLimit))
+	if err != nil {
+		return 1
+	}
+	return parseOrientation(b)
+}
+
+func parseOrientation(b []byte) int {
+	switch {
+	case len(b) > 4 && (bytes.HasPrefix(b, []byte("II*\x00")) || bytes.HasPrefix(b, []byte("MM\x00*"))):
+		return tiffOrientation(b)
+	case len(b) > 2 && b[0] == 0xFF && b[1] == 0xD8:
+		return jpegOrientation(b)
+	}
+	return 1
+}
+
+func jpegOrientation(b []byte) int {
+	i := 2
+	for i+4 <= len(b) {
+		if b[i] != 0xFF {
+			return 1
+		}
+		marker := b[i+1]
+		if marker == 0xD8 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			i += 2
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // start of scan / end of image
+			return 1
+		}
+		l := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+		if l < 2 || i+2+l > len(b) {
+			return 1
+		}
+		seg := b[i+4 : i+2+l]
+		if marker == 0xE1 && bytes.HasPrefix(seg, exifPrefix) {
+			return tiffOrientation(seg[len(exifPrefix):])
+		}
+		i += 2 + l
+	}
+	return 1
+}
+
+func tiffOrientation(b []byte) int {
+	if len(b) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(b[4:8]))
+	if ifd+2 > len(b) {
+		return 1
+	}
+	count := int(order.Uint16(b[ifd : ifd+2]))
+	for e := 0; e < count; e++ {
+		off := ifd + 2 + e*12
+		if off+12 > len(b) {
+			return 1
+		}
+		if order.Uint16(b[off:off+2]) == orientationTag {
+			o := int(order.Uint16(b[off+8 : off+10]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+	return 1
+}
+
+// swapsDimensions returns true if the orientation transposes the picture.
+func swapsDimensions(o int) bool {
+	return o >= 5 && o <= 8
+}
+
+// orient applies the transformation that displays a picture stored with the
+// EXIF orientation o upright.
+func orient(src image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if swapsDimensions(o) {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
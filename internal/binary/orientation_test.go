@@ -0,0 +1,126 @@
+package binary
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func exifSegment(o byte) []byte {
+	tiff := []byte{'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08,
+		0x00, 0x01, // 1 entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, o, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	l := len(payload) + 2
+	return append([]byte{0xFF, 0xE1, byte(l >> 8), byte(l)}, payload...)
+}
+
+func jpegWithOrientation(t *testing.T, img image.Image, o byte) []byte {
+	buf := bytes.Buffer{}
+	assert.Nil(t, jpeg.Encode(&buf, img, nil))
+	b := buf.Bytes()
+	res := append([]byte{}, b[:2]...)
+	res = append(res, exifSegment(o)...)
+	return append(res, b[2:]...)
+}
+
+func TestParseOrientation(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	var tcs = []struct {
+		tcID   string
+		inB    []byte
+		expOri int
+	}{
+		{"jpeg6", jpegWithOrientation(t, img, 6), 6},
+		{"jpeg3", jpegWithOrientation(t, img, 3), 3},
+		{"jpegInvalid", jpegWithOrientation(t, img, 9), 1},
+		{"tiff", exifSegment(8)[10:], 8},
+		{"empty", []byte{}, 1},
+		{"text", []byte("blabla"), 1},
+		{"truncatedJpeg", jpegWithOrientation(t, img, 6)[:12], 1},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expOri, parseOrientation(tc.inB))
+		})
+	}
+}
+
+func TestReadOrientation(t *testing.T) {
+	assert.Equal(t, 1, readOrientation("../../testdata/picture.jpg"))
+	assert.Equal(t, 1, readOrientation("../../testdata/nonExisting.jpg"))
+}
+
+func TestOrient(t *testing.T) {
+	// a b
+	// c d
+	a := color.RGBA{1, 0, 0, 255}
+	b := color.RGBA{2, 0, 0, 255}
+	c := color.RGBA{3, 0, 0, 255}
+	d := color.RGBA{4, 0, 0, 255}
+	src := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	src.Set(0, 0, a)
+	src.Set(1, 0, b)
+	src.Set(0, 1, c)
+	src.Set(1, 1, d)
+
+	var tcs = []struct {
+		inO int
+		exp []color.RGBA // top-left, top-right, bottom-left, bottom-right
+	}{
+		{1, []color.RGBA{a, b, c, d}},
+		{2, []color.RGBA{b, a, d, c}},
+		{3, []color.RGBA{d, c, b, a}},
+		{4, []color.RGBA{c, d, a, b}},
+		{5, []color.RGBA{a, c, b, d}},
+		{6, []color.RGBA{c, a, d, b}},
+		{7, []color.RGBA{d, b, c, a}},
+		{8, []color.RGBA{b, d, a, c}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(string(rune('0'+tc.inO)), func(t *testing.T) {
+			res := orient(src, tc.inO)
+			assert.Equal(t, tc.exp[0], res.At(0, 0))
+			assert.Equal(t, tc.exp[1], res.At(1, 0))
+			assert.Equal(t, tc.exp[2], res.At(0, 1))
+			assert.Equal(t, tc.exp[3], res.At(1, 1))
+		})
+	}
+}
+
+func TestOrient_Dimensions(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	assert.Equal(t, image.Rect(0, 0, 2, 4), orient(src, 6).Bounds())
+	assert.Equal(t, image.Rect(0, 0, 4, 2), orient(src, 3).Bounds())
+}
+
+func TestGoResizer_AutoOrient(t *testing.T) {
+	outDir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outDir)
+
+	inFile := filepath.Join(outDir, "in.jpg")
+	assert.Nil(t, os.WriteFile(inFile, jpegWithOrientation(t, image.NewRGBA(image.Rect(0, 0, 200, 100)), 6), 0644))
+
+	outFile := filepath.Join(outDir, "out.jpg")
+	r, err := NewGoResizer("")
+	assert.Nil(t, err)
+	targets := []target{{Rendition: Rendition{Name: "r", Width: 100, Height: 100}, path: outFile}}
+	_, err = r.resize(context.TODO(), inFile, targets)
+	assert.Nil(t, err)
+
+	img, err := decodeImage(outFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, img.Bounds().Dx())
+	assert.Equal(t, 100, img.Bounds().Dy())
+}
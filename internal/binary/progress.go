@@ -0,0 +1,71 @@
+package binary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const defaultUploadTimeout = 30 * time.Second
+
+// progressWatcher cancels its context when no progress has been made for the
+// duration of the timeout : a slow upload of a big file is not interrupted as
+// long as bytes are transferred.
+type progressWatcher struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	timeout time.Duration
+	expired int32
+}
+
+func newProgressWatcher(ctx context.Context, timeout time.Duration) *progressWatcher {
+	if timeout <= 0 {
+		timeout = defaultUploadTimeout
+	}
+	w := &progressWatcher{timeout: timeout}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	w.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&w.expired, 1)
+		w.cancel()
+	})
+	return w
+}
+
+func (w *progressWatcher) touch() {
+	w.timer.Reset(w.timeout)
+}
+
+func (w *progressWatcher) stop() {
+	w.timer.Stop()
+	w.cancel()
+}
+
+// err explains the error of a request that has been cancelled by the watcher.
+func (w *progressWatcher) err(err error) error {
+	if err != nil && atomic.LoadInt32(&w.expired) == 1 && errors.Is(err, context.Canceled) {
+		return fmt.Errorf("no progress for %v: %w", w.timeout, err)
+	}
+	return err
+}
+
+// reader returns a reader that reports the progress of r to the watcher.
+func (w *progressWatcher) reader(r io.Reader) io.Reader {
+	return progressReader{r: r, w: w}
+}
+
+type progressReader struct {
+	r io.Reader
+	w *progressWatcher
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.w.touch()
+	}
+	return n, err
+}
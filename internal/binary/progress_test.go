@@ -0,0 +1,41 @@
+package binary
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressWatcher(t *testing.T) {
+	w := newProgressWatcher(context.Background(), 50*time.Millisecond)
+	defer w.stop()
+
+	// progressing : the timeout is postponed
+	r := w.reader(strings.NewReader(strings.Repeat("a", 10)))
+	b := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		_, err := r.Read(b)
+		assert.Nil(t, err)
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Nil(t, w.ctx.Err())
+
+	// stalled
+	select {
+	case <-w.ctx.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "watcher should have expired")
+	}
+	assert.Contains(t, w.err(w.ctx.Err()).Error(), "no progress for 50ms")
+}
+
+func TestProgressWatcher_Stopped(t *testing.T) {
+	w := newProgressWatcher(context.Background(), 0)
+	assert.Equal(t, defaultUploadTimeout, w.timeout)
+	w.stop()
+	assert.NotNil(t, w.ctx.Err())
+	assert.Equal(t, context.Canceled, w.err(w.ctx.Err()))
+}
@@ -0,0 +1,156 @@
+package binary
+
+import (
+	"fmt"
+	"image"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	CropFit  = "fit"
+	CropFill = "fill"
+
+	FormatJpeg = "jpeg"
+	FormatPng  = "png"
+	FormatWebp = "webp"
+
+	originalRenditionName = "original"
+)
+
+var subsamplings = map[string]bool{"": true, "4:4:4": true, "4:2:2": true, "4:2:0": true}
+
+// Rendition describes a resized version of a picture.
+type Rendition struct {
+	Name          string
+	Width         int
+	Height        int
+	Quality       int
+	Crop          string
+	KeySuffix     string
+	Format        string
+	Progressive   bool
+	Subsampling   string
+	StripMetadata bool
+	ToSRGB        bool
+	// StripLocation removes the location metadata (GPS) of the rendition,
+	// set by the privacy rules.
+	StripLocation bool `json:",omitempty"`
+	// Watermark is drawn on the rendition.
+	Watermark *Watermark `json:",omitempty"`
+}
+
+// Key returns the storage key of the rendition of a picture : the key suffix
+// is inserted before the file extension, which is replaced for non JPEG
+// formats.
+func (r Rendition) Key(fileID string) string {
+	ext := filepath.Ext(fileID)
+	newExt := ext
+	if f := r.format(); f != FormatJpeg {
+		newExt = "." + f
+	}
+	if r.KeySuffix == "" && newExt == ext {
+		return fileID
+	}
+	return strings.TrimSuffix(fileID, ext) + r.KeySuffix + newExt
+}
+
+func (r Rendition) format() string {
+	if r.Format == "" {
+		return FormatJpeg
+	}
+	return r.Format
+}
+
+func (r Rendition) fill() bool {
+	return r.Crop == CropFill
+}
+
+func validateRenditions(renditions []Rendition) error {
+	if len(renditions) == 0 {
+		return fmt.Errorf("at least one rendition has to be defined")
+	}
+	names := make(map[string]bool)
+	suffixes := make(map[string]bool)
+	for _, r := range renditions {
+		if r.Name == "" {
+			return fmt.Errorf("rendition name can't be empty")
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rendition name %v is used several times", r.Name)
+		}
+		names[r.Name] = true
+		if suffixes[r.KeySuffix+r.format()] {
+			return fmt.Errorf("rendition key suffix '%v' (%v) is used several times for the %v format", r.KeySuffix, r.Name, r.format())
+		}
+		suffixes[r.KeySuffix+r.format()] = true
+		if r.Width <= 0 || r.Height <= 0 {
+			return fmt.Errorf("rendition %v: neither width (%v) nor height (%v) can be <= 0", r.Name, r.Width, r.Height)
+		}
+		if r.Quality < 0 || r.Quality > 100 {
+			return fmt.Errorf("rendition %v: quality (%v) should be in [0, 100]", r.Name, r.Quality)
+		}
+		switch r.Crop {
+		case "", CropFit, CropFill:
+		default:
+			return fmt.Errorf("rendition %v: unsupported crop mode (%v)", r.Name, r.Crop)
+		}
+		switch r.Format {
+		case "", FormatJpeg, FormatPng, FormatWebp:
+		default:
+			return fmt.Errorf("rendition %v: unsupported format (%v)", r.Name, r.Format)
+		}
+		if !subsamplings[r.Subsampling] {
+			return fmt.Errorf("rendition %v: unsupported chroma subsampling (%v)", r.Name, r.Subsampling)
+		}
+		if r.Watermark != nil {
+			if err := r.Watermark.validate(); err != nil {
+				return fmt.Errorf("rendition %v: %w", r.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// target is a rendition of a specific picture.
+type target struct {
+	Rendition
+	key  string
+	path string
+	// watermarkText is the watermark text, its placeholders being resolved
+	watermarkText string
+	marks         *watermarks
+	// markFile is the rendered watermark composited by convert at markOffset
+	markFile   string
+	markOffset image.Point
+}
+
+func buildTargets(renditions []Rendition, marks *watermarks, fileID string, outDir string) []target {
+	targets := make([]target, len(renditions))
+	for i, r := range renditions {
+		k := r.Key(fileID)
+		targets[i] = target{
+			Rendition: r,
+			key:       k,
+			path:      filepath.Join(outDir, k),
+			marks:     marks,
+		}
+	}
+	return targets
+}
+
+func renditionKeys(renditions []Rendition, fileID string) []string {
+	keys := make([]string, len(renditions))
+	for i, r := range renditions {
+		keys[i] = r.Key(fileID)
+	}
+	return keys
+}
+
+func renditionFingerprints(renditions []Rendition) []string {
+	fps := make([]string, len(renditions))
+	for i, r := range renditions {
+		fps[i] = fingerprint(r)
+	}
+	return fps
+}
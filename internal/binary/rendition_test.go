@@ -0,0 +1,57 @@
+package binary
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenditionKey(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		inSuffix string
+		inFormat string
+		inFileID string
+		expKey   string
+	}{
+		{"noSuffix", "", "", "h_a.jpg", "h_a.jpg"},
+		{"suffix", "_thumb", "", "h_a.jpg", "h_a_thumb.jpg"},
+		{"noExtension", "_thumb", "", "h_a", "h_a_thumb"},
+		{"converted", "_thumb", "", "h_a.CR2.jpg", "h_a.CR2_thumb.jpg"},
+		{"png", "", FormatPng, "h_a.jpg", "h_a.png"},
+		{"webp", "_t", FormatWebp, "h_a.jpg", "h_a_t.webp"},
+		{"explicitJpeg", "", FormatJpeg, "h_a.JPG", "h_a.JPG"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expKey, Rendition{KeySuffix: tc.inSuffix, Format: tc.inFormat}.Key(tc.inFileID))
+		})
+	}
+}
+
+func TestValidateRenditions(t *testing.T) {
+	var tcs = []struct {
+		tcID         string
+		inRenditions []Rendition
+		expOk        bool
+	}{
+		{"empty", []Rendition{}, false},
+		{"nominal", []Rendition{{Name: "a", Width: 1, Height: 1}, {Name: "b", Width: 1, Height: 1, KeySuffix: "_b", Crop: CropFill, Quality: 80}}, true},
+		{"noName", []Rendition{{Width: 1, Height: 1}}, false},
+		{"duplicatedName", []Rendition{{Name: "a", Width: 1, Height: 1}, {Name: "a", Width: 1, Height: 1, KeySuffix: "_b"}}, false},
+		{"duplicatedSuffix", []Rendition{{Name: "a", Width: 1, Height: 1}, {Name: "b", Width: 1, Height: 1}}, false},
+		{"noWidth", []Rendition{{Name: "a", Height: 1}}, false},
+		{"wrongQuality", []Rendition{{Name: "a", Width: 1, Height: 1, Quality: 101}}, false},
+		{"wrongCrop", []Rendition{{Name: "a", Width: 1, Height: 1, Crop: "blabla"}}, false},
+		{"sameSuffixOtherFormat", []Rendition{{Name: "a", Width: 1, Height: 1}, {Name: "b", Width: 1, Height: 1, Format: FormatPng}}, true},
+		{"wrongFormat", []Rendition{{Name: "a", Width: 1, Height: 1, Format: "bmp"}}, false},
+		{"wrongSubsampling", []Rendition{{Name: "a", Width: 1, Height: 1, Subsampling: "4:1:1"}}, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expOk, validateRenditions(tc.inRenditions) == nil)
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package binary
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	sigV4Service     = "s3"
+	sigV4DateFormat  = "20060102T150405Z"
+	sigV4ShortFormat = "20060102"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	amzDateHeader    = "X-Amz-Date"
+	amzSha256Header  = "X-Amz-Content-Sha256"
+	amzTokenHeader   = "X-Amz-Security-Token"
+)
+
+// sigV4 signs S3 requests with the AWS signature version 4.
+type sigV4 struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode encodes a string as specified by the signature : every byte but
+// the unreserved characters is percent-encoded, '/' being kept if required.
+func uriEncode(s string, keepSlash bool) string {
+	sb := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9'),
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && keepSlash:
+			sb.WriteByte(c)
+		default:
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return sb.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		values := append([]string{}, q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, false)+"="+uriEncode(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func canonicalPath(u *url.URL) string {
+	p := u.EscapedPath()
+	if unescaped, err := url.PathUnescape(p); err == nil {
+		p = unescaped
+	}
+	if p == "" {
+		p = "/"
+	}
+	return uriEncode(p, true)
+}
+
+func (s sigV4) scope(t time.Time) string {
+	return fmt.Sprintf("%v/%v/%v/aws4_request", t.Format(sigV4ShortFormat), s.region, sigV4Service)
+}
+
+func (s sigV4) signature(t time.Time, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		t.Format(sigV4DateFormat),
+		s.scope(t),
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	k := hmacSha256([]byte("AWS4"+s.secretKey), t.Format(sigV4ShortFormat))
+	k = hmacSha256(k, s.region)
+	k = hmacSha256(k, sigV4Service)
+	k = hmacSha256(k, "aws4_request")
+	return hex.EncodeToString(hmacSha256(k, stringToSign))
+}
+
+// sign adds the Authorization header to the request. The host and all the
+// headers already set are signed.
+func (s sigV4) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set(amzDateHeader, t.Format(sigV4DateFormat))
+	req.Header.Set(amzSha256Header, payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set(amzTokenHeader, s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := strings.Builder{}
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	req.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		sigV4Algorithm, s.accessKey, s.scope(t), signedHeaders, s.signature(t, canonicalRequest)))
+}
+
+// presign returns a presigned URL, valid for the provided duration.
+func (s sigV4) presign(method string, u url.URL, expires time.Duration, t time.Time) string {
+	t = t.UTC()
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", sigV4Algorithm)
+	q.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(t))
+	q.Set("X-Amz-Date", t.Format(sigV4DateFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	if s.sessionToken != "" {
+		q.Set(amzTokenHeader, s.sessionToken)
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		canonicalPath(&u),
+		canonicalQuery(q),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	q.Set("X-Amz-Signature", s.signature(t, canonicalRequest))
+	u.RawQuery = canonicalQuery(q)
+	return u.String()
+}
@@ -0,0 +1,281 @@
+package binary
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	StrategyConvert = "convert"
+	StrategyPreview = "preview"
+	StrategyCommand = "command"
+	StrategyGo      = "go"
+
+	defaultPreviewTag   = "previewImage"
+	inputPlaceholder    = "{input}"
+	outputPlaceholder   = "{output}"
+	strategyIdentifier  = "strategy"
+	intermediateExt     = ".png"
+	strategyNameDivider = ":"
+)
+
+var previewTagRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]+$`)
+
+// Strategy is a way of producing the renditions of a picture :
+//   - convert : the picture is resized by convert
+//   - preview : the embedded preview (Tags, in preference order) extracted by
+//     exiftool is resized by convert
+//   - command : the output of an external command (Command, in which {input}
+//     is replaced by the picture and {output} by an intermediate file, the
+//     standard output being used if {output} is not set) is resized by convert
+//   - go : the picture is resized without any external tool
+type Strategy struct {
+	Type    string
+	Tags    []string
+	Command []string
+}
+
+// StrategyRule associates a strategy chain to file extensions (ex : "cr2")
+// or MIME types (ex : "image/heic").
+type StrategyRule struct {
+	Match      []string
+	Strategies []Strategy
+}
+
+// StrategyConf configures the strategy resizer.
+type StrategyConf struct {
+	Rules []StrategyRule
+	// Default is the chain of the pictures matched by no rule, [convert] if
+	// empty.
+	Default     []Strategy
+	SRGBProfile string
+	Timeout     time.Duration
+	Filter      string
+}
+
+// attempt is a single way of producing the targets, a strategy being
+// expanded to several attempts when several preview tags are provided.
+type attempt struct {
+	name string
+	// run produces the targets, its intermediate files are written in outDir
+	run func(ctx context.Context, from string, outDir string, targets []target) error
+}
+
+// strategyResizer tries each strategy of the chain associated to a picture
+// until one succeeds.
+type strategyResizer struct {
+	convert resizer
+	goR     goResizer
+	rules   []StrategyRule
+	chain   []Strategy
+}
+
+func previewStrategyName(tag string) string {
+	return StrategyPreview + strategyNameDivider + tag
+}
+
+func validateStrategies(strategies []Strategy) error {
+	if len(strategies) == 0 {
+		return fmt.Errorf("strategy chain can't be empty")
+	}
+	for _, s := range strategies {
+		switch s.Type {
+		case StrategyConvert, StrategyGo:
+		case StrategyPreview:
+			for _, t := range s.Tags {
+				if !previewTagRegexp.MatchString(t) {
+					return fmt.Errorf("wrong preview tag (%v)", t)
+				}
+			}
+		case StrategyCommand:
+			if len(s.Command) == 0 {
+				return fmt.Errorf("command strategy requires a command")
+			}
+			found := false
+			for _, a := range s.Command {
+				found = found || strings.Contains(a, inputPlaceholder)
+			}
+			if !found {
+				return fmt.Errorf("command %v requires the %v placeholder", s.Command, inputPlaceholder)
+			}
+		default:
+			return fmt.Errorf("unsupported strategy (%v)", s.Type)
+		}
+	}
+	return nil
+}
+
+func NewStrategyResizer(c StrategyConf) (strategyResizer, error) {
+	r := strategyResizer{
+		convert: NewResizer(nil, c.SRGBProfile, c.Timeout),
+		chain:   c.Default,
+	}
+	if len(r.chain) == 0 {
+		r.chain = []Strategy{{Type: StrategyConvert}}
+	}
+	if err := validateStrategies(r.chain); err != nil {
+		return strategyResizer{}, fmt.Errorf("wrong default strategy chain: %w", err)
+	}
+	for _, rule := range c.Rules {
+		if len(rule.Match) == 0 {
+			return strategyResizer{}, fmt.Errorf("strategy rule must match at least one extension or MIME type")
+		}
+		if err := validateStrategies(rule.Strategies); err != nil {
+			return strategyResizer{}, fmt.Errorf("wrong strategy chain for %v: %w", rule.Match, err)
+		}
+		match := make([]string, len(rule.Match))
+		for i, m := range rule.Match {
+			match[i] = strings.TrimPrefix(strings.ToLower(m), ".")
+		}
+		r.rules = append(r.rules, StrategyRule{Match: match, Strategies: rule.Strategies})
+	}
+	goR, err := NewGoResizer(c.Filter)
+	if err != nil {
+		return strategyResizer{}, err
+	}
+	r.goR = goR
+	return r, nil
+}
+
+// usesGo returns true if a chain uses the go strategy.
+func (r strategyResizer) usesGo() bool {
+	chains := [][]Strategy{r.chain}
+	for _, rule := range r.rules {
+		chains = append(chains, rule.Strategies)
+	}
+	for _, c := range chains {
+		for _, s := range c {
+			if s.Type == StrategyGo {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// chainFor returns the strategy chain of a picture : the first rule matching
+// its extension or its MIME type is used.
+func (r strategyResizer) chainFor(from string) []Strategy {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(from)), ".")
+	mime := ""
+	for _, rule := range r.rules {
+		for _, m := range rule.Match {
+			if !strings.Contains(m, "/") {
+				if m == ext {
+					return rule.Strategies
+				}
+				continue
+			}
+			if mime == "" {
+				if detected, err := mimetype.DetectFile(from); err == nil {
+					mime = strings.ToLower(detected.String())
+				}
+			}
+			if m == mime {
+				return rule.Strategies
+			}
+		}
+	}
+	return r.chain
+}
+
+func (r strategyResizer) attempts(chain []Strategy) []attempt {
+	attempts := []attempt{}
+	for _, s := range chain {
+		s := s
+		switch s.Type {
+		case StrategyConvert:
+			attempts = append(attempts, attempt{name: StrategyConvert, run: func(ctx context.Context, from string, outDir string, targets []target) error {
+				return r.convert.convertFile(ctx, from, from, outDir, targets)
+			}})
+		case StrategyPreview:
+			tags := s.Tags
+			if len(tags) == 0 {
+				tags = []string{defaultPreviewTag}
+			}
+			for _, tag := range tags {
+				tag := tag
+				attempts = append(attempts, attempt{name: previewStrategyName(tag), run: func(ctx context.Context, from string, outDir string, targets []target) error {
+					return r.convert.convertPiped(ctx, from, previewCommand(from, tag), outDir, targets)
+				}})
+			}
+		case StrategyCommand:
+			attempts = append(attempts, attempt{name: StrategyCommand + strategyNameDivider + filepath.Base(s.Command[0]), run: func(ctx context.Context, from string, outDir string, targets []target) error {
+				return r.runCommand(ctx, s.Command, from, outDir, targets)
+			}})
+		case StrategyGo:
+			attempts = append(attempts, attempt{name: StrategyGo, run: func(ctx context.Context, from string, outDir string, targets []target) error {
+				_, err := r.goR.resize(ctx, from, targets)
+				return err
+			}})
+		}
+	}
+	return attempts
+}
+
+// runCommand resizes the output of an external command : the command writes
+// an intermediate file if the template contains {output}, its standard
+// output is piped into convert otherwise.
+func (r strategyResizer) runCommand(ctx context.Context, template []string, from string, outDir string, targets []target) error {
+	output := ""
+	for _, a := range template {
+		if strings.Contains(a, outputPlaceholder) {
+			f, err := os.CreateTemp(outDir, "picdexer-*"+intermediateExt)
+			if err != nil {
+				return fmt.Errorf("error while creating intermediate file: %w", err)
+			}
+			f.Close()
+			output = f.Name()
+			defer os.Remove(output)
+			break
+		}
+	}
+	args := make([]string, len(template)-1)
+	for i, a := range template[1:] {
+		a = strings.ReplaceAll(a, inputPlaceholder, safePath(from))
+		args[i] = strings.ReplaceAll(a, outputPlaceholder, output)
+	}
+	cmd := command{name: template[0], args: args}
+	if output == "" {
+		return r.convert.convertPiped(ctx, from, cmd, outDir, targets)
+	}
+	if err := r.convert.run(ctx, from, []command{cmd}); err != nil {
+		return err
+	}
+	return r.convert.convertFile(ctx, from, output, outDir, targets)
+}
+
+func (r strategyResizer) resize(ctx context.Context, from string, targets []target) (string, error) {
+	if len(targets) == 0 {
+		return "", nil
+	}
+	// the targets are produced in the working dir of the storage
+	outDir := filepath.Dir(targets[0].path)
+	errs := []string{}
+	for _, a := range r.attempts(r.chainFor(from)) {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		err := a.run(ctx, from, outDir, targets)
+		if err == nil {
+			log.Info().Str(common.LogFileIdentifier, from).Str(strategyIdentifier, a.name).Msg("Picture resized")
+			return a.name, nil
+		}
+		log.Warn().Str(common.LogFileIdentifier, from).Str(strategyIdentifier, a.name).Msgf("Resizing strategy failed: %v", err)
+		errs = append(errs, fmt.Sprintf("%v: %v", a.name, err))
+	}
+	return "", fmt.Errorf("all resizing strategies failed (%v)", strings.Join(errs, ", "))
+}
+
+func (r strategyResizer) cleanup(ctx context.Context, f string) error {
+	return os.Remove(f)
+}
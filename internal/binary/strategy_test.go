@@ -0,0 +1,183 @@
+package binary
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateStrategies(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inChain    []Strategy
+		expSuccess bool
+	}{
+		{"convert", []Strategy{{Type: StrategyConvert}}, true},
+		{"all", []Strategy{{Type: StrategyPreview, Tags: []string{"JpgFromRaw", "PreviewImage"}}, {Type: StrategyCommand, Command: []string{"dcraw", "-c", "{input}"}}, {Type: StrategyConvert}, {Type: StrategyGo}}, true},
+		{"empty", []Strategy{}, false},
+		{"unknown", []Strategy{{Type: "blabla"}}, false},
+		{"wrongTag", []Strategy{{Type: StrategyPreview, Tags: []string{"-o"}}}, false},
+		{"noCommand", []Strategy{{Type: StrategyCommand}}, false},
+		{"noInput", []Strategy{{Type: StrategyCommand, Command: []string{"dcraw", "-c"}}}, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expSuccess, validateStrategies(tc.inChain) == nil)
+		})
+	}
+}
+
+func TestNewStrategyResizer(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inConf     StrategyConf
+		expSuccess bool
+		expUsesGo  bool
+	}{
+		{"defaultChain", StrategyConf{}, true, false},
+		{"goRule", StrategyConf{Rules: []StrategyRule{{Match: []string{"heic"}, Strategies: []Strategy{{Type: StrategyGo}}}}}, true, true},
+		{"wrongDefault", StrategyConf{Default: []Strategy{{Type: "blabla"}}}, false, false},
+		{"ruleWithoutMatch", StrategyConf{Rules: []StrategyRule{{Strategies: []Strategy{{Type: StrategyConvert}}}}}, false, false},
+		{"wrongRule", StrategyConf{Rules: []StrategyRule{{Match: []string{"cr2"}}}}, false, false},
+		{"wrongFilter", StrategyConf{Filter: "blabla"}, false, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			r, err := NewStrategyResizer(tc.inConf)
+			assert.Equal(t, tc.expSuccess, err == nil)
+			if err == nil {
+				assert.Equal(t, tc.expUsesGo, r.usesGo())
+			}
+		})
+	}
+}
+
+func TestStrategyResizer_ChainFor(t *testing.T) {
+	raw := []Strategy{{Type: StrategyPreview}}
+	jpeg := []Strategy{{Type: StrategyGo}}
+	r, err := NewStrategyResizer(StrategyConf{Rules: []StrategyRule{
+		{Match: []string{".CR2", "nef"}, Strategies: raw},
+		{Match: []string{"image/JPEG"}, Strategies: jpeg},
+	}})
+	assert.Nil(t, err)
+
+	var tcs = []struct {
+		tcID     string
+		inFile   string
+		expChain []Strategy
+	}{
+		{"extension", "/p/a.cr2", raw},
+		{"extensionCase", "/p/a.NEF", raw},
+		{"mime", "../../testdata/picture.jpg", jpeg},
+		{"default", "../../testdata/nonPictureFile.txt", []Strategy{{Type: StrategyConvert}}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expChain, r.chainFor(tc.inFile))
+		})
+	}
+}
+
+func TestStrategyResizer_Resize(t *testing.T) {
+	var tcs = []struct {
+		tcID        string
+		inScripts   map[string]string
+		inChain     []Strategy
+		expStrategy string
+		expError    bool
+	}{
+		{
+			"convert",
+			map[string]string{"convert": "exit 0"},
+			[]Strategy{{Type: StrategyConvert}},
+			StrategyConvert, false,
+		},
+		{
+			"previewTags",
+			map[string]string{"exiftool": `[ "$2" = "-PreviewImage" ] || exit 1`, "convert": "cat > /dev/null"},
+			[]Strategy{{Type: StrategyPreview, Tags: []string{"JpgFromRaw", "PreviewImage"}}, {Type: StrategyConvert}},
+			"preview:PreviewImage", false,
+		},
+		{
+			"commandWithOutput",
+			map[string]string{"mytool": `cp "$1" "$2"`, "convert": `[ -s "$1" ] || exit 1`},
+			[]Strategy{{Type: StrategyCommand, Command: []string{"mytool", "{input}", "{output}"}}},
+			"command:mytool", false,
+		},
+		{
+			"commandPiped",
+			map[string]string{"mytool": `cat "$2"`, "convert": `[ "$(cat | wc -c)" -gt 0 ] || exit 1`},
+			[]Strategy{{Type: StrategyCommand, Command: []string{"mytool", "-c", "{input}"}}},
+			"command:mytool", false,
+		},
+		{
+			"fallbackToGo",
+			map[string]string{"convert": "exit 1"},
+			[]Strategy{{Type: StrategyConvert}, {Type: StrategyGo}},
+			StrategyGo, false,
+		},
+		{
+			"allFailed",
+			map[string]string{"convert": "exit 1", "exiftool": "exit 1"},
+			[]Strategy{{Type: StrategyPreview}, {Type: StrategyConvert}},
+			"", true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			defer fakeCommands(t, tc.inScripts)()
+			outDir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+			assert.Nil(t, err)
+			defer os.RemoveAll(outDir)
+
+			r, err := NewStrategyResizer(StrategyConf{Default: tc.inChain})
+			assert.Nil(t, err)
+			targets := []target{{Rendition: Rendition{Name: "r", Width: 10, Height: 10}, path: filepath.Join(outDir, "out.jpg")}}
+			strategy, err := r.resize(context.TODO(), "../../testdata/picture.jpg", targets)
+			assert.Equal(t, tc.expError, err != nil)
+			assert.Equal(t, tc.expStrategy, strategy)
+		})
+	}
+}
+
+func TestStrategyResizer_IntermediateInOutDir(t *testing.T) {
+	outDir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outDir)
+	outputFile := filepath.Join(outDir, "output")
+	defer fakeCommands(t, map[string]string{"mytool": `echo -n "$2" > ` + outputFile + `; cp "$1" "$2"`, "convert": "exit 0"})()
+
+	r, err := NewStrategyResizer(StrategyConf{Default: []Strategy{{Type: StrategyCommand, Command: []string{"mytool", "{input}", "{output}"}}}})
+	assert.Nil(t, err)
+	targets := []target{{Rendition: Rendition{Name: "r", Width: 10, Height: 10}, path: filepath.Join(outDir, "out.jpg")}}
+	_, err = r.resize(context.TODO(), "../../testdata/picture.jpg", targets)
+	assert.Nil(t, err)
+	b, err := os.ReadFile(outputFile)
+	assert.Nil(t, err)
+	assert.Equal(t, outDir, filepath.Dir(string(b)))
+	_, err = os.Stat(string(b))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStrategyResizer_Attempts(t *testing.T) {
+	r, err := NewStrategyResizer(StrategyConf{})
+	assert.Nil(t, err)
+	attempts := r.attempts([]Strategy{
+		{Type: StrategyPreview, Tags: []string{"JpgFromRaw", "PreviewImage"}},
+		{Type: StrategyPreview},
+		{Type: StrategyCommand, Command: []string{"/usr/bin/dcraw", "-c", "{input}"}},
+		{Type: StrategyGo},
+	})
+	names := []string{}
+	for _, a := range attempts {
+		names = append(names, a.name)
+	}
+	assert.Equal(t, []string{"preview:JpgFromRaw", "preview:PreviewImage", "preview:previewImage", "command:dcraw", "go"}, names)
+}
@@ -0,0 +1,113 @@
+package binary
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/rs/zerolog/log"
+)
+
+// uploadEntry describes an uploaded file : the parameters used to produce
+// it, the storage it has been uploaded to, its dimensions (0 if unknown), its
+// size and its upload time.
+type uploadEntry struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	Destination string    `json:"destination,omitempty"`
+	Strategy    string    `json:"strategy,omitempty"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// uploadRecord keeps track of the uploaded keys and of the parameters used
+// to produce them, so that a picture is not resized and pushed twice.
+type uploadRecord struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]uploadEntry
+}
+
+func openUploadRecord(path string) (*uploadRecord, error) {
+	if path == "" {
+		return nil, fmt.Errorf("upload record file can't be empty")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error while creating folder for %v: %w", path, err)
+	}
+	r := &uploadRecord{path: path, entries: make(map[string]uploadEntry)}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error while opening upload record %v: %w", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := uploadEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Warn().Msgf("Ignoring unparsable upload record line (%v): %v", path, err)
+			continue
+		}
+		r.entries[e.Key] = e
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading upload record %v: %w", path, err)
+	}
+	return r, nil
+}
+
+// has returns true if a key has been uploaded to the destination with the
+// same fingerprint : a file uploaded to another storage is uploaded again.
+func (r *uploadRecord) has(key string, fingerprint string, destination string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, found := r.entries[key]
+	return found && e.Fingerprint == fingerprint && e.Destination == destination
+}
+
+// get returns the entry recorded for a key.
+func (r *uploadRecord) get(key string) (uploadEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, found := r.entries[key]
+	return e, found
+}
+
+func (r *uploadRecord) add(e uploadEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := common.OpenAppend(r.path)
+	if err != nil {
+		return fmt.Errorf("error while opening upload record %v: %w", r.path, err)
+	}
+	defer f.Close()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := json.NewEncoder(f).Encode(e); err != nil {
+		return fmt.Errorf("error while writing upload record %v: %w", r.path, err)
+	}
+	r.entries[e.Key] = e
+	return nil
+}
+
+// fingerprint identifies the parameters used to produce a rendition : a
+// changed rendition gets a different fingerprint and is produced again.
+func fingerprint(r Rendition) string {
+	b, _ := json.Marshal(r)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,65 @@
+package binary
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadRecord(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "sub", "uploads.jsonl")
+
+	r, err := openUploadRecord(f)
+	assert.Nil(t, err)
+	assert.False(t, r.has("k1", "fp1", "d1"))
+	assert.Nil(t, r.add(uploadEntry{Key: "k1", Fingerprint: "fp1", Destination: "d1", Strategy: "convert", Width: 640, Height: 480, Size: 1234}))
+	assert.Nil(t, r.add(uploadEntry{Key: "k2", Fingerprint: "fp2", Destination: "d1"}))
+	assert.Nil(t, r.add(uploadEntry{Key: "k2", Fingerprint: "fp3", Destination: "d1", Strategy: "go"}))
+	assert.True(t, r.has("k1", "fp1", "d1"))
+
+	f2, err := os.OpenFile(f, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = f2.WriteString("unparsable\n{\"key\": \"trunc")
+	assert.Nil(t, err)
+	assert.Nil(t, f2.Close())
+	// the truncated line doesn't swallow the next entry
+	assert.Nil(t, r.add(uploadEntry{Key: "k4", Fingerprint: "fp4", Destination: "d1"}))
+
+	r, err = openUploadRecord(f)
+	assert.Nil(t, err)
+	assert.True(t, r.has("k1", "fp1", "d1"))
+	assert.False(t, r.has("k1", "fp2", "d1"))
+	assert.False(t, r.has("k2", "fp2", "d1"))
+	assert.True(t, r.has("k2", "fp3", "d1"))
+	assert.True(t, r.has("k4", "fp4", "d1"))
+	// uploaded to another storage
+	assert.False(t, r.has("k1", "fp1", "d2"))
+	e, found := r.get("k1")
+	assert.True(t, found)
+	assert.Equal(t, "convert", e.Strategy)
+	assert.Equal(t, 640, e.Width)
+	assert.Equal(t, 480, e.Height)
+	assert.Equal(t, int64(1234), e.Size)
+	assert.False(t, e.Time.IsZero())
+	e, found = r.get("k2")
+	assert.True(t, found)
+	assert.Equal(t, "go", e.Strategy)
+	_, found = r.get("k3")
+	assert.False(t, found)
+
+	_, err = openUploadRecord("")
+	assert.NotNil(t, err)
+}
+
+func TestFingerprint(t *testing.T) {
+	r := Rendition{Name: "r", Width: 10, Height: 10}
+	assert.Equal(t, fingerprint(r), fingerprint(r))
+	r2 := r
+	r2.Quality = 80
+	assert.NotEqual(t, fingerprint(r), fingerprint(r2))
+}
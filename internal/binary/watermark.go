@@ -0,0 +1,476 @@
+package binary
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	exif "github.com/barasher/go-exiftool"
+	"github.com/barasher/picdexer/internal/metrics"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	PositionNorthWest = "northwest"
+	PositionNorth     = "north"
+	PositionNorthEast = "northeast"
+	PositionWest      = "west"
+	PositionCenter    = "center"
+	PositionEast      = "east"
+	PositionSouthWest = "southwest"
+	PositionSouth     = "south"
+	PositionSouthEast = "southeast"
+
+	defaultWatermarkOpacity = 0.5
+	defaultWatermarkMargin  = 0.02
+	defaultWatermarkScale   = 0.2
+	yearField               = "Year"
+	watermarkTimeout        = time.Minute
+	// the text is rendered at this size and then scaled
+	referenceFontSize = 64
+)
+
+var (
+	placeholderRegexp = regexp.MustCompile(`\{\{\s*([A-Za-z][A-Za-z0-9:_-]*)\s*\}\}`)
+	positions         = map[string]bool{
+		PositionNorthWest: true, PositionNorth: true, PositionNorthEast: true,
+		PositionWest: true, PositionCenter: true, PositionEast: true,
+		PositionSouthWest: true, PositionSouth: true, PositionSouthEast: true,
+	}
+	// dateFields are the exiftool tags used to compute the Year field
+	dateFields = []string{"DateTimeOriginal", "CreateDate"}
+)
+
+// Watermark is drawn on a rendition : a text or a PNG logo (Image). The text
+// is a template whose {{Tag}} placeholders are replaced by the metadata of
+// the picture or by its capture year ({{Year}}). The placeholders are
+// exiftool tag names without group (ex : Artist, Model), read from the
+// picture : they are not the fields of the documents (CameraModel...). Margin (distance to the borders) and Scale (width of the
+// watermark) are relative to the dimensions of the rendition.
+type Watermark struct {
+	Text     string  `json:",omitempty"`
+	Image    string  `json:",omitempty"`
+	Position string  `json:",omitempty"`
+	Opacity  float64 `json:",omitempty"`
+	Margin   float64 `json:",omitempty"`
+	Scale    float64 `json:",omitempty"`
+}
+
+func (w Watermark) position() string {
+	if w.Position == "" {
+		return PositionSouthEast
+	}
+	return strings.ToLower(w.Position)
+}
+
+func (w Watermark) opacity() float64 {
+	if w.Opacity == 0 {
+		return defaultWatermarkOpacity
+	}
+	return w.Opacity
+}
+
+func (w Watermark) margin() float64 {
+	if w.Margin == 0 {
+		return defaultWatermarkMargin
+	}
+	return w.Margin
+}
+
+func (w Watermark) scale() float64 {
+	if w.Scale == 0 {
+		return defaultWatermarkScale
+	}
+	return w.Scale
+}
+
+func (w Watermark) validate() error {
+	if (w.Text == "") == (w.Image == "") {
+		return fmt.Errorf("watermark requires either a text or an image")
+	}
+	if !positions[w.position()] {
+		return fmt.Errorf("unsupported watermark position (%v)", w.Position)
+	}
+	if w.Opacity < 0 || w.Opacity > 1 {
+		return fmt.Errorf("watermark opacity (%v) should be in [0, 1]", w.Opacity)
+	}
+	if w.Margin < 0 || w.Margin >= 0.5 {
+		return fmt.Errorf("watermark margin (%v) should be in [0, 0.5[", w.Margin)
+	}
+	if w.Scale < 0 || w.Scale > 1 {
+		return fmt.Errorf("watermark scale (%v) should be in ]0, 1]", w.Scale)
+	}
+	return nil
+}
+
+func decodeLogo(f string) (image.Image, error) {
+	input, err := os.Open(f)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening watermark %v: %w", f, err)
+	}
+	defer input.Close()
+	img, err := png.Decode(input)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding watermark %v: %w", f, err)
+	}
+	return img, nil
+}
+
+// watermarks holds the resources used to draw the watermarks, loaded once
+// when the binary manager is built : the decoded logos (by file), the font of
+// the texts and the exiftool instance reading the fields of the texts.
+type watermarks struct {
+	logos map[string]image.Image
+	font  *opentype.Font
+	exif  *exif.Exiftool
+	read  fieldReader
+}
+
+// loadWatermarks decodes the logos and parses the font used by the watermarks
+// of the renditions. The font is only parsed if a text watermark is defined,
+// exiftool is only started if a text uses placeholders.
+func loadWatermarks(renditions []Rendition) (*watermarks, error) {
+	m := &watermarks{logos: map[string]image.Image{}}
+	for _, r := range renditions {
+		w := r.Watermark
+		switch {
+		case w == nil:
+		case w.Image != "":
+			if _, found := m.logos[w.Image]; found {
+				continue
+			}
+			logo, err := decodeLogo(w.Image)
+			if err != nil {
+				return nil, fmt.Errorf("rendition %v: %w", r.Name, err)
+			}
+			m.logos[w.Image] = logo
+		case m.font == nil:
+			f, err := opentype.Parse(goregular.TTF)
+			if err != nil {
+				return nil, fmt.Errorf("error while parsing font: %w", err)
+			}
+			m.font = f
+		}
+	}
+	for _, r := range renditions {
+		if r.Watermark != nil && placeholderRegexp.MatchString(r.Watermark.Text) {
+			et, err := exif.NewExiftool()
+			if err != nil {
+				return nil, fmt.Errorf("error while initializing Exiftool: %w", err)
+			}
+			m.exif = et
+			m.read = exiftoolReader(et)
+			break
+		}
+	}
+	return m, nil
+}
+
+func (m *watermarks) close() error {
+	if m == nil || m.exif == nil {
+		return nil
+	}
+	return m.exif.Close()
+}
+
+func (m *watermarks) logo(f string) image.Image {
+	if m == nil {
+		return nil
+	}
+	return m.logos[f]
+}
+
+// placeholders returns the fields used by the watermark texts.
+func placeholders(targets []target) []string {
+	fields := []string{}
+	found := map[string]bool{}
+	for _, t := range targets {
+		if t.Watermark == nil {
+			continue
+		}
+		for _, m := range placeholderRegexp.FindAllStringSubmatch(t.Watermark.Text, -1) {
+			if !found[m[1]] {
+				found[m[1]] = true
+				fields = append(fields, m[1])
+			}
+		}
+	}
+	return fields
+}
+
+// fieldReader reads the metadata of a picture, by exiftool tag name.
+type fieldReader func(from string) (map[string]interface{}, error)
+
+// exiftoolReader reads the metadata of the pictures with a persistent
+// exiftool instance.
+func exiftoolReader(et *exif.Exiftool) fieldReader {
+	return func(from string) (map[string]interface{}, error) {
+		metas := et.ExtractMetadata(from)
+		if len(metas) != 1 {
+			return nil, fmt.Errorf("wrong metadata count (%v)", len(metas))
+		}
+		if metas[0].Err != nil {
+			return nil, metas[0].Err
+		}
+		return metas[0].Fields, nil
+	}
+}
+
+// readFields reads the metadata of a picture used by the watermark texts.
+func (m *watermarks) readFields(ctx context.Context, from string) (map[string]string, error) {
+	if m == nil || m.read == nil {
+		return nil, fmt.Errorf("exiftool is not started")
+	}
+	start := time.Now()
+	fields, err := m.read(from)
+	metrics.Get(ctx).ToolRan("exiftool", time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("error while reading watermark fields of %v: %w", from, err)
+	}
+	values := map[string]string{}
+	for k, v := range fields {
+		values[k] = fmt.Sprint(v)
+	}
+	for _, d := range dateFields {
+		if v := values[d]; len(v) >= 4 && values[yearField] == "" {
+			values[yearField] = v[0:4]
+		}
+	}
+	return values, nil
+}
+
+// resolveWatermarks replaces the placeholders of the watermark texts by the
+// metadata of the picture. Missing fields are replaced by empty strings.
+func resolveWatermarks(ctx context.Context, m *watermarks, from string, targets []target) error {
+	values := map[string]string{}
+	if fields := placeholders(targets); len(fields) > 0 {
+		var err error
+		if values, err = m.readFields(ctx, from); err != nil {
+			return err
+		}
+	}
+	for i, t := range targets {
+		if t.Watermark == nil || t.Watermark.Text == "" {
+			continue
+		}
+		text := placeholderRegexp.ReplaceAllStringFunc(t.Watermark.Text, func(p string) string {
+			return values[placeholderRegexp.FindStringSubmatch(p)[1]]
+		})
+		targets[i].watermarkText = strings.TrimSpace(strings.Join(strings.Fields(text), " "))
+	}
+	return nil
+}
+
+// renderText renders a text in white, on a transparent background.
+func renderText(f *opentype.Font, text string) (image.Image, error) {
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: referenceFontSize, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("error while creating font face: %w", err)
+	}
+	defer face.Close()
+	m := face.Metrics()
+	w := font.MeasureString(face, text).Ceil()
+	h := (m.Ascent + m.Descent).Ceil()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	d := font.Drawer{Dst: img, Src: image.White, Face: face, Dot: fixed.Point26_6{Y: m.Ascent}}
+	d.DrawString(text)
+	return img, nil
+}
+
+// markImage returns the watermark of a target, sized for a rendition of the
+// given dimensions, its opacity being applied.
+func markImage(t target, width int, height int) (image.Image, error) {
+	w := *t.Watermark
+	var src image.Image
+	switch {
+	case w.Image != "":
+		if src = t.marks.logo(w.Image); src == nil {
+			return nil, fmt.Errorf("watermark %v is not loaded", w.Image)
+		}
+	case t.watermarkText == "":
+		return nil, nil
+	case t.marks == nil || t.marks.font == nil:
+		return nil, fmt.Errorf("watermark font is not loaded")
+	default:
+		var err error
+		if src, err = renderText(t.marks.font, t.watermarkText); err != nil {
+			return nil, err
+		}
+	}
+	b := src.Bounds()
+	mw := int(math.Round(float64(width) * w.scale()))
+	mh := int(math.Round(float64(b.Dy()) * float64(mw) / float64(b.Dx())))
+	if maxH := height - 2*int(float64(height)*w.margin()); mh > maxH {
+		mw, mh = int(math.Round(float64(mw)*float64(maxH)/float64(mh))), maxH
+	}
+	if mw <= 0 || mh <= 0 {
+		return nil, nil
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, mw, mh))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, b, draw.Src, nil)
+	mark := image.NewRGBA(scaled.Bounds())
+	draw.DrawMask(mark, mark.Bounds(), scaled, image.Point{}, image.NewUniform(color.Alpha{A: uint8(math.Round(w.opacity() * 255))}), image.Point{}, draw.Src)
+	return mark, nil
+}
+
+// markOffset returns the position of the watermark in the rendition.
+func markOffset(w Watermark, width int, height int, mark image.Rectangle) image.Point {
+	mx := int(float64(width) * w.margin())
+	my := int(float64(height) * w.margin())
+	x := (width - mark.Dx()) / 2
+	y := (height - mark.Dy()) / 2
+	p := w.position()
+	switch {
+	case strings.HasSuffix(p, "west"):
+		x = mx
+	case strings.HasSuffix(p, "east"):
+		x = width - mark.Dx() - mx
+	}
+	switch {
+	case strings.HasPrefix(p, "north"):
+		y = my
+	case strings.HasPrefix(p, "south"):
+		y = height - mark.Dy() - my
+	}
+	return image.Point{X: x, Y: y}
+}
+
+// drawWatermark draws the watermark of a target on a picture.
+func drawWatermark(img image.Image, t target) (image.Image, error) {
+	if t.Watermark == nil {
+		return img, nil
+	}
+	b := img.Bounds()
+	mark, err := markImage(t, b.Dx(), b.Dy())
+	if err != nil || mark == nil {
+		return img, err
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	o := markOffset(*t.Watermark, b.Dx(), b.Dy(), mark.Bounds())
+	draw.Draw(dst, mark.Bounds().Add(o), mark, image.Point{}, draw.Over)
+	return dst, nil
+}
+
+// watermarked returns true if a target has a watermark.
+func watermarked(targets []target) bool {
+	for _, t := range targets {
+		if t.Watermark != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceDimensions reads the dimensions of a picture with identify, once
+// oriented according to its EXIF orientation.
+func sourceDimensions(ctx context.Context, src string) (int, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, watermarkTimeout)
+	defer cancel()
+	out := strings.Builder{}
+	cmd := command{name: "identify", args: []string{"-ping", "-format", "%w %h %[orientation]\n", safePath(src)}}
+	if _, err := runPipeline(ctx, &out, cmd); err != nil {
+		return 0, 0, fmt.Errorf("error while reading dimensions of %v: %w", src, err)
+	}
+	var w, h int
+	var o string
+	// the first frame is used
+	line := strings.SplitN(out.String(), "\n", 2)[0]
+	if n, _ := fmt.Sscan(line, &w, &h, &o); n < 2 || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("error while parsing dimensions of %v (%v)", src, out.String())
+	}
+	switch o {
+	case "LeftTop", "RightTop", "RightBottom", "LeftBottom":
+		w, h = h, w
+	}
+	return w, h, nil
+}
+
+// renditionDimensions returns the dimensions of a target produced by convert
+// from a source of the given dimensions.
+func renditionDimensions(t target, width int, height int) (int, int) {
+	if t.fill() {
+		return t.Width, t.Height
+	}
+	sx := float64(t.Width) / float64(width)
+	sy := float64(t.Height) / float64(height)
+	if sx <= sy {
+		return t.Width, int(math.Max(1, math.Round(float64(height)*sx)))
+	}
+	return int(math.Max(1, math.Round(float64(width)*sy))), t.Height
+}
+
+// writeMark writes a watermark in a PNG file of outDir.
+func writeMark(outDir string, mark image.Image) (string, error) {
+	f, err := os.CreateTemp(outDir, "picdexer-watermark-*.png")
+	if err != nil {
+		return "", fmt.Errorf("error while creating watermark file: %w", err)
+	}
+	if err := png.Encode(f, mark); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error while encoding watermark: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error while writing watermark: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// prepareWatermarks renders the watermarks of the targets produced by convert
+// from src : they are written in files of outDir and composited while the
+// renditions are produced, so that each rendition is encoded once. The
+// returned targets reference the watermark files, release removes them.
+func prepareWatermarks(ctx context.Context, src string, outDir string, targets []target) ([]target, func(), error) {
+	marked := make([]target, len(targets))
+	copy(marked, targets)
+	files := []string{}
+	release := func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}
+	width, height := 0, 0
+	for i, t := range marked {
+		if t.Watermark == nil {
+			continue
+		}
+		if width == 0 {
+			var err error
+			if width, height, err = sourceDimensions(ctx, src); err != nil {
+				release()
+				return nil, nil, err
+			}
+		}
+		rw, rh := renditionDimensions(t, width, height)
+		mark, err := markImage(t, rw, rh)
+		if err != nil {
+			release()
+			return nil, nil, fmt.Errorf("error while rendering %v watermark: %w", t.Name, err)
+		}
+		if mark == nil {
+			continue
+		}
+		f, err := writeMark(outDir, mark)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		files = append(files, f)
+		marked[i].markFile = f
+		marked[i].markOffset = markOffset(*t.Watermark, rw, rh, mark.Bounds())
+	}
+	return marked, release, nil
+}
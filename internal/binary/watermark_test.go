@@ -0,0 +1,384 @@
+package binary
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePng(t *testing.T, f string, w int, h int, c color.Color) {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	out, err := os.Create(f)
+	assert.Nil(t, err)
+	assert.Nil(t, png.Encode(out, img))
+	assert.Nil(t, out.Close())
+}
+
+func TestWatermark_Validate(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logo := filepath.Join(dir, "logo.png")
+	writePng(t, logo, 20, 10, color.White)
+
+	var tcs = []struct {
+		tcID        string
+		inWatermark Watermark
+		expOk       bool
+	}{
+		{"text", Watermark{Text: "© {{Artist}}"}, true},
+		{"image", Watermark{Image: logo, Position: "NorthWest", Opacity: 1, Margin: 0.1, Scale: 1}, true},
+		{"none", Watermark{}, false},
+		{"both", Watermark{Text: "a", Image: logo}, false},
+		{"nonExistingImage", Watermark{Image: filepath.Join(dir, "nonExisting.png")}, false},
+		{"nonPngImage", Watermark{Image: "../../testdata/picture.jpg"}, false},
+		{"wrongPosition", Watermark{Text: "a", Position: "top"}, false},
+		{"wrongOpacity", Watermark{Text: "a", Opacity: 1.5}, false},
+		{"wrongMargin", Watermark{Text: "a", Margin: 0.5}, false},
+		{"wrongScale", Watermark{Text: "a", Scale: 2}, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			r := Rendition{Name: "r", Width: 10, Height: 10, Watermark: &tc.inWatermark}
+			err := validateRenditions([]Rendition{r})
+			if err == nil {
+				_, err = loadWatermarks([]Rendition{r})
+			}
+			assert.Equal(t, tc.expOk, err == nil)
+		})
+	}
+}
+
+func TestLoadWatermarks(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logo := filepath.Join(dir, "logo.png")
+	writePng(t, logo, 20, 10, color.White)
+
+	m, err := loadWatermarks([]Rendition{{Name: "a", Watermark: &Watermark{Image: logo}}, {Name: "b", Watermark: &Watermark{Image: logo, Scale: 1}}, {Name: "c"}})
+	assert.Nil(t, err)
+	assert.Len(t, m.logos, 1)
+	assert.NotNil(t, m.logo(logo))
+	assert.Nil(t, m.font)
+
+	m, err = loadWatermarks([]Rendition{{Name: "a", Watermark: &Watermark{Text: "a"}}})
+	assert.Nil(t, err)
+	assert.Empty(t, m.logos)
+	assert.NotNil(t, m.font)
+}
+
+// loadTarget loads the watermark resources of a target.
+func loadTarget(t *testing.T, tgt target) target {
+	m, err := loadWatermarks([]Rendition{tgt.Rendition})
+	assert.Nil(t, err)
+	tgt.marks = m
+	return tgt
+}
+
+func TestMarkOffset(t *testing.T) {
+	var tcs = []struct {
+		inPosition string
+		expPoint   image.Point
+	}{
+		{"", image.Point{X: 170, Y: 38}},
+		{PositionNorthWest, image.Point{X: 10, Y: 2}},
+		{PositionNorth, image.Point{X: 90, Y: 2}},
+		{PositionNorthEast, image.Point{X: 170, Y: 2}},
+		{PositionWest, image.Point{X: 10, Y: 20}},
+		{PositionCenter, image.Point{X: 90, Y: 20}},
+		{PositionEast, image.Point{X: 170, Y: 20}},
+		{PositionSouthWest, image.Point{X: 10, Y: 38}},
+		{PositionSouth, image.Point{X: 90, Y: 38}},
+		{PositionSouthEast, image.Point{X: 170, Y: 38}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.inPosition, func(t *testing.T) {
+			w := Watermark{Text: "a", Position: tc.inPosition, Margin: 0.05}
+			assert.Equal(t, tc.expPoint, markOffset(w, 200, 50, image.Rect(0, 0, 20, 10)))
+		})
+	}
+}
+
+func TestMarkImage(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logo := filepath.Join(dir, "logo.png")
+	writePng(t, logo, 40, 20, color.White)
+
+	var tcs = []struct {
+		tcID       string
+		inTarget   target
+		inW, inH   int
+		expW, expH int
+	}{
+		{"logo", target{Rendition: Rendition{Watermark: &Watermark{Image: logo, Scale: 0.5}}}, 200, 100, 100, 50},
+		{"logoDefaultScale", target{Rendition: Rendition{Watermark: &Watermark{Image: logo}}}, 200, 100, 40, 20},
+		{"logoTooHigh", target{Rendition: Rendition{Watermark: &Watermark{Image: logo, Scale: 1, Margin: 0.1}}}, 200, 50, 80, 40},
+		{"emptyText", target{Rendition: Rendition{Watermark: &Watermark{Text: "{{Artist}}"}}}, 200, 100, 0, 0},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			mark, err := markImage(loadTarget(t, tc.inTarget), tc.inW, tc.inH)
+			assert.Nil(t, err)
+			if tc.expW == 0 {
+				assert.Nil(t, mark)
+				return
+			}
+			assert.Equal(t, tc.expW, mark.Bounds().Dx())
+			assert.Equal(t, tc.expH, mark.Bounds().Dy())
+			_, _, _, a := mark.At(tc.expW/2, tc.expH/2).RGBA()
+			assert.InDelta(t, 0.5*0xffff, a, 0x200)
+		})
+	}
+}
+
+func TestMarkImage_Text(t *testing.T) {
+	tgt := target{Rendition: Rendition{Watermark: &Watermark{Text: "©", Opacity: 1, Scale: 0.5}}, watermarkText: "© picdexer"}
+	mark, err := markImage(loadTarget(t, tgt), 400, 300)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, mark.Bounds().Dx())
+	assert.True(t, mark.Bounds().Dy() > 0 && mark.Bounds().Dy() < 100)
+	opaque := false
+	for x := 0; x < mark.Bounds().Dx() && !opaque; x++ {
+		for y := 0; y < mark.Bounds().Dy() && !opaque; y++ {
+			_, _, _, a := mark.At(x, y).RGBA()
+			opaque = a == 0xffff
+		}
+	}
+	assert.True(t, opaque)
+}
+
+func TestResolveWatermarks(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		inFields map[string]interface{}
+		inErr    error
+		inText   string
+		expError bool
+		expText  string
+	}{
+		{"fields", map[string]interface{}{"SourceFile": "a.jpg", "Artist": "Bob", "DateTimeOriginal": "2021:10:03 10:12:00"}, nil, "© {{Artist}} {{ Year }}", false, "© Bob 2021"},
+		{"createDate", map[string]interface{}{"CreateDate": "2019:01:01 00:00:00"}, nil, "{{Year}}", false, "2019"},
+		{"number", map[string]interface{}{"ISO": float64(100)}, nil, "ISO {{ISO}}", false, "ISO 100"},
+		{"missing", map[string]interface{}{"SourceFile": "a.jpg"}, nil, "© {{Artist}} {{Year}}", false, "©"},
+		{"noPlaceholder", nil, fmt.Errorf("error"), "© picdexer", false, "© picdexer"},
+		{"exiftoolError", nil, fmt.Errorf("error"), "© {{Artist}}", true, ""},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			read := 0
+			m := &watermarks{read: func(from string) (map[string]interface{}, error) {
+				read++
+				assert.Equal(t, "a.jpg", from)
+				return tc.inFields, tc.inErr
+			}}
+			targets := []target{
+				{Rendition: Rendition{Name: "marked", Watermark: &Watermark{Text: tc.inText}}},
+				{Rendition: Rendition{Name: "unmarked"}},
+			}
+			err := resolveWatermarks(context.TODO(), m, "a.jpg", targets)
+			assert.Equal(t, tc.expError, err != nil)
+			if !tc.expError {
+				assert.Equal(t, tc.expText, targets[0].watermarkText)
+				assert.Equal(t, "", targets[1].watermarkText)
+			}
+			// the fields are only read if a placeholder is used
+			assert.Equal(t, tc.inErr == nil || tc.expError, read == 1)
+		})
+	}
+
+	// exiftool is not started
+	targets := []target{{Rendition: Rendition{Name: "marked", Watermark: &Watermark{Text: "{{Artist}}"}}}}
+	assert.NotNil(t, resolveWatermarks(context.TODO(), &watermarks{}, "a.jpg", targets))
+}
+
+func TestLoadWatermarks_Exiftool(t *testing.T) {
+	m, err := loadWatermarks([]Rendition{{Name: "r", Watermark: &Watermark{Text: "© picdexer"}}})
+	assert.Nil(t, err)
+	assert.Nil(t, m.exif)
+	assert.Nil(t, m.close())
+
+	m, err = loadWatermarks([]Rendition{{Name: "r", Watermark: &Watermark{Text: "© {{Artist}}"}}})
+	assert.Nil(t, err)
+	assert.NotNil(t, m.exif)
+	assert.NotNil(t, m.read)
+	assert.Nil(t, m.close())
+}
+
+func TestGoResizer_Watermark(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logo := filepath.Join(dir, "logo.png")
+	writePng(t, logo, 20, 20, color.White)
+	inFile := filepath.Join(dir, "in.png")
+	writePng(t, inFile, 200, 100, color.Black)
+
+	outFile := filepath.Join(dir, "out.png")
+	r, err := NewGoResizer("")
+	assert.Nil(t, err)
+	w := Watermark{Image: logo, Position: PositionNorthWest, Opacity: 1, Scale: 0.5}
+	targets := []target{loadTarget(t, target{Rendition: Rendition{Name: "r", Width: 100, Height: 100, Format: FormatPng, Watermark: &w}, path: outFile})}
+	_, err = r.resize(context.TODO(), inFile, targets)
+	assert.Nil(t, err)
+
+	img, err := decodeImage(outFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, img.Bounds().Dx())
+	r1, _, _, _ := img.At(10, 10).RGBA()
+	assert.Equal(t, uint32(0xffff), r1)
+	r2, _, _, _ := img.At(90, 40).RGBA()
+	assert.Equal(t, uint32(0), r2)
+}
+
+func TestSourceDimensions(t *testing.T) {
+	var tcs = []struct {
+		tcID      string
+		inScript  string
+		expError  bool
+		expWidth  int
+		expHeight int
+	}{
+		{"nominal", `printf '200 100 TopLeft\n'`, false, 200, 100},
+		{"rotated", `printf '200 100 RightTop\n'`, false, 100, 200},
+		{"noOrientation", `printf '200 100 \n'`, false, 200, 100},
+		{"frames", `printf '200 100 Undefined\n50 25 Undefined\n'`, false, 200, 100},
+		{"wrongOutput", "echo blabla", true, 0, 0},
+		{"failure", "exit 1", true, 0, 0},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			defer fakeCommands(t, map[string]string{"identify": tc.inScript})()
+			w, h, err := sourceDimensions(context.TODO(), "a.jpg")
+			assert.Equal(t, tc.expError, err != nil)
+			assert.Equal(t, tc.expWidth, w)
+			assert.Equal(t, tc.expHeight, h)
+		})
+	}
+}
+
+func TestRenditionDimensions(t *testing.T) {
+	var tcs = []struct {
+		tcID      string
+		inRend    Rendition
+		inWidth   int
+		inHeight  int
+		expWidth  int
+		expHeight int
+	}{
+		{"landscape", Rendition{Width: 100, Height: 100}, 400, 200, 100, 50},
+		{"portrait", Rendition{Width: 100, Height: 100}, 200, 400, 50, 100},
+		{"enlarged", Rendition{Width: 100, Height: 100}, 20, 10, 100, 50},
+		{"fill", Rendition{Width: 100, Height: 60, Crop: CropFill}, 200, 400, 100, 60},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			w, h := renditionDimensions(target{Rendition: tc.inRend}, tc.inWidth, tc.inHeight)
+			assert.Equal(t, tc.expWidth, w)
+			assert.Equal(t, tc.expHeight, h)
+		})
+	}
+}
+
+func TestPrepareWatermarks(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logo := filepath.Join(dir, "logo.png")
+	writePng(t, logo, 20, 10, color.White)
+	defer fakeCommands(t, map[string]string{"identify": `printf '400 200 TopLeft\n'`})()
+
+	targets := []target{
+		loadTarget(t, target{Rendition: Rendition{Name: "marked", Width: 200, Height: 200, Watermark: &Watermark{Image: logo, Margin: 0.1}}}),
+		{Rendition: Rendition{Name: "unmarked", Width: 100, Height: 100}},
+	}
+	marked, release, err := prepareWatermarks(context.TODO(), "a.jpg", dir, targets)
+	assert.Nil(t, err)
+	// the targets are not modified
+	assert.Empty(t, targets[0].markFile)
+	assert.Empty(t, marked[1].markFile)
+	// rendition of 200x100, watermark of 40x20
+	assert.Equal(t, image.Point{X: 140, Y: 70}, marked[0].markOffset)
+	w, h, err := decodeDimensions(marked[0].markFile)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{40, 20}, []int{w, h})
+	release()
+	files, err := filepath.Glob(filepath.Join(dir, "picdexer-watermark-*"))
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+
+	// the watermarks can't be rendered without the source dimensions
+	defer fakeCommands(t, map[string]string{"identify": "exit 1"})()
+	_, _, err = prepareWatermarks(context.TODO(), "a.jpg", dir, targets)
+	assert.NotNil(t, err)
+}
+
+func TestResizer_Watermark(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	logo := filepath.Join(dir, "logo.png")
+	writePng(t, logo, 20, 10, color.White)
+	argsFile := filepath.Join(dir, "args")
+
+	var tcs = []struct {
+		tcID        string
+		inFrom      string
+		inWatermark bool
+		expSource   string
+		expComposed bool
+	}{
+		{"convert", "a.jpg", true, "a.jpg", true},
+		{"preview", "a.nef", true, filepath.Join(dir, "picdexer-source-"), true},
+		{"previewWithoutWatermark", "a.nef", false, "-", false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			defer fakeCommands(t, map[string]string{
+				"identify": `printf '400 200 TopLeft\n'`,
+				"exiftool": "echo preview",
+				"convert":  `echo "$@" > ` + argsFile + `; test "$1" = "-" || grep -q preview "$1" || test "$1" = a.jpg`,
+			})()
+			rend := Rendition{Name: "r", Width: 200, Height: 200}
+			if tc.inWatermark {
+				rend.Watermark = &Watermark{Image: logo}
+			}
+			r := NewResizer([]string{"nef"}, "", 0)
+			_, err := r.resize(context.TODO(), tc.inFrom, []target{loadTarget(t, target{Rendition: rend, path: filepath.Join(dir, "out.jpg")})})
+			assert.Nil(t, err)
+
+			b, err := os.ReadFile(argsFile)
+			assert.Nil(t, err)
+			args := strings.Fields(string(b))
+			assert.True(t, strings.HasPrefix(args[0], tc.expSource), args[0])
+			assert.Equal(t, tc.expComposed, strings.Contains(string(b), "-composite"))
+			// each rendition is encoded once
+			assert.Equal(t, "jpeg:"+filepath.Join(dir, "out.jpg"), args[len(args)-1])
+			files, err := filepath.Glob(filepath.Join(dir, "picdexer-*"))
+			assert.Nil(t, err)
+			assert.Empty(t, files)
+		})
+	}
+}
@@ -2,8 +2,10 @@ package browse
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/barasher/picdexer/internal/common"
+	"github.com/barasher/picdexer/internal/ratelimit"
 	"github.com/rs/zerolog/log"
 	"os"
 	"path/filepath"
@@ -15,23 +17,41 @@ type Task struct {
 	FileID string
 }
 
+var errStopped = errors.New("browsing stopped")
+
 type Browser struct{}
 
+// Browse sends the pictures found in the folders, at the pace allowed by the
+// limits of the context. Browsing stops, without error, when a shutdown is
+// requested.
 func (*Browser) Browse(ctx context.Context, dirList []string, outFileChan chan Task) error {
 	defer close(outFileChan)
 	for _, curDir := range dirList {
 		err := filepath.Walk(curDir, func(path string, info os.FileInfo, err error) error {
+			if common.IsStopping(ctx) || ctx.Err() != nil {
+				return errStopped
+			}
 			if err != nil {
 				return err
 			}
 			if !info.IsDir() {
 				if isPic, key, err := common.CategorizePicture(path); err == nil {
 					if isPic {
-						outFileChan <- Task{
+						if err := ratelimit.Get(ctx).WaitFile(ctx); err != nil {
+							return errStopped
+						}
+						t := Task{
 							Path:   path,
 							Info:   info,
 							FileID: key,
 						}
+						select {
+						case outFileChan <- t:
+						case <-common.Stopping(ctx):
+							return errStopped
+						case <-ctx.Done():
+							return errStopped
+						}
 					}
 				} else {
 					log.Warn().Str(common.LogFileIdentifier, path).Msgf("%v", err)
@@ -39,6 +59,10 @@ func (*Browser) Browse(ctx context.Context, dirList []string, outFileChan chan T
 			}
 			return nil
 		})
+		if errors.Is(err, errStopped) {
+			log.Warn().Msg("Browsing stopped")
+			return nil
+		}
 		if err != nil {
 			return fmt.Errorf("error while browsing %v: %w", curDir, err)
 		}
@@ -2,8 +2,13 @@ package browse
 
 import (
 	"context"
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/barasher/picdexer/internal/ratelimit"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestBrowse(t *testing.T) {
@@ -19,3 +24,44 @@ func TestBrowse(t *testing.T) {
 	assert.Equal(t, 1, len(files))
 	assert.Equal(t, "../../testdata/picture.jpg", files[0])
 }
+
+func TestBrowse_Limited(t *testing.T) {
+	l, err := ratelimit.NewLimits(ratelimit.Settings{FilesPerSecond: 2})
+	assert.Nil(t, err)
+	ctx := ratelimit.WithLimits(context.Background(), l)
+	taskChan := make(chan Task, 10)
+	start := time.Now()
+	b := &Browser{}
+	assert.Nil(t, b.Browse(ctx, []string{"../../testdata", "../../testdata", "../../testdata"}, taskChan))
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+	assert.Equal(t, 3, len(taskChan))
+}
+
+func TestBrowse_Stopping(t *testing.T) {
+	ctx, release := common.WithShutdown(context.Background(), time.Hour, syscall.SIGUSR1)
+	defer release()
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	for !common.IsStopping(ctx) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	taskChan := make(chan Task, 10)
+	b := &Browser{}
+	assert.Nil(t, b.Browse(ctx, []string{"../../testdata"}, taskChan))
+	_, ok := <-taskChan
+	assert.False(t, ok)
+}
+
+func TestBrowse_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	taskChan := make(chan Task)
+	res := make(chan error)
+	go func() {
+		b := &Browser{}
+		res <- b.Browse(ctx, []string{"../../testdata"}, taskChan)
+	}()
+	// nobody reads the tasks
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.Nil(t, <-res)
+}
@@ -0,0 +1,192 @@
+package checkpoint
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/rs/zerolog/log"
+)
+
+type Stage string
+
+const (
+	StageExtracted Stage = "extracted"
+	StageIndexed   Stage = "indexed"
+	StageStored    Stage = "stored"
+
+	journalFilePattern = "picdexer_%v.checkpoint"
+)
+
+var Stages = []Stage{StageExtracted, StageIndexed, StageStored}
+
+type entry struct {
+	ImportID string    `json:"importId"`
+	FileID   string    `json:"fileId"`
+	Path     string    `json:"path,omitempty"`
+	Stage    Stage     `json:"stage"`
+	Time     time.Time `json:"time"`
+}
+
+// Report describes a resumed run : the stages skipped because they were
+// completed by a previous run, and the stages completed by this run that
+// were not completed before.
+type Report struct {
+	Resumed   bool
+	Skipped   map[Stage]int
+	Completed map[Stage]int
+}
+
+type Journal struct {
+	importID  string
+	path      string
+	mu        sync.Mutex
+	file      *os.File
+	encoder   *json.Encoder
+	previous  map[string]map[Stage]bool
+	completed map[string]map[Stage]bool
+	report    Report
+}
+
+func journalPath(dir string, importID string) string {
+	return filepath.Join(dir, fmt.Sprintf(journalFilePattern, importID))
+}
+
+// Open opens the checkpoint journal of an import. When resume is true, the
+// completed stages recorded by previous runs are loaded, otherwise the
+// journal is truncated.
+func Open(dir string, importID string, resume bool) (*Journal, error) {
+	if importID == "" {
+		return nil, fmt.Errorf("import identifier can't be empty")
+	}
+	j := &Journal{
+		importID:  importID,
+		path:      journalPath(dir, importID),
+		previous:  make(map[string]map[Stage]bool),
+		completed: make(map[string]map[Stage]bool),
+		report: Report{
+			Resumed:   resume,
+			Skipped:   make(map[Stage]int),
+			Completed: make(map[Stage]int),
+		},
+	}
+
+	var f *os.File
+	var err error
+	if resume {
+		if err := j.load(); err != nil {
+			return nil, err
+		}
+		// the last entry may have been truncated by a killed run
+		f, err = common.OpenAppend(j.path)
+	} else {
+		f, err = os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while opening checkpoint journal %v: %w", j.path, err)
+	}
+	j.file = f
+	j.encoder = json.NewEncoder(f)
+	log.Debug().Msgf("Checkpoint journal: %v", j.path)
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("no checkpoint journal found for import %v (%v)", j.importID, j.path)
+		}
+		return fmt.Errorf("error while opening checkpoint journal %v: %w", j.path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		e := entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// the last line can be truncated if the previous run was killed
+			log.Warn().Msgf("Ignoring unparsable checkpoint entry (%v, line %v): %v", j.path, line, err)
+			continue
+		}
+		if _, found := j.previous[e.FileID]; !found {
+			j.previous[e.FileID] = make(map[Stage]bool)
+		}
+		j.previous[e.FileID][e.Stage] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error while reading checkpoint journal %v: %w", j.path, err)
+	}
+	return nil
+}
+
+// IsDone returns true if the stage has been completed for the file by a
+// previous run. Each positive answer is counted as a skipped stage.
+func (j *Journal) IsDone(fileID string, s Stage) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	done := j.previous[fileID][s]
+	if done {
+		j.report.Skipped[s]++
+	}
+	return done
+}
+
+// Mark records that the stage is completed for the file.
+func (j *Journal) Mark(fileID string, path string, s Stage) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.previous[fileID][s] && !j.completed[fileID][s] {
+		if _, found := j.completed[fileID]; !found {
+			j.completed[fileID] = make(map[Stage]bool)
+		}
+		j.completed[fileID][s] = true
+		j.report.Completed[s]++
+	}
+	e := entry{
+		ImportID: j.importID,
+		FileID:   fileID,
+		Path:     path,
+		Stage:    s,
+		Time:     time.Now(),
+	}
+	if err := j.encoder.Encode(e); err != nil {
+		return fmt.Errorf("error while writing checkpoint entry: %w", err)
+	}
+	return nil
+}
+
+// Report returns the skipped and completed stages counters.
+func (j *Journal) Report() Report {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	r := Report{
+		Resumed:   j.report.Resumed,
+		Skipped:   make(map[Stage]int),
+		Completed: make(map[Stage]int),
+	}
+	for k, v := range j.report.Skipped {
+		r.Skipped[k] = v
+	}
+	for k, v := range j.report.Completed {
+		r.Completed[k] = v
+	}
+	return r
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
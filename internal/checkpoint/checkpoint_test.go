@@ -0,0 +1,91 @@
+package checkpoint
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpen_EmptyImportID(t *testing.T) {
+	_, err := Open(os.TempDir(), "", false)
+	assert.NotNil(t, err)
+}
+
+func TestOpen_ResumeWithoutJournal(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = Open(dir, "imp", true)
+	assert.NotNil(t, err)
+}
+
+func TestJournal_Resume(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	j, err := Open(dir, "imp", false)
+	assert.Nil(t, err)
+	assert.Nil(t, j.Mark("id1", "/a/1.jpg", StageExtracted))
+	assert.Nil(t, j.Mark("id1", "/a/1.jpg", StageIndexed))
+	assert.Nil(t, j.Mark("id2", "/a/2.jpg", StageExtracted))
+	assert.Nil(t, j.Mark("id2", "/a/2.jpg", StageStored))
+	assert.False(t, j.IsDone("id1", StageIndexed))
+	assert.Nil(t, j.Close())
+
+	// simulate a run killed while writing
+	f, err := os.OpenFile(journalPath(dir, "imp"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteString(`{"fileId":"id3","sta`)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	j, err = Open(dir, "imp", true)
+	assert.Nil(t, err)
+	defer j.Close()
+	assert.True(t, j.IsDone("id1", StageIndexed))
+	assert.False(t, j.IsDone("id1", StageStored))
+	assert.False(t, j.IsDone("id2", StageIndexed))
+	assert.True(t, j.IsDone("id2", StageStored))
+	assert.False(t, j.IsDone("id3", StageIndexed))
+	assert.Nil(t, j.Mark("id4", "/a/4.jpg", StageExtracted))
+	assert.Nil(t, j.Mark("id2", "/a/2.jpg", StageExtracted))
+	assert.Nil(t, j.Mark("id2", "/a/2.jpg", StageIndexed))
+	assert.Nil(t, j.Mark("id2", "/a/2.jpg", StageIndexed))
+
+	r := j.Report()
+	assert.True(t, r.Resumed)
+	assert.Equal(t, map[Stage]int{StageIndexed: 1, StageStored: 1}, r.Skipped)
+	// id2 had already been extracted
+	assert.Equal(t, map[Stage]int{StageExtracted: 1, StageIndexed: 1}, r.Completed)
+	assert.Nil(t, j.Close())
+
+	// the entries appended after the truncated one are loaded
+	j, err = Open(dir, "imp", true)
+	assert.Nil(t, err)
+	defer j.Close()
+	assert.True(t, j.IsDone("id4", StageExtracted))
+	assert.True(t, j.IsDone("id2", StageIndexed))
+}
+
+func TestJournal_NoResumeTruncates(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	j, err := Open(dir, "imp", false)
+	assert.Nil(t, err)
+	assert.Nil(t, j.Mark("id1", "/a/1.jpg", StageIndexed))
+	assert.Nil(t, j.Close())
+
+	j, err = Open(dir, "imp", false)
+	assert.Nil(t, err)
+	assert.Nil(t, j.Close())
+
+	j, err = Open(dir, "imp", true)
+	assert.Nil(t, err)
+	defer j.Close()
+	assert.False(t, j.IsDone("id1", StageIndexed))
+}
@@ -61,3 +61,30 @@ func CategorizePicture(path string) (bool, string, error) {
 	}
 	return isPicture, h + "_" + f, nil
 }
+
+// OpenAppend opens (or creates) a file to append lines. If the last line is
+// truncated (the previous writer was killed), a new line is started : the
+// next line is not merged into it.
+func OpenAppend(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	last := make([]byte, 1)
+	if fi, err := f.Stat(); err != nil {
+		f.Close()
+		return nil, err
+	} else if fi.Size() > 0 {
+		if _, err := f.ReadAt(last, fi.Size()-1); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if last[0] != '\n' {
+			if _, err := f.Write([]byte{'\n'}); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+	return f, nil
+}
@@ -2,6 +2,8 @@ package common
 
 import (
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -85,3 +87,38 @@ func TestCategorizePicture(t *testing.T) {
 		})
 	}
 }
+
+func TestOpenAppend(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "lines")
+	var tcs = []struct {
+		tcID     string
+		inExists bool
+		inData   string
+		expData  string
+	}{
+		{"new", false, "", "l2\n"},
+		{"empty", true, "", "l2\n"},
+		{"complete", true, "l1\n", "l1\nl2\n"},
+		{"truncated", true, "l1", "l1\nl2\n"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			os.Remove(f)
+			if tc.inExists {
+				assert.Nil(t, os.WriteFile(f, []byte(tc.inData), 0644))
+			}
+			out, err := OpenAppend(f)
+			assert.Nil(t, err)
+			_, err = out.WriteString("l2\n")
+			assert.Nil(t, err)
+			assert.Nil(t, out.Close())
+			b, err := os.ReadFile(f)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expData, string(b))
+		})
+	}
+
+	_, err := OpenAppend(filepath.Join(f, "nonExisting", "lines"))
+	assert.NotNil(t, err)
+}
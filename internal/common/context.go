@@ -2,11 +2,20 @@ package common
 
 import (
 	"context"
+	"os"
+	"os/signal"
 	"strconv"
+	"sync"
 	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
-const importIdCtxKey = "impID"
+const (
+	importIdCtxKey = "impID"
+	resumeCtxKey   = "resume"
+	stopCtxKey     = "stop"
+)
 
 func NewContext(i string) context.Context {
 	impID := i
@@ -22,3 +31,78 @@ func GetImportID(ctx context.Context) string {
 	}
 	return ""
 }
+
+// WithResume flags the context as resuming a previously interrupted import.
+func WithResume(ctx context.Context) context.Context {
+	return context.WithValue(ctx, resumeCtxKey, true)
+}
+
+func IsResumed(ctx context.Context) bool {
+	if v := ctx.Value(resumeCtxKey); v != nil {
+		return v.(bool)
+	}
+	return false
+}
+
+// WithShutdown returns a context that handles the shutdown signals. At the
+// first signal, the context is flagged as stopping : no new work should be
+// started, the in-flight work being drained. The context is canceled when
+// the grace period expires or at the second signal. release stops handling
+// the signals and cancels the context.
+func WithShutdown(parent context.Context, grace time.Duration, signals ...os.Signal) (ctx context.Context, release func()) {
+	ctx, cancel := context.WithCancel(parent)
+	stopping := make(chan struct{})
+	ctx = context.WithValue(ctx, stopCtxKey, stopping)
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, signals...)
+	released := make(chan struct{})
+
+	go func() {
+		defer cancel()
+		select {
+		case s := <-sigs:
+			log.Warn().Msgf("%v received, stopping (grace period: %v)...", s, grace)
+			close(stopping)
+		case <-released:
+			return
+		case <-ctx.Done():
+			return
+		}
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			log.Warn().Msg("Grace period expired, interrupting...")
+		case s := <-sigs:
+			log.Warn().Msgf("%v received again, interrupting...", s)
+		case <-released:
+		}
+	}()
+
+	once := sync.Once{}
+	return ctx, func() {
+		once.Do(func() {
+			signal.Stop(sigs)
+			close(released)
+			cancel()
+		})
+	}
+}
+
+// Stopping returns a channel that is closed when a shutdown is requested,
+// nil (never closed) if the context doesn't handle the shutdown signals.
+func Stopping(ctx context.Context) <-chan struct{} {
+	if v := ctx.Value(stopCtxKey); v != nil {
+		return v.(chan struct{})
+	}
+	return nil
+}
+
+func IsStopping(ctx context.Context) bool {
+	select {
+	case <-Stopping(ctx):
+		return true
+	default:
+		return false
+	}
+}
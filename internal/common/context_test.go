@@ -3,7 +3,10 @@ package common
 import (
 	"context"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestBuildContextWithProvidedID(t *testing.T) {
@@ -29,3 +32,49 @@ func TestGetImportIDWithoutID(t *testing.T) {
 	ctx := context.Background()
 	assert.Equal(t, "", GetImportID(ctx))
 }
+
+func TestIsResumed(t *testing.T) {
+	ctx := NewContext("anID")
+	assert.False(t, IsResumed(ctx))
+	ctx = WithResume(ctx)
+	assert.True(t, IsResumed(ctx))
+	assert.Equal(t, "anID", GetImportID(ctx))
+}
+
+func TestWithShutdown(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inSignals  int
+		inGrace    time.Duration
+		expStopped bool
+		expDone    bool
+	}{
+		{"noSignal", 0, time.Hour, false, false},
+		{"signal", 1, time.Hour, true, false},
+		{"graceExpired", 1, 10 * time.Millisecond, true, true},
+		{"secondSignal", 2, time.Hour, true, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			ctx, release := WithShutdown(NewContext("imp"), tc.inGrace, syscall.SIGUSR1)
+			defer release()
+			assert.Equal(t, "imp", GetImportID(ctx))
+			for i := 0; i < tc.inSignals; i++ {
+				assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+				time.Sleep(50 * time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			assert.Equal(t, tc.expStopped, IsStopping(ctx))
+			assert.Equal(t, tc.expDone, ctx.Err() != nil)
+
+			release()
+			assert.NotNil(t, ctx.Err())
+		})
+	}
+}
+
+func TestStopping_WithoutShutdown(t *testing.T) {
+	assert.Nil(t, Stopping(context.Background()))
+	assert.False(t, IsStopping(context.Background()))
+}
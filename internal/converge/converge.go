@@ -0,0 +1,204 @@
+package converge
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/barasher/picdexer/internal/binary"
+	"github.com/barasher/picdexer/internal/metadata"
+)
+
+// Joiner holds the metadata of the pictures until their storage is done, so
+// that the storage results (stored files, resizing strategy, storage error)
+// are recorded in the documents.
+type Joiner struct {
+	mu            sync.Mutex
+	expected      map[string]int
+	results       chan binary.StoreResult
+	forgotten     chan string
+	done          chan struct{}
+	maxHeld       int
+	refs          func(fileID string) []metadata.RenditionRef
+	onInterrupted func(ids []string, err error)
+}
+
+// NewJoiner creates a Joiner holding up to maxHeld metadata (0 meaning
+// unlimited) : the metadata are not read any more until storage results
+// release some. refs returns the renditions of the pictures whose storage is
+// not expected (already stored for instance). onInterrupted is called with
+// the pictures held when the context is done, which are not forwarded.
+func NewJoiner(bufferSize int, maxHeld int, refs func(fileID string) []metadata.RenditionRef, onInterrupted func(ids []string, err error)) *Joiner {
+	return &Joiner{
+		expected:      make(map[string]int),
+		results:       make(chan binary.StoreResult, bufferSize),
+		forgotten:     make(chan string, bufferSize),
+		done:          make(chan struct{}),
+		maxHeld:       maxHeld,
+		refs:          refs,
+		onInterrupted: onInterrupted,
+	}
+}
+
+// Expect declares that the storage result of a picture has to be waited for.
+func (j *Joiner) Expect(fileID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.expected[fileID]++
+}
+
+func (j *Joiner) isExpected(fileID string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.expected[fileID] > 0
+}
+
+func (j *Joiner) consume(fileID string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.expected[fileID]--; j.expected[fileID] <= 0 {
+		delete(j.expected, fileID)
+	}
+}
+
+// Forget declares that the metadata of a picture whose storage result is
+// expected will never come (extraction failure, exclusion...) : its storage
+// result is not held. It is ignored if Join is over.
+func (j *Joiner) Forget(fileID string) {
+	select {
+	case j.forgotten <- fileID:
+	case <-j.done:
+	}
+}
+
+// Stored receives the storage result of a picture. It is dropped if Join is
+// over.
+func (j *Joiner) Stored(r binary.StoreResult) {
+	select {
+	case j.results <- r:
+	case <-j.done:
+	}
+}
+
+// CloseStored has to be called once all the storage results have been
+// received.
+func (j *Joiner) CloseStored() {
+	close(j.results)
+}
+
+// merge records a storage result in the metadata : the stored files, or the
+// error that prevented the storage.
+func merge(m metadata.PictureMetadata, r binary.StoreResult) metadata.PictureMetadata {
+	if r.Err != nil {
+		e := r.Err.Error()
+		m.StorageError = &e
+		return m
+	}
+	m.Renditions = r.Renditions
+	m.Archive = r.Archive
+	if r.Strategy != "" {
+		s := r.Strategy
+		m.ResizeStrategy = &s
+	}
+	return m
+}
+
+// Join forwards the metadata, completed by the storage results. The metadata
+// whose storage result never comes are forwarded when the storage is over.
+func (j *Joiner) Join(ctx context.Context, in chan metadata.PictureMetadata, out chan metadata.PictureMetadata) error {
+	defer close(out)
+	defer close(j.done)
+	pendingMeta := make(map[string][]metadata.PictureMetadata)
+	pendingRes := make(map[string][]binary.StoreResult)
+	held := 0
+	results := j.results
+	for in != nil || results != nil {
+		// the metadata are not read while too many are held
+		inChan := in
+		if j.maxHeld > 0 && held >= j.maxHeld {
+			inChan = nil
+		}
+		select {
+		case <-ctx.Done():
+			j.interrupted(pendingMeta)
+			return nil
+		case m, ok := <-inChan:
+			if !ok {
+				in = nil
+				continue
+			}
+			if !j.isExpected(m.FileID) {
+				if j.refs != nil {
+					m.Renditions = j.refs(m.FileID)
+				}
+				out <- m
+				continue
+			}
+			if res := pendingRes[m.FileID]; len(res) > 0 {
+				if pendingRes[m.FileID] = res[1:]; len(pendingRes[m.FileID]) == 0 {
+					delete(pendingRes, m.FileID)
+				}
+				j.consume(m.FileID)
+				out <- merge(m, res[0])
+				continue
+			}
+			if results == nil {
+				// the storage is over, no result can come
+				out <- m
+				continue
+			}
+			pendingMeta[m.FileID] = append(pendingMeta[m.FileID], m)
+			held++
+		case id := <-j.forgotten:
+			if res := pendingRes[id]; len(res) > 0 {
+				if pendingRes[id] = res[1:]; len(pendingRes[id]) == 0 {
+					delete(pendingRes, id)
+				}
+			}
+			// the result that has not come yet is dropped when received
+			j.consume(id)
+		case r, ok := <-results:
+			if !ok {
+				results = nil
+				for id, metas := range pendingMeta {
+					for _, m := range metas {
+						out <- m
+					}
+					delete(pendingMeta, id)
+				}
+				held = 0
+				continue
+			}
+			id := r.Task.FileID
+			if metas := pendingMeta[id]; len(metas) > 0 {
+				if pendingMeta[id] = metas[1:]; len(pendingMeta[id]) == 0 {
+					delete(pendingMeta, id)
+				}
+				held--
+				j.consume(id)
+				out <- merge(metas[0], r)
+				continue
+			}
+			if !j.isExpected(id) {
+				// the metadata of the picture will never come
+				continue
+			}
+			pendingRes[id] = append(pendingRes[id], r)
+		}
+	}
+	return nil
+}
+
+// interrupted reports the held metadata, which are not forwarded since the
+// following stages are stopped.
+func (j *Joiner) interrupted(pendingMeta map[string][]metadata.PictureMetadata) {
+	ids := []string{}
+	for id, metas := range pendingMeta {
+		for range metas {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 && j.onInterrupted != nil {
+		j.onInterrupted(ids, fmt.Errorf("interrupted while waiting for the storage result"))
+	}
+}
@@ -0,0 +1,203 @@
+package converge
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/barasher/picdexer/internal/binary"
+	"github.com/barasher/picdexer/internal/browse"
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func refs(fileID string) []metadata.RenditionRef {
+	return []metadata.RenditionRef{{Name: "computed", Key: fileID}}
+}
+
+func TestJoin(t *testing.T) {
+	j := NewJoiner(10, 0, refs, nil)
+	in := make(chan metadata.PictureMetadata, 10)
+	out := make(chan metadata.PictureMetadata, 10)
+
+	j.Expect("stored")
+	j.Expect("storedFirst")
+	j.Expect("failed")
+	j.Expect("neverStored")
+
+	// metadata before the storage result
+	in <- metadata.PictureMetadata{FileID: "stored"}
+	// storage result before the metadata
+	j.Stored(binary.StoreResult{Task: browse.Task{FileID: "storedFirst"}, Strategy: "go", Renditions: []metadata.RenditionRef{{Name: "r", Key: "k2"}}})
+	// storage not expected
+	in <- metadata.PictureMetadata{FileID: "notExpected"}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		j.Stored(binary.StoreResult{Task: browse.Task{FileID: "stored"}, Strategy: "convert", Renditions: []metadata.RenditionRef{{Name: "r", Key: "k1"}}, Archive: &metadata.ArchiveRef{Key: "a1", Sha256: "a1"}})
+		in <- metadata.PictureMetadata{FileID: "storedFirst"}
+		in <- metadata.PictureMetadata{FileID: "failed"}
+		in <- metadata.PictureMetadata{FileID: "neverStored"}
+		j.Stored(binary.StoreResult{Task: browse.Task{FileID: "failed"}, Err: fmt.Errorf("error")})
+		close(in)
+		j.CloseStored()
+	}()
+
+	assert.Nil(t, j.Join(context.TODO(), in, out))
+	got := map[string]metadata.PictureMetadata{}
+	ids := []string{}
+	for m := range out {
+		got[m.FileID] = m
+		ids = append(ids, m.FileID)
+	}
+	sort.Strings(ids)
+	assert.Equal(t, []string{"failed", "neverStored", "notExpected", "stored", "storedFirst"}, ids)
+	assert.Equal(t, metadata.PictureMetadata{FileID: "stored", Renditions: []metadata.RenditionRef{{Name: "r", Key: "k1"}}, ResizeStrategy: strPtr("convert"), Archive: &metadata.ArchiveRef{Key: "a1", Sha256: "a1"}}, got["stored"])
+	assert.Equal(t, metadata.PictureMetadata{FileID: "storedFirst", Renditions: []metadata.RenditionRef{{Name: "r", Key: "k2"}}, ResizeStrategy: strPtr("go")}, got["storedFirst"])
+	assert.Equal(t, metadata.PictureMetadata{FileID: "notExpected", Renditions: refs("notExpected")}, got["notExpected"])
+	assert.Equal(t, metadata.PictureMetadata{FileID: "failed", StorageError: strPtr("error")}, got["failed"])
+	assert.Equal(t, metadata.PictureMetadata{FileID: "neverStored"}, got["neverStored"])
+}
+
+func TestJoin_Duplicates(t *testing.T) {
+	j := NewJoiner(10, 0, nil, nil)
+	in := make(chan metadata.PictureMetadata, 10)
+	out := make(chan metadata.PictureMetadata, 10)
+
+	j.Expect("id")
+	j.Expect("id")
+	in <- metadata.PictureMetadata{FileID: "id", Folder: "f1"}
+	in <- metadata.PictureMetadata{FileID: "id", Folder: "f2"}
+	close(in)
+	j.Stored(binary.StoreResult{Task: browse.Task{FileID: "id"}, Strategy: "s1"})
+	j.Stored(binary.StoreResult{Task: browse.Task{FileID: "id"}, Strategy: "s2"})
+	j.CloseStored()
+
+	assert.Nil(t, j.Join(context.TODO(), in, out))
+	strategies := []string{}
+	for m := range out {
+		assert.NotNil(t, m.ResizeStrategy)
+		strategies = append(strategies, *m.ResizeStrategy)
+	}
+	assert.ElementsMatch(t, []string{"s1", "s2"}, strategies)
+}
+
+func TestJoin_Canceled(t *testing.T) {
+	j := NewJoiner(0, 0, nil, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	out := make(chan metadata.PictureMetadata)
+	assert.Nil(t, j.Join(ctx, make(chan metadata.PictureMetadata), out))
+	_, ok := <-out
+	assert.False(t, ok)
+	// storage results are dropped once the join is over
+	j.Stored(binary.StoreResult{})
+}
+
+func TestJoin_MaxHeld(t *testing.T) {
+	j := NewJoiner(10, 1, nil, nil)
+	in := make(chan metadata.PictureMetadata, 2)
+	out := make(chan metadata.PictureMetadata, 2)
+	j.Expect("id1")
+	j.Expect("id2")
+	in <- metadata.PictureMetadata{FileID: "id1"}
+	in <- metadata.PictureMetadata{FileID: "id2"}
+
+	res := make(chan error)
+	go func() { res <- j.Join(context.TODO(), in, out) }()
+	// id2 is not read while id1 is held
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, len(in))
+
+	j.Stored(binary.StoreResult{Task: browse.Task{FileID: "id1"}})
+	assert.Equal(t, "id1", (<-out).FileID)
+	j.Stored(binary.StoreResult{Task: browse.Task{FileID: "id2"}})
+	assert.Equal(t, "id2", (<-out).FileID)
+	close(in)
+	j.CloseStored()
+	assert.Nil(t, <-res)
+}
+
+func TestJoin_StorageOver(t *testing.T) {
+	j := NewJoiner(10, 1, nil, nil)
+	in := make(chan metadata.PictureMetadata, 3)
+	out := make(chan metadata.PictureMetadata, 3)
+	j.Expect("id1")
+	j.Expect("id2")
+	j.Expect("id3")
+	in <- metadata.PictureMetadata{FileID: "id1"}
+	in <- metadata.PictureMetadata{FileID: "id2"}
+	in <- metadata.PictureMetadata{FileID: "id3"}
+	close(in)
+	// the storage ends before the results come : the metadata are forwarded
+	j.CloseStored()
+
+	assert.Nil(t, j.Join(context.TODO(), in, out))
+	ids := []string{}
+	for m := range out {
+		ids = append(ids, m.FileID)
+	}
+	sort.Strings(ids)
+	assert.Equal(t, []string{"id1", "id2", "id3"}, ids)
+}
+
+func TestJoin_InterruptedWhileHolding(t *testing.T) {
+	interrupted := []string{}
+	j := NewJoiner(10, 0, nil, func(ids []string, err error) {
+		assert.NotNil(t, err)
+		interrupted = append(interrupted, ids...)
+	})
+	in := make(chan metadata.PictureMetadata, 2)
+	out := make(chan metadata.PictureMetadata, 2)
+	j.Expect("id1")
+	in <- metadata.PictureMetadata{FileID: "id1"}
+	in <- metadata.PictureMetadata{FileID: "notExpected"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res := make(chan error)
+	go func() { res <- j.Join(ctx, in, out) }()
+	assert.Equal(t, "notExpected", (<-out).FileID)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	assert.Nil(t, <-res)
+	assert.Equal(t, []string{"id1"}, interrupted)
+}
+
+func TestJoin_Forget(t *testing.T) {
+	j := NewJoiner(10, 0, refs, nil)
+	in := make(chan metadata.PictureMetadata, 3)
+	out := make(chan metadata.PictureMetadata, 3)
+	j.Expect("storedFirst")
+	j.Expect("forgottenFirst")
+
+	res := make(chan error)
+	go func() { res <- j.Join(context.TODO(), in, out) }()
+	j.Stored(binary.StoreResult{Task: browse.Task{FileID: "storedFirst"}, Strategy: "go"})
+	j.Forget("storedFirst")
+	j.Forget("forgottenFirst")
+	j.Stored(binary.StoreResult{Task: browse.Task{FileID: "forgottenFirst"}, Strategy: "go"})
+	// the metadata of a picture that is not indexed never come
+	j.Stored(binary.StoreResult{Task: browse.Task{FileID: "notExpected"}, Strategy: "go"})
+	time.Sleep(20 * time.Millisecond)
+
+	// the storage results are not held : they are not merged
+	in <- metadata.PictureMetadata{FileID: "storedFirst"}
+	in <- metadata.PictureMetadata{FileID: "forgottenFirst"}
+	in <- metadata.PictureMetadata{FileID: "notExpected"}
+	close(in)
+	j.CloseStored()
+	assert.Nil(t, <-res)
+	for m := range out {
+		assert.Nil(t, m.ResizeStrategy)
+		assert.Equal(t, refs(m.FileID), m.Renditions)
+	}
+	assert.Empty(t, j.expected)
+	// ignored once the join is over
+	j.Forget("id")
+}
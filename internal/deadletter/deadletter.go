@@ -0,0 +1,208 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/rs/zerolog/log"
+)
+
+type Stage string
+
+const (
+	StageExtract Stage = "extract"
+	StageIndex   Stage = "index"
+	StageStore   Stage = "store"
+
+	StatusFailed   = "failed"
+	StatusResolved = "resolved"
+	// StatusDropped closes a failure that can't be retried (file removed)
+	StatusDropped = "dropped"
+
+	journalFile = "picdexer_deadletter.jsonl"
+)
+
+// Entry is a line of the dead-letter journal : a failure of a stage for a
+// file, its resolution or its drop.
+type Entry struct {
+	ImportID string    `json:"importId"`
+	Path     string    `json:"path"`
+	FileID   string    `json:"fileId"`
+	Stage    Stage     `json:"stage"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+type key struct {
+	fileID string
+	stage  Stage
+}
+
+// Journal is an append-only journal of the failures. A failure stays pending
+// until the stage succeeds for the file, in any later run.
+type Journal struct {
+	importID string
+	path     string
+	mu       sync.Mutex
+	file     *os.File
+	encoder  *json.Encoder
+	pending  map[key]Entry
+}
+
+// Path returns the path of the dead-letter journal stored in a folder.
+func Path(dir string) string {
+	return filepath.Join(dir, journalFile)
+}
+
+// Open opens (or creates) a dead-letter journal and loads its pending
+// failures.
+func Open(path string, importID string) (*Journal, error) {
+	j := &Journal{
+		importID: importID,
+		path:     path,
+		pending:  make(map[key]Entry),
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error while creating folder for %v: %w", path, err)
+	}
+	f, err := common.OpenAppend(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening dead-letter journal %v: %w", path, err)
+	}
+	j.file = f
+	j.encoder = json.NewEncoder(f)
+	log.Debug().Msgf("Dead-letter journal: %v", path)
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("error while opening dead-letter journal %v: %w", j.path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		e := Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// the last line can be truncated if the previous run was killed
+			log.Warn().Msgf("Ignoring unparsable dead-letter entry (%v, line %v): %v", j.path, line, err)
+			continue
+		}
+		k := key{fileID: e.FileID, stage: e.Stage}
+		if e.Status == StatusResolved || e.Status == StatusDropped {
+			delete(j.pending, k)
+		} else {
+			j.pending[k] = e
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error while reading dead-letter journal %v: %w", j.path, err)
+	}
+	return nil
+}
+
+func (j *Journal) write(e Entry) error {
+	if j.encoder == nil {
+		return fmt.Errorf("dead-letter journal %v is closed", j.path)
+	}
+	if err := j.encoder.Encode(e); err != nil {
+		return fmt.Errorf("error while writing dead-letter entry: %w", err)
+	}
+	return nil
+}
+
+// Failed records the failure of a stage for a file.
+func (j *Journal) Failed(path string, fileID string, s Stage, cause error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := Entry{
+		ImportID: j.importID,
+		Path:     path,
+		FileID:   fileID,
+		Stage:    s,
+		Status:   StatusFailed,
+		Error:    cause.Error(),
+		Time:     time.Now(),
+	}
+	j.pending[key{fileID: fileID, stage: s}] = e
+	return j.write(e)
+}
+
+// Resolved records that a stage succeeded for a file. Nothing is written if
+// no failure is pending.
+func (j *Journal) Resolved(fileID string, s Stage) error {
+	return j.close(fileID, s, StatusResolved, "")
+}
+
+// Dropped records that the failure of a stage for a file can't be retried
+// (the file doesn't exist anymore) : it is not pending anymore. Nothing is
+// written if no failure is pending.
+func (j *Journal) Dropped(fileID string, s Stage, cause error) error {
+	return j.close(fileID, s, StatusDropped, cause.Error())
+}
+
+func (j *Journal) close(fileID string, s Stage, status string, cause string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	k := key{fileID: fileID, stage: s}
+	prev, found := j.pending[k]
+	if !found {
+		return nil
+	}
+	delete(j.pending, k)
+	return j.write(Entry{
+		ImportID: j.importID,
+		Path:     prev.Path,
+		FileID:   fileID,
+		Stage:    s,
+		Status:   status,
+		Error:    cause,
+		Time:     time.Now(),
+	})
+}
+
+// Pending returns the pending failures, the oldest first.
+func (j *Journal) Pending() []Entry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := make([]Entry, 0, len(j.pending))
+	for _, e := range j.pending {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		if entries[a].Time.Equal(entries[b].Time) {
+			return entries[a].Path < entries[b].Path
+		}
+		return entries[a].Time.Before(entries[b].Time)
+	})
+	return entries
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	j.encoder = nil
+	return err
+}
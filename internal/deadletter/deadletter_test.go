@@ -0,0 +1,66 @@
+package deadletter
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	j, err := Open(Path(dir), "imp1")
+	assert.Nil(t, err)
+	assert.Empty(t, j.Pending())
+	assert.Nil(t, j.Failed("a.jpg", "idA", StageExtract, fmt.Errorf("error A")))
+	assert.Nil(t, j.Failed("b.jpg", "idB", StageStore, fmt.Errorf("error B")))
+	assert.Nil(t, j.Failed("b.jpg", "idB", StageIndex, fmt.Errorf("error B2")))
+	// nothing is pending
+	assert.Nil(t, j.Resolved("idC", StageStore))
+	assert.Nil(t, j.Resolved("idB", StageIndex))
+	assert.Nil(t, j.Close())
+	assert.Nil(t, j.Close())
+	assert.NotNil(t, j.Failed("c.jpg", "idC", StageStore, fmt.Errorf("closed")))
+
+	b, err := os.ReadFile(Path(dir))
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(Path(dir), append(b, []byte(`{"importId": "trunc`)...), 0644))
+
+	j, err = Open(Path(dir), "imp2")
+	assert.Nil(t, err)
+	defer j.Close()
+	pending := j.Pending()
+	assert.Len(t, pending, 2)
+	assert.Equal(t, Entry{ImportID: "imp1", Path: "a.jpg", FileID: "idA", Stage: StageExtract, Status: StatusFailed, Error: "error A", Time: pending[0].Time}, pending[0])
+	assert.Equal(t, "idB", pending[1].FileID)
+	assert.Equal(t, StageStore, pending[1].Stage)
+
+	assert.Nil(t, j.Resolved("idA", StageExtract))
+	assert.Nil(t, j.Failed("b.jpg", "idB", StageStore, fmt.Errorf("error B3")))
+	pending = j.Pending()
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "imp2", pending[0].ImportID)
+	assert.Equal(t, "error B3", pending[0].Error)
+
+	// the dropped failures are not pending anymore
+	assert.Nil(t, j.Dropped("idB", StageStore, fmt.Errorf("removed")))
+	assert.Nil(t, j.Dropped("idB", StageStore, fmt.Errorf("removed")))
+	assert.Empty(t, j.Pending())
+	assert.Nil(t, j.Close())
+	j, err = Open(Path(dir), "imp3")
+	assert.Nil(t, err)
+	assert.Empty(t, j.Pending())
+}
+
+func TestOpen_Failure(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	// the journal path is a folder
+	_, err = Open(dir, "imp")
+	assert.NotNil(t, err)
+}
@@ -5,19 +5,54 @@ import (
 	"github.com/barasher/picdexer/internal/browse"
 )
 
+// Filter returns true if the task has to be forwarded.
+type Filter func(browse.Task) bool
+
+// All returns a filter that accepts the tasks accepted by all the filters,
+// which are evaluated in order. Nil filters are ignored.
+func All(filters ...Filter) Filter {
+	return func(t browse.Task) bool {
+		for _, f := range filters {
+			if f != nil && !f(t) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
 func DispatchTasks(ctx context.Context, inFileChan chan browse.Task, outIdxChan chan browse.Task, outBinChan chan browse.Task) {
+	DispatchFilteredTasks(ctx, inFileChan, outIdxChan, outBinChan, nil, nil)
+}
+
+// DispatchFilteredTasks forwards each task to the output channels whose filter
+// accepts it. A nil filter accepts every task, a nil output channel (disabled
+// stage) receives nothing and its filter is not evaluated. Both filters are
+// evaluated, the index filter first, before the task is forwarded : a filter
+// can prepare the processing of the task by the other stage.
+func DispatchFilteredTasks(ctx context.Context, inFileChan chan browse.Task, outIdxChan chan browse.Task, outBinChan chan browse.Task, idxFilter Filter, binFilter Filter) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case t, ok := <-inFileChan:
 			if !ok {
-				close(outIdxChan)
-				close(outBinChan)
+				if outIdxChan != nil {
+					close(outIdxChan)
+				}
+				if outBinChan != nil {
+					close(outBinChan)
+				}
 				return
 			}
-			outIdxChan <- t
-			outBinChan <- t
+			toIdx := outIdxChan != nil && (idxFilter == nil || idxFilter(t))
+			toBin := outBinChan != nil && (binFilter == nil || binFilter(t))
+			if toIdx {
+				outIdxChan <- t
+			}
+			if toBin {
+				outBinChan <- t
+			}
 		}
 	}
 }
@@ -42,3 +42,97 @@ func TestDispatchTasks(t *testing.T) {
 	assert.Equal(t, []string{"p1", "p2"}, dispatched1)
 	assert.Equal(t, []string{"p1", "p2"}, dispatched2)
 }
+
+func TestDispatchFilteredTasks(t *testing.T) {
+	in := make(chan browse.Task, 3)
+	outIdx := make(chan browse.Task, 3)
+	outBin := make(chan browse.Task, 3)
+
+	in <- browse.Task{Path: "p1"}
+	in <- browse.Task{Path: "p2"}
+	in <- browse.Task{Path: "p3"}
+	close(in)
+
+	DispatchFilteredTasks(context.TODO(), in, outIdx, outBin,
+		func(t browse.Task) bool { return t.Path != "p1" },
+		func(t browse.Task) bool { return t.Path == "p3" })
+
+	dispatchedIdx := []string{}
+	for cur := range outIdx {
+		dispatchedIdx = append(dispatchedIdx, cur.Path)
+	}
+	dispatchedBin := []string{}
+	for cur := range outBin {
+		dispatchedBin = append(dispatchedBin, cur.Path)
+	}
+	assert.Equal(t, []string{"p2", "p3"}, dispatchedIdx)
+	assert.Equal(t, []string{"p3"}, dispatchedBin)
+}
+
+func TestDispatchFilteredTasks_FiltersBeforeForwarding(t *testing.T) {
+	in := make(chan browse.Task, 1)
+	outIdx := make(chan browse.Task)
+	outBin := make(chan browse.Task, 1)
+	in <- browse.Task{Path: "p1"}
+	close(in)
+
+	binEvaluated := make(chan bool, 1)
+	go DispatchFilteredTasks(context.TODO(), in, outIdx, outBin, nil,
+		func(t browse.Task) bool {
+			binEvaluated <- true
+			return true
+		})
+
+	assert.Equal(t, "p1", (<-outIdx).Path)
+	select {
+	case <-binEvaluated:
+	default:
+		assert.Fail(t, "task forwarded before evaluating the store filter")
+	}
+	assert.Equal(t, "p1", (<-outBin).Path)
+}
+
+func TestDispatchFilteredTasks_DisabledOutput(t *testing.T) {
+	in := make(chan browse.Task, 2)
+	outBin := make(chan browse.Task, 2)
+	in <- browse.Task{Path: "p1"}
+	in <- browse.Task{Path: "p2"}
+	close(in)
+
+	evaluated := false
+	DispatchFilteredTasks(context.TODO(), in, nil, outBin,
+		func(t browse.Task) bool {
+			evaluated = true
+			return true
+		}, nil)
+
+	dispatchedBin := []string{}
+	for cur := range outBin {
+		dispatchedBin = append(dispatchedBin, cur.Path)
+	}
+	assert.Equal(t, []string{"p1", "p2"}, dispatchedBin)
+	assert.False(t, evaluated)
+}
+
+func TestAll(t *testing.T) {
+	notP1 := func(t browse.Task) bool { return t.Path != "p1" }
+	notP2 := func(t browse.Task) bool { return t.Path != "p2" }
+	var tcs = []struct {
+		tcID      string
+		inFilters []Filter
+		inPath    string
+		expOk     bool
+	}{
+		{"none", nil, "p1", true},
+		{"nil", []Filter{nil}, "p1", true},
+		{"accepted", []Filter{notP1, nil, notP2}, "p3", true},
+		{"rejectedByFirst", []Filter{notP1, notP2}, "p1", false},
+		{"rejectedBySecond", []Filter{notP1, notP2}, "p2", false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expOk, All(tc.inFilters...)(browse.Task{Path: tc.inPath}))
+		})
+	}
+}
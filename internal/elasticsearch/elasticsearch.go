@@ -2,15 +2,20 @@ package elasticsearch
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/barasher/picdexer/internal/metrics"
+	"github.com/barasher/picdexer/internal/ratelimit"
 	"github.com/rs/zerolog/log"
 	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"sync"
 	"time"
 )
 
@@ -19,6 +24,8 @@ const (
 	bulkSuffix      = "_bulk"
 	ndJsonMimeType  = "application/x-ndjson"
 	baseSyncDate    = 946684800 * 1000 // 2000-01-01
+	picdexerIndex   = "picdexer"
+	syncOnDateIndex = "sync-on-date"
 )
 
 type EsDoc struct {
@@ -41,9 +48,53 @@ type EsChildDoc struct {
 }
 
 type EsPusher struct {
-	bulkSize int
-	url      string
-	dateSync map[string]uint64
+	bulkSize   int
+	url        string
+	dateSync   map[string]uint64
+	onIndexed  func(ids []string)
+	onFailed   func(ids []string, err error)
+	normalize  func(metadata.PictureMetadata) metadata.PictureMetadata
+	workers    int
+	maxBytes   int
+	gzip       bool
+	httpClient *http.Client
+}
+
+// bulk is a set of encoded documents sunk at once.
+type bulk struct {
+	body []byte
+	docs int
+	ids  []string
+	// final is true for the bulk flushed once the context is done
+	final bool
+}
+
+// bulkResponse is the part of the _bulk response describing the outcome of
+// each document.
+type bulkResponse struct {
+	Errors bool                  `json:"errors"`
+	Items  []map[string]bulkItem `json:"items"`
+}
+
+type bulkItem struct {
+	Index  string `json:"_index"`
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// bulkItemsError is returned when some documents of a bulk have not been
+// indexed, failed holding the reason of each failed picture.
+type bulkItemsError struct {
+	count  int
+	failed map[string]string
+}
+
+func (e bulkItemsError) Error() string {
+	return fmt.Sprintf("%v documents not indexed", e.count)
 }
 
 type SyncOnDateBody struct {
@@ -60,6 +111,10 @@ func NewEsPusher(bulkSize int, opts ...func(*EsPusher) error) (*EsPusher, error)
 	p := &EsPusher{
 		bulkSize: bulkSize,
 		dateSync: make(map[string]uint64),
+		workers:  1,
+		httpClient: &http.Client{
+			Timeout: 60 * time.Second,
+		},
 	}
 	for _, cur := range opts {
 		if err := cur(p); err != nil {
@@ -83,22 +138,128 @@ func SyncOnDate(kw string, d time.Time) func(*EsPusher) error {
 	}
 }
 
-func (pusher *EsPusher) sinkChan(ctx context.Context, inEsDocChan chan EsDoc, collectFct func(ctx context.Context, reader io.Reader) error) error {
-	buffer := bytes.Buffer{}
-	jsonEncoder := json.NewEncoder(&buffer)
-	bufferDocCount := 0
+// OnIndexed registers a function that is called with the identifiers of the
+// pictures documents contained in each bulk that has been successfully sunk.
+func OnIndexed(f func(ids []string)) func(*EsPusher) error {
+	return func(p *EsPusher) error {
+		p.onIndexed = f
+		return nil
+	}
+}
+
+// OnIndexFailed registers a function that is called with the identifiers of
+// the pictures documents contained in each bulk that could not be sunk.
+func OnIndexFailed(f func(ids []string, err error)) func(*EsPusher) error {
+	return func(p *EsPusher) error {
+		p.onFailed = f
+		return nil
+	}
+}
+
+// BulkWorkers defines how many bulks are sent concurrently (1 by default).
+// The documents are encoded while the bulks are sent, at most workers bulks
+// being in flight.
+func BulkWorkers(workers int) func(*EsPusher) error {
+	return func(p *EsPusher) error {
+		if workers <= 0 {
+			return fmt.Errorf("bulk workers should be >0 (%v)", workers)
+		}
+		p.workers = workers
+		return nil
+	}
+}
+
+// MaxBulkBytes flushes a bulk as soon as its encoded documents reach
+// maxBytes, even if it holds less than bulkSize documents.
+func MaxBulkBytes(maxBytes int) func(*EsPusher) error {
+	return func(p *EsPusher) error {
+		if maxBytes <= 0 {
+			return fmt.Errorf("max bulk bytes should be >0 (%v)", maxBytes)
+		}
+		p.maxBytes = maxBytes
+		return nil
+	}
+}
+
+// Gzip compresses the bulk requests.
+func Gzip() func(*EsPusher) error {
+	return func(p *EsPusher) error {
+		p.gzip = true
+		return nil
+	}
+}
+
+// Normalize registers a function that normalizes the metadata of the
+// pictures before their conversion to documents.
+func Normalize(f func(metadata.PictureMetadata) metadata.PictureMetadata) func(*EsPusher) error {
+	return func(p *EsPusher) error {
+		p.normalize = f
+		return nil
+	}
+}
+
+// sinkChan encodes the documents in bulks that are sunk by collectFct in
+// workers goroutines.
+func (pusher *EsPusher) sinkChan(ctx context.Context, inEsDocChan chan EsDoc, workers int, collectFct func(ctx context.Context, b bulk) error) error {
+	// a failed bulk doesn't interrupt the sinking of the following ones, the
+	// first error is returned
+	var sinkErr error
+	errMu := sync.Mutex{}
+	bulkChan := make(chan bulk)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			// the bulks are sunk even if the context is done : the buffer
+			// only holds complete documents
+			for b := range bulkChan {
+				pusher.sink(ctx, b, collectFct, func(err error) {
+					errMu.Lock()
+					defer errMu.Unlock()
+					if sinkErr == nil {
+						sinkErr = err
+					}
+				})
+			}
+		}()
+	}
+
+	err := pusher.encode(ctx, inEsDocChan, bulkChan)
+	close(bulkChan)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return sinkErr
+}
+
+// encode encodes the documents in bulks, flushed when they hold bulkSize
+// documents or maxBytes bytes, and when the input is over.
+func (pusher *EsPusher) encode(ctx context.Context, inEsDocChan chan EsDoc, out chan bulk) error {
+	buffer := &bytes.Buffer{}
+	jsonEncoder := json.NewEncoder(buffer)
+	b := bulk{}
+	flush := func() {
+		b.body = buffer.Bytes()
+		out <- b
+		buffer = &bytes.Buffer{}
+		jsonEncoder = json.NewEncoder(buffer)
+		b = bulk{}
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
+			if b.docs > 0 {
+				b.final = true
+				flush()
+			}
 			return nil
 		case doc, ok := <-inEsDocChan:
 			if !ok {
-				if bufferDocCount > 0 {
-					log.Info().Msgf("Pushing ES bulk (%v docs)...", bufferDocCount)
-					if err := collectFct(ctx, &buffer); err != nil {
-						return fmt.Errorf("error while sinking buffer: %w", err)
-					}
+				if b.docs > 0 {
+					flush()
 				}
 				return nil
 			}
@@ -110,34 +271,90 @@ func (pusher *EsPusher) sinkChan(ctx context.Context, inEsDocChan chan EsDoc, co
 				log.Debug().Str(esDocIdentifier, doc.Header.Index.ID).Msgf("Body: %v", doc.Document)
 				return fmt.Errorf("error while encoding body: %w", err)
 			}
-			bufferDocCount++
-			if bufferDocCount == pusher.bulkSize {
-				log.Info().Msgf("Pushing ES bulk (%v docs)...", bufferDocCount)
-				if err := collectFct(ctx, &buffer); err != nil {
-					return fmt.Errorf("error while sinking buffer: %w", err)
-				}
-				bufferDocCount = 0
+			b.docs++
+			if doc.Header.Index.Index == picdexerIndex {
+				b.ids = append(b.ids, doc.Header.Index.ID)
+			}
+			if b.docs == pusher.bulkSize || (pusher.maxBytes > 0 && buffer.Len() >= pusher.maxBytes) {
+				flush()
 			}
 		}
 	}
+}
+
+// sink sinks a bulk and reports the result.
+func (pusher *EsPusher) sink(ctx context.Context, b bulk, collectFct func(ctx context.Context, b bulk) error, onErr func(error)) {
+	log.Info().Msgf("Pushing ES bulk (%v docs)...", b.docs)
+	err := collectFct(ctx, b)
+	if err == nil {
+		pusher.reportIndexed(b.ids)
+		return
+	}
+	err = fmt.Errorf("error while sinking buffer: %w", err)
+	log.Error().Msgf("%v", err)
+	onErr(err)
 
-	return nil
+	var itemsErr bulkItemsError
+	if !errors.As(err, &itemsErr) {
+		if pusher.onFailed != nil && len(b.ids) > 0 {
+			pusher.onFailed(b.ids, err)
+		}
+		return
+	}
+	// only the documents rejected by Elasticsearch are failed
+	indexed := []string{}
+	for _, id := range b.ids {
+		reason, failed := itemsErr.failed[id]
+		if !failed {
+			indexed = append(indexed, id)
+			continue
+		}
+		log.Error().Str(esDocIdentifier, id).Msgf("Document not indexed: %v", reason)
+		if pusher.onFailed != nil {
+			pusher.onFailed([]string{id}, fmt.Errorf("error while indexing document: %v", reason))
+		}
+	}
+	pusher.reportIndexed(indexed)
+}
+
+func (pusher *EsPusher) reportIndexed(ids []string) {
+	if pusher.onIndexed != nil && len(ids) > 0 {
+		pusher.onIndexed(ids)
+	}
 }
 
 func (pusher *EsPusher) Print(ctx context.Context, inEsDocChan chan EsDoc) error {
-	return pusher.sinkChan(ctx, inEsDocChan, func(ctx context.Context, reader io.Reader) error {
-		b, err := io.ReadAll(reader)
-		if err != nil {
-			return fmt.Errorf("error while printing documents: %w", err)
-		}
-		fmt.Printf("%v", string(b))
+	// a single worker so that the bulks are not interleaved
+	return pusher.sinkChan(ctx, inEsDocChan, 1, func(ctx context.Context, b bulk) error {
+		fmt.Printf("%v", string(b.body))
 		return nil
 	})
 }
 
+// Push sends the documents to Elasticsearch by bulks, at the pace allowed by
+// the limits of the context.
 func (pusher *EsPusher) Push(ctx context.Context, inEsDocChan chan EsDoc) error {
-	return pusher.sinkChan(ctx, inEsDocChan, func(ctx context.Context, reader io.Reader) error {
-		return pusher.pushToEs(ctx, reader)
+	return pusher.sinkChan(ctx, inEsDocChan, pusher.workers, func(ctx context.Context, b bulk) error {
+		// the requests are interrupted when the context is done, except the
+		// final one which waits for the limits and whose duration is bounded
+		// by the client timeout
+		reqCtx := ctx
+		if b.final {
+			reqCtx = context.Background()
+		}
+		done, err := ratelimit.Get(ctx).StartBulk(reqCtx)
+		if err != nil {
+			return fmt.Errorf("error while waiting to send bulk: %w", err)
+		}
+		defer done()
+		start := time.Now()
+		err = pusher.pushToEs(reqCtx, bytes.NewReader(b.body))
+		d := time.Since(start)
+		metrics.Get(ctx).BulkSent(d, err)
+		if err == nil {
+			log.Info().Msgf("ES bulk pushed (%v docs, %v bytes) in %v", b.docs, len(b.body), d)
+		}
+		return err
 	})
 }
 
@@ -148,10 +365,27 @@ func (pusher *EsPusher) pushToEs(ctx context.Context, body io.Reader) error {
 	}
 	u.Path = path.Join(u.Path, bulkSuffix)
 
-	httpClient := &http.Client{
-		Timeout: 60 * time.Second,
+	if pusher.gzip {
+		compressed := bytes.Buffer{}
+		gz := gzip.NewWriter(&compressed)
+		if _, err := io.Copy(gz, body); err != nil {
+			return fmt.Errorf("error while compressing bulk: %w", err)
+		}
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("error while compressing bulk: %w", err)
+		}
+		body = &compressed
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), body)
+	if err != nil {
+		return fmt.Errorf("error while creating bulk request: %w", err)
 	}
-	resp, err := httpClient.Post(u.String(), ndJsonMimeType, body)
+	req.Header.Set("Content-Type", ndJsonMimeType)
+	if pusher.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := pusher.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("error while pushing to Elasticsearch: %v", err)
 	}
@@ -166,7 +400,38 @@ func (pusher *EsPusher) pushToEs(ctx context.Context, body io.Reader) error {
 		return fmt.Errorf("wrong status code (%v)", resp.StatusCode)
 	}
 
-	return nil
+	return checkBulkResponse(resp.Body)
+}
+
+// checkBulkResponse returns a bulkItemsError if some documents of the bulk
+// have been rejected.
+func checkBulkResponse(body io.Reader) error {
+	r := bulkResponse{}
+	if err := json.NewDecoder(body).Decode(&r); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return fmt.Errorf("error while decoding response body: %w", err)
+	}
+	if !r.Errors {
+		return nil
+	}
+	itemsErr := bulkItemsError{failed: make(map[string]string)}
+	for _, item := range r.Items {
+		for _, res := range item {
+			if res.Error == nil {
+				continue
+			}
+			itemsErr.count++
+			if res.Index == picdexerIndex {
+				itemsErr.failed[res.ID] = fmt.Sprintf("%v (%v): %v", res.Error.Type, res.Status, res.Error.Reason)
+			}
+		}
+	}
+	if itemsErr.count == 0 {
+		return nil
+	}
+	return itemsErr
 }
 
 func (pusher *EsPusher) ConvertMetadataToEsDoc(ctx context.Context, in chan metadata.PictureMetadata, out chan EsDoc) error {
@@ -180,10 +445,13 @@ func (pusher *EsPusher) ConvertMetadataToEsDoc(ctx context.Context, in chan meta
 				return nil
 			}
 			// main doc
+			if pusher.normalize != nil {
+				cur = pusher.normalize(cur)
+			}
 			out <- EsDoc{
 				Header: EsHeader{
 					Index: EsHeaderIndex{
-						Index: "picdexer",
+						Index: picdexerIndex,
 						ID:    cur.FileID,
 					},
 				},
@@ -197,7 +465,7 @@ func (pusher *EsPusher) ConvertMetadataToEsDoc(ctx context.Context, in chan meta
 							syncDoc := EsDoc{
 								Header: EsHeader{
 									Index: EsHeaderIndex{
-										Index: "sync-on-date",
+										Index: syncOnDateIndex,
 										ID:    kw + "_" + cur.FileID,
 									},
 								},
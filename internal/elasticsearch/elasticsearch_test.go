@@ -1,15 +1,21 @@
 package elasticsearch
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/barasher/picdexer/internal/metrics"
+	"github.com/barasher/picdexer/internal/ratelimit"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -120,6 +126,151 @@ func TestPush_Nominal(t *testing.T) {
 		"{\"FileName\":\"f3.jpg\",\"Folder\":\"\",\"ImportID\":\"\",\"FileSize\":0}\n", collectedBodies[1])
 }
 
+func TestBulkOptions(t *testing.T) {
+	var tcs = []struct {
+		tcID  string
+		inOpt func(*EsPusher) error
+		expOk bool
+	}{
+		{"workers", BulkWorkers(4), true},
+		{"noWorker", BulkWorkers(0), false},
+		{"maxBytes", MaxBulkBytes(1024), true},
+		{"noMaxBytes", MaxBulkBytes(0), false},
+		{"gzip", Gzip(), true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			_, err := NewEsPusher(10, tc.inOpt)
+			assert.Equal(t, tc.expOk, err == nil)
+		})
+	}
+}
+
+func TestPush_MaxBulkBytes(t *testing.T) {
+	bodies := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		bodies = append(bodies, string(b))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	// a document is bigger than 50 bytes : each bulk holds a single one
+	pusher, err := NewEsPusher(10, EsUrl(ts.URL), MaxBulkBytes(50))
+	assert.Nil(t, err)
+	inChan := make(chan EsDoc, 3)
+	inChan <- buildEsDoc("id1", "f1.jpg")
+	inChan <- buildEsDoc("id2", "f2.jpg")
+	inChan <- buildEsDoc("id3", "f3.jpg")
+	close(inChan)
+
+	assert.Nil(t, pusher.Push(context.TODO(), inChan))
+	assert.Equal(t, 3, len(bodies))
+	for i, b := range bodies {
+		assert.Contains(t, b, fmt.Sprintf("f%v.jpg", i+1))
+	}
+}
+
+func TestPush_Gzip(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-type"))
+		gz, err := gzip.NewReader(r.Body)
+		assert.Nil(t, err)
+		b, err := io.ReadAll(gz)
+		assert.Nil(t, err)
+		body = string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	pusher, err := NewEsPusher(10, EsUrl(ts.URL), Gzip())
+	assert.Nil(t, err)
+	inChan := make(chan EsDoc, 1)
+	inChan <- buildEsDoc("id1", "f1.jpg")
+	close(inChan)
+
+	assert.Nil(t, pusher.Push(context.TODO(), inChan))
+	assert.Equal(t, "{\"index\":{\"_index\":\"idx\",\"_id\":\"id1\"}}\n"+
+		"{\"FileName\":\"f1.jpg\",\"Folder\":\"\",\"ImportID\":\"\",\"FileSize\":0}\n", body)
+}
+
+func TestPush_Workers(t *testing.T) {
+	inFlight, maxInFlight := int32(0), int32(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		cur := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if cur <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, cur) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	var tcs = []struct {
+		tcID      string
+		inWorkers int
+		expMax    int32
+	}{
+		{"sequential", 1, 1},
+		{"concurrent", 3, 3},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			atomic.StoreInt32(&maxInFlight, 0)
+			indexed := int32(0)
+			pusher, err := NewEsPusher(1, EsUrl(ts.URL), BulkWorkers(tc.inWorkers), OnIndexed(func(ids []string) {
+				atomic.AddInt32(&indexed, int32(len(ids)))
+			}))
+			assert.Nil(t, err)
+			inChan := make(chan EsDoc, 6)
+			for i := 0; i < 6; i++ {
+				doc := buildEsDoc("id"+strconv.Itoa(i), "f.jpg")
+				doc.Header.Index.Index = picdexerIndex
+				inChan <- doc
+			}
+			close(inChan)
+
+			assert.Nil(t, pusher.Push(context.TODO(), inChan))
+			assert.Equal(t, tc.expMax, atomic.LoadInt32(&maxInFlight))
+			assert.Equal(t, int32(6), atomic.LoadInt32(&indexed))
+		})
+	}
+}
+
+func TestPush_Limited(t *testing.T) {
+	bulks := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		bulks++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := ratelimit.NewLimits(ratelimit.Settings{BulksPerSecond: 2, MaxInFlightBulks: 1})
+	assert.Nil(t, err)
+	ctx := ratelimit.WithLimits(context.Background(), l)
+
+	pusher, err := NewEsPusher(1, EsUrl(ts.URL))
+	assert.Nil(t, err)
+	inChan := make(chan EsDoc, 3)
+	inChan <- buildEsDoc("id1", "f1.jpg")
+	inChan <- buildEsDoc("id2", "f2.jpg")
+	inChan <- buildEsDoc("id3", "f3.jpg")
+	close(inChan)
+
+	start := time.Now()
+	assert.Nil(t, pusher.Push(ctx, inChan))
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+	assert.Equal(t, 3, bulks)
+}
+
 func TestPush_ErrorOnPush(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -246,4 +397,257 @@ func TestConvertMetadataToEsDoc_WithSync(t *testing.T) {
 	assert.Equal(t, uint64(d.Unix()), doc.Date)
 	assert.Equal(t, "kw2_f1IDValue", docs[1].Header.Index.ID)
 	assert.Equal(t, "sync-on-date", docs[1].Header.Index.Index)
-}
\ No newline at end of file
+}
+func TestPush_OnIndexed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	indexed := [][]string{}
+	pusher, err := NewEsPusher(2, EsUrl(ts.URL), OnIndexed(func(ids []string) {
+		indexed = append(indexed, ids)
+	}))
+	assert.Nil(t, err)
+
+	inChan := make(chan EsDoc, 4)
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id1"}}}
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "sync-on-date", ID: "kw_id1"}}}
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id2"}}}
+	close(inChan)
+
+	assert.Nil(t, pusher.Push(context.TODO(), inChan))
+	assert.Equal(t, [][]string{{"id1"}, {"id2"}}, indexed)
+}
+
+func TestPush_RejectedDocuments(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"took":3,"errors":true,"items":[` +
+			`{"index":{"_index":"picdexer","_id":"id1","status":201}},` +
+			`{"index":{"_index":"sync-on-date","_id":"kw_id1","status":201}},` +
+			`{"index":{"_index":"picdexer","_id":"id2","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [Date]"}}}]}`))
+	}))
+	defer ts.Close()
+
+	indexed := [][]string{}
+	failed := [][]string{}
+	pusher, err := NewEsPusher(3, EsUrl(ts.URL), OnIndexed(func(ids []string) {
+		indexed = append(indexed, ids)
+	}), OnIndexFailed(func(ids []string, err error) {
+		assert.Contains(t, err.Error(), "failed to parse field [Date]")
+		failed = append(failed, ids)
+	}))
+	assert.Nil(t, err)
+
+	inChan := make(chan EsDoc, 3)
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id1"}}}
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "sync-on-date", ID: "kw_id1"}}}
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id2"}}}
+	close(inChan)
+
+	assert.NotNil(t, pusher.Push(context.TODO(), inChan))
+	assert.Equal(t, [][]string{{"id1"}}, indexed)
+	assert.Equal(t, [][]string{{"id2"}}, failed)
+}
+
+func TestCheckBulkResponse(t *testing.T) {
+	var tcs = []struct {
+		tcID      string
+		inBody    string
+		expOk     bool
+		expFailed map[string]string
+	}{
+		{"empty", ``, true, nil},
+		{"noError", `{"errors":false,"items":[{"index":{"_index":"picdexer","_id":"id1","status":201}}]}`, true, nil},
+		{"unparsable", `{`, false, nil},
+		{"rejected", `{"errors":true,"items":[{"create":{"_index":"picdexer","_id":"id1","status":409,"error":{"type":"conflict","reason":"exists"}}}]}`, false,
+			map[string]string{"id1": "conflict (409): exists"}},
+		{"rejectedSync", `{"errors":true,"items":[{"index":{"_index":"sync-on-date","_id":"kw_id1","status":400,"error":{"type":"t","reason":"r"}}}]}`, false,
+			map[string]string{}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			err := checkBulkResponse(strings.NewReader(tc.inBody))
+			assert.Equal(t, tc.expOk, err == nil)
+			var itemsErr bulkItemsError
+			if errors.As(err, &itemsErr) {
+				assert.Equal(t, tc.expFailed, itemsErr.failed)
+			} else {
+				assert.Nil(t, tc.expFailed)
+			}
+		})
+	}
+}
+
+func TestPush_Metrics(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		status = http.StatusInternalServerError
+	}))
+	defer ts.Close()
+
+	pusher, err := NewEsPusher(1, EsUrl(ts.URL))
+	assert.Nil(t, err)
+	inChan := make(chan EsDoc, 2)
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id1"}}}
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id2"}}}
+	close(inChan)
+
+	m := metrics.New()
+	assert.NotNil(t, pusher.Push(metrics.WithMetrics(context.TODO(), m), inChan))
+	b := bytes.Buffer{}
+	_, err = m.WriteTo(&b)
+	assert.Nil(t, err)
+	assert.Contains(t, b.String(), `picdexer_es_bulks_total{outcome="processed"} 1`)
+	assert.Contains(t, b.String(), `picdexer_es_bulks_total{outcome="failed"} 1`)
+	assert.Contains(t, b.String(), "picdexer_es_bulk_duration_seconds_count 2")
+}
+
+func TestConvertMetadataToEsDoc_WithNormalize(t *testing.T) {
+	d := uint64(1600000000000)
+	in := make(chan metadata.PictureMetadata, 1)
+	in <- metadata.PictureMetadata{FileID: "id_a.jpg", Keywords: []string{"KW1"}, Date: &d}
+	close(in)
+
+	out := make(chan EsDoc, 2)
+	p, err := NewEsPusher(10, SyncOnDate("kw1", time.Now()), Normalize(func(m metadata.PictureMetadata) metadata.PictureMetadata {
+		m.Keywords = []string{strings.ToLower(m.Keywords[0])}
+		return m
+	}))
+	assert.Nil(t, err)
+	p.ConvertMetadataToEsDoc(context.TODO(), in, out)
+
+	doc := (<-out).Document.(metadata.PictureMetadata)
+	assert.Equal(t, []string{"kw1"}, doc.Keywords)
+	// the date synchronization relies on the normalized keywords
+	assert.Equal(t, syncOnDateIndex, (<-out).Header.Index.Index)
+}
+
+func TestPush_OnIndexFailed(t *testing.T) {
+	q := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if q == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		q++
+	}))
+	defer ts.Close()
+
+	indexed := [][]string{}
+	failed := [][]string{}
+	pusher, err := NewEsPusher(1, EsUrl(ts.URL),
+		OnIndexed(func(ids []string) {
+			indexed = append(indexed, ids)
+		}),
+		OnIndexFailed(func(ids []string, err error) {
+			assert.NotNil(t, err)
+			failed = append(failed, ids)
+		}))
+	assert.Nil(t, err)
+
+	inChan := make(chan EsDoc, 2)
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id1"}}}
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id2"}}}
+	close(inChan)
+
+	assert.NotNil(t, pusher.Push(context.TODO(), inChan))
+	assert.Equal(t, [][]string{{"id1"}}, failed)
+	assert.Equal(t, [][]string{{"id2"}}, indexed)
+	assert.Equal(t, 2, q)
+}
+
+func TestPush_FlushOnCancel(t *testing.T) {
+	bodies := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	indexed := []string{}
+	pusher, err := NewEsPusher(10, EsUrl(ts.URL), OnIndexed(func(ids []string) {
+		indexed = append(indexed, ids...)
+	}))
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	inChan := make(chan EsDoc)
+	res := make(chan error)
+	go func() { res <- pusher.Push(ctx, inChan) }()
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id1"}}}
+	cancel()
+
+	assert.Nil(t, <-res)
+	assert.Equal(t, []string{"id1"}, indexed)
+	assert.Len(t, bodies, 1)
+}
+
+func TestPush_InterruptedOnCancel(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	failed := []string{}
+	pusher, err := NewEsPusher(1, EsUrl(ts.URL), OnIndexFailed(func(ids []string, err error) {
+		failed = append(failed, ids...)
+	}))
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	inChan := make(chan EsDoc)
+	res := make(chan error)
+	go func() { res <- pusher.Push(ctx, inChan) }()
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id1"}}}
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-res:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "request not interrupted")
+	}
+	assert.Equal(t, []string{"id1"}, failed)
+}
+
+func TestPush_LimitedFlushOnCancel(t *testing.T) {
+	bulks := int32(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		atomic.AddInt32(&bulks, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	l, err := ratelimit.NewLimits(ratelimit.Settings{BulksPerSecond: 1})
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(ratelimit.WithLimits(context.Background(), l))
+
+	indexed := []string{}
+	pusher, err := NewEsPusher(2, EsUrl(ts.URL), OnIndexed(func(ids []string) {
+		indexed = append(indexed, ids...)
+	}))
+	assert.Nil(t, err)
+	inChan := make(chan EsDoc)
+	res := make(chan error)
+	go func() { res <- pusher.Push(ctx, inChan) }()
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id1"}}}
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id2"}}}
+	inChan <- EsDoc{Header: EsHeader{Index: EsHeaderIndex{Index: "picdexer", ID: "id3"}}}
+	// the first bulk is over, the final one waits for the limits although
+	// the context is done
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	assert.Nil(t, <-res)
+	assert.Equal(t, []string{"id1", "id2", "id3"}, indexed)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&bulks))
+}
@@ -0,0 +1,277 @@
+package enrich
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/barasher/picdexer/internal/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultTimeout = 30 * time.Second
+
+// Plugin is an external command that adds fields to the documents. It reads
+// a Request on its standard input and writes on its standard output a JSON
+// object : the fields to merge in the document, a null value removing a
+// field added by a previous plugin. The fields of PictureMetadata can't be
+// overridden.
+//
+// The plugin is only run on the pictures whose MIME type matches one of the
+// MimeTypes globs (image/* for instance) and having one of the Keywords, if
+// defined. Concurrency limits the number of simultaneous runs (the thread
+// count of the enricher if 0).
+type Plugin struct {
+	Name        string
+	Command     []string
+	Timeout     time.Duration
+	Concurrency int
+	MimeTypes   []string
+	Keywords    []string
+}
+
+// Request is the input of a plugin : the path of the picture and its current
+// document.
+type Request struct {
+	Path     string          `json:"path"`
+	Document json.RawMessage `json:"document"`
+}
+
+type plugin struct {
+	Plugin
+	slots chan struct{}
+}
+
+// Enricher runs the plugins on the metadata of the pictures, in the order of
+// their declaration : each plugin receives the fields added by the previous
+// ones. A failing plugin doesn't prevent the picture from being indexed.
+type Enricher struct {
+	threadCount int
+	plugins     []Plugin
+	onFailed    func(metadata.PictureMetadata, error)
+}
+
+func NewEnricher(threadCount int, opts ...func(*Enricher) error) (*Enricher, error) {
+	if threadCount <= 0 {
+		return nil, fmt.Errorf("threadCount should be >0 (%v)", threadCount)
+	}
+	e := &Enricher{threadCount: threadCount}
+	for _, cur := range opts {
+		if err := cur(e); err != nil {
+			return nil, fmt.Errorf("error while creating Enricher: %w", err)
+		}
+	}
+	return e, nil
+}
+
+func WithPlugin(p Plugin) func(*Enricher) error {
+	return func(e *Enricher) error {
+		switch {
+		case p.Name == "":
+			return fmt.Errorf("plugin name is missing")
+		case len(p.Command) == 0:
+			return fmt.Errorf("command of plugin %v is missing", p.Name)
+		case p.Concurrency < 0:
+			return fmt.Errorf("concurrency of plugin %v should be >=0 (%v)", p.Name, p.Concurrency)
+		}
+		for _, m := range p.MimeTypes {
+			if _, err := path.Match(m, ""); err != nil {
+				return fmt.Errorf("wrong MIME type pattern for plugin %v (%v): %w", p.Name, m, err)
+			}
+		}
+		e.plugins = append(e.plugins, p)
+		return nil
+	}
+}
+
+// OnEnrichmentFailed registers a function that is called each time a plugin
+// fails on a picture.
+func OnEnrichmentFailed(f func(metadata.PictureMetadata, error)) func(*Enricher) error {
+	return func(e *Enricher) error {
+		e.onFailed = f
+		return nil
+	}
+}
+
+// enabled returns true if the plugin has to be run on the picture.
+func (p Plugin) enabled(m metadata.PictureMetadata) bool {
+	if len(p.MimeTypes) > 0 {
+		if m.MimeType == nil || !matchesAny(p.MimeTypes, strings.ToLower(*m.MimeType)) {
+			return false
+		}
+	}
+	if len(p.Keywords) > 0 {
+		for _, kw := range m.Keywords {
+			for _, cur := range p.Keywords {
+				if kw == cur {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Enricher) Enrich(ctx context.Context, in chan metadata.PictureMetadata, out chan metadata.PictureMetadata) error {
+	plugins := make([]*plugin, len(e.plugins))
+	for i, p := range e.plugins {
+		if p.Concurrency == 0 {
+			p.Concurrency = e.threadCount
+		}
+		if p.Timeout == 0 {
+			p.Timeout = defaultTimeout
+		}
+		plugins[i] = &plugin{Plugin: p, slots: make(chan struct{}, p.Concurrency)}
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(e.threadCount)
+	for i := 0; i < e.threadCount; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case cur, ok := <-in:
+					if !ok {
+						return
+					}
+					for _, p := range plugins {
+						if !p.enabled(cur) {
+							continue
+						}
+						var err error
+						if cur, err = p.enrich(ctx, cur); err != nil {
+							log.Warn().Str(common.LogFileIdentifier, cur.SourceFile).Msgf("Error while enriching metadata: %v", err)
+							if e.onFailed != nil {
+								e.onFailed(cur, err)
+							}
+						}
+					}
+					out <- cur
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(out)
+	return nil
+}
+
+// enrich runs the plugin and merges its fields in the metadata, which are
+// unchanged if it fails.
+func (p *plugin) enrich(ctx context.Context, m metadata.PictureMetadata) (metadata.PictureMetadata, error) {
+	doc, err := json.Marshal(m)
+	if err != nil {
+		return m, fmt.Errorf("error while encoding document: %w", err)
+	}
+	req, err := json.Marshal(Request{Path: m.SourceFile, Document: doc})
+	if err != nil {
+		return m, fmt.Errorf("error while encoding request: %w", err)
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return m, fmt.Errorf("plugin %v not run: %w", p.Name, ctx.Err())
+	}
+	out, err := p.run(ctx, req)
+	<-p.slots
+	if err != nil {
+		return m, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(out, &fields); err != nil {
+		return m, fmt.Errorf("plugin %v returned a wrong output: %w", p.Name, err)
+	}
+	merged := make(map[string]interface{}, len(m.Fields)+len(fields))
+	for k, v := range m.Fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		switch {
+		case metadata.IsBuiltinField(k):
+			log.Warn().Str(common.LogFileIdentifier, m.SourceFile).Msgf("Plugin %v can't override field %v", p.Name, k)
+		case string(v) == "null":
+			delete(merged, k)
+		default:
+			merged[k] = v
+		}
+	}
+	m.Fields = merged
+	return m, nil
+}
+
+func (p *plugin) run(ctx context.Context, req []byte) ([]byte, error) {
+	cctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(cctx, p.Command[0], p.Command[1:]...)
+	// the input and outputs are files rather than pipes : a pipe kept open by
+	// a child of a killed plugin would block Wait
+	stdin, err := os.CreateTemp(os.TempDir(), "picdexer-plugin-")
+	if err != nil {
+		return nil, fmt.Errorf("error while creating stdin file: %w", err)
+	}
+	defer os.Remove(stdin.Name())
+	defer stdin.Close()
+	if _, err := stdin.Write(req); err != nil {
+		return nil, fmt.Errorf("error while writing request: %w", err)
+	}
+	if _, err := stdin.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("error while writing request: %w", err)
+	}
+	stdout, err := os.CreateTemp(os.TempDir(), "picdexer-plugin-")
+	if err != nil {
+		return nil, fmt.Errorf("error while creating stdout file: %w", err)
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	stderr, err := os.CreateTemp(os.TempDir(), "picdexer-plugin-")
+	if err != nil {
+		return nil, fmt.Errorf("error while creating stderr file: %w", err)
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err = cmd.Run()
+	metrics.Get(ctx).ToolRan(p.Name, time.Since(start))
+	switch {
+	case errors.Is(cctx.Err(), context.DeadlineExceeded):
+		return nil, fmt.Errorf("plugin %v timed out (%v)", p.Name, p.Timeout)
+	case err != nil:
+		b, _ := os.ReadFile(stderr.Name())
+		return nil, fmt.Errorf("plugin %v failed: %w (stderr: %v)", p.Name, err, strings.TrimSpace(string(b)))
+	}
+	out, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		return nil, fmt.Errorf("error while reading output of plugin %v: %w", p.Name, err)
+	}
+	return out, nil
+}
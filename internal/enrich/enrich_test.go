@@ -0,0 +1,143 @@
+package enrich
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func shPlugin(name string, script string) Plugin {
+	return Plugin{Name: name, Command: []string{"sh", "-c", script}}
+}
+
+func TestNewEnricher(t *testing.T) {
+	var tcs = []struct {
+		tcID          string
+		inThreadCount int
+		inPlugin      Plugin
+		expOk         bool
+	}{
+		{"nominal", 1, Plugin{Name: "p", Command: []string{"cmd"}, MimeTypes: []string{"image/*"}}, true},
+		{"wrongThreadCount", 0, Plugin{Name: "p", Command: []string{"cmd"}}, false},
+		{"noName", 1, Plugin{Command: []string{"cmd"}}, false},
+		{"noCommand", 1, Plugin{Name: "p"}, false},
+		{"negativeConcurrency", 1, Plugin{Name: "p", Command: []string{"cmd"}, Concurrency: -1}, false},
+		{"wrongMimeType", 1, Plugin{Name: "p", Command: []string{"cmd"}, MimeTypes: []string{"image/["}}, false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			_, err := NewEnricher(tc.inThreadCount, WithPlugin(tc.inPlugin))
+			assert.Equal(t, tc.expOk, err == nil)
+		})
+	}
+}
+
+func TestPlugin_Enabled(t *testing.T) {
+	jpeg := "image/jpeg"
+	raw := "image/x-canon-cr2"
+	var tcs = []struct {
+		tcID       string
+		inMime     []string
+		inKeywords []string
+		inMeta     metadata.PictureMetadata
+		expEnabled bool
+	}{
+		{"noRule", nil, nil, metadata.PictureMetadata{}, true},
+		{"mimeMatch", []string{"image/jpeg"}, nil, metadata.PictureMetadata{MimeType: &jpeg}, true},
+		{"mimeGlob", []string{"image/*"}, nil, metadata.PictureMetadata{MimeType: &raw}, true},
+		{"mimeCase", []string{"IMAGE/JPEG"}, nil, metadata.PictureMetadata{MimeType: &jpeg}, true},
+		{"mimeMismatch", []string{"image/jpeg"}, nil, metadata.PictureMetadata{MimeType: &raw}, false},
+		{"mimeUnknown", []string{"image/jpeg"}, nil, metadata.PictureMetadata{}, false},
+		{"keywordMatch", nil, []string{"kw1", "kw2"}, metadata.PictureMetadata{Keywords: []string{"kw0", "kw2"}}, true},
+		{"keywordMismatch", nil, []string{"kw1"}, metadata.PictureMetadata{Keywords: []string{"kw0"}}, false},
+		{"bothMatch", []string{"image/jpeg"}, []string{"kw1"}, metadata.PictureMetadata{MimeType: &jpeg, Keywords: []string{"kw1"}}, true},
+		{"onlyMimeMatch", []string{"image/jpeg"}, []string{"kw1"}, metadata.PictureMetadata{MimeType: &jpeg}, false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			p := Plugin{MimeTypes: tc.inMime, Keywords: tc.inKeywords}
+			assert.Equal(t, tc.expEnabled, p.enabled(tc.inMeta))
+		})
+	}
+}
+
+func runEnricher(t *testing.T, e *Enricher, in ...metadata.PictureMetadata) map[string]metadata.PictureMetadata {
+	inChan := make(chan metadata.PictureMetadata, len(in))
+	outChan := make(chan metadata.PictureMetadata, len(in))
+	for _, cur := range in {
+		inChan <- cur
+	}
+	close(inChan)
+	assert.Nil(t, e.Enrich(context.Background(), inChan, outChan))
+	res := make(map[string]metadata.PictureMetadata)
+	for cur := range outChan {
+		res[cur.FileID] = cur
+	}
+	return res
+}
+
+func TestEnrich(t *testing.T) {
+	mu := sync.Mutex{}
+	failures := []string{}
+	timeout := shPlugin("timeout", `sleep 5`)
+	timeout.Timeout = 100 * time.Millisecond
+	skipped := shPlugin("skipped", `echo '{"Skipped":true}'`)
+	skipped.Keywords = []string{"kw"}
+	e, err := NewEnricher(2,
+		WithPlugin(shPlugin("add", `cat > /dev/null; echo '{"A":1,"B":"b"}'`)),
+		WithPlugin(shPlugin("echo", `printf '{"Request":'; cat; printf '}'`)),
+		WithPlugin(shPlugin("remove", `cat > /dev/null; echo '{"B":null,"FileName":"other.jpg"}'`)),
+		WithPlugin(shPlugin("fail", `echo boom >&2; exit 1`)),
+		WithPlugin(shPlugin("garbage", `echo garbage`)),
+		WithPlugin(timeout),
+		WithPlugin(skipped),
+		OnEnrichmentFailed(func(m metadata.PictureMetadata, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			failures = append(failures, m.FileID)
+		}),
+	)
+	assert.Nil(t, err)
+
+	res := runEnricher(t, e,
+		metadata.PictureMetadata{FileID: "id1", FileName: "f1.jpg", SourceFile: "/a/f1.jpg"},
+		metadata.PictureMetadata{FileID: "id2", FileName: "f2.jpg", SourceFile: "/a/f2.jpg"},
+	)
+	assert.Len(t, res, 2)
+	assert.Len(t, failures, 6)
+	for id, path := range map[string]string{"id1": "/a/f1.jpg", "id2": "/a/f2.jpg"} {
+		m := res[id]
+		assert.Equal(t, path, m.SourceFile)
+		assert.Len(t, m.Fields, 2)
+		assert.Equal(t, json.RawMessage("1"), m.Fields["A"])
+		// each plugin receives the fields added by the previous ones
+		req := Request{}
+		assert.Nil(t, json.Unmarshal(m.Fields["Request"].(json.RawMessage), &req))
+		assert.Equal(t, path, req.Path)
+		doc := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal(req.Document, &doc))
+		assert.Equal(t, float64(1), doc["A"])
+		assert.Equal(t, "b", doc["B"])
+		// the built-in fields can't be overridden
+		b, err := json.Marshal(m)
+		assert.Nil(t, err)
+		assert.Contains(t, string(b), `"FileName":"`+m.FileName+`"`)
+	}
+}
+
+func TestEnrich_Canceled(t *testing.T) {
+	e, err := NewEnricher(1, WithPlugin(shPlugin("p", `echo '{}'`)))
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	in := make(chan metadata.PictureMetadata)
+	out := make(chan metadata.PictureMetadata)
+	assert.Nil(t, e.Enrich(ctx, in, out))
+	_, ok := <-out
+	assert.False(t, ok)
+}
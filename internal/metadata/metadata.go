@@ -2,12 +2,15 @@ package metadata
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/barasher/picdexer/internal/browse"
 	"github.com/barasher/picdexer/internal/common"
+	"github.com/barasher/picdexer/internal/metrics"
 	"github.com/rs/zerolog/log"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,36 +31,135 @@ const (
 	captureDateKey = "CreateDate"
 	gpsKey         = "GPSPosition"
 	isoKey         = "ISO"
+	orientationKey = "Orientation"
 
 	srcDateFormat = "2006:01:02 15:04:05"
 )
 
 var defaultDate = uint64(0)
 
+// orientations maps the exiftool descriptions of the EXIF orientation to its
+// numerical value
+var orientations = map[string]uint64{
+	"Horizontal (normal)":                 1,
+	"Mirror horizontal":                   2,
+	"Rotate 180":                          3,
+	"Mirror vertical":                     4,
+	"Mirror horizontal and rotate 270 CW": 5,
+	"Rotate 90 CW":                        6,
+	"Mirror horizontal and rotate 90 CW":  7,
+	"Rotate 270 CW":                       8,
+}
+
 type PictureMetadata struct {
-	FileID       string `json:"-"`
-	FileName     string
-	Folder       string
-	ImportID     string
-	FileSize     uint64
-	ISO          *uint64    `json:",omitempty"`
-	Aperture     *float64   `json:",omitempty"`
-	ShutterSpeed *string    `json:",omitempty"`
-	Keywords     []string   `json:",omitempty"`
-	CameraModel  *string    `json:",omitempty"`
-	LensModel    *string    `json:",omitempty"`
-	MimeType     *string    `json:",omitempty"`
-	Height       *uint64    `json:",omitempty"`
-	Width        *uint64    `json:",omitempty"`
-	Date         *uint64    `json:",omitempty"`
-	ParsedDate   *time.Time `json:"-"`
-	GPS          *string    `json:",omitempty"`
-	SourceFile   string     `json:"-"`
+	FileID         string `json:"-"`
+	FileName       string
+	Folder         string
+	ImportID       string
+	FileSize       uint64
+	ISO            *uint64        `json:",omitempty"`
+	Aperture       *float64       `json:",omitempty"`
+	ShutterSpeed   *string        `json:",omitempty"`
+	Keywords       []string       `json:",omitempty"`
+	CameraModel    *string        `json:",omitempty"`
+	LensModel      *string        `json:",omitempty"`
+	MimeType       *string        `json:",omitempty"`
+	Height         *uint64        `json:",omitempty"`
+	Width          *uint64        `json:",omitempty"`
+	Orientation    *uint64        `json:",omitempty"`
+	DisplayHeight  *uint64        `json:",omitempty"`
+	DisplayWidth   *uint64        `json:",omitempty"`
+	Date           *uint64        `json:",omitempty"`
+	ParsedDate     *time.Time     `json:"-"`
+	GPS            *string        `json:",omitempty"`
+	SourceFile     string         `json:"-"`
+	Renditions     []RenditionRef `json:",omitempty"`
+	ResizeStrategy *string        `json:",omitempty"`
+	StorageError   *string        `json:",omitempty"`
+	Archive        *ArchiveRef    `json:",omitempty"`
+	// Fields are the additional fields of the document (set by the
+	// enrichment plugins), they can't override the fields above
+	Fields map[string]interface{} `json:"-"`
+}
+
+// builtinFields are the names of the fields of the documents defined by
+// PictureMetadata
+var builtinFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(PictureMetadata{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.SplitN(t.Field(i).Tag.Get("json"), ",", 2)[0]
+		switch name {
+		case "-":
+		case "":
+			fields[t.Field(i).Name] = true
+		default:
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// IsBuiltinField returns true if the field of the documents is defined by
+// PictureMetadata.
+func IsBuiltinField(name string) bool {
+	return builtinFields[name]
+}
+
+// MarshalJSON adds the additional fields to the document.
+func (m PictureMetadata) MarshalJSON() ([]byte, error) {
+	type doc PictureMetadata
+	b, err := json.Marshal(doc(m))
+	if err != nil || len(m.Fields) == 0 {
+		return b, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("error while decoding document: %w", err)
+	}
+	for k, v := range m.Fields {
+		if IsBuiltinField(k) {
+			continue
+		}
+		if fields[k], err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("error while encoding field %v: %w", k, err)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// RenditionRef describes a stored file. Dimensions, size and storage date
+// (milliseconds since epoch) are set if known.
+type RenditionRef struct {
+	Name     string
+	Key      string
+	Url      string  `json:",omitempty"`
+	Width    *uint64 `json:",omitempty"`
+	Height   *uint64 `json:",omitempty"`
+	Size     *uint64 `json:",omitempty"`
+	Backend  string  `json:",omitempty"`
+	StoredAt *uint64 `json:",omitempty"`
+}
+
+// ArchiveRef describes the archived original of a picture, stored under the
+// SHA-256 of its content.
+type ArchiveRef struct {
+	Key      string
+	Url      string `json:",omitempty"`
+	Backend  string `json:",omitempty"`
+	Sha256   string
+	Size     *uint64 `json:",omitempty"`
+	StoredAt *uint64 `json:",omitempty"`
 }
 
 type MetadataExtractor struct {
 	threadCount int
 	exif        *exif.Exiftool
+	onExtracted func(PictureMetadata)
+	onFailed    func(browse.Task, error)
+	scrubGPS    func(PictureMetadata) bool
+	exclude     func(PictureMetadata) bool
+	onExcluded  func(PictureMetadata)
 }
 
 func NewMetadataExtractor(threadCount int, opts ...func(*MetadataExtractor) error) (*MetadataExtractor, error) {
@@ -80,6 +182,48 @@ func NewMetadataExtractor(threadCount int, opts ...func(*MetadataExtractor) erro
 	return e, nil
 }
 
+func OnExtracted(f func(PictureMetadata)) func(*MetadataExtractor) error {
+	return func(ext *MetadataExtractor) error {
+		ext.onExtracted = f
+		return nil
+	}
+}
+
+// OnExtractionFailed registers a function that is called for each picture
+// whose metadata can't be extracted.
+func OnExtractionFailed(f func(browse.Task, error)) func(*MetadataExtractor) error {
+	return func(ext *MetadataExtractor) error {
+		ext.onFailed = f
+		return nil
+	}
+}
+
+// ScrubGPS removes the GPS position of the pictures for which f returns true.
+func ScrubGPS(f func(PictureMetadata) bool) func(*MetadataExtractor) error {
+	return func(ext *MetadataExtractor) error {
+		ext.scrubGPS = f
+		return nil
+	}
+}
+
+// Exclude doesn't forward the extracted metadata of the pictures for which f
+// returns true.
+func Exclude(f func(PictureMetadata) bool) func(*MetadataExtractor) error {
+	return func(ext *MetadataExtractor) error {
+		ext.exclude = f
+		return nil
+	}
+}
+
+// OnExcluded registers a function that is called for each picture whose
+// metadata are not forwarded because of Exclude.
+func OnExcluded(f func(PictureMetadata)) func(*MetadataExtractor) error {
+	return func(ext *MetadataExtractor) error {
+		ext.onExcluded = f
+		return nil
+	}
+}
+
 func (ext *MetadataExtractor) Close() error {
 	if ext.exif != nil {
 		if err := ext.exif.Close(); err != nil {
@@ -107,7 +251,19 @@ func (ext *MetadataExtractor) ExtractMetadata(ctx context.Context, inTaskChan ch
 					picMeta, err := ext.extractMetadataFromFile(ctx, task)
 					if err != nil {
 						log.Error().Str(common.LogFileIdentifier, task.Path).Msgf("conversion error: %v", err)
+						if ext.onFailed != nil {
+							ext.onFailed(task, err)
+						}
 					} else {
+						if ext.onExtracted != nil {
+							ext.onExtracted(picMeta)
+						}
+						if ext.exclude != nil && ext.exclude(picMeta) {
+							if ext.onExcluded != nil {
+								ext.onExcluded(picMeta)
+							}
+							continue
+						}
 						outPicMetaChan <- picMeta
 					}
 				}
@@ -125,7 +281,9 @@ func (ext *MetadataExtractor) extractMetadataFromFile(ctx context.Context, task
 	log.Info().Str(common.LogFileIdentifier, task.Path).Msg("Extracting metadata...")
 	pic := PictureMetadata{}
 
+	start := time.Now()
 	metas := ext.exif.ExtractMetadata(task.Path)
+	metrics.Get(ctx).ToolRan("exiftool", time.Since(start))
 	if len(metas) != 1 {
 		return pic, fmt.Errorf("wrong metadata count (%v)", len(metas))
 	}
@@ -141,6 +299,8 @@ func (ext *MetadataExtractor) extractMetadataFromFile(ctx context.Context, task
 	pic.MimeType = getString(meta, mimeTypeKey)
 	pic.Height = getInt64(meta, heightKey)
 	pic.Width = getInt64(meta, widthKey)
+	pic.Orientation = getOrientation(meta, orientationKey)
+	pic.DisplayWidth, pic.DisplayHeight = displayDimensions(pic.Width, pic.Height, pic.Orientation)
 	pic.Keywords = getStrings(meta, keywordsKey)
 	pic.FileSize = uint64(task.Info.Size())
 	pic.FileName = task.Info.Name()
@@ -152,6 +312,9 @@ func (ext *MetadataExtractor) extractMetadataFromFile(ctx context.Context, task
 	if len(components) > 1 {
 		pic.Folder = components[len(components)-2]
 	}
+	if ext.scrubGPS != nil && ext.scrubGPS(pic) {
+		pic.GPS = nil
+	}
 
 	return pic, nil
 }
@@ -214,6 +377,32 @@ func getDate(m exif.FileMetadata, k string) *uint64 {
 	return &defaultDate
 }
 
+func getOrientation(m exif.FileMetadata, k string) *uint64 {
+	if _, found := m.Fields[k]; !found {
+		return nil
+	}
+	if v, err := m.GetInt(k); err == nil && v >= 1 && v <= 8 {
+		uv := uint64(v)
+		return &uv
+	}
+	if strO := getString(m, k); strO != nil {
+		if o, found := orientations[*strO]; found {
+			return &o
+		}
+		log.Warn().Str(common.LogFileIdentifier, m.File).Msgf("unsupported orientation from field %v (%v)", k, *strO)
+	}
+	return nil
+}
+
+// displayDimensions returns the dimensions of the picture once displayed
+// upright : they are swapped if the orientation rotates the picture by 90°.
+func displayDimensions(w *uint64, h *uint64, o *uint64) (*uint64, *uint64) {
+	if o != nil && *o >= 5 && *o <= 8 {
+		return h, w
+	}
+	return w, h
+}
+
 func getGPS(m exif.FileMetadata, k string) *string {
 	if rawGPS := getString(m, k); rawGPS != nil {
 		lat, long, err := convertGPSCoordinates(*rawGPS)
@@ -2,6 +2,7 @@ package metadata
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	exif "github.com/barasher/go-exiftool"
 	"github.com/barasher/picdexer/internal/browse"
@@ -359,3 +360,152 @@ func TestExtractMetadata(t *testing.T) {
 	assert.Equal(t, 1, len(pics))
 	checkTestdataPictureResult(t, pics[0])
 }
+
+func TestOnExtracted(t *testing.T) {
+	extracted := []string{}
+	ext := &MetadataExtractor{}
+	assert.Nil(t, OnExtracted(func(p PictureMetadata) {
+		extracted = append(extracted, p.FileID)
+	})(ext))
+	ext.onExtracted(PictureMetadata{FileID: "id1"})
+	assert.Equal(t, []string{"id1"}, extracted)
+}
+
+func TestScrubGPS(t *testing.T) {
+	scrubbed := []string{}
+	ext, err := NewMetadataExtractor(1, ScrubGPS(func(p PictureMetadata) bool {
+		scrubbed = append(scrubbed, p.Keywords...)
+		return true
+	}))
+	assert.Nil(t, err)
+	defer ext.Close()
+
+	f := "../../testdata/picture.jpg"
+	fInfo, err := os.Stat(f)
+	assert.Nil(t, err)
+	m, err := ext.extractMetadataFromFile(context.TODO(), browse.Task{Path: f, Info: fInfo, FileID: "fileId42"})
+	assert.Nil(t, err)
+	assert.Nil(t, m.GPS)
+	assert.Equal(t, []string{"keyword"}, scrubbed)
+}
+
+func TestExclude(t *testing.T) {
+	inChan := make(chan browse.Task, 2)
+	outChan := make(chan PictureMetadata, 2)
+	f := "../../testdata/picture.jpg"
+	fInfo, err := os.Stat(f)
+	assert.Nil(t, err)
+	inChan <- browse.Task{Path: f, Info: fInfo, FileID: "excluded"}
+	inChan <- browse.Task{Path: f, Info: fInfo, FileID: "included"}
+	close(inChan)
+
+	extracted, excluded := []string{}, []string{}
+	ext, err := NewMetadataExtractor(1, OnExtracted(func(p PictureMetadata) {
+		extracted = append(extracted, p.FileID)
+	}), Exclude(func(p PictureMetadata) bool {
+		return p.FileID == "excluded"
+	}), OnExcluded(func(p PictureMetadata) {
+		excluded = append(excluded, p.FileID)
+	}))
+	assert.Nil(t, err)
+	defer ext.Close()
+	assert.Nil(t, ext.ExtractMetadata(context.TODO(), inChan, outChan))
+
+	forwarded := []string{}
+	for cur := range outChan {
+		forwarded = append(forwarded, cur.FileID)
+	}
+	assert.Equal(t, []string{"excluded", "included"}, extracted)
+	assert.Equal(t, []string{"included"}, forwarded)
+	assert.Equal(t, []string{"excluded"}, excluded)
+}
+
+func TestGetOrientation(t *testing.T) {
+	meta := exif.FileMetadata{
+		File: "aFile",
+		Fields: map[string]interface{}{
+			"numeric":     float64(6),
+			"outOfRange":  float64(12),
+			"description": "Rotate 270 CW",
+			"unknown":     "blabla",
+		},
+	}
+
+	var tcs = []struct {
+		inKey     string
+		expValNil bool
+		expVal    uint64
+	}{
+		{"numeric", false, 6},
+		{"outOfRange", true, 0},
+		{"description", false, 8},
+		{"unknown", true, 0},
+		{"nonExisting", true, 0},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.inKey, func(t *testing.T) {
+			v := getOrientation(meta, tc.inKey)
+			if tc.expValNil {
+				assert.Nil(t, v)
+			} else {
+				assert.NotNil(t, v)
+				assert.Equal(t, tc.expVal, *v)
+			}
+		})
+	}
+}
+
+func TestDisplayDimensions(t *testing.T) {
+	w := uint64(640)
+	h := uint64(480)
+	o1 := uint64(1)
+	o6 := uint64(6)
+
+	var tcs = []struct {
+		tcID string
+		inO  *uint64
+		expW *uint64
+		expH *uint64
+	}{
+		{"noOrientation", nil, &w, &h},
+		{"normal", &o1, &w, &h},
+		{"rotated", &o6, &h, &w},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			dw, dh := displayDimensions(&w, &h, tc.inO)
+			assert.Equal(t, *tc.expW, *dw)
+			assert.Equal(t, *tc.expH, *dh)
+		})
+	}
+}
+
+func TestPictureMetadata_MarshalJSON(t *testing.T) {
+	d := uint64(1600000000000)
+	var tcs = []struct {
+		tcID     string
+		inFields map[string]interface{}
+		expJSON  string
+	}{
+		{"noField", nil, `{"FileName":"f.jpg","Folder":"","ImportID":"","FileSize":0,"Date":1600000000000}`},
+		{"fields", map[string]interface{}{"Labels": []string{"cat"}, "Project": "p1"}, `{"Date":1600000000000,"FileName":"f.jpg","FileSize":0,"Folder":"","ImportID":"","Labels":["cat"],"Project":"p1"}`},
+		{"builtinIgnored", map[string]interface{}{"FileName": "other.jpg", "Date": 1}, `{"Date":1600000000000,"FileName":"f.jpg","FileSize":0,"Folder":"","ImportID":""}`},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			b, err := json.Marshal(PictureMetadata{FileID: "id", FileName: "f.jpg", Date: &d, Fields: tc.inFields})
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expJSON, string(b))
+		})
+	}
+}
+
+func TestIsBuiltinField(t *testing.T) {
+	assert.True(t, IsBuiltinField("FileName"))
+	assert.True(t, IsBuiltinField("Renditions"))
+	assert.False(t, IsBuiltinField("FileID"))
+	assert.False(t, IsBuiltinField("Fields"))
+	assert.False(t, IsBuiltinField("Labels"))
+}
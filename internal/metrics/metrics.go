@@ -0,0 +1,276 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	metricsCtxKey = "metrics"
+
+	OutcomeProcessed = "processed"
+	OutcomeSkipped   = "skipped"
+	OutcomeFailed    = "failed"
+
+	prefix = "picdexer_"
+)
+
+// durationBuckets are the upper bounds (in seconds) of the histograms
+// buckets : from a quick exiftool call to a slow bulk or RAW conversion.
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	s := d.Seconds()
+	for i, b := range durationBuckets {
+		if s <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+type fileKey struct {
+	stage   string
+	outcome string
+}
+
+// Metrics holds the metrics of the imports, exposed in the Prometheus text
+// format. It can be used concurrently, a nil Metrics ignoring everything.
+type Metrics struct {
+	mu          sync.Mutex
+	files       map[fileKey]uint64
+	bulks       map[string]uint64
+	bulkLatency histogram
+	uploaded    map[string]uint64
+	tools       map[string]*histogram
+	lastSuccess time.Time
+	queues      map[string]func() int
+}
+
+func New() *Metrics {
+	return &Metrics{
+		files:    make(map[fileKey]uint64),
+		bulks:    make(map[string]uint64),
+		uploaded: make(map[string]uint64),
+		tools:    make(map[string]*histogram),
+		queues:   make(map[string]func() int),
+	}
+}
+
+// WithMetrics returns a context in which the pipeline records its metrics.
+func WithMetrics(ctx context.Context, m *Metrics) context.Context {
+	return context.WithValue(ctx, metricsCtxKey, m)
+}
+
+// Get returns the metrics of the context, nil if none.
+func Get(ctx context.Context) *Metrics {
+	if v := ctx.Value(metricsCtxKey); v != nil {
+		return v.(*Metrics)
+	}
+	return nil
+}
+
+// File counts a file handled by a stage.
+func (m *Metrics) File(stage string, outcome string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[fileKey{stage: stage, outcome: outcome}]++
+}
+
+// BulkSent records the duration of an Elasticsearch bulk request.
+func (m *Metrics) BulkSent(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	outcome := OutcomeProcessed
+	if err != nil {
+		outcome = OutcomeFailed
+	}
+	m.bulks[outcome]++
+	m.bulkLatency.observe(d)
+}
+
+// Uploaded counts the bytes sent to a storage backend.
+func (m *Metrics) Uploaded(backend string, n int64) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploaded[backend] += uint64(n)
+}
+
+// ToolRan records the duration of an external tool (exiftool, convert...).
+func (m *Metrics) ToolRan(tool string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.tools[tool]
+	if !ok {
+		h = &histogram{}
+		m.tools[tool] = h
+	}
+	h.observe(d)
+}
+
+// Succeeded records the time of the last successful iteration.
+func (m *Metrics) Succeeded(t time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastSuccess = t
+}
+
+// Queue registers a function that returns the depth of a queue, until the
+// returned function is called.
+func (m *Metrics) Queue(name string, depth func() int) func() {
+	if m == nil {
+		return func() {}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queues[name] = depth
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.queues, name)
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+type writer struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *writer) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(w.w, format, args...)
+	w.n += int64(n)
+	w.err = err
+}
+
+func (w *writer) header(name string, typ string, help string) {
+	w.printf("# HELP %v%v %v\n# TYPE %v%v %v\n", prefix, name, help, prefix, name, typ)
+}
+
+func (w *writer) histogram(name string, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range durationBuckets {
+		var c uint64
+		if h.counts != nil {
+			c = h.counts[i]
+		}
+		w.printf("%v%v_bucket{%v%vle=\"%v\"} %v\n", prefix, name, labels, sep, formatFloat(b), c)
+	}
+	w.printf("%v%v_bucket{%v%vle=\"+Inf\"} %v\n", prefix, name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	w.printf("%v%v_sum%v %v\n", prefix, name, labels, formatFloat(h.sum))
+	w.printf("%v%v_count%v %v\n", prefix, name, labels, h.count)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(out io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w := &writer{w: out}
+
+	w.header("files_total", "counter", "Files handled by each stage.")
+	keys := make([]fileKey, 0, len(m.files))
+	for k := range m.files {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].stage != keys[j].stage {
+			return keys[i].stage < keys[j].stage
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+	for _, k := range keys {
+		w.printf("%vfiles_total{stage=%q,outcome=%q} %v\n", prefix, k.stage, k.outcome, m.files[k])
+	}
+
+	w.header("queue_depth", "gauge", "Items waiting in the pipeline queues.")
+	names := make([]string, 0, len(m.queues))
+	for k := range m.queues {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		w.printf("%vqueue_depth{queue=%q} %v\n", prefix, k, m.queues[k]())
+	}
+
+	w.header("es_bulks_total", "counter", "Elasticsearch bulk requests.")
+	for _, k := range sortedKeys(m.bulks) {
+		w.printf("%ves_bulks_total{outcome=%q} %v\n", prefix, k, m.bulks[k])
+	}
+	w.header("es_bulk_duration_seconds", "histogram", "Duration of the Elasticsearch bulk requests.")
+	w.histogram("es_bulk_duration_seconds", "", &m.bulkLatency)
+
+	w.header("upload_bytes_total", "counter", "Bytes sent to the storage backends.")
+	for _, k := range sortedKeys(m.uploaded) {
+		w.printf("%vupload_bytes_total{backend=%q} %v\n", prefix, k, m.uploaded[k])
+	}
+
+	w.header("tool_duration_seconds", "histogram", "Duration of the external tools runs.")
+	tools := make([]string, 0, len(m.tools))
+	for k := range m.tools {
+		tools = append(tools, k)
+	}
+	sort.Strings(tools)
+	for _, k := range tools {
+		w.histogram("tool_duration_seconds", fmt.Sprintf("tool=%q", k), m.tools[k])
+	}
+
+	w.header("last_success_timestamp_seconds", "gauge", "Time of the last successful iteration.")
+	var last float64
+	if !m.lastSuccess.IsZero() {
+		last = float64(m.lastSuccess.UnixNano()) / 1e9
+	}
+	w.printf("%vlast_success_timestamp_seconds %v\n", prefix, formatFloat(last))
+	return w.n, w.err
+}
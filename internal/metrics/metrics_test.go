@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func write(t *testing.T, m *Metrics) string {
+	b := bytes.Buffer{}
+	n, err := m.WriteTo(&b)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(b.Len()), n)
+	return b.String()
+}
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	m.File("store", OutcomeProcessed)
+	m.File("store", OutcomeProcessed)
+	m.File("index", OutcomeFailed)
+	m.BulkSent(200*time.Millisecond, nil)
+	m.BulkSent(3*time.Second, fmt.Errorf("error"))
+	m.Uploaded("s3", 1000)
+	m.Uploaded("s3", 24)
+	m.Uploaded("fs", 0)
+	m.ToolRan("convert", 20*time.Millisecond)
+	m.Succeeded(time.Unix(1600000000, 500000000))
+	q := []int{1, 2}
+	unregister := m.Queue("browse", func() int { return len(q) })
+
+	out := write(t, m)
+	var tcs = []struct {
+		tcID   string
+		expOut string
+	}{
+		{"filesProcessed", `picdexer_files_total{stage="store",outcome="processed"} 2`},
+		{"filesFailed", `picdexer_files_total{stage="index",outcome="failed"} 1`},
+		{"queue", `picdexer_queue_depth{queue="browse"} 2`},
+		{"bulksProcessed", `picdexer_es_bulks_total{outcome="processed"} 1`},
+		{"bulksFailed", `picdexer_es_bulks_total{outcome="failed"} 1`},
+		{"bulkBucket", `picdexer_es_bulk_duration_seconds_bucket{le="0.25"} 1`},
+		{"bulkBucket2", `picdexer_es_bulk_duration_seconds_bucket{le="5"} 2`},
+		{"bulkInf", `picdexer_es_bulk_duration_seconds_bucket{le="+Inf"} 2`},
+		{"bulkSum", "picdexer_es_bulk_duration_seconds_sum 3.2"},
+		{"bulkCount", "picdexer_es_bulk_duration_seconds_count 2"},
+		{"upload", `picdexer_upload_bytes_total{backend="s3"} 1024`},
+		{"toolBucket", `picdexer_tool_duration_seconds_bucket{tool="convert",le="0.01"} 0`},
+		{"toolBucket2", `picdexer_tool_duration_seconds_bucket{tool="convert",le="0.05"} 1`},
+		{"toolCount", `picdexer_tool_duration_seconds_count{tool="convert"} 1`},
+		{"lastSuccess", "picdexer_last_success_timestamp_seconds 1600000000.5"},
+		{"type", "# TYPE picdexer_files_total counter"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Contains(t, out, tc.expOut+"\n")
+		})
+	}
+	assert.NotContains(t, out, `backend="fs"`)
+
+	unregister()
+	assert.NotContains(t, write(t, m), `queue="browse"`)
+}
+
+func TestMetrics_Empty(t *testing.T) {
+	out := write(t, New())
+	assert.Contains(t, out, "picdexer_es_bulk_duration_seconds_count 0\n")
+	assert.Contains(t, out, "picdexer_last_success_timestamp_seconds 0\n")
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	var m *Metrics
+	m.File("store", OutcomeProcessed)
+	m.BulkSent(time.Second, nil)
+	m.Uploaded("s3", 1)
+	m.ToolRan("convert", time.Second)
+	m.Succeeded(time.Now())
+	m.Queue("browse", func() int { return 0 })()
+}
+
+func TestContext(t *testing.T) {
+	assert.Nil(t, Get(context.TODO()))
+	m := New()
+	assert.Equal(t, m, Get(WithMetrics(context.TODO(), m)))
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	checkTimeout    = 5 * time.Second
+	shutdownTimeout = 5 * time.Second
+	statusOk        = "ok"
+	statusKo        = "ko"
+)
+
+// Check probes a dependency, an error meaning it is not reachable.
+type Check struct {
+	Name  string
+	Probe func(ctx context.Context) error
+}
+
+// Health is the body of the health endpoints.
+type Health struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Handler serves the metrics on /metrics, the liveness on /healthz and the
+// readiness on /readyz : the instance is ready when all the checks pass.
+func Handler(m *Metrics, checks ...Check) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if _, err := m.WriteTo(w); err != nil {
+			log.Warn().Msgf("Error while writing metrics: %v", err)
+		}
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, Health{Status: statusOk})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, probe(r.Context(), checks))
+	})
+	return mux
+}
+
+func probe(ctx context.Context, checks []Check) Health {
+	h := Health{Status: statusOk, Checks: make(map[string]string)}
+	for _, c := range checks {
+		cctx, cancel := context.WithTimeout(ctx, checkTimeout)
+		err := c.Probe(cctx)
+		cancel()
+		if err != nil {
+			log.Warn().Msgf("%v is not reachable: %v", c.Name, err)
+			h.Status = statusKo
+			h.Checks[c.Name] = err.Error()
+		} else {
+			h.Checks[c.Name] = statusOk
+		}
+	}
+	return h
+}
+
+func writeHealth(w http.ResponseWriter, h Health) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.Status != statusOk {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(h); err != nil {
+		log.Warn().Msgf("Error while writing health: %v", err)
+	}
+}
+
+// Serve listens on addr and serves the handler in the background. The
+// returned function stops the server.
+func Serve(addr string, h http.Handler) (func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error while listening on %v: %w", addr, err)
+	}
+	srv := &http.Server{Handler: h}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Msgf("Error while serving metrics: %v", err)
+		}
+	}()
+	log.Info().Msgf("Serving metrics and health on %v", l.Addr())
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warn().Msgf("Error while stopping metrics server: %v", err)
+		}
+		<-done
+	}, nil
+}
+
+// HTTPProbe returns a probe that succeeds if the url answers without a
+// server error.
+func HTTPProbe(url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return fmt.Errorf("error while building request: %w", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("wrong status code (%v)", resp.StatusCode)
+		}
+		return nil
+	}
+}
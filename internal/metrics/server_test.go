@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	okCheck := Check{Name: "ok", Probe: func(ctx context.Context) error { return nil }}
+	koCheck := Check{Name: "ko", Probe: func(ctx context.Context) error { return fmt.Errorf("unreachable") }}
+
+	var tcs = []struct {
+		tcID      string
+		inChecks  []Check
+		inPath    string
+		expStatus int
+		expHealth *Health
+	}{
+		{"metrics", nil, "/metrics", http.StatusOK, nil},
+		{"healthz", []Check{koCheck}, "/healthz", http.StatusOK, &Health{Status: statusOk}},
+		{"readyzOk", []Check{okCheck}, "/readyz", http.StatusOK, &Health{Status: statusOk, Checks: map[string]string{"ok": statusOk}}},
+		{"readyzKo", []Check{okCheck, koCheck}, "/readyz", http.StatusServiceUnavailable, &Health{Status: statusKo, Checks: map[string]string{"ok": statusOk, "ko": "unreachable"}}},
+		{"readyzNoCheck", nil, "/readyz", http.StatusOK, &Health{Status: statusOk}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			ts := httptest.NewServer(Handler(New(), tc.inChecks...))
+			defer ts.Close()
+			resp, err := http.Get(ts.URL + tc.inPath)
+			assert.Nil(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tc.expStatus, resp.StatusCode)
+			if tc.expHealth == nil {
+				assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain"))
+				return
+			}
+			var h Health
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(&h))
+			assert.Equal(t, *tc.expHealth, h)
+		})
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		inStatus int
+		expError bool
+	}{
+		{"ok", http.StatusOK, false},
+		{"notFound", http.StatusNotFound, false},
+		{"serverError", http.StatusBadGateway, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.inStatus)
+			}))
+			defer ts.Close()
+			assert.Equal(t, tc.expError, HTTPProbe(ts.URL)(context.TODO()) != nil)
+		})
+	}
+}
+
+func TestHTTPProbe_Unreachable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+	assert.NotNil(t, HTTPProbe(ts.URL)(context.TODO()))
+}
+
+func TestServe(t *testing.T) {
+	stop, err := Serve("127.0.0.1:0", Handler(New()))
+	assert.Nil(t, err)
+	stop()
+}
+
+func TestServe_WrongAddress(t *testing.T) {
+	_, err := Serve("wrong:address:1", Handler(New()))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,306 @@
+package privacy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	exif "github.com/barasher/go-exiftool"
+	"github.com/barasher/picdexer/internal/browse"
+	"github.com/barasher/picdexer/internal/common"
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ExcludeNone    = ""
+	ExcludeStorage = "storage"
+	ExcludeIndex   = "index"
+	ExcludeAll     = "all"
+
+	keywordsKey = "Keywords"
+)
+
+// Rule matches pictures by keyword, by folder (any folder of the path) or by
+// path glob. A picture matched by a rule is excluded from the storage, from
+// the indexation or from both, and its location is scrubbed if required.
+type Rule struct {
+	Keywords []string
+	Folders  []string
+	Paths    []string
+	Exclude  string
+	ScrubGPS bool
+}
+
+// Conf configures the privacy policy. ScrubGPS scrubs the location of all the
+// pictures.
+type Conf struct {
+	Rules    []Rule
+	ScrubGPS bool
+}
+
+type decision struct {
+	noStorage bool
+	noIndex   bool
+	scrubGPS  bool
+}
+
+// entry is the decision of a picture, kept until the storage (location of
+// the stored files) and the indexation (references of the excluded stored
+// files) have consumed it.
+type entry struct {
+	d            decision
+	storePending bool
+	indexPending bool
+}
+
+// Policy applies the privacy rules. The keywords are read with exiftool for
+// the storage, the indexation uses the extracted keywords.
+type Policy struct {
+	rules    []Rule
+	scrubGPS bool
+	exif     *exif.Exiftool
+	keywords func(path string) ([]string, error)
+	mu       sync.Mutex
+	cache    map[string]*entry
+}
+
+func validateRules(rules []Rule) error {
+	for i, r := range rules {
+		if len(r.Keywords) == 0 && len(r.Folders) == 0 && len(r.Paths) == 0 {
+			return fmt.Errorf("privacy rule %v matches nothing", i)
+		}
+		switch r.Exclude {
+		case ExcludeNone, ExcludeStorage, ExcludeIndex, ExcludeAll:
+		default:
+			return fmt.Errorf("privacy rule %v: unsupported exclusion (%v)", i, r.Exclude)
+		}
+		if r.Exclude == ExcludeNone && !r.ScrubGPS {
+			return fmt.Errorf("privacy rule %v has no effect", i)
+		}
+		for _, p := range r.Paths {
+			if _, err := filepath.Match(p, ""); err != nil {
+				return fmt.Errorf("privacy rule %v: wrong path glob (%v): %w", i, p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// NewPolicy creates a Policy. Exiftool is used to read the keywords if a rule
+// matches keywords.
+func NewPolicy(c Conf) (*Policy, error) {
+	if err := validateRules(c.Rules); err != nil {
+		return nil, err
+	}
+	p := &Policy{rules: c.Rules, scrubGPS: c.ScrubGPS, cache: make(map[string]*entry)}
+	for _, r := range c.Rules {
+		if len(r.Keywords) > 0 {
+			et, err := exif.NewExiftool()
+			if err != nil {
+				return nil, fmt.Errorf("error while initializing Exiftool: %w", err)
+			}
+			p.exif = et
+			p.keywords = p.readKeywords
+			break
+		}
+	}
+	return p, nil
+}
+
+func (p *Policy) Close() error {
+	if p.exif != nil {
+		return p.exif.Close()
+	}
+	return nil
+}
+
+func (p *Policy) readKeywords(path string) ([]string, error) {
+	metas := p.exif.ExtractMetadata(path)
+	if len(metas) != 1 {
+		return nil, fmt.Errorf("wrong metadata count (%v)", len(metas))
+	}
+	if metas[0].Err != nil {
+		return nil, metas[0].Err
+	}
+	k, err := metas[0].GetStrings(keywordsKey)
+	if err != nil && !errors.Is(err, exif.ErrKeyNotFound) {
+		return nil, err
+	}
+	return k, nil
+}
+
+func matchesFolder(path string, folders []string) bool {
+	dirs := strings.Split(filepath.Dir(path), string(os.PathSeparator))
+	for _, d := range dirs {
+		for _, f := range folders {
+			if d == f {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesPath matches the globs against the path and, for the globs without
+// separator, against the file name.
+func matchesPath(path string, globs []string) bool {
+	for _, g := range globs {
+		target := path
+		if !strings.ContainsRune(g, os.PathSeparator) {
+			target = filepath.Base(path)
+		}
+		if ok, _ := filepath.Match(g, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesKeywords(keywords []string, expected []string) bool {
+	for _, k := range keywords {
+		for _, e := range expected {
+			if strings.EqualFold(k, e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decide applies the rules to a picture. The keywords are only read if
+// needed : if they can't be read, the keyword rules are considered as
+// matching. Without keywords function, the keyword rules are ignored.
+func (p *Policy) decide(path string, keywords func() ([]string, error)) decision {
+	d := decision{scrubGPS: p.scrubGPS}
+	var kw []string
+	var kwErr error
+	kwRead := false
+	for _, r := range p.rules {
+		matched := matchesFolder(path, r.Folders) || matchesPath(path, r.Paths)
+		if !matched && len(r.Keywords) > 0 && keywords != nil {
+			if !kwRead {
+				kw, kwErr = keywords()
+				kwRead = true
+				if kwErr != nil {
+					log.Warn().Str(common.LogFileIdentifier, path).Msgf("Error while reading keywords, keyword privacy rules applied: %v", kwErr)
+				}
+			}
+			matched = kwErr != nil || matchesKeywords(kw, r.Keywords)
+		}
+		if !matched {
+			continue
+		}
+		d.noStorage = d.noStorage || r.Exclude == ExcludeStorage || r.Exclude == ExcludeAll
+		d.noIndex = d.noIndex || r.Exclude == ExcludeIndex || r.Exclude == ExcludeAll
+		d.scrubGPS = d.scrubGPS || r.ScrubGPS
+	}
+	return d
+}
+
+// readDecision applies the rules to a picture, its keywords being read if
+// needed.
+func (p *Policy) readDecision(t browse.Task) decision {
+	return p.decide(t.Path, func() ([]string, error) {
+		if p.keywords == nil {
+			return nil, nil
+		}
+		return p.keywords(t.Path)
+	})
+}
+
+// consume returns the decision of a picture and evicts it once the storage
+// and the indexation have consumed it, p.mu being held.
+func (p *Policy) consume(fileID string, consumed func(e *entry)) (decision, bool) {
+	e, found := p.cache[fileID]
+	if !found {
+		return decision{}, false
+	}
+	consumed(e)
+	if !e.storePending && !e.indexPending {
+		delete(p.cache, fileID)
+	}
+	return e.d, true
+}
+
+// Index returns true if a picture can be indexed according to the folder and
+// path rules, the keyword rules are applied by IndexMetadata once the
+// keywords are extracted.
+func (p *Policy) Index(t browse.Task) bool {
+	return !p.decide(t.Path, nil).noIndex
+}
+
+// IndexMetadata returns true if a picture can be indexed, the keyword rules
+// being applied on the extracted keywords.
+func (p *Policy) IndexMetadata(m metadata.PictureMetadata) bool {
+	d := p.decide(m.SourceFile, func() ([]string, error) {
+		return m.Keywords, nil
+	})
+	if d.noIndex {
+		log.Info().Str(common.LogFileIdentifier, m.SourceFile).Msg("Picture excluded from indexation by privacy rules")
+		return false
+	}
+	if d.noStorage {
+		// the references of the stored files are not indexed
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		e, found := p.cache[m.FileID]
+		if !found {
+			e = &entry{d: d}
+			p.cache[m.FileID] = e
+		}
+		e.indexPending = true
+	}
+	return true
+}
+
+// Store returns true if a picture can be stored.
+func (p *Policy) Store(t browse.Task) bool {
+	d := p.readDecision(t)
+	if d.noStorage {
+		log.Info().Str(common.LogFileIdentifier, t.Path).Msg("Picture excluded from storage by privacy rules")
+		return false
+	}
+	// the decision is kept for the location of the stored files
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, found := p.cache[t.FileID]
+	if !found {
+		e = &entry{d: d}
+		p.cache[t.FileID] = e
+	}
+	e.storePending = true
+	return true
+}
+
+// ScrubLocation returns true if the location of the stored files of a
+// picture has to be scrubbed.
+func (p *Policy) ScrubLocation(t browse.Task) bool {
+	p.mu.Lock()
+	d, found := p.consume(t.FileID, func(e *entry) { e.storePending = false })
+	p.mu.Unlock()
+	if !found {
+		d = p.readDecision(t)
+	}
+	return d.scrubGPS
+}
+
+// ScrubGPS returns true if the GPS position of a picture has to be removed
+// from its document. The extracted keywords are used.
+func (p *Policy) ScrubGPS(m metadata.PictureMetadata) bool {
+	return p.decide(m.SourceFile, func() ([]string, error) {
+		return m.Keywords, nil
+	}).scrubGPS
+}
+
+// StorageExcluded returns true if the storage of an indexed picture has been
+// excluded.
+func (p *Policy) StorageExcluded(fileID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, _ := p.consume(fileID, func(e *entry) { e.indexPending = false })
+	return d.noStorage
+}
@@ -0,0 +1,154 @@
+package privacy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/barasher/picdexer/internal/browse"
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPolicy(t *testing.T) {
+	var tcs = []struct {
+		tcID     string
+		inRules  []Rule
+		expError bool
+	}{
+		{"noRule", nil, false},
+		{"folder", []Rule{{Folders: []string{"kids"}, Exclude: ExcludeAll}}, false},
+		{"path", []Rule{{Paths: []string{"/photos/private/*"}, ScrubGPS: true}}, false},
+		{"matchesNothing", []Rule{{Exclude: ExcludeAll}}, true},
+		{"noEffect", []Rule{{Folders: []string{"kids"}}}, true},
+		{"wrongExclusion", []Rule{{Folders: []string{"kids"}, Exclude: "blabla"}}, true},
+		{"wrongGlob", []Rule{{Paths: []string{"[a"}, Exclude: ExcludeAll}}, true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			p, err := NewPolicy(Conf{Rules: tc.inRules})
+			assert.Equal(t, tc.expError, err != nil)
+			if err == nil {
+				assert.Nil(t, p.Close())
+			}
+		})
+	}
+}
+
+func TestMatchesPath(t *testing.T) {
+	var tcs = []struct {
+		tcID   string
+		inPath string
+		inGlob string
+		expOk  bool
+	}{
+		{"fullPath", "/photos/private/a.jpg", "/photos/private/*", true},
+		{"fullPathOtherFolder", "/photos/public/a.jpg", "/photos/private/*", false},
+		{"fileName", "/photos/private/secret_a.jpg", "secret_*", true},
+		{"fileNameNotMatching", "/photos/private/a.jpg", "secret_*", false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			assert.Equal(t, tc.expOk, matchesPath(tc.inPath, []string{tc.inGlob}))
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	keywords := map[string][]string{
+		"/photos/2020/kid.jpg":    {"Private", "family"},
+		"/photos/2020/public.jpg": {"landscape"},
+	}
+	rules := []Rule{
+		{Keywords: []string{"private"}, Exclude: ExcludeStorage, ScrubGPS: true},
+		{Folders: []string{"kids"}, Exclude: ExcludeAll},
+		{Paths: []string{"*_noindex.jpg"}, Exclude: ExcludeIndex},
+		{Paths: []string{"/photos/home/*"}, ScrubGPS: true},
+	}
+	assert.Nil(t, validateRules(rules))
+	// exiftool is replaced by the keywords map
+	p := &Policy{rules: rules, cache: map[string]*entry{}}
+	reads := 0
+	p.keywords = func(path string) ([]string, error) {
+		reads++
+		if path == "/photos/2020/unreadable.jpg" {
+			return nil, fmt.Errorf("error")
+		}
+		return keywords[path], nil
+	}
+
+	var tcs = []struct {
+		tcID               string
+		inPath             string
+		expIndex           bool
+		expIndexMetadata   bool
+		expStore           bool
+		expScrub           bool
+		expStorageExcluded bool
+	}{
+		{"keyword", "/photos/2020/kid.jpg", true, true, false, true, true},
+		{"noMatch", "/photos/2020/public.jpg", true, true, true, false, false},
+		{"folder", "/photos/kids/2020/a.jpg", false, false, false, false, false},
+		{"glob", "/photos/2020/a_noindex.jpg", false, false, true, false, false},
+		{"scrubOnly", "/photos/home/a.jpg", true, true, true, true, false},
+		// the extracted keywords don't match
+		{"unreadableKeywords", "/photos/2020/unreadable.jpg", true, true, false, true, false},
+	}
+
+	for i, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			task := browse.Task{Path: tc.inPath, FileID: fmt.Sprintf("id%v", i)}
+			assert.Equal(t, tc.expIndex, p.Index(task))
+			assert.Equal(t, tc.expStore, p.Store(task))
+			if tc.expStore {
+				assert.Equal(t, tc.expScrub, p.ScrubLocation(task))
+			}
+			m := metadata.PictureMetadata{FileID: task.FileID, SourceFile: tc.inPath, Keywords: keywords[tc.inPath]}
+			assert.Equal(t, tc.expIndexMetadata, p.IndexMetadata(m))
+			if tc.expIndexMetadata {
+				assert.Equal(t, tc.expStorageExcluded, p.StorageExcluded(task.FileID))
+			}
+		})
+	}
+	// the keywords are only read for the storage, the decisions are evicted
+	// once consumed
+	assert.Equal(t, len(tcs), reads)
+	assert.Empty(t, p.cache)
+}
+
+func TestPolicy_IndexWithoutStorage(t *testing.T) {
+	p := &Policy{rules: []Rule{{Keywords: []string{"private"}, Exclude: ExcludeAll}}, cache: map[string]*entry{}}
+	p.keywords = func(path string) ([]string, error) {
+		assert.Fail(t, "keywords read")
+		return nil, nil
+	}
+	task := browse.Task{Path: "/photos/a.jpg", FileID: "id1"}
+	assert.True(t, p.Index(task))
+	assert.False(t, p.IndexMetadata(metadata.PictureMetadata{FileID: "id1", SourceFile: task.Path, Keywords: []string{"Private"}}))
+	assert.True(t, p.IndexMetadata(metadata.PictureMetadata{FileID: "id2", SourceFile: task.Path, Keywords: []string{"public"}}))
+	assert.False(t, p.StorageExcluded("id2"))
+	assert.Empty(t, p.cache)
+}
+
+func TestPolicy_ScrubGPS(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inConf     Conf
+		inMetadata metadata.PictureMetadata
+		expScrub   bool
+	}{
+		{"all", Conf{ScrubGPS: true}, metadata.PictureMetadata{SourceFile: "/a.jpg"}, true},
+		{"keyword", Conf{Rules: []Rule{{Keywords: []string{"private"}, ScrubGPS: true}}}, metadata.PictureMetadata{SourceFile: "/a.jpg", Keywords: []string{"PRIVATE"}}, true},
+		{"otherKeyword", Conf{Rules: []Rule{{Keywords: []string{"private"}, ScrubGPS: true}}}, metadata.PictureMetadata{SourceFile: "/a.jpg", Keywords: []string{"public"}}, false},
+		{"excludedOnly", Conf{Rules: []Rule{{Folders: []string{"kids"}, Exclude: ExcludeStorage}}}, metadata.PictureMetadata{SourceFile: "/kids/a.jpg"}, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			// keyword rules are evaluated on the extracted keywords
+			p := &Policy{rules: tc.inConf.Rules, scrubGPS: tc.inConf.ScrubGPS, cache: map[string]*entry{}}
+			assert.Equal(t, tc.expScrub, p.ScrubGPS(tc.inMetadata))
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const limitsCtxKey = "limits"
+
+// Limiter is a token bucket that can be adjusted while it is used. A rate of
+// 0 means unlimited, as does a nil Limiter.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	tokens  float64
+	last    time.Time
+	changed chan struct{}
+}
+
+func NewLimiter(rate float64) *Limiter {
+	l := &Limiter{changed: make(chan struct{})}
+	l.SetRate(rate)
+	return l
+}
+
+// burst is the number of tokens that can be accumulated : one second worth
+// of tokens, at least 1.
+func (l *Limiter) burst() float64 {
+	if l.rate < 1 {
+		return 1
+	}
+	return l.rate
+}
+
+// refill adds the tokens accumulated since the last call, l.mu being held.
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if b := l.burst(); l.tokens > b {
+		l.tokens = b
+	}
+	l.last = now
+}
+
+// SetRate changes the number of tokens per second, the waiting callers being
+// woken up so that they take the new rate into account.
+func (l *Limiter) SetRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	unlimited := l.rate <= 0
+	if !unlimited {
+		l.refill(now)
+	}
+	l.rate = rate
+	l.last = now
+	// a limiter that was unlimited starts with a full bucket
+	if b := l.burst(); unlimited || l.tokens > b {
+		l.tokens = b
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *Limiter) Rate() float64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait blocks until n tokens are available or the context is done. More
+// tokens than the burst are taken in several times.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	remaining := float64(n)
+	for remaining > 0 {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		l.refill(time.Now())
+		take := remaining
+		if b := l.burst(); take > b {
+			take = b
+		}
+		if l.tokens >= take {
+			l.tokens -= take
+			remaining -= take
+			l.mu.Unlock()
+			continue
+		}
+		wait := time.Duration((take - l.tokens) / l.rate * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Semaphore limits the number of concurrent operations, the limit can be
+// adjusted while it is used. A limit of 0 means unlimited, as does a nil
+// Semaphore.
+type Semaphore struct {
+	mu       sync.Mutex
+	limit    int
+	acquired int
+	changed  chan struct{}
+}
+
+func NewSemaphore(limit int) *Semaphore {
+	return &Semaphore{limit: limit, changed: make(chan struct{})}
+}
+
+// notify wakes up the waiting callers, s.mu being held.
+func (s *Semaphore) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// SetLimit changes the limit. Lowering it doesn't interrupt the operations
+// in progress, the new ones wait until there are less than limit.
+func (s *Semaphore) SetLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.notify()
+}
+
+func (s *Semaphore) Limit() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit
+}
+
+// Acquire blocks until an operation can start or the context is done. The
+// operation has to be released if no error is returned.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	for {
+		s.mu.Lock()
+		if s.limit <= 0 || s.acquired < s.limit {
+			s.acquired++
+			s.mu.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Semaphore) Release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acquired--
+	s.notify()
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+// NewReader returns a reader whose throughput (bytes per second) is limited
+// by l.
+func NewReader(ctx context.Context, r io.Reader, l *Limiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, l: l}
+}
+
+// readChunk bounds the reads so that the throughput is smooth.
+const readChunk = 32 * 1024
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > readChunk {
+		p = p[:readChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.Wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Settings are the limits of the pipeline, 0 meaning unlimited.
+type Settings struct {
+	FilesPerSecond       float64
+	UploadsPerSecond     float64
+	UploadBytesPerSecond int64
+	BulksPerSecond       float64
+	MaxInFlightBulks     int
+}
+
+// Limits holds the limiters shared by the stages of the pipeline. A nil
+// Limits doesn't limit anything.
+type Limits struct {
+	files       *Limiter
+	uploads     *Limiter
+	uploadBytes *Limiter
+	bulks       *Limiter
+	inFlight    *Semaphore
+}
+
+func NewLimits(s Settings) (*Limits, error) {
+	l := &Limits{
+		files:       NewLimiter(0),
+		uploads:     NewLimiter(0),
+		uploadBytes: NewLimiter(0),
+		bulks:       NewLimiter(0),
+		inFlight:    NewSemaphore(0),
+	}
+	if err := l.Set(s); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func checkSettings(s Settings) error {
+	switch {
+	case s.FilesPerSecond < 0:
+		return fmt.Errorf("filesPerSecond should be >=0 (%v)", s.FilesPerSecond)
+	case s.UploadsPerSecond < 0:
+		return fmt.Errorf("uploadsPerSecond should be >=0 (%v)", s.UploadsPerSecond)
+	case s.UploadBytesPerSecond < 0:
+		return fmt.Errorf("uploadBytesPerSecond should be >=0 (%v)", s.UploadBytesPerSecond)
+	case s.BulksPerSecond < 0:
+		return fmt.Errorf("bulksPerSecond should be >=0 (%v)", s.BulksPerSecond)
+	case s.MaxInFlightBulks < 0:
+		return fmt.Errorf("maxInFlightBulks should be >=0 (%v)", s.MaxInFlightBulks)
+	}
+	return nil
+}
+
+// Set adjusts the limits, the stages that are running taking them into
+// account immediately.
+func (l *Limits) Set(s Settings) error {
+	if err := checkSettings(s); err != nil {
+		return err
+	}
+	l.files.SetRate(s.FilesPerSecond)
+	l.uploads.SetRate(s.UploadsPerSecond)
+	l.uploadBytes.SetRate(float64(s.UploadBytesPerSecond))
+	l.bulks.SetRate(s.BulksPerSecond)
+	l.inFlight.SetLimit(s.MaxInFlightBulks)
+	return nil
+}
+
+func (l *Limits) Settings() Settings {
+	if l == nil {
+		return Settings{}
+	}
+	return Settings{
+		FilesPerSecond:       l.files.Rate(),
+		UploadsPerSecond:     l.uploads.Rate(),
+		UploadBytesPerSecond: int64(l.uploadBytes.Rate()),
+		BulksPerSecond:       l.bulks.Rate(),
+		MaxInFlightBulks:     l.inFlight.Limit(),
+	}
+}
+
+// WaitFile blocks until a browsed file can be sent.
+func (l *Limits) WaitFile(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	return l.files.Wait(ctx, 1)
+}
+
+// WaitUpload blocks until an upload can start.
+func (l *Limits) WaitUpload(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	return l.uploads.Wait(ctx, 1)
+}
+
+// UploadReader limits the throughput of an uploaded file.
+func (l *Limits) UploadReader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return NewReader(ctx, r, l.uploadBytes)
+}
+
+// StartBulk blocks until a bulk request can be sent. The returned function
+// has to be called when the request is over if no error is returned.
+func (l *Limits) StartBulk(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	if err := l.inFlight.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	if err := l.bulks.Wait(ctx, 1); err != nil {
+		l.inFlight.Release()
+		return nil, err
+	}
+	return l.inFlight.Release, nil
+}
+
+// WithLimits returns a context in which the pipeline applies the limits.
+func WithLimits(ctx context.Context, l *Limits) context.Context {
+	return context.WithValue(ctx, limitsCtxKey, l)
+}
+
+// Get returns the limits of the context, nil if none.
+func Get(ctx context.Context) *Limits {
+	if v := ctx.Value(limitsCtxKey); v != nil {
+		return v.(*Limits)
+	}
+	return nil
+}
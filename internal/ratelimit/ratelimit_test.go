@@ -0,0 +1,186 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func elapsed(f func()) time.Duration {
+	start := time.Now()
+	f()
+	return time.Since(start)
+}
+
+func TestLimiter_Wait(t *testing.T) {
+	var tcs = []struct {
+		tcID   string
+		inRate float64
+		inN    int
+		inCall int
+		expMin time.Duration
+		expMax time.Duration
+	}{
+		{"unlimited", 0, 1000, 10, 0, 50 * time.Millisecond},
+		{"burst", 10, 1, 10, 0, 50 * time.Millisecond},
+		{"overBurst", 10, 1, 13, 250 * time.Millisecond, 600 * time.Millisecond},
+		{"moreThanBurst", 100, 150, 1, 450 * time.Millisecond, 900 * time.Millisecond},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			l := NewLimiter(tc.inRate)
+			d := elapsed(func() {
+				for i := 0; i < tc.inCall; i++ {
+					assert.Nil(t, l.Wait(context.Background(), tc.inN))
+				}
+			})
+			assert.True(t, d >= tc.expMin && d <= tc.expMax, "%v", d)
+		})
+	}
+}
+
+func TestLimiter_Nil(t *testing.T) {
+	var l *Limiter
+	assert.Nil(t, l.Wait(context.Background(), 10))
+	assert.Equal(t, 0.0, l.Rate())
+}
+
+func TestLimiter_SetRate(t *testing.T) {
+	l := NewLimiter(1)
+	assert.Nil(t, l.Wait(context.Background(), 1))
+	done := make(chan error)
+	go func() {
+		done <- l.Wait(context.Background(), 1)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l.SetRate(0)
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(500 * time.Millisecond):
+		assert.Fail(t, "waiting caller not woken up")
+	}
+	assert.Equal(t, 0.0, l.Rate())
+}
+
+func TestLimiter_Canceled(t *testing.T) {
+	l := NewLimiter(1)
+	assert.Nil(t, l.Wait(context.Background(), 1))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, l.Wait(ctx, 1))
+}
+
+func TestSemaphore(t *testing.T) {
+	s := NewSemaphore(1)
+	assert.Nil(t, s.Acquire(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, s.Acquire(ctx))
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- s.Acquire(context.Background())
+	}()
+	s.SetLimit(2)
+	assert.Nil(t, <-acquired)
+	assert.Equal(t, 2, s.Limit())
+
+	go func() {
+		acquired <- s.Acquire(context.Background())
+	}()
+	s.Release()
+	assert.Nil(t, <-acquired)
+}
+
+func TestSemaphore_Nil(t *testing.T) {
+	var s *Semaphore
+	assert.Nil(t, s.Acquire(context.Background()))
+	s.Release()
+	assert.Equal(t, 0, s.Limit())
+}
+
+func TestNewReader(t *testing.T) {
+	in := bytes.Repeat([]byte("a"), 3000)
+	var out []byte
+	d := elapsed(func() {
+		var err error
+		out, err = io.ReadAll(NewReader(context.Background(), bytes.NewReader(in), NewLimiter(1000)))
+		assert.Nil(t, err)
+	})
+	assert.Equal(t, in, out)
+	assert.True(t, d >= 1500*time.Millisecond && d <= 3*time.Second, "%v", d)
+}
+
+func TestNewLimits(t *testing.T) {
+	var tcs = []struct {
+		tcID       string
+		inSettings Settings
+		expOk      bool
+	}{
+		{"unlimited", Settings{}, true},
+		{"nominal", Settings{FilesPerSecond: 10, UploadsPerSecond: 0.5, UploadBytesPerSecond: 1024, BulksPerSecond: 2, MaxInFlightBulks: 1}, true},
+		{"negativeFiles", Settings{FilesPerSecond: -1}, false},
+		{"negativeUploads", Settings{UploadsPerSecond: -1}, false},
+		{"negativeBytes", Settings{UploadBytesPerSecond: -1}, false},
+		{"negativeBulks", Settings{BulksPerSecond: -1}, false},
+		{"negativeInFlight", Settings{MaxInFlightBulks: -1}, false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			l, err := NewLimits(tc.inSettings)
+			assert.Equal(t, tc.expOk, err == nil)
+			if tc.expOk {
+				assert.Equal(t, tc.inSettings, l.Settings())
+			}
+		})
+	}
+}
+
+func TestLimits_Set(t *testing.T) {
+	l, err := NewLimits(Settings{BulksPerSecond: 1})
+	assert.Nil(t, err)
+	assert.NotNil(t, l.Set(Settings{BulksPerSecond: -1}))
+	assert.Equal(t, Settings{BulksPerSecond: 1}, l.Settings())
+	assert.Nil(t, l.Set(Settings{MaxInFlightBulks: 3}))
+	assert.Equal(t, Settings{MaxInFlightBulks: 3}, l.Settings())
+}
+
+func TestLimits_StartBulk(t *testing.T) {
+	l, err := NewLimits(Settings{MaxInFlightBulks: 1})
+	assert.Nil(t, err)
+	done, err := l.StartBulk(context.Background())
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = l.StartBulk(ctx)
+	assert.NotNil(t, err)
+	done()
+	done, err = l.StartBulk(context.Background())
+	assert.Nil(t, err)
+	done()
+}
+
+func TestLimits_Nil(t *testing.T) {
+	var l *Limits
+	ctx := context.Background()
+	assert.Nil(t, l.WaitFile(ctx))
+	assert.Nil(t, l.WaitUpload(ctx))
+	r := bytes.NewReader(nil)
+	assert.Equal(t, r, l.UploadReader(ctx, r))
+	done, err := l.StartBulk(ctx)
+	assert.Nil(t, err)
+	done()
+	assert.Equal(t, Settings{}, l.Settings())
+}
+
+func TestGet(t *testing.T) {
+	assert.Nil(t, Get(context.Background()))
+	l, err := NewLimits(Settings{})
+	assert.Nil(t, err)
+	assert.Equal(t, l, Get(WithLimits(context.Background(), l)))
+}
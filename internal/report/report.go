@@ -0,0 +1,198 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type Stage string
+
+const (
+	StageBrowse  Stage = "browse"
+	StageExtract Stage = "extract"
+	StageIndex   Stage = "index"
+	StageStore   Stage = "store"
+
+	StatusSuccess        = "success"
+	StatusPartialFailure = "partialFailure"
+	StatusFailure        = "failure"
+
+	// maxFailures is the maximum number of failures detailed in a report
+	maxFailures = 100
+)
+
+var Stages = []Stage{StageBrowse, StageExtract, StageIndex, StageStore}
+
+// Failure describes an item that could not be processed by a stage.
+type Failure struct {
+	Stage Stage  `json:"stage"`
+	File  string `json:"file,omitempty"`
+	Error string `json:"error"`
+}
+
+// Summary is the outcome of a run.
+type Summary struct {
+	ImportID string    `json:"importId"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Status   string    `json:"status"`
+	// Interrupted is true if the run has been stopped by a shutdown
+	Interrupted bool          `json:"interrupted"`
+	Browsed     int           `json:"browsed"`
+	Extracted   int           `json:"extracted"`
+	Indexed     int           `json:"indexed"`
+	Stored      int           `json:"stored"`
+	Skipped     map[Stage]int `json:"skipped"`
+	Failed      map[Stage]int `json:"failed"`
+	Failures    []Failure     `json:"failures,omitempty"`
+	// Resume is set if the run resumes a previous one
+	Resume *Resume `json:"resume,omitempty"`
+}
+
+// Resume describes a resumed run, by checkpoint stage : the stages skipped
+// because they were completed by a previous run, and the stages completed by
+// this run that were not completed before.
+type Resume struct {
+	Skipped   map[string]int `json:"skipped"`
+	Completed map[string]int `json:"completed"`
+}
+
+// Report counts the items processed by each stage of a run. It can be used
+// concurrently.
+type Report struct {
+	mu sync.Mutex
+	s  Summary
+}
+
+func New(importID string) *Report {
+	return &Report{s: Summary{
+		ImportID: importID,
+		Start:    time.Now(),
+		Skipped:  make(map[Stage]int),
+		Failed:   make(map[Stage]int),
+	}}
+}
+
+func (r *Report) Browsed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s.Browsed++
+}
+
+func (r *Report) Extracted() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s.Extracted++
+}
+
+func (r *Report) Indexed(count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s.Indexed += count
+}
+
+func (r *Report) Stored() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s.Stored++
+}
+
+// Resumed records the checkpoint counters of a resumed run.
+func (r *Report) Resumed(skipped map[string]int, completed map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s.Resume = &Resume{Skipped: skipped, Completed: completed}
+}
+
+// Interrupted flags the run as stopped by a shutdown.
+func (r *Report) Interrupted() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s.Interrupted = true
+}
+
+// Skipped counts an item that has not been submitted to a stage (already
+// done, excluded, ...).
+func (r *Report) Skipped(s Stage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s.Skipped[s]++
+}
+
+// Failed counts an item that could not be processed by a stage. file is
+// empty if the failure is not related to a specific file.
+func (r *Report) Failed(s Stage, file string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s.Failed[s]++
+	if len(r.s.Failures) < maxFailures {
+		r.s.Failures = append(r.s.Failures, Failure{Stage: s, File: file, Error: err.Error()})
+	}
+}
+
+// Summary returns the current outcome of the run. A run is a failure if
+// nothing has been indexed nor stored whereas errors occurred, a partial
+// failure if errors occurred but some items were indexed or stored.
+func (r *Report) Summary() Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.s
+	s.End = time.Now()
+	s.Skipped = make(map[Stage]int)
+	s.Failed = make(map[Stage]int)
+	failed := 0
+	for _, st := range Stages {
+		s.Skipped[st] = r.s.Skipped[st]
+		s.Failed[st] = r.s.Failed[st]
+		failed += r.s.Failed[st]
+	}
+	s.Failures = append([]Failure{}, r.s.Failures...)
+	switch {
+	case failed == 0:
+		s.Status = StatusSuccess
+	case s.Indexed == 0 && s.Stored == 0:
+		s.Status = StatusFailure
+	default:
+		s.Status = StatusPartialFailure
+	}
+	return s
+}
+
+// Log logs the summary of the run.
+func (s Summary) Log() {
+	e := log.Info()
+	if s.Status != StatusSuccess || s.Interrupted {
+		e = log.Error()
+	}
+	status := s.Status
+	if s.Interrupted {
+		status += ", interrupted"
+	}
+	resume := ""
+	if s.Resume != nil {
+		resume = fmt.Sprintf(", resumed (skipped %v, completed %v)", s.Resume.Skipped, s.Resume.Completed)
+	}
+	e.Msgf("Import %v (%v): %v browsed, %v extracted, %v indexed, %v stored, skipped %v, failed %v%v",
+		s.ImportID, status, s.Browsed, s.Extracted, s.Indexed, s.Stored, s.Skipped, s.Failed, resume)
+}
+
+// Write writes the summary as a JSON file.
+func (s Summary) Write(f string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error while marshaling report: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+		return fmt.Errorf("error while creating folder for %v: %w", f, err)
+	}
+	if err := os.WriteFile(f, b, 0644); err != nil {
+		return fmt.Errorf("error while writing report %v: %w", f, err)
+	}
+	return nil
+}
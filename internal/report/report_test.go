@@ -0,0 +1,103 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummary_Status(t *testing.T) {
+	var tcs = []struct {
+		tcID      string
+		inFct     func(r *Report)
+		expStatus string
+	}{
+		{"empty", func(r *Report) {}, StatusSuccess},
+		{"success", func(r *Report) { r.Browsed(); r.Extracted(); r.Indexed(1); r.Stored() }, StatusSuccess},
+		{"skipped", func(r *Report) { r.Browsed(); r.Skipped(StageIndex); r.Skipped(StageStore) }, StatusSuccess},
+		{"partial", func(r *Report) { r.Indexed(1); r.Failed(StageStore, "a.jpg", fmt.Errorf("e")) }, StatusPartialFailure},
+		{"partialStored", func(r *Report) { r.Stored(); r.Failed(StageIndex, "a.jpg", fmt.Errorf("e")) }, StatusPartialFailure},
+		{"failure", func(r *Report) { r.Extracted(); r.Failed(StageIndex, "a.jpg", fmt.Errorf("e")) }, StatusFailure},
+		{"browseFailure", func(r *Report) { r.Failed(StageBrowse, "", fmt.Errorf("e")) }, StatusFailure},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			r := New("imp")
+			tc.inFct(r)
+			assert.Equal(t, tc.expStatus, r.Summary().Status)
+		})
+	}
+}
+
+func TestSummary_Counters(t *testing.T) {
+	r := New("imp")
+	for i := 0; i < maxFailures+10; i++ {
+		r.Browsed()
+		r.Failed(StageExtract, fmt.Sprintf("%v.jpg", i), fmt.Errorf("e%v", i))
+	}
+	r.Extracted()
+	r.Indexed(3)
+	r.Stored()
+	r.Skipped(StageStore)
+
+	s := r.Summary()
+	assert.Equal(t, "imp", s.ImportID)
+	assert.Equal(t, maxFailures+10, s.Browsed)
+	assert.Equal(t, 1, s.Extracted)
+	assert.Equal(t, 3, s.Indexed)
+	assert.Equal(t, 1, s.Stored)
+	assert.Equal(t, map[Stage]int{StageBrowse: 0, StageExtract: 0, StageIndex: 0, StageStore: 1}, s.Skipped)
+	assert.Equal(t, map[Stage]int{StageBrowse: 0, StageExtract: maxFailures + 10, StageIndex: 0, StageStore: 0}, s.Failed)
+	assert.Len(t, s.Failures, maxFailures)
+	assert.Equal(t, Failure{Stage: StageExtract, File: "0.jpg", Error: "e0"}, s.Failures[0])
+	assert.False(t, s.End.Before(s.Start))
+}
+
+func TestSummary_Write(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := New("imp")
+	r.Stored()
+	r.Failed(StageIndex, "a.jpg", fmt.Errorf("e"))
+	f := filepath.Join(dir, "sub", "report.json")
+	assert.Nil(t, r.Summary().Write(f))
+
+	b, err := os.ReadFile(f)
+	assert.Nil(t, err)
+	read := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(b, &read))
+	assert.Equal(t, "imp", read["importId"])
+	assert.Equal(t, StatusPartialFailure, read["status"])
+	assert.Equal(t, float64(1), read["stored"])
+	assert.Equal(t, float64(1), read["failed"].(map[string]interface{})["index"])
+	assert.Len(t, read["failures"], 1)
+	assert.Nil(t, read["resume"])
+}
+
+func TestSummary_Resumed(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "picdexer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := New("imp")
+	r.Resumed(map[string]int{"extracted": 2}, map[string]int{"extracted": 1})
+	s := r.Summary()
+	assert.Equal(t, &Resume{Skipped: map[string]int{"extracted": 2}, Completed: map[string]int{"extracted": 1}}, s.Resume)
+
+	f := filepath.Join(dir, "report.json")
+	assert.Nil(t, s.Write(f))
+	b, err := os.ReadFile(f)
+	assert.Nil(t, err)
+	read := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(b, &read))
+	resume := read["resume"].(map[string]interface{})
+	assert.Equal(t, float64(2), resume["skipped"].(map[string]interface{})["extracted"])
+	assert.Equal(t, float64(1), resume["completed"].(map[string]interface{})["extracted"])
+}
@@ -0,0 +1,322 @@
+package rules
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/barasher/picdexer/internal/metadata"
+)
+
+const (
+	// TypeMap replaces the values of Field listed in Values
+	TypeMap = "map"
+	// TypeReplace replaces the matches of Pattern in the values of Field by
+	// Replacement ($1 being the first group)
+	TypeReplace = "replace"
+	// TypeLowercase lower-cases the values of Field
+	TypeLowercase = "lowercase"
+	// TypeSynonyms replaces the keywords listed in Synonyms by their
+	// canonical keyword (case insensitive)
+	TypeSynonyms = "synonyms"
+	// TypeSplit splits the keywords on Separator
+	TypeSplit = "split"
+	// TypeMerge replaces Keywords by Into when the picture has all of them
+	TypeMerge = "merge"
+	// TypeTag adds Keywords
+	TypeTag = "tag"
+	// TypeDrop removes Field from the document
+	TypeDrop = "drop"
+
+	keywordsField = "Keywords"
+)
+
+// Condition matches the pictures having a value of Field matching the
+// Matches regular expression.
+type Condition struct {
+	Field   string
+	Matches string
+}
+
+// Rule normalizes a field of the documents. A rule with a condition (When)
+// only applies to the pictures it matches.
+type Rule struct {
+	Type        string
+	Field       string
+	When        *Condition
+	Values      map[string]string
+	Pattern     string
+	Replacement string
+	Synonyms    map[string][]string
+	Separator   string
+	Keywords    []string
+	Into        string
+}
+
+type condition struct {
+	field   string
+	matches *regexp.Regexp
+}
+
+type compiled struct {
+	Rule
+	when     *condition
+	pattern  *regexp.Regexp
+	synonyms map[string]string
+}
+
+// Engine applies rules to the metadata of the pictures, in the order of
+// their declaration.
+type Engine struct {
+	rules []compiled
+}
+
+func NewEngine(rules ...Rule) (*Engine, error) {
+	e := &Engine{}
+	for i, r := range rules {
+		c, err := compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("error while compiling rule #%v (%v): %w", i+1, r.Type, err)
+		}
+		e.rules = append(e.rules, c)
+	}
+	return e, nil
+}
+
+func compile(r Rule) (compiled, error) {
+	c := compiled{Rule: r}
+	if r.When != nil {
+		if err := checkValueField(r.When.Field); err != nil {
+			return c, fmt.Errorf("wrong condition: %w", err)
+		}
+		re, err := regexp.Compile(r.When.Matches)
+		if err != nil {
+			return c, fmt.Errorf("wrong condition pattern (%v): %w", r.When.Matches, err)
+		}
+		c.when = &condition{field: r.When.Field, matches: re}
+	}
+	switch r.Type {
+	case TypeMap:
+		if len(r.Values) == 0 {
+			return c, fmt.Errorf("no value to map")
+		}
+		return c, checkValueField(r.Field)
+	case TypeReplace:
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return c, fmt.Errorf("wrong pattern (%v): %w", r.Pattern, err)
+		}
+		c.pattern = re
+		return c, checkValueField(r.Field)
+	case TypeLowercase:
+		return c, checkValueField(r.Field)
+	case TypeSynonyms:
+		c.synonyms = make(map[string]string)
+		for canonical, synonyms := range r.Synonyms {
+			for _, s := range synonyms {
+				c.synonyms[strings.ToLower(s)] = canonical
+			}
+		}
+		if len(c.synonyms) == 0 {
+			return c, fmt.Errorf("no synonym")
+		}
+	case TypeSplit:
+		if r.Separator == "" {
+			return c, fmt.Errorf("separator is missing")
+		}
+	case TypeMerge:
+		if len(r.Keywords) < 2 || r.Into == "" {
+			return c, fmt.Errorf("at least 2 keywords have to be merged into a keyword")
+		}
+	case TypeTag:
+		if len(r.Keywords) == 0 {
+			return c, fmt.Errorf("no keyword to add")
+		}
+	case TypeDrop:
+		if r.Field == "" {
+			return c, fmt.Errorf("field is missing")
+		}
+		if _, ok := reflect.TypeOf(metadata.PictureMetadata{}).FieldByName(r.Field); ok && !metadata.IsBuiltinField(r.Field) {
+			return c, fmt.Errorf("%v is not a field of the documents", r.Field)
+		}
+	default:
+		return c, fmt.Errorf("unsupported rule type")
+	}
+	return c, nil
+}
+
+// checkValueField checks that a field of the documents holds text values.
+func checkValueField(field string) error {
+	if !metadata.IsBuiltinField(field) {
+		return fmt.Errorf("unsupported field (%v)", field)
+	}
+	f, _ := reflect.TypeOf(metadata.PictureMetadata{}).FieldByName(field)
+	t := f.Type
+	if t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.String {
+		return fmt.Errorf("%v doesn't hold text values", field)
+	}
+	return nil
+}
+
+// values returns the values of a text field.
+func values(m *metadata.PictureMetadata, field string) []string {
+	v := reflect.ValueOf(m).Elem().FieldByName(field)
+	switch v.Kind() {
+	case reflect.String:
+		return []string{v.String()}
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return []string{v.Elem().String()}
+	case reflect.Slice:
+		return append([]string{}, v.Interface().([]string)...)
+	}
+	return nil
+}
+
+// setValues sets the values of a text field, the empty values being
+// removed.
+func setValues(m *metadata.PictureMetadata, field string, vals []string) {
+	kept := []string{}
+	seen := make(map[string]bool)
+	for _, cur := range vals {
+		if cur != "" && !seen[cur] {
+			kept = append(kept, cur)
+			seen[cur] = true
+		}
+	}
+	v := reflect.ValueOf(m).Elem().FieldByName(field)
+	switch v.Kind() {
+	case reflect.String:
+		s := ""
+		if len(kept) > 0 {
+			s = kept[0]
+		}
+		v.SetString(s)
+	case reflect.Ptr:
+		if len(kept) == 0 {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			s := kept[0]
+			v.Set(reflect.ValueOf(&s))
+		}
+	case reflect.Slice:
+		if len(kept) == 0 {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(kept))
+		}
+	}
+}
+
+func (c *condition) match(m *metadata.PictureMetadata) bool {
+	for _, v := range values(m, c.field) {
+		if c.matches.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapValues applies a function to each value of a field.
+func mapValues(m *metadata.PictureMetadata, field string, f func(string) []string) {
+	res := []string{}
+	for _, v := range values(m, field) {
+		res = append(res, f(v)...)
+	}
+	setValues(m, field, res)
+}
+
+// Apply returns the metadata normalized by the rules.
+func (e *Engine) Apply(m metadata.PictureMetadata) metadata.PictureMetadata {
+	for _, r := range e.rules {
+		if r.when != nil && !r.when.match(&m) {
+			continue
+		}
+		switch r.Type {
+		case TypeMap:
+			mapValues(&m, r.Field, func(v string) []string {
+				if to, ok := r.Values[v]; ok {
+					return []string{to}
+				}
+				return []string{v}
+			})
+		case TypeReplace:
+			mapValues(&m, r.Field, func(v string) []string {
+				return []string{r.pattern.ReplaceAllString(v, r.Replacement)}
+			})
+		case TypeLowercase:
+			mapValues(&m, r.Field, func(v string) []string {
+				return []string{strings.ToLower(v)}
+			})
+		case TypeSynonyms:
+			mapValues(&m, keywordsField, func(v string) []string {
+				if canonical, ok := r.synonyms[strings.ToLower(v)]; ok {
+					return []string{canonical}
+				}
+				return []string{v}
+			})
+		case TypeSplit:
+			mapValues(&m, keywordsField, func(v string) []string {
+				parts := strings.Split(v, r.Separator)
+				for i := range parts {
+					parts[i] = strings.TrimSpace(parts[i])
+				}
+				return parts
+			})
+		case TypeMerge:
+			merge(&m, r.Keywords, r.Into)
+		case TypeTag:
+			setValues(&m, keywordsField, append(values(&m, keywordsField), r.Keywords...))
+		case TypeDrop:
+			drop(&m, r.Field)
+		}
+	}
+	return m
+}
+
+// merge replaces the keywords by a single one if the picture has all of
+// them.
+func merge(m *metadata.PictureMetadata, keywords []string, into string) {
+	merged := make(map[string]bool)
+	for _, kw := range keywords {
+		merged[kw] = true
+	}
+	found := 0
+	kept := []string{}
+	for _, kw := range m.Keywords {
+		if merged[kw] {
+			found++
+			continue
+		}
+		kept = append(kept, kw)
+	}
+	if found < len(merged) {
+		return
+	}
+	setValues(m, keywordsField, append(kept, into))
+}
+
+// drop removes a field of the document, either a built-in one or one added by
+// the enrichment.
+func drop(m *metadata.PictureMetadata, field string) {
+	if metadata.IsBuiltinField(field) {
+		v := reflect.ValueOf(m).Elem().FieldByName(field)
+		v.Set(reflect.Zero(v.Type()))
+		return
+	}
+	if m.Fields != nil {
+		fields := make(map[string]interface{}, len(m.Fields))
+		for k, v := range m.Fields {
+			if k != field {
+				fields[k] = v
+			}
+		}
+		m.Fields = fields
+	}
+}
@@ -0,0 +1,160 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestNewEngine(t *testing.T) {
+	var tcs = []struct {
+		tcID   string
+		inRule Rule
+		expOk  bool
+	}{
+		{"map", Rule{Type: TypeMap, Field: "CameraModel", Values: map[string]string{"5D3": "Canon EOS 5D Mark III"}}, true},
+		{"mapNoValue", Rule{Type: TypeMap, Field: "CameraModel"}, false},
+		{"mapUnknownField", Rule{Type: TypeMap, Field: "Blabla", Values: map[string]string{"a": "b"}}, false},
+		{"mapNumericField", Rule{Type: TypeMap, Field: "ISO", Values: map[string]string{"a": "b"}}, false},
+		{"mapHiddenField", Rule{Type: TypeMap, Field: "SourceFile", Values: map[string]string{"a": "b"}}, false},
+		{"replace", Rule{Type: TypeReplace, Field: "LensModel", Pattern: "^EF(\\d+)", Replacement: "EF $1"}, true},
+		{"replaceWrongPattern", Rule{Type: TypeReplace, Field: "LensModel", Pattern: "("}, false},
+		{"lowercase", Rule{Type: TypeLowercase, Field: "Keywords"}, true},
+		{"synonyms", Rule{Type: TypeSynonyms, Synonyms: map[string][]string{"cat": {"kitty"}}}, true},
+		{"synonymsEmpty", Rule{Type: TypeSynonyms}, false},
+		{"split", Rule{Type: TypeSplit, Separator: "/"}, true},
+		{"splitNoSeparator", Rule{Type: TypeSplit}, false},
+		{"merge", Rule{Type: TypeMerge, Keywords: []string{"new", "york"}, Into: "new york"}, true},
+		{"mergeOneKeyword", Rule{Type: TypeMerge, Keywords: []string{"new"}, Into: "new york"}, false},
+		{"mergeNoInto", Rule{Type: TypeMerge, Keywords: []string{"new", "york"}}, false},
+		{"tag", Rule{Type: TypeTag, Keywords: []string{"canon"}, When: &Condition{Field: "CameraModel", Matches: "Canon"}}, true},
+		{"tagNoKeyword", Rule{Type: TypeTag}, false},
+		{"tagWrongCondition", Rule{Type: TypeTag, Keywords: []string{"canon"}, When: &Condition{Field: "CameraModel", Matches: "("}}, false},
+		{"tagWrongConditionField", Rule{Type: TypeTag, Keywords: []string{"canon"}, When: &Condition{Field: "ISO", Matches: "1"}}, false},
+		{"drop", Rule{Type: TypeDrop, Field: "GPS"}, true},
+		{"dropCustomField", Rule{Type: TypeDrop, Field: "Labels"}, true},
+		{"dropHiddenField", Rule{Type: TypeDrop, Field: "FileID"}, false},
+		{"dropNoField", Rule{Type: TypeDrop}, false},
+		{"unknownType", Rule{Type: "blabla"}, false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			_, err := NewEngine(tc.inRule)
+			assert.Equal(t, tc.expOk, err == nil)
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	var tcs = []struct {
+		tcID    string
+		inRules []Rule
+		inMeta  metadata.PictureMetadata
+		expMeta metadata.PictureMetadata
+	}{
+		{"noRule", nil,
+			metadata.PictureMetadata{CameraModel: strPtr("5D3")},
+			metadata.PictureMetadata{CameraModel: strPtr("5D3")}},
+		{"map",
+			[]Rule{{Type: TypeMap, Field: "CameraModel", Values: map[string]string{"5D3": "Canon EOS 5D Mark III"}}},
+			metadata.PictureMetadata{CameraModel: strPtr("5D3")},
+			metadata.PictureMetadata{CameraModel: strPtr("Canon EOS 5D Mark III")}},
+		{"mapUnmatched",
+			[]Rule{{Type: TypeMap, Field: "CameraModel", Values: map[string]string{"5D3": "Canon EOS 5D Mark III"}}},
+			metadata.PictureMetadata{CameraModel: strPtr("X-T3")},
+			metadata.PictureMetadata{CameraModel: strPtr("X-T3")}},
+		{"mapUnset",
+			[]Rule{{Type: TypeMap, Field: "CameraModel", Values: map[string]string{"5D3": "Canon EOS 5D Mark III"}}},
+			metadata.PictureMetadata{},
+			metadata.PictureMetadata{}},
+		{"mapKeywords",
+			[]Rule{{Type: TypeMap, Field: "Keywords", Values: map[string]string{"nyc": "new york"}}},
+			metadata.PictureMetadata{Keywords: []string{"nyc", "street"}},
+			metadata.PictureMetadata{Keywords: []string{"new york", "street"}}},
+		{"replace",
+			[]Rule{{Type: TypeReplace, Field: "LensModel", Pattern: "^EF(\\d+)", Replacement: "EF $1"}},
+			metadata.PictureMetadata{LensModel: strPtr("EF50mm f/1.8")},
+			metadata.PictureMetadata{LensModel: strPtr("EF 50mm f/1.8")}},
+		{"replaceToEmpty",
+			[]Rule{{Type: TypeReplace, Field: "LensModel", Pattern: "^Unknown.*$"}},
+			metadata.PictureMetadata{LensModel: strPtr("Unknown (0)")},
+			metadata.PictureMetadata{}},
+		{"replaceFolder",
+			[]Rule{{Type: TypeReplace, Field: "Folder", Pattern: "^/mnt/photos", Replacement: "/photos"}},
+			metadata.PictureMetadata{Folder: "/mnt/photos/2020"},
+			metadata.PictureMetadata{Folder: "/photos/2020"}},
+		{"lowercaseDeduplicates",
+			[]Rule{{Type: TypeLowercase, Field: "Keywords"}},
+			metadata.PictureMetadata{Keywords: []string{"Cat", "cat", "Dog"}},
+			metadata.PictureMetadata{Keywords: []string{"cat", "dog"}}},
+		{"synonyms",
+			[]Rule{{Type: TypeSynonyms, Synonyms: map[string][]string{"cat": {"kitty", "chat"}}}},
+			metadata.PictureMetadata{Keywords: []string{"Kitty", "chat", "dog"}},
+			metadata.PictureMetadata{Keywords: []string{"cat", "dog"}}},
+		{"split",
+			[]Rule{{Type: TypeSplit, Separator: "/"}},
+			metadata.PictureMetadata{Keywords: []string{"places/paris", "cat"}},
+			metadata.PictureMetadata{Keywords: []string{"places", "paris", "cat"}}},
+		{"merge",
+			[]Rule{{Type: TypeMerge, Keywords: []string{"new", "york"}, Into: "new york"}},
+			metadata.PictureMetadata{Keywords: []string{"new", "cat", "york"}},
+			metadata.PictureMetadata{Keywords: []string{"cat", "new york"}}},
+		{"mergeIncomplete",
+			[]Rule{{Type: TypeMerge, Keywords: []string{"new", "york"}, Into: "new york"}},
+			metadata.PictureMetadata{Keywords: []string{"new", "cat"}},
+			metadata.PictureMetadata{Keywords: []string{"new", "cat"}}},
+		{"tag",
+			[]Rule{{Type: TypeTag, Keywords: []string{"canon", "fullframe"}, When: &Condition{Field: "CameraModel", Matches: "5D"}}},
+			metadata.PictureMetadata{CameraModel: strPtr("Canon EOS 5D Mark III"), Keywords: []string{"canon"}},
+			metadata.PictureMetadata{CameraModel: strPtr("Canon EOS 5D Mark III"), Keywords: []string{"canon", "fullframe"}}},
+		{"tagUnmatched",
+			[]Rule{{Type: TypeTag, Keywords: []string{"canon"}, When: &Condition{Field: "CameraModel", Matches: "5D"}}},
+			metadata.PictureMetadata{CameraModel: strPtr("X-T3")},
+			metadata.PictureMetadata{CameraModel: strPtr("X-T3")}},
+		{"tagConditionOnKeywords",
+			[]Rule{{Type: TypeTag, Keywords: []string{"animal"}, When: &Condition{Field: "Keywords", Matches: "^(cat|dog)$"}}},
+			metadata.PictureMetadata{Keywords: []string{"dog"}},
+			metadata.PictureMetadata{Keywords: []string{"dog", "animal"}}},
+		{"drop",
+			[]Rule{{Type: TypeDrop, Field: "GPS"}},
+			metadata.PictureMetadata{GPS: strPtr("1,2"), FileName: "f.jpg"},
+			metadata.PictureMetadata{FileName: "f.jpg"}},
+		{"dropConditional",
+			[]Rule{{Type: TypeDrop, Field: "GPS", When: &Condition{Field: "Folder", Matches: "private"}}},
+			metadata.PictureMetadata{GPS: strPtr("1,2"), Folder: "/photos"},
+			metadata.PictureMetadata{GPS: strPtr("1,2"), Folder: "/photos"}},
+		{"dropCustomField",
+			[]Rule{{Type: TypeDrop, Field: "Labels"}},
+			metadata.PictureMetadata{Fields: map[string]interface{}{"Labels": "cat", "Project": "p1"}},
+			metadata.PictureMetadata{Fields: map[string]interface{}{"Project": "p1"}}},
+		{"chained",
+			[]Rule{
+				{Type: TypeLowercase, Field: "Keywords"},
+				{Type: TypeSynonyms, Synonyms: map[string][]string{"cat": {"kitty"}}},
+				{Type: TypeTag, Keywords: []string{"pets"}, When: &Condition{Field: "Keywords", Matches: "^cat$"}},
+			},
+			metadata.PictureMetadata{Keywords: []string{"KITTY"}},
+			metadata.PictureMetadata{Keywords: []string{"cat", "pets"}}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			e, err := NewEngine(tc.inRules...)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expMeta, e.Apply(tc.inMeta))
+		})
+	}
+}
+
+func TestApply_DoesNotAlterInput(t *testing.T) {
+	e, err := NewEngine(Rule{Type: TypeLowercase, Field: "Keywords"}, Rule{Type: TypeDrop, Field: "Labels"})
+	assert.Nil(t, err)
+	in := metadata.PictureMetadata{Keywords: []string{"Cat"}, Fields: map[string]interface{}{"Labels": "cat"}}
+	e.Apply(in)
+	assert.Equal(t, []string{"Cat"}, in.Keywords)
+	assert.Equal(t, map[string]interface{}{"Labels": "cat"}, in.Fields)
+}
@@ -0,0 +1,353 @@
+// Package picdexer is the library API of the indexing pipeline : pictures
+// are browsed from a source, their metadata are extracted, enriched and
+// indexed while the pictures are stored (and resized). Each stage can be replaced by a
+// custom implementation.
+package picdexer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/barasher/picdexer/internal/binary"
+	"github.com/barasher/picdexer/internal/browse"
+	"github.com/barasher/picdexer/internal/dispatch"
+	"github.com/barasher/picdexer/internal/elasticsearch"
+	"github.com/barasher/picdexer/internal/enrich"
+	"github.com/barasher/picdexer/internal/metadata"
+	"github.com/barasher/picdexer/internal/ratelimit"
+	"github.com/barasher/picdexer/internal/rules"
+)
+
+type (
+	// Task is a picture to process.
+	Task = browse.Task
+	// PictureMetadata are the metadata extracted from a picture, indexed as
+	// a document.
+	PictureMetadata = metadata.PictureMetadata
+	// RenditionRef references a stored file of a picture.
+	RenditionRef = metadata.RenditionRef
+	// Doc is a document to index.
+	Doc = elasticsearch.EsDoc
+	// StoreResult describes the storage of a picture, successful or not.
+	StoreResult = binary.StoreResult
+	// Filter returns true if a picture has to be processed by a stage.
+	Filter = dispatch.Filter
+	// Rendition describes a resized version of the pictures.
+	Rendition = binary.Rendition
+	// Watermark describes the watermark of a rendition.
+	Watermark = binary.Watermark
+	// S3Conf configures a S3 compatible storage.
+	S3Conf = binary.S3Conf
+	// Plugin is an external command adding fields to the documents.
+	Plugin = enrich.Plugin
+	// Rule normalizes a field of the documents.
+	Rule = rules.Rule
+	// Condition restricts a rule to the pictures having a matching field.
+	Condition = rules.Condition
+	// Limits are the rate limits applied by the built-in stages, adjustable
+	// while the pipeline runs.
+	Limits = ratelimit.Limits
+	// LimitSettings are the values of the limits, 0 meaning unlimited.
+	LimitSettings = ratelimit.Settings
+
+	ExtractorOption = func(*metadata.MetadataExtractor) error
+	IndexerOption   = func(*elasticsearch.EsPusher) error
+	StorageOption   = func(*binary.BinaryManager) error
+)
+
+// the types of rules
+const (
+	RuleMap       = rules.TypeMap
+	RuleReplace   = rules.TypeReplace
+	RuleLowercase = rules.TypeLowercase
+	RuleSynonyms  = rules.TypeSynonyms
+	RuleSplit     = rules.TypeSplit
+	RuleMerge     = rules.TypeMerge
+	RuleTag       = rules.TypeTag
+	RuleDrop      = rules.TypeDrop
+)
+
+// Stage identifies a stage of the pipeline.
+type Stage string
+
+const (
+	StageBrowse  Stage = "browse"
+	StageExtract Stage = "extract"
+	StageEnrich  Stage = "enrich"
+	StageIndex   Stage = "index"
+	StageStore   Stage = "store"
+)
+
+// Source lists the pictures to process. out has to be closed once all the
+// pictures have been sent.
+type Source interface {
+	Browse(ctx context.Context, inputs []string, out chan Task) error
+}
+
+// Extractor extracts the metadata of the pictures. out has to be closed once
+// in is closed and all the pictures have been processed.
+type Extractor interface {
+	Close() error
+	ExtractMetadata(ctx context.Context, in chan Task, out chan PictureMetadata) error
+}
+
+// Enricher completes the metadata of the pictures. out has to be closed once
+// in is closed and all the pictures have been processed.
+type Enricher interface {
+	Enrich(ctx context.Context, in chan PictureMetadata, out chan PictureMetadata) error
+}
+
+// Indexer converts the metadata to documents (out has to be closed once in
+// is closed) and indexes them.
+type Indexer interface {
+	Push(ctx context.Context, in chan Doc) error
+	ConvertMetadataToEsDoc(ctx context.Context, in chan PictureMetadata, out chan Doc) error
+}
+
+// Storage stores the pictures, outDir being the working directory.
+type Storage interface {
+	Store(ctx context.Context, in chan Task, outDir string) error
+}
+
+// Referencer is implemented by the storages that can reference the stored
+// files of a picture, recorded in its document.
+type Referencer interface {
+	RenditionRefs(fileID string) []RenditionRef
+}
+
+// EventReporter is implemented by the custom stages that report the per file
+// events : the events of the pipeline are registered before running. The
+// built-in stages always report them.
+type EventReporter interface {
+	SetEvents(e Events)
+}
+
+// Events are the per file notifications of a pipeline, they can be called
+// concurrently. Nil functions are ignored : the stages always receive
+// non-nil functions.
+type Events struct {
+	// Browsed is called for each picture found by the source
+	Browsed func(Task)
+	// Extracted is called for each picture whose metadata have been extracted
+	Extracted func(PictureMetadata)
+	// ExtractionFailed is called for each picture whose metadata could not
+	// be extracted
+	ExtractionFailed func(Task, error)
+	// Excluded is called for each picture whose metadata are not indexed
+	// because of the exclusion rules of the extractor
+	Excluded func(PictureMetadata)
+	// EnrichmentFailed is called each time the metadata of a picture could
+	// not be enriched, the picture being indexed anyway
+	EnrichmentFailed func(PictureMetadata, error)
+	// Indexed is called with the file identifiers of each indexed bulk
+	Indexed func(ids []string)
+	// IndexFailed is called with the file identifiers of each bulk that
+	// could not be indexed, or of each document rejected by Elasticsearch
+	IndexFailed func(ids []string, err error)
+	// Stored is called for each stored picture, successfully or not
+	Stored func(StoreResult)
+	// Failed is called when a stage fails as a whole
+	Failed func(Stage, error)
+}
+
+// orNoop returns the events, the nil functions being replaced by functions
+// doing nothing : the stages don't have to check them.
+func (e Events) orNoop() Events {
+	if e.Browsed == nil {
+		e.Browsed = func(Task) {}
+	}
+	if e.Extracted == nil {
+		e.Extracted = func(PictureMetadata) {}
+	}
+	if e.ExtractionFailed == nil {
+		e.ExtractionFailed = func(Task, error) {}
+	}
+	if e.Excluded == nil {
+		e.Excluded = func(PictureMetadata) {}
+	}
+	if e.EnrichmentFailed == nil {
+		e.EnrichmentFailed = func(PictureMetadata, error) {}
+	}
+	if e.Indexed == nil {
+		e.Indexed = func([]string) {}
+	}
+	if e.IndexFailed == nil {
+		e.IndexFailed = func([]string, error) {}
+	}
+	if e.Stored == nil {
+		e.Stored = func(StoreResult) {}
+	}
+	if e.Failed == nil {
+		e.Failed = func(Stage, error) {}
+	}
+	return e
+}
+
+// StageError is the failure of a stage as a whole.
+type StageError struct {
+	Stage Stage
+	Err   error
+}
+
+func (e StageError) Error() string {
+	return string(e.Stage) + ": " + e.Err.Error()
+}
+
+func (e StageError) Unwrap() error {
+	return e.Err
+}
+
+// NewBrowser creates the source that browses folders and files.
+func NewBrowser() Source {
+	return &browse.Browser{}
+}
+
+// NewExtractor creates the extractor that reads the metadata with exiftool.
+func NewExtractor(threadCount int, opts ...ExtractorOption) (Extractor, error) {
+	e, err := metadata.NewMetadataExtractor(threadCount, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// NewEnricher creates the enricher that runs the plugins on the metadata.
+func NewEnricher(threadCount int, plugins ...Plugin) (Enricher, error) {
+	opts := make([]func(*enrich.Enricher) error, len(plugins))
+	for i, p := range plugins {
+		opts[i] = enrich.WithPlugin(p)
+	}
+	e, err := enrich.NewEnricher(threadCount, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// NewIndexer creates the indexer that pushes the documents to Elasticsearch
+// in bulks.
+func NewIndexer(url string, bulkSize int, opts ...IndexerOption) (Indexer, error) {
+	i, err := elasticsearch.NewEsPusher(bulkSize, append([]IndexerOption{elasticsearch.EsUrl(url)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// SyncOnDate indexes the dates of the pictures having a keyword relatively
+// to a reference date.
+func SyncOnDate(keyword string, d time.Time) IndexerOption {
+	return elasticsearch.SyncOnDate(keyword, d)
+}
+
+// BulkWorkers sends up to workers bulks concurrently.
+func BulkWorkers(workers int) IndexerOption {
+	return elasticsearch.BulkWorkers(workers)
+}
+
+// MaxBulkBytes flushes a bulk once it reaches maxBytes, even if it holds
+// less documents than the bulk size.
+func MaxBulkBytes(maxBytes int) IndexerOption {
+	return elasticsearch.MaxBulkBytes(maxBytes)
+}
+
+// Gzip compresses the bulk requests.
+func Gzip() IndexerOption {
+	return elasticsearch.Gzip()
+}
+
+// Normalize applies the rules to the metadata before their conversion to
+// documents.
+func Normalize(rs ...Rule) IndexerOption {
+	return func(p *elasticsearch.EsPusher) error {
+		e, err := rules.NewEngine(rs...)
+		if err != nil {
+			return fmt.Errorf("error while building rules: %w", err)
+		}
+		return elasticsearch.Normalize(e.Apply)(p)
+	}
+}
+
+// NewStorage creates the storage of the pictures, which doesn't store
+// anything without storage option. It implements io.Closer : it has to be
+// closed once the pictures are stored.
+func NewStorage(threadCount int, opts ...StorageOption) (Storage, error) {
+	s, err := binary.NewBinaryManager(threadCount, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// StoreOnFileServer stores the pictures on file-server.
+func StoreOnFileServer(url string, uploadTimeout time.Duration) StorageOption {
+	return binary.BinaryManagerDoPush(url, uploadTimeout)
+}
+
+// StoreOnFs stores the pictures in a folder.
+func StoreOnFs(root string, baseUrl string, hardLink bool) StorageOption {
+	return binary.BinaryManagerDoFsPush(root, baseUrl, hardLink)
+}
+
+// StoreOnS3 stores the pictures in a S3 compatible bucket.
+func StoreOnS3(c S3Conf) StorageOption {
+	return binary.BinaryManagerDoS3Push(c)
+}
+
+// Resize stores renditions resized with convert instead of the pictures.
+func Resize(renditions ...Rendition) StorageOption {
+	return binary.BinaryManagerDoResize(nil, "", 0, renditions...)
+}
+
+// GoResize stores renditions resized without external tool instead of the
+// pictures.
+func GoResize(filter string, renditions ...Rendition) StorageOption {
+	return binary.BinaryManagerDoGoResize(filter, renditions...)
+}
+
+// SkipExisting skips the pictures already recorded as stored in recordFile.
+func SkipExisting(recordFile string, verify bool) StorageOption {
+	return binary.BinaryManagerSkipExisting(recordFile, verify)
+}
+
+// NewLimits creates limits to apply with WithLimits.
+func NewLimits(s LimitSettings) (*Limits, error) {
+	return ratelimit.NewLimits(s)
+}
+
+// WithLimits returns a context in which the built-in stages apply the
+// limits : files browsed per second, uploads and uploaded bytes per second,
+// Elasticsearch bulks per second and in flight. They can be changed with
+// Limits.Set while the pipeline runs.
+func WithLimits(ctx context.Context, l *Limits) context.Context {
+	return ratelimit.WithLimits(ctx, l)
+}
+
+// registerEvents makes a stage report the per file events.
+func registerEvents(stage interface{}, e Events) {
+	switch s := stage.(type) {
+	case *metadata.MetadataExtractor:
+		metadata.OnExtracted(e.Extracted)(s)
+		metadata.OnExtractionFailed(e.ExtractionFailed)(s)
+		metadata.OnExcluded(e.Excluded)(s)
+	case *enrich.Enricher:
+		enrich.OnEnrichmentFailed(e.EnrichmentFailed)(s)
+	case *elasticsearch.EsPusher:
+		elasticsearch.OnIndexed(e.Indexed)(s)
+		elasticsearch.OnIndexFailed(e.IndexFailed)(s)
+	case *binary.BinaryManager:
+		binary.BinaryManagerOnStoreResult(e.Stored)(s)
+	case EventReporter:
+		s.SetEvents(e)
+	}
+}
+
+// reportsEvents returns true if a stage reports the per file events.
+func reportsEvents(stage interface{}) bool {
+	switch stage.(type) {
+	case *metadata.MetadataExtractor, *enrich.Enricher, *elasticsearch.EsPusher, *binary.BinaryManager, EventReporter:
+		return true
+	}
+	return false
+}
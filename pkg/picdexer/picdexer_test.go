@@ -0,0 +1,97 @@
+package picdexer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/barasher/picdexer/internal/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewIndexer(t *testing.T) {
+	i, err := NewIndexer("http://localhost:9200", 0)
+	assert.NotNil(t, err)
+	assert.Nil(t, i)
+	i, err = NewIndexer("http://localhost:9200", 10)
+	assert.Nil(t, err)
+	assert.True(t, reportsEvents(i))
+}
+
+func TestNormalize(t *testing.T) {
+	_, err := NewIndexer("http://localhost:9200", 10, Normalize(Rule{Type: "blabla"}))
+	assert.NotNil(t, err)
+	_, err = NewIndexer("http://localhost:9200", 10, Normalize(Rule{Type: RuleLowercase, Field: "Keywords"}))
+	assert.Nil(t, err)
+}
+
+func TestBulkOptions(t *testing.T) {
+	_, err := NewIndexer("http://localhost:9200", 10, BulkWorkers(0))
+	assert.NotNil(t, err)
+	_, err = NewIndexer("http://localhost:9200", 10, MaxBulkBytes(-1))
+	assert.NotNil(t, err)
+	_, err = NewIndexer("http://localhost:9200", 10, BulkWorkers(4), MaxBulkBytes(1024), Gzip())
+	assert.Nil(t, err)
+}
+
+func TestNewStorage(t *testing.T) {
+	s, err := NewStorage(0)
+	assert.NotNil(t, err)
+	assert.Nil(t, s)
+	s, err = NewStorage(1, StoreOnFs(t.TempDir(), "", false))
+	assert.Nil(t, err)
+	assert.True(t, reportsEvents(s))
+	_, ok := s.(Referencer)
+	assert.True(t, ok)
+}
+
+func TestNewEnricher(t *testing.T) {
+	e, err := NewEnricher(1, Plugin{Name: "p"})
+	assert.NotNil(t, err)
+	assert.Nil(t, e)
+	e, err = NewEnricher(1, Plugin{Name: "p", Command: []string{"cmd"}})
+	assert.Nil(t, err)
+	assert.True(t, reportsEvents(e))
+}
+
+func TestWithLimits(t *testing.T) {
+	_, err := NewLimits(LimitSettings{FilesPerSecond: -1})
+	assert.NotNil(t, err)
+	l, err := NewLimits(LimitSettings{FilesPerSecond: 10})
+	assert.Nil(t, err)
+	ctx := WithLimits(context.Background(), l)
+	assert.Equal(t, l, ratelimit.Get(ctx))
+}
+
+func TestRegisterEvents(t *testing.T) {
+	stored := []string{}
+	e := Events{Stored: func(r StoreResult) { stored = append(stored, r.Task.FileID) }}
+
+	s := &storageMock{}
+	registerEvents(s, e)
+	s.events.Stored(StoreResult{Task: Task{FileID: "custom"}})
+
+	assert.Equal(t, []string{"custom"}, stored)
+	assert.True(t, reportsEvents(s))
+	assert.False(t, reportsEvents(sourceMock{}))
+}
+
+func TestEventsOrNoop(t *testing.T) {
+	browsed := 0
+	e := Events{Browsed: func(Task) { browsed++ }}.orNoop()
+	e.Browsed(Task{})
+	e.Extracted(PictureMetadata{})
+	e.ExtractionFailed(Task{}, nil)
+	e.Indexed(nil)
+	e.IndexFailed(nil, nil)
+	e.Stored(StoreResult{})
+	e.Failed(StageStore, nil)
+	assert.Equal(t, 1, browsed)
+}
+
+func TestStageError(t *testing.T) {
+	err := errors.New("boom")
+	se := StageError{Stage: StageStore, Err: err}
+	assert.Equal(t, "store: boom", se.Error())
+	assert.True(t, errors.Is(se, err))
+}
@@ -0,0 +1,383 @@
+package picdexer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/barasher/picdexer/internal/converge"
+	"github.com/barasher/picdexer/internal/dispatch"
+	"github.com/barasher/picdexer/internal/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultThreadCount = 4
+	// maxHeldMetadata bounds the metadata waiting for their storage result,
+	// the extraction being slowed down beyond
+	maxHeldMetadata = 1000
+)
+
+// Pipeline processes pictures : they are browsed from the source, dispatched
+// to the indexing (extractor, optional enricher then indexer) and to the
+// storage, the storage results being recorded in the documents. A stage that
+// is not configured is disabled.
+type Pipeline struct {
+	source           Source
+	extractor        Extractor
+	extractorThreads int
+	enricher         Enricher
+	indexer          Indexer
+	storage          Storage
+	storageThreads   int
+	workingDir       string
+	refs             func(fileID string) []RenditionRef
+	idxFilter        Filter
+	storeFilter      Filter
+	events           Events
+}
+
+func NewPipeline(opts ...func(*Pipeline) error) (*Pipeline, error) {
+	p := &Pipeline{
+		source:           NewBrowser(),
+		extractorThreads: defaultThreadCount,
+		storageThreads:   defaultThreadCount,
+	}
+	for _, cur := range opts {
+		if err := cur(p); err != nil {
+			return nil, fmt.Errorf("error while creating Pipeline: %w", err)
+		}
+	}
+	if (p.extractor == nil) != (p.indexer == nil) {
+		return nil, fmt.Errorf("the extractor and the indexer have to be configured together")
+	}
+	if p.enricher != nil && p.indexer == nil {
+		return nil, fmt.Errorf("the enricher requires the indexing to be configured")
+	}
+	if p.indexer == nil && p.storage == nil {
+		return nil, fmt.Errorf("neither indexing nor storage configured")
+	}
+	return p, nil
+}
+
+func WithSource(s Source) func(*Pipeline) error {
+	return func(p *Pipeline) error {
+		if s == nil {
+			return fmt.Errorf("source can't be nil")
+		}
+		p.source = s
+		return nil
+	}
+}
+
+// WithExtractor configures the metadata extraction, threadCount sizing the
+// queues of the stage.
+func WithExtractor(e Extractor, threadCount int) func(*Pipeline) error {
+	return func(p *Pipeline) error {
+		if threadCount <= 0 {
+			return fmt.Errorf("threadCount should be >0 (%v)", threadCount)
+		}
+		p.extractor = e
+		p.extractorThreads = threadCount
+		return nil
+	}
+}
+
+// WithEnricher configures the enrichment of the metadata, between the
+// extraction and the indexing.
+func WithEnricher(e Enricher) func(*Pipeline) error {
+	return func(p *Pipeline) error {
+		p.enricher = e
+		return nil
+	}
+}
+
+func WithIndexer(i Indexer) func(*Pipeline) error {
+	return func(p *Pipeline) error {
+		p.indexer = i
+		return nil
+	}
+}
+
+// WithStorage configures the storage, threadCount sizing the queue of the
+// stage and workingDir being where the temporary files are written.
+func WithStorage(s Storage, threadCount int, workingDir string) func(*Pipeline) error {
+	return func(p *Pipeline) error {
+		if threadCount <= 0 {
+			return fmt.Errorf("threadCount should be >0 (%v)", threadCount)
+		}
+		p.storage = s
+		p.storageThreads = threadCount
+		p.workingDir = workingDir
+		return nil
+	}
+}
+
+// WithRenditionRefs defines the references of the stored files recorded in
+// the documents of the pictures whose storage is not expected (already
+// stored, storage disabled...). They are provided by the storage if it is a
+// Referencer.
+func WithRenditionRefs(f func(fileID string) []RenditionRef) func(*Pipeline) error {
+	return func(p *Pipeline) error {
+		p.refs = f
+		return nil
+	}
+}
+
+// IndexFilter defines the pictures that are indexed.
+func IndexFilter(f Filter) func(*Pipeline) error {
+	return func(p *Pipeline) error {
+		p.idxFilter = f
+		return nil
+	}
+}
+
+// StoreFilter defines the pictures that are stored.
+func StoreFilter(f Filter) func(*Pipeline) error {
+	return func(p *Pipeline) error {
+		p.storeFilter = f
+		return nil
+	}
+}
+
+func WithEvents(e Events) func(*Pipeline) error {
+	return func(p *Pipeline) error {
+		p.events = e
+		return nil
+	}
+}
+
+func max(v1, v2 int) int {
+	if v1 < v2 {
+		return v2
+	}
+	return v1
+}
+
+// Run processes the pictures of the inputs. When the context is canceled,
+// the stages are abandoned but the last documents are indexed and the
+// temporary files are cleaned : the stages have to return once the context
+// is done. The first stage failure is returned, the per file failures are
+// only reported by the events.
+func (p *Pipeline) Run(ctx context.Context, inputs []string) error {
+	indexing, storing := p.indexer != nil, p.storage != nil
+	events := p.events.orNoop()
+	var errMu sync.Mutex
+	var firstErr error
+	failed := func(s Stage, err error) {
+		log.Error().Msgf("Error while running %v stage: %v", s, err)
+		errMu.Lock()
+		if firstErr == nil {
+			firstErr = StageError{Stage: s, Err: err}
+		}
+		errMu.Unlock()
+		events.Failed(s, err)
+	}
+
+	// the metadata wait for the storage results to be recorded in the documents
+	refs := p.refs
+	if r, ok := p.storage.(Referencer); ok && refs == nil {
+		refs = r.RenditionRefs
+	}
+	var joiner *converge.Joiner
+	if indexing && (refs != nil || (storing && reportsEvents(p.storage))) {
+		// the held metadata are not indexed if the pipeline is interrupted
+		joiner = converge.NewJoiner(p.storageThreads, maxHeldMetadata, refs, events.IndexFailed)
+	}
+	stored := events.Stored
+	events.Stored = func(r StoreResult) {
+		stored(r)
+		if joiner != nil {
+			joiner.Stored(r)
+		}
+	}
+	// the metadata of the pictures that are not extracted or excluded never
+	// come : their storage result is not held
+	extractionFailed, excluded := events.ExtractionFailed, events.Excluded
+	events.ExtractionFailed = func(t Task, err error) {
+		extractionFailed(t, err)
+		if joiner != nil && storing {
+			joiner.Forget(t.FileID)
+		}
+	}
+	events.Excluded = func(m PictureMetadata) {
+		excluded(m)
+		if joiner != nil && storing {
+			joiner.Forget(m.FileID)
+		}
+	}
+	if indexing {
+		registerEvents(p.extractor, events)
+		if p.enricher != nil {
+			registerEvents(p.enricher, events)
+		}
+		registerEvents(p.indexer, events)
+	}
+	if storing {
+		registerEvents(p.storage, events)
+	}
+
+	idxFilter, storeFilter := p.idxFilter, p.storeFilter
+	browsed := func(t Task) bool {
+		events.Browsed(t)
+		return true
+	}
+	// the browsed pictures are reported by the first enabled stage
+	if indexing {
+		idxFilter = dispatch.All(browsed, idxFilter)
+	} else {
+		storeFilter = dispatch.All(browsed, storeFilter)
+	}
+	switch {
+	case joiner == nil:
+	case storing:
+		// the dispatch evaluates the index filter and then the store filter
+		// before forwarding the task : the storage result of an indexed
+		// picture is expected before its document can be joined
+		indexed := false
+		idxAccepted, storeAccepted := idxFilter, storeFilter
+		idxFilter = func(t Task) bool {
+			indexed = idxAccepted(t)
+			return indexed
+		}
+		storeFilter = func(t Task) bool {
+			if storeAccepted != nil && !storeAccepted(t) {
+				return false
+			}
+			if indexed {
+				joiner.Expect(t.FileID)
+			}
+			return true
+		}
+	default:
+		// no storage result is expected, the documents reference the
+		// previously stored files
+		joiner.CloseStored()
+	}
+
+	// the input channels of the disabled stages are nil : the dispatch
+	// doesn't forward anything to them
+	var metaToExtractChan, binToPushChan chan Task
+	if indexing {
+		metaToExtractChan = make(chan Task, p.extractorThreads)
+	}
+	if storing {
+		binToPushChan = make(chan Task, p.storageThreads)
+	}
+	browseChan := make(chan Task, max(p.extractorThreads, p.storageThreads))
+	metaToJoinChan := make(chan PictureMetadata, p.extractorThreads)
+	// without enricher, the extracted metadata are directly joined
+	metaToEnrichChan := metaToJoinChan
+	if p.enricher != nil {
+		metaToEnrichChan = make(chan PictureMetadata, p.extractorThreads)
+	}
+	metaToConvertChan := make(chan PictureMetadata, p.extractorThreads)
+	docToPushChan := make(chan Doc, p.extractorThreads)
+	m := metrics.Get(ctx)
+	queues := map[string]func() int{
+		"browse":  func() int { return len(browseChan) },
+		"store":   func() int { return len(binToPushChan) },
+		"extract": func() int { return len(metaToExtractChan) },
+		"enrich":  func() int { return len(metaToEnrichChan) },
+		"join":    func() int { return len(metaToJoinChan) },
+		"convert": func() int { return len(metaToConvertChan) },
+		"index":   func() int { return len(docToPushChan) },
+	}
+	for name, depth := range queues {
+		defer m.Queue(name, depth)()
+	}
+
+	wg := sync.WaitGroup{}
+	// the last bulk has to be flushed and the temporary files cleaned, even
+	// if the grace period expires
+	flushWg := sync.WaitGroup{}
+
+	if indexing {
+		wg.Add(3)
+		flushWg.Add(1)
+
+		go func() { // join metadata and storage results
+			if joiner == nil {
+				for cur := range metaToJoinChan {
+					metaToConvertChan <- cur
+				}
+				close(metaToConvertChan)
+			} else if err := joiner.Join(ctx, metaToJoinChan, metaToConvertChan); err != nil {
+				log.Error().Msgf("Error while joining metadata and storage results: %v", err)
+			}
+			wg.Done()
+		}()
+
+		go func() { // push to es
+			if err := p.indexer.Push(ctx, docToPushChan); err != nil {
+				log.Error().Msgf("Error while pushing to Elasticsearch: %v", err)
+			}
+			flushWg.Done()
+		}()
+
+		go func() { // metadata to doc
+			if err := p.indexer.ConvertMetadataToEsDoc(ctx, metaToConvertChan, docToPushChan); err != nil {
+				log.Error().Msgf("Error while converting metadata to Elasticsearch documents: %v", err)
+			}
+			wg.Done()
+		}()
+
+		go func() { // task to metadata
+			if err := p.extractor.ExtractMetadata(ctx, metaToExtractChan, metaToEnrichChan); err != nil {
+				failed(StageExtract, fmt.Errorf("error while extracting metadata: %w", err))
+			}
+			wg.Done()
+		}()
+
+		if p.enricher != nil {
+			wg.Add(1)
+			go func() { // enrich metadata
+				if err := p.enricher.Enrich(ctx, metaToEnrichChan, metaToJoinChan); err != nil {
+					failed(StageEnrich, fmt.Errorf("error while enriching metadata: %w", err))
+				}
+				wg.Done()
+			}()
+		}
+	}
+
+	if storing {
+		flushWg.Add(1)
+		go func() { // task to binary upload
+			if err := p.storage.Store(ctx, binToPushChan, p.workingDir); err != nil {
+				failed(StageStore, fmt.Errorf("error while storing: %w", err))
+			}
+			if joiner != nil {
+				joiner.CloseStored()
+			}
+			flushWg.Done()
+		}()
+	}
+
+	wg.Add(1)
+	go func() { // dispatch
+		dispatch.DispatchFilteredTasks(ctx, browseChan, metaToExtractChan, binToPushChan, idxFilter, storeFilter)
+		wg.Done()
+	}()
+
+	// browse
+	if err := p.source.Browse(ctx, inputs, browseChan); err != nil {
+		failed(StageBrowse, fmt.Errorf("error while browsing input folder: %w", err))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		flushWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// the stages blocked on a channel are abandoned
+		flushWg.Wait()
+	}
+
+	errMu.Lock()
+	defer errMu.Unlock()
+	return firstErr
+}
@@ -0,0 +1,364 @@
+package picdexer
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sourceMock struct {
+	fileIDs []string
+	err     error
+}
+
+func (s sourceMock) Browse(ctx context.Context, inputs []string, out chan Task) error {
+	defer close(out)
+	for _, id := range s.fileIDs {
+		out <- Task{Path: "/" + id, FileID: id}
+	}
+	return s.err
+}
+
+type extractorMock struct {
+	events   Events
+	failed   map[string]bool
+	excluded map[string]bool
+}
+
+func (e *extractorMock) SetEvents(ev Events) { e.events = ev }
+
+func (e *extractorMock) Close() error { return nil }
+
+func (e *extractorMock) ExtractMetadata(ctx context.Context, in chan Task, out chan PictureMetadata) error {
+	defer close(out)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case t, ok := <-in:
+			if !ok {
+				return nil
+			}
+			if e.failed[t.FileID] {
+				e.events.ExtractionFailed(t, errors.New("extraction failed"))
+				continue
+			}
+			m := PictureMetadata{FileID: t.FileID, SourceFile: t.Path}
+			e.events.Extracted(m)
+			if e.excluded[t.FileID] {
+				e.events.Excluded(m)
+				continue
+			}
+			out <- m
+		}
+	}
+}
+
+type enricherMock struct {
+	events Events
+}
+
+func (e *enricherMock) SetEvents(ev Events) { e.events = ev }
+
+func (e *enricherMock) Enrich(ctx context.Context, in chan PictureMetadata, out chan PictureMetadata) error {
+	defer close(out)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-in:
+			if !ok {
+				return nil
+			}
+			if m.FileID == "b" {
+				e.events.EnrichmentFailed(m, errors.New("enrichment failed"))
+			} else {
+				m.Fields = map[string]interface{}{"Label": "label-" + m.FileID}
+			}
+			out <- m
+		}
+	}
+}
+
+type indexerMock struct {
+	events Events
+	mu     sync.Mutex
+	docs   map[string]PictureMetadata
+}
+
+func (i *indexerMock) SetEvents(ev Events) { i.events = ev }
+
+func (i *indexerMock) Push(ctx context.Context, in chan Doc) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-in:
+			if !ok {
+				return nil
+			}
+			m := d.Document.(PictureMetadata)
+			i.mu.Lock()
+			i.docs[m.FileID] = m
+			i.mu.Unlock()
+			i.events.Indexed([]string{m.FileID})
+		}
+	}
+}
+
+func (i *indexerMock) ConvertMetadataToEsDoc(ctx context.Context, in chan PictureMetadata, out chan Doc) error {
+	defer close(out)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-in:
+			if !ok {
+				return nil
+			}
+			out <- Doc{Document: m}
+		}
+	}
+}
+
+type storageMock struct {
+	events Events
+	err    error
+}
+
+func (s *storageMock) SetEvents(ev Events) { s.events = ev }
+
+func (s *storageMock) RenditionRefs(fileID string) []RenditionRef {
+	return []RenditionRef{{Name: "previous", Key: fileID}}
+}
+
+func (s *storageMock) Store(ctx context.Context, in chan Task, outDir string) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case t, ok := <-in:
+			if !ok {
+				return s.err
+			}
+			s.events.Stored(StoreResult{Task: t, Renditions: []RenditionRef{{Name: "stored", Key: t.FileID}}})
+		}
+	}
+}
+
+// recorder records the events of a pipeline.
+type recorder struct {
+	mu        sync.Mutex
+	browsed   []string
+	extracted []string
+	extractKo []string
+	excluded  []string
+	indexed   []string
+	stored    []string
+	failed    []Stage
+}
+
+func (r *recorder) add(l *[]string, ids ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*l = append(*l, ids...)
+	sort.Strings(*l)
+}
+
+func (r *recorder) events() Events {
+	return Events{
+		Browsed:          func(t Task) { r.add(&r.browsed, t.FileID) },
+		Extracted:        func(m PictureMetadata) { r.add(&r.extracted, m.FileID) },
+		ExtractionFailed: func(t Task, err error) { r.add(&r.extractKo, t.FileID) },
+		Excluded:         func(m PictureMetadata) { r.add(&r.excluded, m.FileID) },
+		Indexed:          func(ids []string) { r.add(&r.indexed, ids...) },
+		Stored:           func(s StoreResult) { r.add(&r.stored, s.Task.FileID) },
+		Failed: func(s Stage, err error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.failed = append(r.failed, s)
+		},
+	}
+}
+
+func TestNewPipeline(t *testing.T) {
+	var tcs = []struct {
+		tcID    string
+		inOpts  []func(*Pipeline) error
+		expOk   bool
+		expIdx  bool
+		expStor bool
+	}{
+		{"indexing", []func(*Pipeline) error{WithExtractor(&extractorMock{}, 1), WithIndexer(&indexerMock{})}, true, true, false},
+		{"storage", []func(*Pipeline) error{WithStorage(&storageMock{}, 1, "")}, true, false, true},
+		{"both", []func(*Pipeline) error{WithExtractor(&extractorMock{}, 1), WithIndexer(&indexerMock{}), WithStorage(&storageMock{}, 1, "")}, true, true, true},
+		{"nothing", nil, false, false, false},
+		{"extractorOnly", []func(*Pipeline) error{WithExtractor(&extractorMock{}, 1)}, false, false, false},
+		{"indexerOnly", []func(*Pipeline) error{WithIndexer(&indexerMock{})}, false, false, false},
+		{"enricher", []func(*Pipeline) error{WithExtractor(&extractorMock{}, 1), WithEnricher(&enricherMock{}), WithIndexer(&indexerMock{})}, true, true, false},
+		{"enricherWithoutIndexer", []func(*Pipeline) error{WithEnricher(&enricherMock{}), WithStorage(&storageMock{}, 1, "")}, false, false, false},
+		{"nilSource", []func(*Pipeline) error{WithSource(nil), WithStorage(&storageMock{}, 1, "")}, false, false, false},
+		{"wrongExtractorThreadCount", []func(*Pipeline) error{WithExtractor(&extractorMock{}, 0), WithIndexer(&indexerMock{})}, false, false, false},
+		{"wrongStorageThreadCount", []func(*Pipeline) error{WithStorage(&storageMock{}, 0, "")}, false, false, false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			p, err := NewPipeline(tc.inOpts...)
+			assert.Equal(t, tc.expOk, err == nil)
+			if err == nil {
+				assert.Equal(t, tc.expIdx, p.indexer != nil)
+				assert.Equal(t, tc.expStor, p.storage != nil)
+			}
+		})
+	}
+}
+
+func TestPipeline_Run(t *testing.T) {
+	idx := &indexerMock{docs: map[string]PictureMetadata{}}
+	rec := &recorder{}
+	p, err := NewPipeline(
+		WithSource(sourceMock{fileIDs: []string{"a", "b", "c", "d", "e"}}),
+		WithExtractor(&extractorMock{failed: map[string]bool{"d": true}, excluded: map[string]bool{"e": true}}, 2),
+		WithIndexer(idx),
+		WithStorage(&storageMock{}, 2, ""),
+		IndexFilter(func(t Task) bool { return t.FileID != "c" }),
+		StoreFilter(func(t Task) bool { return t.FileID != "b" }),
+		WithEvents(rec.events()),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, p.Run(context.Background(), nil))
+
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, rec.browsed)
+	assert.Equal(t, []string{"a", "b", "e"}, rec.extracted)
+	assert.Equal(t, []string{"d"}, rec.extractKo)
+	assert.Equal(t, []string{"e"}, rec.excluded)
+	assert.Equal(t, []string{"a", "b"}, rec.indexed)
+	assert.Equal(t, []string{"a", "c", "d", "e"}, rec.stored)
+	assert.Empty(t, rec.failed)
+	// the storage results are recorded in the documents, the previously
+	// stored files are referenced otherwise
+	assert.Len(t, idx.docs, 2)
+	assert.Equal(t, []RenditionRef{{Name: "stored", Key: "a"}}, idx.docs["a"].Renditions)
+	assert.Equal(t, []RenditionRef{{Name: "previous", Key: "b"}}, idx.docs["b"].Renditions)
+}
+
+func TestPipeline_Run_Enricher(t *testing.T) {
+	idx := &indexerMock{docs: map[string]PictureMetadata{}}
+	rec := &recorder{}
+	enrichKo := []string{}
+	ev := rec.events()
+	ev.EnrichmentFailed = func(m PictureMetadata, err error) { rec.add(&enrichKo, m.FileID) }
+	p, err := NewPipeline(
+		WithSource(sourceMock{fileIDs: []string{"a", "b"}}),
+		WithExtractor(&extractorMock{}, 1),
+		WithEnricher(&enricherMock{}),
+		WithIndexer(idx),
+		WithStorage(&storageMock{}, 1, ""),
+		WithEvents(ev),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, p.Run(context.Background(), nil))
+	assert.Equal(t, []string{"b"}, enrichKo)
+	assert.Equal(t, []string{"a", "b"}, rec.indexed)
+	assert.Equal(t, map[string]interface{}{"Label": "label-a"}, idx.docs["a"].Fields)
+	assert.Nil(t, idx.docs["b"].Fields)
+	// the storage results are still recorded
+	assert.Equal(t, []RenditionRef{{Name: "stored", Key: "a"}}, idx.docs["a"].Renditions)
+}
+
+func TestPipeline_Run_RenditionRefs(t *testing.T) {
+	idx := &indexerMock{docs: map[string]PictureMetadata{}}
+	p, err := NewPipeline(
+		WithSource(sourceMock{fileIDs: []string{"a"}}),
+		WithExtractor(&extractorMock{}, 1),
+		WithIndexer(idx),
+		WithRenditionRefs(func(fileID string) []RenditionRef {
+			return []RenditionRef{{Name: "custom", Key: fileID}}
+		}),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, p.Run(context.Background(), nil))
+	assert.Equal(t, []RenditionRef{{Name: "custom", Key: "a"}}, idx.docs["a"].Renditions)
+}
+
+func TestPipeline_Run_DisabledStages(t *testing.T) {
+	var tcs = []struct {
+		tcID         string
+		inIndexing   bool
+		inStoring    bool
+		expExtracted []string
+		expStored    []string
+	}{
+		{"indexOnly", true, false, []string{"a", "b"}, nil},
+		{"storeOnly", false, true, nil, []string{"a", "b"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.tcID, func(t *testing.T) {
+			rec := &recorder{}
+			opts := []func(*Pipeline) error{
+				WithSource(sourceMock{fileIDs: []string{"a", "b"}}),
+				WithEvents(rec.events()),
+			}
+			if tc.inIndexing {
+				opts = append(opts, WithExtractor(&extractorMock{}, 1), WithIndexer(&indexerMock{docs: map[string]PictureMetadata{}}))
+			}
+			if tc.inStoring {
+				opts = append(opts, WithStorage(&storageMock{}, 1, ""))
+			}
+			p, err := NewPipeline(opts...)
+			assert.Nil(t, err)
+			assert.Nil(t, p.Run(context.Background(), nil))
+			assert.Equal(t, []string{"a", "b"}, rec.browsed)
+			assert.Equal(t, tc.expExtracted, rec.extracted)
+			assert.Equal(t, tc.expStored, rec.stored)
+		})
+	}
+}
+
+func TestPipeline_Run_StageFailures(t *testing.T) {
+	rec := &recorder{}
+	storeErr := errors.New("store failed")
+	p, err := NewPipeline(
+		WithSource(sourceMock{fileIDs: []string{"a"}, err: errors.New("browse failed")}),
+		WithStorage(&storageMock{err: storeErr}, 1, ""),
+		WithEvents(rec.events()),
+	)
+	assert.Nil(t, err)
+	err = p.Run(context.Background(), nil)
+	var se StageError
+	assert.True(t, errors.As(err, &se))
+	assert.ElementsMatch(t, []Stage{StageBrowse, StageStore}, rec.failed)
+	assert.Equal(t, []string{"a"}, rec.stored)
+}
+
+// blockingSource browses until the context is canceled
+type blockingSource struct{}
+
+func (blockingSource) Browse(ctx context.Context, inputs []string, out chan Task) error {
+	defer close(out)
+	<-ctx.Done()
+	return nil
+}
+
+func TestPipeline_Run_Canceled(t *testing.T) {
+	p, err := NewPipeline(
+		WithSource(blockingSource{}),
+		WithExtractor(&extractorMock{}, 1),
+		WithIndexer(&indexerMock{docs: map[string]PictureMetadata{}}),
+		WithStorage(&storageMock{}, 1, ""),
+	)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Nil(t, p.Run(ctx, nil))
+}
+
+func TestMax(t *testing.T) {
+	assert.Equal(t, 2, max(1, 2))
+	assert.Equal(t, 2, max(2, 1))
+	assert.Equal(t, 2, max(2, 2))
+}